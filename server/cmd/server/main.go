@@ -14,6 +14,9 @@ import (
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/noted/server/internal/api"
 	"github.com/noted/server/internal/config"
+	"github.com/noted/server/internal/mail"
+	"github.com/noted/server/internal/purge"
+	"github.com/noted/server/internal/signing"
 	"github.com/noted/server/internal/storage"
 	"github.com/noted/server/internal/store"
 	"github.com/noted/server/migrations"
@@ -39,10 +42,11 @@ func main() {
 
 	// Initialize blob storage
 	blobStore, err := storage.New(storage.Config{
-		Backend:       storage.Backend(cfg.StorageBackend),
-		LocalPath:     cfg.ImageStoragePath,
-		SigningSecret: cfg.StorageSigningSecret,
-		BaseURL:       cfg.StorageBaseURL,
+		Backend:                storage.Backend(cfg.StorageBackend),
+		LocalPath:              cfg.ImageStoragePath,
+		SigningSecret:          cfg.StorageSigningSecret,
+		PreviousSigningSecrets: cfg.StoragePreviousSigningSecrets,
+		BaseURL:                cfg.StorageBaseURL,
 
 		// S3 config
 		S3Bucket:          cfg.S3Bucket,
@@ -58,8 +62,54 @@ func main() {
 	}
 	defer blobStore.Close()
 
+	// Initialize mail transport
+	mailer, err := mail.New(mail.Config{
+		Transport:    mail.Transport(cfg.MailTransport),
+		From:         cfg.MailFrom,
+		SMTPHost:     cfg.SMTPHost,
+		SMTPPort:     cfg.SMTPPort,
+		SMTPUsername: cfg.SMTPUsername,
+		SMTPPassword: cfg.SMTPPassword,
+		OutboxDir:    cfg.MailOutboxDir,
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
+
+	// Load token signing keys
+	keys, err := signing.New(signing.Config{
+		Dir:                  cfg.JWTKeyDir,
+		Rotation:             cfg.JWTKeyRotation,
+		Algorithm:            cfg.JWTKeyAlgorithm,
+		SigningKeyFile:       cfg.JWTSigningKeyFile,
+		VerificationKeyFiles: cfg.JWTVerificationKeyFiles,
+		Retention:            api.SignedTokenLifetime(cfg.JWTExpiration),
+	})
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+
 	// Create server
-	srv := api.NewServer(pgStore, cfg, blobStore)
+	srv := api.NewServer(pgStore, cfg, blobStore, mailer, keys)
+
+	// Background jobs stop when the server shuts down
+	bgCtx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+
+	// Relay change notifications to connected clients
+	go srv.ListenForChanges(bgCtx)
+
+	// Rotate signing keys
+	go keys.Run(bgCtx)
+
+	// Purge old tombstones, and deleted accounts as soon as they are deleted
+	purger := purge.NewWorker(pgStore, blobStore, cfg.PurgeRetention, cfg.PurgeInterval, purge.RevisionPolicy{
+		KeepAll:    cfg.RevisionKeepAll,
+		KeepHourly: cfg.RevisionKeepHourly,
+		Retention:  cfg.RevisionRetention,
+	})
+	srv.SetAccountPurger(purger)
+	go purger.Run(bgCtx)
 
 	// Start HTTP server
 	httpServer := &http.Server{
@@ -80,6 +130,7 @@ func main() {
 		<-sigChan
 
 		log.Println("Shutting down server...")
+		stopBackground()
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
@@ -0,0 +1,499 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/mail"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// handleForgotPassword emails a password reset link. It responds the same
+// way whether or not the address has an account.
+func (s *Server) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ForgotPasswordRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	if req.Email == "" {
+		respondError(w, http.StatusBadRequest, "validation_error", "email is required")
+		return
+	}
+
+	user, err := s.store.GetUserByEmail(r.Context(), req.Email)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get user")
+		return
+	}
+
+	if user != nil {
+		if err := s.sendPasswordReset(r.Context(), user); err != nil {
+			log.Printf("failed to send password reset to user %s: %v", user.ID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleResetPassword sets a new password using an emailed token and signs
+// out every session
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ResetPasswordRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	if req.Token == "" || req.Password == "" {
+		respondError(w, http.StatusBadRequest, "validation_error", "token and password are required")
+		return
+	}
+
+	if len(req.Password) < 8 {
+		respondError(w, http.StatusBadRequest, "validation_error", "password must be at least 8 characters")
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to hash password")
+		return
+	}
+
+	err = s.store.WithTx(r.Context(), func(tx store.Store) error {
+		token, err := tx.ConsumeUserToken(r.Context(), hashToken(req.Token), models.UserTokenPasswordReset)
+		if err != nil {
+			return err
+		}
+
+		user, err := tx.GetUserByID(r.Context(), token.UserID)
+		if err != nil {
+			return err
+		}
+		if user.Email != token.Email {
+			return store.ErrNotFound
+		}
+
+		now := time.Now()
+		user.PasswordHash = string(hashedPassword)
+		user.UpdatedAt = now
+		if err := tx.UpdateUser(r.Context(), user); err != nil {
+			return err
+		}
+
+		// Following the link proves the user can read mail at the address
+		if user.EmailVerifiedAt == nil {
+			if err := tx.SetEmailVerified(r.Context(), user.ID, user.Email, now); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.RevokeOtherSessions(r.Context(), user.ID, uuid.Nil)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusBadRequest, "invalid_token", "reset link is invalid or has expired")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to reset password")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req models.VerifyEmailRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	if req.Token == "" {
+		respondError(w, http.StatusBadRequest, "validation_error", "token is required")
+		return
+	}
+
+	err := s.store.WithTx(r.Context(), func(tx store.Store) error {
+		token, err := tx.ConsumeUserToken(r.Context(), hashToken(req.Token), models.UserTokenVerifyEmail)
+		if err != nil {
+			return err
+		}
+		return tx.SetEmailVerified(r.Context(), token.UserID, token.Email, time.Now())
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusBadRequest, "invalid_token", "verification link is invalid or has expired")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to verify email")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	user, err := s.store.GetUserByID(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "user not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get user")
+		return
+	}
+
+	if user.EmailVerifiedAt != nil {
+		respondError(w, http.StatusConflict, "already_verified", "email address is already verified")
+		return
+	}
+
+	if err := s.sendEmailVerification(r.Context(), user); err != nil {
+		log.Printf("failed to send verification email to user %s: %v", user.ID, err)
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to send verification email")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleChangePassword sets a new password for the signed-in user and signs
+// out every other session. Accounts created through single sign-on have no
+// password to confirm, so they set one with a password reset instead.
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	var req models.ChangePasswordRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	if req.NewPassword == "" {
+		respondError(w, http.StatusBadRequest, "validation_error", "new password is required")
+		return
+	}
+
+	if len(req.NewPassword) < 8 {
+		respondError(w, http.StatusBadRequest, "validation_error", "password must be at least 8 characters")
+		return
+	}
+
+	if !s.confirmPassword(r.Context(), w, userID, req.CurrentPassword) {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to hash password")
+		return
+	}
+
+	currentID, _ := GetSessionID(r.Context())
+	err = s.store.WithTx(r.Context(), func(tx store.Store) error {
+		user, err := tx.GetUserByID(r.Context(), userID)
+		if err != nil {
+			return err
+		}
+
+		user.PasswordHash = string(hashedPassword)
+		user.UpdatedAt = time.Now()
+		if err := tx.UpdateUser(r.Context(), user); err != nil {
+			return err
+		}
+
+		_, err = tx.RevokeOtherSessions(r.Context(), userID, currentID)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "user not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to change password")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleChangeEmail starts moving the signed-in user to a new address. The
+// address only changes once the link emailed to it is followed, with
+// handleConfirmEmailChange.
+func (s *Server) handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	var req models.ChangeEmailRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email == "" {
+		respondError(w, http.StatusBadRequest, "validation_error", "email is required")
+		return
+	}
+
+	if !s.confirmPassword(r.Context(), w, userID, req.Password) {
+		return
+	}
+
+	user, err := s.store.GetUserByID(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "user not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get user")
+		return
+	}
+
+	if req.Email == user.Email {
+		respondError(w, http.StatusBadRequest, "validation_error", "email is unchanged")
+		return
+	}
+
+	if _, err := s.store.GetUserByEmail(r.Context(), req.Email); err == nil {
+		respondError(w, http.StatusConflict, "conflict", "user with this email already exists")
+		return
+	} else if !errors.Is(err, store.ErrNotFound) {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get user")
+		return
+	}
+
+	if err := s.sendEmailChangeConfirmation(r.Context(), user, req.Email); err != nil {
+		log.Printf("failed to send email change confirmation to user %s: %v", user.ID, err)
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to send confirmation email")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleConfirmEmailChange moves the user to the address a change link was
+// sent to, which following the link verifies. The old address is told about
+// the change.
+func (s *Server) handleConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var req models.VerifyEmailRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	if req.Token == "" {
+		respondError(w, http.StatusBadRequest, "validation_error", "token is required")
+		return
+	}
+
+	var oldEmail, newEmail string
+	var userID uuid.UUID
+	err := s.store.WithTx(r.Context(), func(tx store.Store) error {
+		token, err := tx.ConsumeUserToken(r.Context(), hashToken(req.Token), models.UserTokenChangeEmail)
+		if err != nil {
+			return err
+		}
+
+		user, err := tx.GetUserByID(r.Context(), token.UserID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		oldEmail, newEmail, userID = user.Email, token.Email, user.ID
+		user.Email = token.Email
+		user.UpdatedAt = now
+		if err := tx.UpdateUser(r.Context(), user); err != nil {
+			return err
+		}
+		return tx.SetEmailVerified(r.Context(), user.ID, user.Email, now)
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusBadRequest, "invalid_token", "confirmation link is invalid or has expired")
+			return
+		}
+		if errors.Is(err, store.ErrAlreadyExists) {
+			respondError(w, http.StatusConflict, "conflict", "user with this email already exists")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to change email")
+		return
+	}
+
+	// The change has been made; mail failures are only logged
+	if err := s.sendEmailChanged(r.Context(), oldEmail, newEmail); err != nil {
+		log.Printf("failed to send email change notice to user %s: %v", userID, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeleteAccount deletes the signed-in user. The account is closed
+// straight away and the purge worker is asked to remove its data.
+func (s *Server) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	var req models.PasswordConfirmRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	if !s.confirmPassword(r.Context(), w, userID, req.Password) {
+		return
+	}
+
+	if err := s.store.DeleteUser(r.Context(), userID, time.Now()); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "user not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to delete account")
+		return
+	}
+
+	if s.purger != nil {
+		s.purger.PurgeAccounts()
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) sendPasswordReset(ctx context.Context, user *models.User) error {
+	token, err := s.issueUserToken(ctx, user, models.UserTokenPasswordReset, s.config.PasswordResetExpiry)
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Noted password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your Noted account.\n\n"+
+			"To choose a new password, open this link within %s:\n\n%s\n\n"+
+			"If this wasn't you, you can ignore this email.\n",
+			formatExpiry(s.config.PasswordResetExpiry), s.appLink("/reset-password", token)),
+	})
+}
+
+func (s *Server) sendEmailVerification(ctx context.Context, user *models.User) error {
+	token, err := s.issueUserToken(ctx, user, models.UserTokenVerifyEmail, s.config.EmailVerificationExpiry)
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your Noted email address",
+		Body: fmt.Sprintf("To confirm this is your email address, open this link within %s:\n\n%s\n",
+			formatExpiry(s.config.EmailVerificationExpiry), s.appLink("/verify-email", token)),
+	})
+}
+
+// sendEmailChangeConfirmation sends a link for moving the user to a new
+// address to that address. The token records the new address until the link
+// is followed.
+func (s *Server) sendEmailChangeConfirmation(ctx context.Context, user *models.User, newEmail string) error {
+	pending := *user
+	pending.Email = newEmail
+	token, err := s.issueUserToken(ctx, &pending, models.UserTokenChangeEmail, s.config.EmailVerificationExpiry)
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(ctx, mail.Message{
+		To:      newEmail,
+		Subject: "Confirm your new Noted email address",
+		Body: fmt.Sprintf("To move your Noted account to this address, open this link within %s:\n\n%s\n\n"+
+			"Until then your account keeps its current address. If this wasn't you, you can ignore this email.\n",
+			formatExpiry(s.config.EmailVerificationExpiry), s.appLink("/confirm-email", token)),
+	})
+}
+
+// sendEmailChanged tells the old address that the account has moved, so
+// the owner notices if it wasn't them
+func (s *Server) sendEmailChanged(ctx context.Context, oldEmail, newEmail string) error {
+	return s.mailer.Send(ctx, mail.Message{
+		To:      oldEmail,
+		Subject: "Your Noted email address was changed",
+		Body: fmt.Sprintf("The email address of your Noted account was changed to %s.\n\n"+
+			"If this wasn't you, reset your password and contact support.\n", newEmail),
+	})
+}
+
+// issueUserToken records a new single-use token for the user's address and
+// returns it
+func (s *Server) issueUserToken(ctx context.Context, user *models.User, purpose string, ttl time.Duration) (string, error) {
+	token, hash, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = s.store.CreateUserToken(ctx, &models.UserToken{
+		TokenHash: hash,
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// appLink returns a link to a web app page that takes an emailed token
+func (s *Server) appLink(path, token string) string {
+	return s.config.AppURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// formatExpiry describes a token lifetime for an email, such as "1 hour"
+func formatExpiry(d time.Duration) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return plural(int(d/time.Hour), "hour")
+	case d >= time.Minute && d%time.Minute == 0:
+		return plural(int(d/time.Minute), "minute")
+	default:
+		return d.String()
+	}
+}
@@ -0,0 +1,283 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/noted/server/internal/api"
+	"github.com/noted/server/internal/config"
+	"github.com/noted/server/internal/mail"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/testutil"
+)
+
+var emailTokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+func setupTestServerWithOutbox(t *testing.T) (*api.Server, *mail.Outbox, models.AuthResponse) {
+	t.Helper()
+	db := testutil.TestDB(t)
+	testutil.CleanTables(t, db)
+	outbox := testutil.TestMailer(t)
+
+	cfg := &config.Config{
+		JWTExpiration:           15 * time.Minute,
+		RefreshExpiry:           7 * 24 * time.Hour,
+		AppURL:                  "http://app.test",
+		PasswordResetExpiry:     time.Hour,
+		EmailVerificationExpiry: 48 * time.Hour,
+	}
+	srv := api.NewServer(db, cfg, testutil.TestBlobStore(t), outbox, testutil.TestKeys(t))
+
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/register", map[string]string{
+		"email": "account@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("failed to register user: %s", rec.Body.String())
+	}
+	var auth models.AuthResponse
+	json.NewDecoder(rec.Body).Decode(&auth)
+	return srv, outbox, auth
+}
+
+// lastEmailToken returns the token in the most recent message's link
+func lastEmailToken(t *testing.T, outbox *mail.Outbox) string {
+	t.Helper()
+	sent := outbox.Sent()
+	if len(sent) == 0 {
+		t.Fatal("expected an email to be sent")
+	}
+	match := emailTokenPattern.FindStringSubmatch(sent[len(sent)-1].Body)
+	if match == nil {
+		t.Fatalf("no token link in email: %s", sent[len(sent)-1].Body)
+	}
+	return match[1]
+}
+
+func TestEmailVerification(t *testing.T) {
+	srv, outbox, auth := setupTestServerWithOutbox(t)
+	if auth.User.EmailVerifiedAt != nil {
+		t.Fatal("expected a new account to be unverified")
+	}
+
+	token := lastEmailToken(t, outbox)
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/verify-email", map[string]string{"token": token})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusNoContent, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, auth.AccessToken, http.MethodGet, "/api/auth/me", nil)
+	var user models.User
+	json.NewDecoder(rec.Body).Decode(&user)
+	if user.EmailVerifiedAt == nil {
+		t.Error("expected the email to be verified")
+	}
+
+	// Tokens are single-use
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/verify-email", map[string]string{"token": token})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	srv, outbox, auth := setupTestServerWithOutbox(t)
+
+	// Unknown addresses get the same response
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/forgot-password", map[string]string{"email": "nobody@example.com"})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusAccepted)
+	}
+
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/forgot-password", map[string]string{"email": "account@example.com"})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	token := lastEmailToken(t, outbox)
+
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/reset-password", map[string]string{
+		"token": token, "password": "new-password456",
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusNoContent, rec.Body.String())
+	}
+
+	// Existing sessions are signed out and the new password works
+	if code, _ := refreshTokens(srv, auth.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("old session: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+		"email": "account@example.com", "password": "new-password456",
+	})
+	if rec.Code != http.StatusOK {
+		t.Errorf("login with new password: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/reset-password", map[string]string{
+		"token": token, "password": "another-password789",
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("reused token: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	srv, _, auth := setupTestServerWithOutbox(t)
+
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+		"email": "account@example.com", "password": "password123",
+	})
+	var other models.AuthResponse
+	json.NewDecoder(rec.Body).Decode(&other)
+
+	rec = authedRequest(srv, auth.AccessToken, http.MethodPut, "/api/auth/me/password", map[string]string{
+		"current_password": "wrong-password", "new_password": "new-password456",
+	})
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("wrong current password: got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	rec = authedRequest(srv, auth.AccessToken, http.MethodPut, "/api/auth/me/password", map[string]string{
+		"current_password": "password123", "new_password": "new-password456",
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusNoContent, rec.Body.String())
+	}
+
+	// Other sessions are signed out, the current one is kept
+	if code, _ := refreshTokens(srv, other.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("other session: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code, _ := refreshTokens(srv, auth.RefreshToken); code != http.StatusOK {
+		t.Errorf("current session: got status %d, want %d", code, http.StatusOK)
+	}
+
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+		"email": "account@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("login with old password: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	srv, outbox, auth := setupTestServerWithOutbox(t)
+
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/verify-email", map[string]string{"token": lastEmailToken(t, outbox)})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("failed to verify email: %s", rec.Body.String())
+	}
+
+	rec = authedRequest(srv, auth.AccessToken, http.MethodPut, "/api/auth/me/email", map[string]string{
+		"email": "moved@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusAccepted, rec.Body.String())
+	}
+
+	// Nothing changes until the link sent to the new address is followed
+	msg := outbox.Sent()[len(outbox.Sent())-1]
+	if msg.To != "moved@example.com" {
+		t.Fatalf("expected a confirmation link sent to the new address, got one to %q", msg.To)
+	}
+	rec = authedRequest(srv, auth.AccessToken, http.MethodGet, "/api/auth/me", nil)
+	var user models.User
+	json.NewDecoder(rec.Body).Decode(&user)
+	if user.Email != "account@example.com" || user.EmailVerifiedAt == nil {
+		t.Errorf("expected the verified old address to stay, got %+v", user)
+	}
+
+	// The link doesn't work as an ordinary verification link
+	token := lastEmailToken(t, outbox)
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/verify-email", map[string]string{"token": token})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("verify-email: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/confirm-email", map[string]string{"token": token})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("confirm new address: got status %d, want %d. Body: %s", rec.Code, http.StatusNoContent, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, auth.AccessToken, http.MethodGet, "/api/auth/me", nil)
+	json.NewDecoder(rec.Body).Decode(&user)
+	if user.Email != "moved@example.com" || user.EmailVerifiedAt == nil {
+		t.Errorf("expected the new address to be verified, got %+v", user)
+	}
+
+	// The old address is told about the change
+	msg = outbox.Sent()[len(outbox.Sent())-1]
+	if msg.To != "account@example.com" || msg.Subject != "Your Noted email address was changed" {
+		t.Errorf("expected a notice to the old address, got %q to %q", msg.Subject, msg.To)
+	}
+
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/confirm-email", map[string]string{"token": token})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("reused link: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+		"email": "moved@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusOK {
+		t.Errorf("login with new address: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestChangeEmailConflict(t *testing.T) {
+	srv, _, auth := setupTestServerWithOutbox(t)
+
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/register", map[string]string{
+		"email": "taken@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("failed to register user: %s", rec.Body.String())
+	}
+
+	rec = authedRequest(srv, auth.AccessToken, http.MethodPut, "/api/auth/me/email", map[string]string{
+		"email": "taken@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusConflict {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	srv, _, auth := setupTestServerWithOutbox(t)
+
+	rec := authedRequest(srv, auth.AccessToken, http.MethodDelete, "/api/auth/me", map[string]string{"password": "wrong-password"})
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("wrong password: got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	rec = authedRequest(srv, auth.AccessToken, http.MethodDelete, "/api/auth/me", map[string]string{"password": "password123"})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusNoContent, rec.Body.String())
+	}
+
+	// Access tokens stop working straight away, not when they expire
+	rec = authedRequest(srv, auth.AccessToken, http.MethodGet, "/api/notebooks", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("access token: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+		"email": "account@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("login: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if code, _ := refreshTokens(srv, auth.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// The address is free to sign up again
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/register", map[string]string{
+		"email": "account@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusCreated {
+		t.Errorf("register again: got status %d, want %d", rec.Code, http.StatusCreated)
+	}
+}
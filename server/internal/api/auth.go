@@ -1,14 +1,21 @@
 package api
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/signing"
 	"github.com/noted/server/internal/store"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -17,8 +24,15 @@ import (
 type Claims struct {
 	jwt.RegisteredClaims
 	TokenType string `json:"type"`
+	SessionID string `json:"sid,omitempty"`
 }
 
+var (
+	errInvalidToken     = errors.New("invalid token")
+	errInvalidTokenType = errors.New("invalid token type")
+	errSessionEnded     = errors.New("session has ended")
+)
+
 func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	var req models.CreateUserRequest
 	if err := decodeJSON(r, &req); err != nil {
@@ -66,6 +80,7 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		UserID:    user.ID,
 		Title:     "Main",
 		SortOrder: 0,
+		Version:   1,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
@@ -75,7 +90,11 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("Warning: failed to create default notebook for user %s: %v\n", user.ID, err)
 	}
 
-	tokens, err := s.generateTokens(user.ID)
+	if err := s.sendEmailVerification(r.Context(), user); err != nil {
+		log.Printf("failed to send verification email to user %s: %v", user.ID, err)
+	}
+
+	tokens, err := s.startSession(r, user.ID)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "server_error", "failed to generate tokens")
 		return
@@ -95,9 +114,22 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Repeated failures lock the address, whether or not it has an account,
+	// so guessing can't be used to find accounts either
+	lockedFor, err := s.loginLockedFor(r.Context(), req.Email)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to check login attempts")
+		return
+	}
+	if lockedFor > 0 {
+		respondRateLimited(w, lockedFor, "too many failed login attempts, try again later")
+		return
+	}
+
 	user, err := s.store.GetUserByEmail(r.Context(), req.Email)
 	if err != nil {
 		if errors.Is(err, store.ErrNotFound) {
+			s.recordLoginFailure(r.Context(), req.Email)
 			respondError(w, http.StatusUnauthorized, "unauthorized", "invalid email or password")
 			return
 		}
@@ -106,11 +138,29 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		s.recordLoginFailure(r.Context(), req.Email)
 		respondError(w, http.StatusUnauthorized, "unauthorized", "invalid email or password")
 		return
 	}
 
-	tokens, err := s.generateTokens(user.ID)
+	// With two-factor authentication the session is only started once a
+	// code is supplied to handleMFALogin, which also clears the failures
+	if user.MFAEnabled {
+		mfaToken, expiresAt, err := s.generateMFAToken(r.Context(), user)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to generate tokens")
+			return
+		}
+		respondJSON(w, http.StatusOK, models.MFAChallengeResponse{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+			ExpiresAt:   expiresAt,
+		})
+		return
+	}
+	s.clearLoginFailures(r.Context(), req.Email)
+
+	tokens, err := s.startSession(r, user.ID)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "server_error", "failed to generate tokens")
 		return
@@ -132,33 +182,35 @@ func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(req.RefreshToken, claims, func(token *jwt.Token) (interface{}, error) {
-		// Validate signing algorithm to prevent algorithm confusion attacks
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(s.config.JWTSecret), nil
-	})
-
-	if err != nil || !token.Valid {
+	if req.RefreshToken == "" {
 		respondError(w, http.StatusUnauthorized, "unauthorized", "invalid or expired refresh token")
 		return
 	}
 
-	if claims.TokenType != "refresh" {
-		respondError(w, http.StatusUnauthorized, "unauthorized", "invalid token type")
+	refreshToken, refreshHash, err := newOpaqueToken()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to generate tokens")
 		return
 	}
 
-	userID, err := uuid.Parse(claims.Subject)
+	// The device is picked up here because clients register it after
+	// signing in
+	session, err := s.store.RotateRefreshToken(r.Context(), hashToken(req.RefreshToken), refreshHash,
+		headerDeviceID(r), time.Now().Add(s.config.RefreshExpiry))
 	if err != nil {
-		respondError(w, http.StatusUnauthorized, "unauthorized", "invalid user ID in token")
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			respondError(w, http.StatusUnauthorized, "unauthorized", "invalid or expired refresh token")
+		case errors.Is(err, store.ErrRefreshTokenReused):
+			respondError(w, http.StatusUnauthorized, "unauthorized", "refresh token was already used; the session has been signed out")
+		default:
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to refresh session")
+		}
 		return
 	}
 
 	// Verify user still exists
-	user, err := s.store.GetUserByID(r.Context(), userID)
+	user, err := s.store.GetUserByID(r.Context(), session.UserID)
 	if err != nil {
 		if errors.Is(err, store.ErrNotFound) {
 			respondError(w, http.StatusUnauthorized, "unauthorized", "user not found")
@@ -168,7 +220,7 @@ func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tokens, err := s.generateTokens(user.ID)
+	accessToken, err := s.generateAccessToken(user.ID, session.ID)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "server_error", "failed to generate tokens")
 		return
@@ -176,11 +228,37 @@ func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
 
 	respondJSON(w, http.StatusOK, models.AuthResponse{
 		User:         user,
-		AccessToken:  tokens.AccessToken,
-		RefreshToken: tokens.RefreshToken,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
 	})
 }
 
+// handleLogout ends the session a refresh token belongs to, along with the
+// access tokens issued for it, which stop working straight away.
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	if req.RefreshToken == "" {
+		respondError(w, http.StatusBadRequest, "validation_error", "refresh_token is required")
+		return
+	}
+
+	// Logging out of a session that has already ended succeeds too
+	err := s.store.RevokeSessionByToken(r.Context(), hashToken(req.RefreshToken))
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to log out")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Server) handleGetMe(w http.ResponseWriter, r *http.Request) {
 	userID, ok := GetUserID(r.Context())
 	if !ok {
@@ -201,73 +279,161 @@ func (s *Server) handleGetMe(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, user)
 }
 
+// handleJWKS publishes the public keys that verify the server's tokens, so
+// other services can check them without sharing a secret
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondJSON(w, http.StatusOK, struct {
+		Keys []signing.JWK `json:"keys"`
+	}{Keys: s.keys.Keys()})
+}
+
 type tokenPair struct {
 	AccessToken  string
 	RefreshToken string
 }
 
-func (s *Server) generateTokens(userID uuid.UUID) (*tokenPair, error) {
-	now := time.Now()
+// startSession creates a session for a user who just signed in and returns
+// its first tokens
+func (s *Server) startSession(r *http.Request, userID uuid.UUID) (*tokenPair, error) {
+	refreshToken, refreshHash, err := newOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
 
-	// Access token
-	accessClaims := &Claims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   userID.String(),
-			IssuedAt:  jwt.NewNumericDate(now),
-			ExpiresAt: jwt.NewNumericDate(now.Add(s.config.JWTExpiration)),
-		},
-		TokenType: "access",
+	now := time.Now()
+	session := &models.Session{
+		ID:         uuid.New(),
+		UserID:     userID,
+		DeviceID:   headerDeviceID(r),
+		UserAgent:  truncate(r.UserAgent(), 500),
+		IPAddress:  clientIP(r),
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(s.config.RefreshExpiry),
+	}
+	if err := s.store.CreateSession(r.Context(), session, refreshHash); err != nil {
+		return nil, err
 	}
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	accessTokenString, err := accessToken.SignedString([]byte(s.config.JWTSecret))
+
+	accessToken, err := s.generateAccessToken(userID, session.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Refresh token
-	refreshClaims := &Claims{
+	return &tokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (s *Server) generateAccessToken(userID, sessionID uuid.UUID) (string, error) {
+	now := time.Now()
+	claims := &Claims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			Subject:   userID.String(),
 			IssuedAt:  jwt.NewNumericDate(now),
-			ExpiresAt: jwt.NewNumericDate(now.Add(s.config.RefreshExpiry)),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.config.JWTExpiration)),
 		},
-		TokenType: "refresh",
+		TokenType: "access",
+		SessionID: sessionID.String(),
 	}
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	refreshTokenString, err := refreshToken.SignedString([]byte(s.config.JWTSecret))
-	if err != nil {
-		return nil, err
+	return s.keys.Sign(claims)
+}
+
+// newOpaqueToken returns a random token for refresh tokens and emailed
+// links, and the hash it is stored under
+func newOpaqueToken() (string, []byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
 	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
 
-	return &tokenPair{
-		AccessToken:  accessTokenString,
-		RefreshToken: refreshTokenString,
-	}, nil
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
 }
 
-// validateToken validates an access token and returns the user ID
-func (s *Server) validateToken(tokenString string) (uuid.UUID, error) {
-	claims := &Claims{}
+// headerDeviceID returns the device named in the X-Device-ID header, if it
+// is a valid ID. The store checks that the device belongs to the user.
+func headerDeviceID(r *http.Request) *uuid.UUID {
+	id, err := uuid.Parse(r.Header.Get("X-Device-ID"))
+	if err != nil {
+		return nil
+	}
+	return &id
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(s.config.JWTSecret), nil
-	})
+// clientIP returns the address the request came from, without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
 
-	if err != nil || !token.Valid {
-		return uuid.Nil, fmt.Errorf("invalid token")
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
 	}
+	return s
+}
 
-	if claims.TokenType != "access" {
-		return uuid.Nil, fmt.Errorf("invalid token type")
+// validateToken validates an access token and returns the user and session
+// IDs. Access tokens end with their session, so signing out or deleting the
+// account takes effect straight away.
+func (s *Server) validateToken(ctx context.Context, tokenString string) (uuid.UUID, uuid.UUID, error) {
+	claims, err := s.parseToken(tokenString, "access")
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
 	}
 
 	userID, err := uuid.Parse(claims.Subject)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID in token")
+		return uuid.Nil, uuid.Nil, errInvalidToken
+	}
+	sessionID, err := uuid.Parse(claims.SessionID)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, errInvalidToken
+	}
+
+	session, err := s.store.GetSessionByID(ctx, sessionID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return uuid.Nil, uuid.Nil, errSessionEnded
+		}
+		return uuid.Nil, uuid.Nil, err
+	}
+	if session.UserID != userID || session.RevokedAt != nil {
+		return uuid.Nil, uuid.Nil, errSessionEnded
+	}
+
+	return userID, sessionID, nil
+}
+
+// SignedTokenLifetime is the longest a token signed by the server lasts,
+// given how long access tokens last, and so how long a retired signing key
+// has to keep verifying them
+func SignedTokenLifetime(accessExpiry time.Duration) time.Duration {
+	return max(accessExpiry, mfaChallengeExpiry, oidcStateExpiry)
+}
+
+// parseToken verifies a token signed by the server and checks its type.
+// The server signs all its tokens, and the single sign-on state cookie,
+// with the same keys.
+func (s *Server) parseToken(tokenString, tokenType string) (*Claims, error) {
+	claims := &Claims{}
+	if err := s.keys.Parse(tokenString, claims); err != nil {
+		return nil, errInvalidToken
+	}
+
+	if claims.TokenType != tokenType {
+		return nil, errInvalidTokenType
 	}
 
-	return userID, nil
+	return claims, nil
 }
@@ -2,12 +2,15 @@ package api_test
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/noted/server/internal/api"
 	"github.com/noted/server/internal/config"
 	"github.com/noted/server/internal/models"
@@ -20,11 +23,10 @@ func TestAuthRegister(t *testing.T) {
 	blobStore := testutil.TestBlobStore(t)
 
 	cfg := &config.Config{
-		JWTSecret:      "test-secret",
 		JWTExpiration:  15 * time.Minute,
 		RefreshExpiry:  7 * 24 * time.Hour,
 	}
-	srv := api.NewServer(db, cfg, blobStore)
+	srv := api.NewServer(db, cfg, blobStore, testutil.TestMailer(t), testutil.TestKeys(t))
 
 	tests := []struct {
 		name       string
@@ -91,11 +93,10 @@ func TestAuthLogin(t *testing.T) {
 	blobStore := testutil.TestBlobStore(t)
 
 	cfg := &config.Config{
-		JWTSecret:      "test-secret",
 		JWTExpiration:  15 * time.Minute,
 		RefreshExpiry:  7 * 24 * time.Hour,
 	}
-	srv := api.NewServer(db, cfg, blobStore)
+	srv := api.NewServer(db, cfg, blobStore, testutil.TestMailer(t), testutil.TestKeys(t))
 
 	// Register a user first
 	regBody, _ := json.Marshal(map[string]string{"email": "login@example.com", "password": "password123"})
@@ -152,11 +153,10 @@ func TestAuthRefresh(t *testing.T) {
 	blobStore := testutil.TestBlobStore(t)
 
 	cfg := &config.Config{
-		JWTSecret:      "test-secret",
 		JWTExpiration:  15 * time.Minute,
 		RefreshExpiry:  7 * 24 * time.Hour,
 	}
-	srv := api.NewServer(db, cfg, blobStore)
+	srv := api.NewServer(db, cfg, blobStore, testutil.TestMailer(t), testutil.TestKeys(t))
 
 	// Register a user
 	regBody, _ := json.Marshal(map[string]string{"email": "refresh@example.com", "password": "password123"})
@@ -202,11 +202,10 @@ func TestAuthMe(t *testing.T) {
 	blobStore := testutil.TestBlobStore(t)
 
 	cfg := &config.Config{
-		JWTSecret:      "test-secret",
 		JWTExpiration:  15 * time.Minute,
 		RefreshExpiry:  7 * 24 * time.Hour,
 	}
-	srv := api.NewServer(db, cfg, blobStore)
+	srv := api.NewServer(db, cfg, blobStore, testutil.TestMailer(t), testutil.TestKeys(t))
 
 	// Register a user
 	regBody, _ := json.Marshal(map[string]string{"email": "me@example.com", "password": "password123"})
@@ -251,11 +250,10 @@ func TestAuthMiddleware(t *testing.T) {
 	blobStore := testutil.TestBlobStore(t)
 
 	cfg := &config.Config{
-		JWTSecret:      "test-secret",
 		JWTExpiration:  15 * time.Minute,
 		RefreshExpiry:  7 * 24 * time.Hour,
 	}
-	srv := api.NewServer(db, cfg, blobStore)
+	srv := api.NewServer(db, cfg, blobStore, testutil.TestMailer(t), testutil.TestKeys(t))
 
 	tests := []struct {
 		name       string
@@ -295,3 +293,36 @@ func TestAuthMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestJWKSVerifiesAccessTokens(t *testing.T) {
+	srv, auth := setupTestServerWithSession(t)
+
+	rec := authedRequest(srv, "", http.MethodGet, "/.well-known/jwks.json", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Alg string `json:"alg"`
+			X   string `json:"x"`
+		} `json:"keys"`
+	}
+	json.NewDecoder(rec.Body).Decode(&jwks)
+
+	// Another service can verify the token with the published key alone
+	_, err := jwt.Parse(auth.AccessToken, func(token *jwt.Token) (interface{}, error) {
+		for _, key := range jwks.Keys {
+			if key.Kid == token.Header["kid"] && key.Kty == "OKP" {
+				x, err := base64.RawURLEncoding.DecodeString(key.X)
+				return ed25519.PublicKey(x), err
+			}
+		}
+		return nil, jwt.ErrTokenUnverifiable
+	}, jwt.WithValidMethods([]string{"EdDSA"}))
+	if err != nil {
+		t.Errorf("failed to verify the access token with the JWKS: %v", err)
+	}
+}
+
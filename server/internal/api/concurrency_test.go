@@ -0,0 +1,142 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/noted/server/internal/api"
+	"github.com/noted/server/internal/models"
+)
+
+// ifMatchRequest makes an authenticated request with an If-Match header
+func ifMatchRequest(srv *api.Server, token, method, path, ifMatch string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("If-Match", ifMatch)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestUpdateNoteIfMatch(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	note := createTestNote(t, srv, token, notebookID)
+	path := "/api/notes/" + note.ID.String()
+
+	rec := authedRequest(srv, token, http.MethodGet, path, nil)
+	if got := rec.Header().Get("ETag"); got != `"1"` {
+		t.Fatalf("got ETag %q, want %q", got, `"1"`)
+	}
+
+	rec = ifMatchRequest(srv, token, http.MethodPut, path, `"1"`, map[string]string{"plain_text": "first"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	if got := rec.Header().Get("ETag"); got != `"2"` {
+		t.Errorf("got ETag %q, want %q", got, `"2"`)
+	}
+
+	// A second writer still holding version 1 gets the current copy back
+	rec = ifMatchRequest(srv, token, http.MethodPut, path, `"1"`, map[string]string{"plain_text": "second"})
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusConflict, rec.Body.String())
+	}
+	if got := rec.Header().Get("ETag"); got != `"2"` {
+		t.Errorf("got ETag %q, want %q", got, `"2"`)
+	}
+	var conflict struct {
+		Error  string      `json:"error"`
+		Server models.Note `json:"server"`
+	}
+	json.NewDecoder(rec.Body).Decode(&conflict)
+	if conflict.Error != "version_conflict" || conflict.Server.Version != 2 || conflict.Server.PlainText != "first" {
+		t.Errorf("got conflict %+v", conflict)
+	}
+
+	// The version field in the body works like If-Match
+	rec = authedRequest(srv, token, http.MethodPut, path, map[string]interface{}{"plain_text": "second", "version": 1})
+	if rec.Code != http.StatusConflict {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusConflict)
+	}
+	rec = authedRequest(srv, token, http.MethodPut, path, map[string]interface{}{"plain_text": "second", "version": 2})
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	// Updates without a version still apply to the current one
+	rec = ifMatchRequest(srv, token, http.MethodPut, path, "*", map[string]string{"plain_text": "third"})
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	rec = ifMatchRequest(srv, token, http.MethodPut, path, `W/"4"`, map[string]string{"plain_text": "fourth"})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestUpdateNotebookIfMatch(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	path := "/api/notebooks/" + notebookID
+
+	rec := authedRequest(srv, token, http.MethodGet, path, nil)
+	var notebook models.Notebook
+	json.NewDecoder(rec.Body).Decode(&notebook)
+	if notebook.Version != 1 || rec.Header().Get("ETag") != `"1"` {
+		t.Fatalf("got version %d and ETag %q, want 1", notebook.Version, rec.Header().Get("ETag"))
+	}
+
+	rec = ifMatchRequest(srv, token, http.MethodPut, path, `"1"`, map[string]string{"title": "Renamed"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	rec = ifMatchRequest(srv, token, http.MethodPut, path, `"1"`, map[string]string{"title": "Stale"})
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusConflict, rec.Body.String())
+	}
+	var conflict struct {
+		Server models.Notebook `json:"server"`
+	}
+	json.NewDecoder(rec.Body).Decode(&conflict)
+	if conflict.Server.Title != "Renamed" || conflict.Server.Version != 2 {
+		t.Errorf("got server copy %+v", conflict.Server)
+	}
+}
+
+func TestUpdateTagIfMatch(t *testing.T) {
+	srv, token, _ := setupTestServerWithNotebook(t)
+
+	rec := authedRequest(srv, token, http.MethodPost, "/api/tags", map[string]string{"name": "work"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("failed to create tag: %d %s", rec.Code, rec.Body.String())
+	}
+	var tag models.Tag
+	json.NewDecoder(rec.Body).Decode(&tag)
+	path := "/api/tags/" + tag.ID.String()
+
+	rec = authedRequest(srv, token, http.MethodPut, path, map[string]interface{}{"name": "office", "version": tag.Version})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, token, http.MethodPut, path, map[string]interface{}{"name": "stale", "version": tag.Version})
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusConflict, rec.Body.String())
+	}
+	var conflict struct {
+		Server models.Tag `json:"server"`
+	}
+	json.NewDecoder(rec.Body).Decode(&conflict)
+	if conflict.Server.Name != "office" || conflict.Server.Version != tag.Version+1 {
+		t.Errorf("got server copy %+v", conflict.Server)
+	}
+}
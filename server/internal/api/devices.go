@@ -0,0 +1,123 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/store"
+)
+
+func (s *Server) handleListDevices(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	devices, err := s.store.GetDevicesByUserID(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get devices")
+		return
+	}
+
+	if devices == nil {
+		devices = []models.Device{}
+	}
+
+	// Flag the device making the request
+	if currentID, ok := store.DeviceIDFromContext(r.Context()); ok {
+		for i := range devices {
+			devices[i].IsCurrent = devices[i].ID == currentID
+		}
+	}
+
+	respondJSON(w, http.StatusOK, devices)
+}
+
+func (s *Server) handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	var req models.CreateDeviceRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	if req.Name == "" {
+		respondError(w, http.StatusBadRequest, "validation_error", "name is required")
+		return
+	}
+	if len(req.Name) > 255 {
+		respondError(w, http.StatusBadRequest, "validation_error", "name must be at most 255 characters")
+		return
+	}
+	if len(req.Platform) > 50 {
+		respondError(w, http.StatusBadRequest, "validation_error", "platform must be at most 50 characters")
+		return
+	}
+
+	now := time.Now()
+	device := &models.Device{
+		ID:         uuid.New(),
+		UserID:     userID,
+		Name:       req.Name,
+		Platform:   req.Platform,
+		CreatedAt:  now,
+		LastSeenAt: &now,
+	}
+
+	if err := s.store.CreateDevice(r.Context(), device); err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to register device")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, device)
+}
+
+func (s *Server) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid device ID")
+		return
+	}
+
+	device, err := s.store.GetDeviceByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "device not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get device")
+		return
+	}
+
+	if device.UserID != userID || device.RevokedAt != nil {
+		respondError(w, http.StatusNotFound, "not_found", "device not found")
+		return
+	}
+
+	if err := s.store.RevokeDevice(r.Context(), id); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "device not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to revoke device")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,124 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/noted/server/internal/models"
+)
+
+func TestDevicesRegisterListRevoke(t *testing.T) {
+	srv, token, _ := setupTestServerWithNotebook(t)
+
+	// Register
+	body, _ := json.Marshal(map[string]string{"name": "Work laptop", "platform": "web"})
+	req := httptest.NewRequest(http.MethodPost, "/api/devices", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusCreated, rec.Body.String())
+	}
+	var device models.Device
+	json.NewDecoder(rec.Body).Decode(&device)
+
+	// List from the device itself
+	req = httptest.NewRequest(http.MethodGet, "/api/devices", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Device-ID", device.ID.String())
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	var devices []models.Device
+	json.NewDecoder(rec.Body).Decode(&devices)
+	if len(devices) != 1 || devices[0].ID != device.ID || !devices[0].IsCurrent {
+		t.Errorf("expected the registered device marked current, got %+v", devices)
+	}
+
+	// Revoke
+	req = httptest.NewRequest(http.MethodDelete, "/api/devices/"+device.ID.String(), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	// A revoked device can no longer make requests
+	req = httptest.NewRequest(http.MethodGet, "/api/devices", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Device-ID", device.ID.String())
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSyncExcludesOwnDeviceChanges(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+
+	body, _ := json.Marshal(map[string]string{"name": "Phone", "platform": "ios"})
+	req := httptest.NewRequest(http.MethodPost, "/api/devices", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	var device models.Device
+	json.NewDecoder(rec.Body).Decode(&device)
+
+	full := syncGet(t, srv, token, "")
+
+	// The device creates a note
+	noteBody, _ := json.Marshal(map[string]interface{}{
+		"content":    map[string]interface{}{"type": "doc"},
+		"plain_text": "From the phone",
+	})
+	req = httptest.NewRequest(http.MethodPost, "/api/notebooks/"+notebookID+"/notes", bytes.NewReader(noteBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Device-ID", device.ID.String())
+	srv.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The device doesn't get its own note back
+	req = httptest.NewRequest(http.MethodGet, "/api/sync?cursor="+full.Cursor, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Device-ID", device.ID.String())
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	var own models.SyncResponse
+	json.NewDecoder(rec.Body).Decode(&own)
+	if len(own.Notes) != 0 {
+		t.Errorf("expected no notes for the originating device, got %d", len(own.Notes))
+	}
+	if own.Cursor == full.Cursor {
+		t.Error("expected the cursor to move past the device's own change")
+	}
+
+	// Other clients do
+	other := syncGet(t, srv, token, full.Cursor)
+	if len(other.Notes) != 1 {
+		t.Errorf("expected the note for other clients, got %d", len(other.Notes))
+	}
+
+	// The sync shows up on the device
+	req = httptest.NewRequest(http.MethodGet, "/api/devices", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	var devices []models.Device
+	json.NewDecoder(rec.Body).Decode(&devices)
+	if len(devices) != 1 || devices[0].LastSyncedAt == nil {
+		t.Errorf("expected last_synced_at to be set, got %+v", devices)
+	}
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/store"
+)
+
+const (
+	// eventsHeartbeat keeps idle streams open through proxies
+	eventsHeartbeat = 25 * time.Second
+
+	// eventsRetryDelay is how long the listener waits before reconnecting
+	// after losing its database connection
+	eventsRetryDelay = 5 * time.Second
+
+	// eventTicketExpiry is how long a client has to open an event stream
+	// with a ticket
+	eventTicketExpiry = time.Minute
+)
+
+// eventHub fans change notifications out to the event streams of each user
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[uuid.UUID]map[*eventSubscriber]struct{}
+
+	// closed ends every stream once changes are no longer being relayed,
+	// so open streams don't hold up a graceful shutdown
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// eventSubscriber is one open event stream. Notifications that arrive while
+// the stream is busy are coalesced into the latest change sequence.
+type eventSubscriber struct {
+	mu     sync.Mutex
+	seq    int64
+	notify chan struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subscribers: make(map[uuid.UUID]map[*eventSubscriber]struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (h *eventHub) close() {
+	h.closeOnce.Do(func() { close(h.closed) })
+}
+
+func (h *eventHub) subscribe(userID uuid.UUID) *eventSubscriber {
+	sub := &eventSubscriber{notify: make(chan struct{}, 1)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[*eventSubscriber]struct{})
+	}
+	h.subscribers[userID][sub] = struct{}{}
+	return sub
+}
+
+func (h *eventHub) unsubscribe(userID uuid.UUID, sub *eventSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers[userID], sub)
+	if len(h.subscribers[userID]) == 0 {
+		delete(h.subscribers, userID)
+	}
+}
+
+func (h *eventHub) publish(userID uuid.UUID, seq int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscribers[userID] {
+		sub.mu.Lock()
+		if seq > sub.seq {
+			sub.seq = seq
+		}
+		sub.mu.Unlock()
+
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (sub *eventSubscriber) latest() int64 {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.seq
+}
+
+// ListenForChanges relays change notifications from the database to open
+// event streams until ctx is cancelled, reconnecting if the listener fails.
+// Open streams are closed when it returns.
+func (s *Server) ListenForChanges(ctx context.Context) {
+	defer s.events.close()
+	for {
+		err := s.store.ListenChanges(ctx, s.events.publish)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("events: change listener stopped, retrying in %s: %v", eventsRetryDelay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(eventsRetryDelay):
+		}
+	}
+}
+
+// handleEvents streams a "changed" Server-Sent Event carrying the latest sync
+// cursor whenever the user's data changes. Clients then fetch the changes
+// with GET /api/sync.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "streaming not supported")
+		return
+	}
+
+	sub := s.events.subscribe(userID)
+	defer s.events.unsubscribe(userID, sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "event: ready\ndata: {}\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.events.closed:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-sub.notify:
+			seq := sub.latest()
+			fmt.Fprintf(w, "id: %d\nevent: changed\ndata: {\"cursor\":%q}\n\n", seq, encodeSyncCursor(seq))
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// handleCreateEventTicket issues a single-use ticket for opening an event
+// stream. Browsers can't send an Authorization header with the EventSource
+// API, so they pass a ticket in the query string instead of an access token.
+func (s *Server) handleCreateEventTicket(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	user, err := s.store.GetUserByID(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusUnauthorized, "unauthorized", "user not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get user")
+		return
+	}
+
+	ticket, err := s.issueUserToken(r.Context(), user, models.UserTokenEventStream, eventTicketExpiry)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to create ticket")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, models.EventTicketResponse{
+		Ticket:    ticket,
+		ExpiresAt: time.Now().Add(eventTicketExpiry),
+	})
+}
+
+// eventStreamAuth authenticates an event stream with the Authorization header
+// or with a ticket from handleCreateEventTicket in the ticket query
+// parameter. Access tokens are never accepted in the query string.
+func (s *Server) eventStreamAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Has("access_token") {
+			respondError(w, http.StatusUnauthorized, "unauthorized", "access tokens can't be passed in the URL, use a ticket from POST /api/events/ticket")
+			return
+		}
+
+		ticket := query.Get("ticket")
+		if ticket == "" || r.Header.Get("Authorization") != "" {
+			s.authMiddleware(next).ServeHTTP(w, r)
+			return
+		}
+
+		token, err := s.store.ConsumeUserToken(r.Context(), hashToken(ticket), models.UserTokenEventStream)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				respondError(w, http.StatusUnauthorized, "unauthorized", "invalid, expired or used ticket")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to check ticket")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userIDKey, token.UserID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,148 @@
+package api_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/noted/server/internal/api"
+	"github.com/noted/server/internal/models"
+)
+
+func TestEventsRequiresAuth(t *testing.T) {
+	srv, _, _ := setupTestServerWithNotebook(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/events", nil)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func createEventTicket(t *testing.T, srv *api.Server, token string) string {
+	t.Helper()
+	rec := authedRequest(srv, token, http.MethodPost, "/api/events/ticket", nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("failed to create event ticket: %d %s", rec.Code, rec.Body.String())
+	}
+	var resp models.EventTicketResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return resp.Ticket
+}
+
+func TestEventsTicket(t *testing.T) {
+	srv, token, _ := setupTestServerWithNotebook(t)
+
+	// Access tokens aren't taken from the URL, where they would be logged
+	req := httptest.NewRequest(http.MethodGet, "/api/events?access_token="+token, nil)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	// Personal access tokens can't be exchanged for tickets
+	pat := createPersonalAccessToken(t, srv, token, models.ScopeSync)
+	rec = authedRequest(srv, pat.Token, http.MethodPost, "/api/events/ticket", nil)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	// Tickets from two tabs both work, but only once
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	first := createEventTicket(t, srv, token)
+	second := createEventTicket(t, srv, token)
+	for _, ticket := range []string{first, second} {
+		resp, err := http.Get(ts.URL + "/api/events?ticket=" + ticket)
+		if err != nil {
+			t.Fatalf("failed to open event stream: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/events?ticket="+first, nil)
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestEventsStreamsChanges(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.ListenForChanges(ctx)
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	ticket := createEventTicket(t, srv, token)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/events?ticket="+ticket, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got content type %q, want text/event-stream", ct)
+	}
+
+	events := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if name, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+				events <- name
+			}
+		}
+		close(events)
+	}()
+
+	if name := <-events; name != "ready" {
+		t.Fatalf("got first event %q, want ready", name)
+	}
+
+	// The listener may still be connecting, so keep making changes until
+	// one is announced
+	deadline := time.After(10 * time.Second)
+	for {
+		body, _ := json.Marshal(map[string]interface{}{
+			"content":    map[string]interface{}{"type": "doc"},
+			"plain_text": "Hello",
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/notebooks/"+notebookID+"/notes", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		srv.ServeHTTP(httptest.NewRecorder(), req)
+
+		select {
+		case name := <-events:
+			if name != "changed" {
+				t.Fatalf("got event %q, want changed", name)
+			}
+			return
+		case <-time.After(500 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("timed out waiting for a change event")
+		}
+	}
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"log"
@@ -82,6 +83,32 @@ func (s *Server) handleUploadImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Offline clients pick the image ID themselves so they can reference the
+	// image before it is uploaded
+	imageID := uuid.New()
+	if idStr := r.FormValue("id"); idStr != "" {
+		imageID, err = uuid.Parse(idStr)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid_request", "invalid image ID")
+			return
+		}
+
+		existing, err := s.store.GetImageByID(r.Context(), imageID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to get image")
+			return
+		}
+		if existing != nil {
+			// A retried upload of the same image returns the stored record
+			if existing.NoteID != noteID || existing.DeletedAt != nil {
+				respondError(w, http.StatusConflict, "already_exists", "image already exists")
+				return
+			}
+			respondJSON(w, http.StatusOK, s.imageResponse(r.Context(), existing))
+			return
+		}
+	}
+
 	// Read first 512 bytes to detect content type from magic bytes
 	headerBytes := make([]byte, 512)
 	n, err := file.Read(headerBytes)
@@ -110,7 +137,6 @@ func (s *Server) handleUploadImage(w http.ResponseWriter, r *http.Request) {
 	contentType := detectedType
 
 	// Generate storage key with validated extension
-	imageID := uuid.New()
 	ext := getExtensionForMimeType(contentType)
 	if ext == "" {
 		// Fallback to original extension only if it matches allowed types
@@ -155,15 +181,20 @@ func (s *Server) handleUploadImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	respondJSON(w, http.StatusCreated, s.imageResponse(r.Context(), image))
+}
+
+// imageResponse builds the response for an image with a fresh signed URL
+func (s *Server) imageResponse(ctx context.Context, image *models.Image) ImageResponse {
 	// Generate signed URL for the response (use image ID, not storage key)
-	signedURL, err := s.blobStore.GetSignedURL(r.Context(), imageID.String(), s.config.StorageURLExpiry)
+	signedURL, err := s.blobStore.GetSignedURL(ctx, image.ID.String(), s.config.StorageURLExpiry)
 	if err != nil {
-		// Log error but don't fail the request - image was uploaded successfully
+		// Log error but don't fail the request - the image itself is fine
 		log.Printf("WARNING: failed to generate signed URL: %v", err)
 		signedURL = ""
 	}
 
-	response := ImageResponse{
+	return ImageResponse{
 		ID:         image.ID,
 		NoteID:     image.NoteID,
 		Filename:   image.Filename,
@@ -173,8 +204,6 @@ func (s *Server) handleUploadImage(w http.ResponseWriter, r *http.Request) {
 		CreatedAt:  image.CreatedAt,
 		URL:        signedURL,
 	}
-
-	respondJSON(w, http.StatusCreated, response)
 }
 
 func (s *Server) handleGetImage(w http.ResponseWriter, r *http.Request) {
@@ -194,6 +223,10 @@ func (s *Server) handleGetImage(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusInternalServerError, "server_error", "failed to get image")
 		return
 	}
+	if image.DeletedAt != nil {
+		respondError(w, http.StatusNotFound, "not_found", "image not found")
+		return
+	}
 
 	// Check for signed URL parameters
 	expiresStr := r.URL.Query().Get("expires")
@@ -201,7 +234,7 @@ func (s *Server) handleGetImage(w http.ResponseWriter, r *http.Request) {
 
 	// Try signed URL authentication first
 	if expiresStr != "" && sig != "" {
-		params, err := storage.ParseSignedURLParams(expiresStr, sig, id.String())
+		params, err := storage.ParseSignedURLParams(expiresStr, r.URL.Query().Get("kid"), sig, id.String())
 		if err != nil {
 			respondError(w, http.StatusBadRequest, "invalid_request", "invalid signature parameters")
 			return
@@ -209,7 +242,7 @@ func (s *Server) handleGetImage(w http.ResponseWriter, r *http.Request) {
 
 		// Verify signature using SignedURLVerifier interface if available
 		if verifier, ok := s.blobStore.(storage.SignedURLVerifier); ok {
-			if err := verifier.VerifySignedURL(params.Key, params.Expires, params.Sig); err != nil {
+			if err := verifier.VerifySignedURL(params.Key, params.Expires, params.KeyID, params.Sig); err != nil {
 				if errors.Is(err, storage.ErrExpired) {
 					respondError(w, http.StatusForbidden, "forbidden", "url expired")
 					return
@@ -359,6 +392,10 @@ func (s *Server) handleGetImageURL(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusInternalServerError, "server_error", "failed to get image")
 		return
 	}
+	if image.DeletedAt != nil {
+		respondError(w, http.StatusNotFound, "not_found", "image not found")
+		return
+	}
 
 	// Verify note ownership
 	note, err := s.store.GetNoteByID(r.Context(), image.NoteID)
@@ -388,6 +425,61 @@ func (s *Server) handleGetImageURL(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *Server) handleDeleteImage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid image ID")
+		return
+	}
+
+	image, err := s.store.GetImageByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "image not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get image")
+		return
+	}
+	if image.DeletedAt != nil {
+		respondError(w, http.StatusNotFound, "not_found", "image not found")
+		return
+	}
+
+	// Verify note ownership
+	note, err := s.store.GetNoteByID(r.Context(), image.NoteID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "associated note not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get note")
+		return
+	}
+
+	if note.UserID != userID {
+		respondError(w, http.StatusForbidden, "forbidden", "you don't have access to this image")
+		return
+	}
+
+	if err := s.store.DeleteImage(r.Context(), id); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "image not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to delete image")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // tryAuthFromRequest attempts to extract and validate JWT from request
 func (s *Server) tryAuthFromRequest(r *http.Request) (uuid.UUID, bool) {
 	authHeader := r.Header.Get("Authorization")
@@ -400,7 +492,7 @@ func (s *Server) tryAuthFromRequest(r *http.Request) (uuid.UUID, bool) {
 	}
 
 	tokenStr := authHeader[7:]
-	userID, err := s.validateToken(tokenStr)
+	userID, _, err := s.validateToken(r.Context(), tokenStr)
 	if err != nil {
 		return uuid.Nil, false
 	}
@@ -0,0 +1,444 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/store"
+	"github.com/noted/server/internal/totp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// totpIssuer names the account in authenticator apps
+	totpIssuer = "Noted"
+
+	// mfaChallengeExpiry is how long a user has to enter their code after
+	// signing in with their password
+	mfaChallengeExpiry = 5 * time.Minute
+
+	// mfaChallengeAttempts is how many codes can be tried against one MFA
+	// challenge before the user has to sign in again
+	mfaChallengeAttempts = 3
+
+	// recoveryCodeCount is how many recovery codes are generated at a time
+	recoveryCodeCount = 10
+
+	// recoveryCodeAlphabet leaves out characters that are easily confused
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+// handleGetMFA reports whether two-factor authentication is enabled
+func (s *Server) handleGetMFA(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	var resp models.MFAStatusResponse
+	t, err := s.store.GetUserTOTP(r.Context(), userID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get two-factor authentication")
+		return
+	}
+	if t != nil && t.EnabledAt != nil {
+		resp.Enabled = true
+		resp.EnabledAt = t.EnabledAt
+
+		resp.RecoveryCodesRemaining, err = s.store.CountRecoveryCodes(r.Context(), userID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to count recovery codes")
+			return
+		}
+	}
+
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// handleSetupMFA creates a new authenticator secret. Two-factor
+// authentication isn't enabled until a code from it is confirmed with
+// handleEnableMFA.
+func (s *Server) handleSetupMFA(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	user, err := s.store.GetUserByID(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "user not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get user")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to generate secret")
+		return
+	}
+
+	err = s.store.SetPendingTOTP(r.Context(), &models.UserTOTP{
+		UserID:    userID,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrAlreadyExists) {
+			respondError(w, http.StatusConflict, "mfa_already_enabled", "two-factor authentication is already enabled")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to set up two-factor authentication")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, models.MFASetupResponse{
+		Secret: secret,
+		URI:    totp.URI(totpIssuer, user.Email, secret),
+	})
+}
+
+// handleEnableMFA turns on two-factor authentication once the user confirms
+// a code from their new secret, and returns their recovery codes
+func (s *Server) handleEnableMFA(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	var req models.EnableMFARequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	if req.Code == "" {
+		respondError(w, http.StatusBadRequest, "validation_error", "code is required")
+		return
+	}
+
+	t, err := s.store.GetUserTOTP(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusConflict, "mfa_not_set_up", "two-factor authentication has not been set up")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get two-factor authentication")
+		return
+	}
+	if t.EnabledAt != nil {
+		respondError(w, http.StatusConflict, "mfa_already_enabled", "two-factor authentication is already enabled")
+		return
+	}
+
+	step, ok := totp.Validate(t.Secret, req.Code, time.Now())
+	if !ok {
+		respondError(w, http.StatusBadRequest, "invalid_code", "invalid authentication code")
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to generate recovery codes")
+		return
+	}
+
+	if err := s.store.EnableTOTP(r.Context(), userID, step, time.Now(), hashes); err != nil {
+		// Enabled or reset by a concurrent request
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusBadRequest, "invalid_code", "invalid authentication code")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to enable two-factor authentication")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// handleDisableMFA turns off two-factor authentication. The current password
+// is required so a stolen access token can't remove it.
+func (s *Server) handleDisableMFA(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	var req models.PasswordConfirmRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	if !s.confirmPassword(r.Context(), w, userID, req.Password) {
+		return
+	}
+
+	if err := s.store.DisableTOTP(r.Context(), userID); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusConflict, "mfa_not_enabled", "two-factor authentication is not enabled")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to disable two-factor authentication")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRegenerateRecoveryCodes replaces the user's recovery codes with new
+// ones, invalidating the old ones
+func (s *Server) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	var req models.PasswordConfirmRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	if !s.confirmPassword(r.Context(), w, userID, req.Password) {
+		return
+	}
+
+	t, err := s.store.GetUserTOTP(r.Context(), userID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get two-factor authentication")
+		return
+	}
+	if t == nil || t.EnabledAt == nil {
+		respondError(w, http.StatusConflict, "mfa_not_enabled", "two-factor authentication is not enabled")
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to generate recovery codes")
+		return
+	}
+
+	if err := s.store.ReplaceRecoveryCodes(r.Context(), userID, hashes); err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to replace recovery codes")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// handleMFALogin completes a login that returned an MFA challenge, given an
+// authenticator code or a recovery code
+func (s *Server) handleMFALogin(w http.ResponseWriter, r *http.Request) {
+	var req models.MFALoginRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	if req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		respondError(w, http.StatusBadRequest, "validation_error", "mfa_token and code or recovery_code are required")
+		return
+	}
+
+	userID, challenge, err := s.validateMFAToken(req.MFAToken)
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "invalid or expired MFA token")
+		return
+	}
+
+	user, err := s.store.GetUserByID(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusUnauthorized, "unauthorized", "user not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get user")
+		return
+	}
+
+	// Wrong codes count towards the same lockout as wrong passwords
+	lockedFor, err := s.loginLockedFor(r.Context(), user.Email)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to check login attempts")
+		return
+	}
+	if lockedFor > 0 {
+		respondRateLimited(w, lockedFor, "too many failed login attempts, try again later")
+		return
+	}
+
+	// Each challenge also takes only a few codes, and only until one works
+	_, err = s.store.RecordUserTokenAttempt(r.Context(), challenge, models.UserTokenMFAChallenge, mfaChallengeAttempts)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusUnauthorized, "unauthorized", "invalid or expired MFA token")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to check MFA token")
+		return
+	}
+
+	t, err := s.store.GetUserTOTP(r.Context(), userID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get two-factor authentication")
+		return
+	}
+	if t == nil || t.EnabledAt == nil {
+		// Disabled since the challenge was issued; sign in again
+		respondError(w, http.StatusUnauthorized, "unauthorized", "invalid or expired MFA token")
+		return
+	}
+
+	if req.Code != "" {
+		step, ok := totp.Validate(t.Secret, req.Code, time.Now())
+		if ok {
+			err = s.store.UseTOTPStep(r.Context(), userID, step)
+		} else {
+			err = store.ErrNotFound
+		}
+	} else {
+		err = s.store.UseRecoveryCode(r.Context(), userID, hashToken(normalizeRecoveryCode(req.RecoveryCode)))
+	}
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			s.recordLoginFailure(r.Context(), user.Email)
+			respondError(w, http.StatusUnauthorized, "invalid_code", "invalid authentication code")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to check authentication code")
+		return
+	}
+
+	if _, err := s.store.ConsumeUserToken(r.Context(), challenge, models.UserTokenMFAChallenge); err != nil {
+		// Completed by a concurrent request
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusUnauthorized, "unauthorized", "invalid or expired MFA token")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to check MFA token")
+		return
+	}
+	s.clearLoginFailures(r.Context(), user.Email)
+
+	tokens, err := s.startSession(r, user.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to generate tokens")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, models.AuthResponse{
+		User:         user,
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+	})
+}
+
+// confirmPassword checks a password the signed-in user re-entered,
+// responding with 403 if it is wrong
+func (s *Server) confirmPassword(ctx context.Context, w http.ResponseWriter, userID uuid.UUID, password string) bool {
+	if password == "" {
+		respondError(w, http.StatusBadRequest, "validation_error", "password is required")
+		return false
+	}
+
+	user, err := s.store.GetUserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "user not found")
+			return false
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get user")
+		return false
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		respondError(w, http.StatusForbidden, "invalid_password", "password is incorrect")
+		return false
+	}
+	return true
+}
+
+// generateMFAToken returns the short-lived token a user exchanges, together
+// with a code, for a session after signing in with their password. The token
+// names a challenge kept as a user token, which counts the codes tried.
+func (s *Server) generateMFAToken(ctx context.Context, user *models.User) (string, time.Time, error) {
+	challenge, err := s.issueUserToken(ctx, user, models.UserTokenMFAChallenge, mfaChallengeExpiry)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(mfaChallengeExpiry)
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.ID.String(),
+			ID:        challenge,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		TokenType: "mfa",
+	}
+	signed, err := s.keys.Sign(claims)
+	return signed, expiresAt, err
+}
+
+// validateMFAToken validates an MFA challenge token and returns the user ID
+// and the hash of its challenge
+func (s *Server) validateMFAToken(tokenString string) (uuid.UUID, []byte, error) {
+	claims, err := s.parseToken(tokenString, "mfa")
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	if claims.ID == "" {
+		return uuid.Nil, nil, errInvalidToken
+	}
+
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	return userID, hashToken(claims.ID), nil
+}
+
+// newRecoveryCodes returns a fresh set of recovery codes, formatted as
+// "xxxxx-xxxxx", and the hashes they are stored under
+func newRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		for j := range b {
+			// 256 is not a multiple of the alphabet size, but the bias is
+			// negligible next to the codes' 49 bits of entropy
+			b[j] = recoveryCodeAlphabet[int(b[j])%len(recoveryCodeAlphabet)]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode makes recovery codes match however they were typed
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
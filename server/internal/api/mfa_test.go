@@ -0,0 +1,191 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/noted/server/internal/api"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/totp"
+)
+
+// enableMFA turns on two-factor authentication and returns the secret and
+// recovery codes
+func enableMFA(t *testing.T, srv *api.Server, token string) (string, []string) {
+	t.Helper()
+	rec := authedRequest(srv, token, http.MethodPost, "/api/auth/mfa/setup", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("failed to set up MFA: %s", rec.Body.String())
+	}
+	var setup models.MFASetupResponse
+	json.NewDecoder(rec.Body).Decode(&setup)
+
+	code, _ := totp.Code(setup.Secret, totp.Step(time.Now()))
+	rec = authedRequest(srv, token, http.MethodPost, "/api/auth/mfa/enable", map[string]string{"code": code})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("failed to enable MFA: %s", rec.Body.String())
+	}
+	var codes models.RecoveryCodesResponse
+	json.NewDecoder(rec.Body).Decode(&codes)
+	return setup.Secret, codes.RecoveryCodes
+}
+
+func loginChallenge(t *testing.T, srv *api.Server) models.MFAChallengeResponse {
+	t.Helper()
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+		"email": "sessions@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("failed to log in: %s", rec.Body.String())
+	}
+	var challenge models.MFAChallengeResponse
+	json.NewDecoder(rec.Body).Decode(&challenge)
+	if !challenge.MFARequired || challenge.MFAToken == "" {
+		t.Fatalf("expected an MFA challenge, got %s", rec.Body.String())
+	}
+	return challenge
+}
+
+func TestMFALogin(t *testing.T) {
+	srv, auth := setupTestServerWithSession(t)
+	secret, recoveryCodes := enableMFA(t, srv, auth.AccessToken)
+	if len(recoveryCodes) != 10 {
+		t.Fatalf("got %d recovery codes, want 10", len(recoveryCodes))
+	}
+
+	challenge := loginChallenge(t, srv)
+
+	// The challenge token is not an access token
+	rec := authedRequest(srv, challenge.MFAToken, http.MethodGet, "/api/auth/me", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for the challenge token, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login/mfa", map[string]string{
+		"mfa_token": challenge.MFAToken, "code": "000000",
+	})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for a wrong code, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	// The code used to enable MFA is spent, so use the next one
+	code, _ := totp.Code(secret, totp.Step(time.Now())+1)
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login/mfa", map[string]string{
+		"mfa_token": challenge.MFAToken, "code": code,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var loggedIn models.AuthResponse
+	json.NewDecoder(rec.Body).Decode(&loggedIn)
+	if loggedIn.AccessToken == "" || !loggedIn.User.MFAEnabled {
+		t.Errorf("unexpected login response: %s", rec.Body.String())
+	}
+
+	// Codes can't be replayed
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login/mfa", map[string]string{
+		"mfa_token": challenge.MFAToken, "code": code,
+	})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for a reused code, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestMFARecoveryCode(t *testing.T) {
+	srv, auth := setupTestServerWithSession(t)
+	_, recoveryCodes := enableMFA(t, srv, auth.AccessToken)
+
+	challenge := loginChallenge(t, srv)
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/login/mfa", map[string]string{
+		"mfa_token": challenge.MFAToken, "recovery_code": recoveryCodes[0],
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login/mfa", map[string]string{
+		"mfa_token": challenge.MFAToken, "recovery_code": recoveryCodes[0],
+	})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for a used recovery code, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	rec = authedRequest(srv, auth.AccessToken, http.MethodGet, "/api/auth/mfa", nil)
+	var status models.MFAStatusResponse
+	json.NewDecoder(rec.Body).Decode(&status)
+	if !status.Enabled || status.RecoveryCodesRemaining != 9 {
+		t.Errorf("unexpected status: %s", rec.Body.String())
+	}
+}
+
+func TestMFADisableRequiresPassword(t *testing.T) {
+	srv, auth := setupTestServerWithSession(t)
+	enableMFA(t, srv, auth.AccessToken)
+
+	rec := authedRequest(srv, auth.AccessToken, http.MethodPost, "/api/auth/mfa/disable", map[string]string{"password": "wrong-password"})
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("got status %d for a wrong password, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	rec = authedRequest(srv, auth.AccessToken, http.MethodPost, "/api/auth/mfa/disable", map[string]string{"password": "password123"})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusNoContent, rec.Body.String())
+	}
+
+	// Logging in no longer needs a code
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+		"email": "sessions@example.com", "password": "password123",
+	})
+	var loggedIn models.AuthResponse
+	json.NewDecoder(rec.Body).Decode(&loggedIn)
+	if rec.Code != http.StatusOK || loggedIn.AccessToken == "" {
+		t.Errorf("expected a normal login, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMFALockout(t *testing.T) {
+	srv, auth := setupTestServerWithSession(t)
+	secret, _ := enableMFA(t, srv, auth.AccessToken)
+	code, _ := totp.Code(secret, totp.Step(time.Now())+1)
+
+	// A challenge takes only a few codes, even once the right one is sent
+	challenge := loginChallenge(t, srv)
+	for i := 0; i < 3; i++ {
+		rec := authedRequest(srv, "", http.MethodPost, "/api/auth/login/mfa", map[string]string{
+			"mfa_token": challenge.MFAToken, "code": "000000",
+		})
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got status %d, want %d", i+1, rec.Code, http.StatusUnauthorized)
+		}
+	}
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/login/mfa", map[string]string{
+		"mfa_token": challenge.MFAToken, "code": code,
+	})
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("got status %d for a spent challenge, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	// Signing in with the password again doesn't reset the failed codes,
+	// which lock the address like failed passwords
+	challenge = loginChallenge(t, srv)
+	for _, recoveryCode := range []string{"aaaaa-aaaaa", "bbbbb-bbbbb"} {
+		authedRequest(srv, "", http.MethodPost, "/api/auth/login/mfa", map[string]string{
+			"mfa_token": challenge.MFAToken, "recovery_code": recoveryCode,
+		})
+	}
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login/mfa", map[string]string{
+		"mfa_token": challenge.MFAToken, "code": code,
+	})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusTooManyRequests, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+		"email": "sessions@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d for the password, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+}
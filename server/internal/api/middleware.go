@@ -2,18 +2,24 @@ package api
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"log"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/noted/server/internal/store"
 )
 
 type contextKey string
 
 const (
-	userIDKey contextKey = "userID"
+	userIDKey    contextKey = "userID"
+	sessionIDKey contextKey = "sessionID"
+	scopesKey    contextKey = "scopes"
 )
 
 // GetUserID extracts the user ID from context
@@ -22,7 +28,51 @@ func GetUserID(ctx context.Context) (uuid.UUID, bool) {
 	return id, ok
 }
 
-// authMiddleware validates JWT tokens and adds user ID to context
+// GetSessionID extracts the ID of the session the access token was issued
+// to from context
+func GetSessionID(ctx context.Context) (uuid.UUID, bool) {
+	id, ok := ctx.Value(sessionIDKey).(uuid.UUID)
+	return id, ok
+}
+
+// GetTokenScopes extracts the scopes of the personal access token the request
+// was made with from context. It returns false for session access tokens,
+// which are not limited by scope.
+func GetTokenScopes(ctx context.Context) ([]string, bool) {
+	scopes, ok := ctx.Value(scopesKey).([]string)
+	return scopes, ok
+}
+
+// redactedQueryParams are query parameters that carry credentials
+var redactedQueryParams = []string{"access_token", "ticket"}
+
+// redactQueryCredentials hides credentials passed in the query string from
+// the request logger. Only the RequestURI is rewritten, so handlers still
+// see the real values in r.URL.
+func redactQueryCredentials(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, query, ok := strings.Cut(r.RequestURI, "?")
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		params := strings.Split(query, "&")
+		for i, param := range params {
+			name, _, _ := strings.Cut(param, "=")
+			if unescaped, err := url.QueryUnescape(name); err == nil && slices.Contains(redactedQueryParams, unescaped) {
+				params[i] = name + "=REDACTED"
+			}
+		}
+
+		r = r.WithContext(r.Context())
+		r.RequestURI = path + "?" + strings.Join(params, "&")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authMiddleware validates JWT tokens or personal access tokens and adds
+// user ID to context
 func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
@@ -38,33 +88,124 @@ func (s *Server) authMiddleware(next http.Handler) http.Handler {
 		}
 
 		tokenString := parts[1]
-		claims := &Claims{}
+		if strings.HasPrefix(tokenString, patPrefix) {
+			s.authenticatePAT(w, r, next, tokenString)
+			return
+		}
 
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			// Validate signing algorithm to prevent algorithm confusion attacks
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		userID, sessionID, err := s.validateToken(r.Context(), tokenString)
+		if err != nil {
+			switch {
+			case errors.Is(err, errInvalidTokenType):
+				respondError(w, http.StatusUnauthorized, "unauthorized", "invalid token type")
+			case errors.Is(err, errSessionEnded):
+				respondError(w, http.StatusUnauthorized, "unauthorized", "session has ended")
+			case errors.Is(err, errInvalidToken):
+				respondError(w, http.StatusUnauthorized, "unauthorized", "invalid or expired token")
+			default:
+				respondError(w, http.StatusInternalServerError, "server_error", "failed to check token")
 			}
-			return []byte(s.config.JWTSecret), nil
-		})
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		ctx = context.WithValue(ctx, sessionIDKey, sessionID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
-		if err != nil || !token.Valid {
-			respondError(w, http.StatusUnauthorized, "unauthorized", "invalid or expired token")
+// deviceMiddleware attributes the request to the device named in the
+// X-Device-ID header, if any, and records that the device was seen.
+// Must run after authMiddleware.
+func (s *Server) deviceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("X-Device-ID")
+		if header == "" {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		if claims.TokenType != "access" {
-			respondError(w, http.StatusUnauthorized, "unauthorized", "invalid token type")
+		userID, ok := GetUserID(r.Context())
+		if !ok {
+			respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
 			return
 		}
 
-		userID, err := uuid.Parse(claims.Subject)
+		deviceID, err := uuid.Parse(header)
 		if err != nil {
-			respondError(w, http.StatusUnauthorized, "unauthorized", "invalid user ID in token")
+			respondError(w, http.StatusBadRequest, "invalid_request", "invalid X-Device-ID header")
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		if err := s.store.TouchDevice(r.Context(), userID, deviceID); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				respondError(w, http.StatusUnauthorized, "invalid_device", "device not found or revoked")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to check device")
+			return
+		}
+
+		ctx := store.WithDeviceID(r.Context(), deviceID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// authenticatePAT serves a request made with a personal access token,
+// adding the user ID and the token's scopes to context
+func (s *Server) authenticatePAT(w http.ResponseWriter, r *http.Request, next http.Handler, tokenString string) {
+	pat, err := s.store.GetPersonalAccessTokenByHash(r.Context(), hashToken(tokenString))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusUnauthorized, "unauthorized", "invalid, expired or revoked token")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to check token")
+		return
+	}
+
+	if err := s.store.TouchPersonalAccessToken(r.Context(), pat.ID, time.Now()); err != nil {
+		log.Printf("failed to record use of personal access token %s: %v", pat.ID, err)
+	}
+
+	ctx := context.WithValue(r.Context(), userIDKey, pat.UserID)
+	ctx = context.WithValue(ctx, scopesKey, pat.Scopes)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// requireScope limits personal access tokens to the routes their scopes
+// cover: GET requests need readScope and all others writeScope. Session
+// access tokens are not limited. Must run after authMiddleware.
+func requireScope(readScope, writeScope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scopes, ok := GetTokenScopes(r.Context())
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			want := writeScope
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				want = readScope
+			}
+			if !slices.Contains(scopes, want) {
+				respondError(w, http.StatusForbidden, "insufficient_scope", "token is missing the "+want+" scope")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// sessionOnly rejects personal access tokens on routes that manage the
+// account itself. Must run after authMiddleware.
+func sessionOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := GetTokenScopes(r.Context()); ok {
+			respondError(w, http.StatusForbidden, "insufficient_scope", "personal access tokens can't be used here")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -62,6 +62,7 @@ func (s *Server) handleCreateNotebook(w http.ResponseWriter, r *http.Request) {
 		UserID:    userID,
 		Title:     req.Title,
 		SortOrder: sortOrder,
+		Version:   1,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
@@ -71,6 +72,7 @@ func (s *Server) handleCreateNotebook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", etag(notebook.Version))
 	respondJSON(w, http.StatusCreated, notebook)
 }
 
@@ -103,6 +105,7 @@ func (s *Server) handleGetNotebook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", etag(notebook.Version))
 	respondJSON(w, http.StatusOK, notebook)
 }
 
@@ -130,6 +133,12 @@ func (s *Server) handleUpdateNotebook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	expected, err := expectedVersion(r, req.Version)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
 	// Get existing notebook to verify ownership
 	notebook, err := s.store.GetNotebookByID(r.Context(), id)
 	if err != nil {
@@ -147,17 +156,33 @@ func (s *Server) handleUpdateNotebook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if expected != nil && *expected != notebook.Version {
+		respondVersionConflict(w, notebook.Version, notebook)
+		return
+	}
+
 	notebook.Title = req.Title
 	if req.SortOrder != nil {
 		notebook.SortOrder = *req.SortOrder
 	}
+	notebook.Version++
 	notebook.UpdatedAt = time.Now()
 
 	if err := s.store.UpdateNotebook(r.Context(), notebook); err != nil {
+		if errors.Is(err, store.ErrVersionConflict) {
+			current, err := s.store.GetNotebookByID(r.Context(), id)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, "server_error", "failed to get notebook")
+				return
+			}
+			respondVersionConflict(w, current.Version, current)
+			return
+		}
 		respondError(w, http.StatusInternalServerError, "server_error", "failed to update notebook")
 		return
 	}
 
+	w.Header().Set("ETag", etag(notebook.Version))
 	respondJSON(w, http.StatusOK, notebook)
 }
 
@@ -191,7 +216,41 @@ func (s *Server) handleDeleteNotebook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.store.DeleteNotebook(r.Context(), id); err != nil {
+	// Optionally move the notes elsewhere instead of deleting them with the
+	// notebook
+	var moveTo *uuid.UUID
+	if raw := r.URL.Query().Get("move_to"); raw != "" {
+		targetID, err := uuid.Parse(raw)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid_request", "invalid move_to notebook ID")
+			return
+		}
+		if targetID == id {
+			respondError(w, http.StatusBadRequest, "validation_error", "cannot move notes to the notebook being deleted")
+			return
+		}
+
+		target, err := s.store.GetNotebookByID(r.Context(), targetID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to get notebook")
+			return
+		}
+		if err != nil || target.UserID != userID || target.DeletedAt != nil {
+			respondError(w, http.StatusNotFound, "not_found", "move_to notebook not found")
+			return
+		}
+		moveTo = &targetID
+	}
+
+	err = s.store.WithTx(r.Context(), func(tx store.Store) error {
+		if moveTo != nil {
+			if _, err := tx.MoveNotes(r.Context(), id, *moveTo); err != nil {
+				return err
+			}
+		}
+		return tx.DeleteNotebook(r.Context(), id)
+	})
+	if err != nil {
 		if errors.Is(err, store.ErrNotFound) {
 			respondError(w, http.StatusNotFound, "not_found", "notebook not found")
 			return
@@ -22,11 +22,10 @@ func setupTestServer(t *testing.T) (*api.Server, string) {
 	blobStore := testutil.TestBlobStore(t)
 
 	cfg := &config.Config{
-		JWTSecret:      "test-secret",
 		JWTExpiration:  15 * time.Minute,
 		RefreshExpiry:  7 * 24 * time.Hour,
 	}
-	srv := api.NewServer(db, cfg, blobStore)
+	srv := api.NewServer(db, cfg, blobStore, testutil.TestMailer(t), testutil.TestKeys(t))
 
 	// Register and get token
 	regBody, _ := json.Marshal(map[string]string{"email": "test@example.com", "password": "password123"})
@@ -253,3 +252,33 @@ func TestNotebookAuthorization(t *testing.T) {
 		}
 	})
 }
+
+func TestDeleteNotebookMovesNotes(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	note := createTestNote(t, srv, token, notebookID)
+
+	rec := authedRequest(srv, token, http.MethodPost, "/api/notebooks", map[string]string{"title": "Archive"})
+	var target models.Notebook
+	json.NewDecoder(rec.Body).Decode(&target)
+
+	rec = authedRequest(srv, token, http.MethodDelete, "/api/notebooks/"+notebookID+"?move_to="+target.ID.String(), nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusNoContent, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String(), nil)
+	var moved models.Note
+	json.NewDecoder(rec.Body).Decode(&moved)
+	if moved.DeletedAt != nil || moved.NotebookID != target.ID {
+		t.Errorf("expected the note to be moved and kept, got notebook %s deleted_at %v", moved.NotebookID, moved.DeletedAt)
+	}
+	if moved.Version != note.Version+1 {
+		t.Errorf("got version %d, want %d", moved.Version, note.Version+1)
+	}
+
+	// The target has to be one of the user's notebooks
+	rec = authedRequest(srv, token, http.MethodDelete, "/api/notebooks/"+target.ID.String()+"?move_to="+notebookID, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -1,9 +1,14 @@
 package api
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -12,6 +17,17 @@ import (
 	"github.com/noted/server/internal/store"
 )
 
+// Page sizes for a notebook's note timeline
+const (
+	defaultNoteLimit = 50
+	maxNoteLimit     = 200
+)
+
+// handleListNotes returns a page of a notebook's timeline, oldest first.
+// Without a cursor it is the latest page; "before" and "after" take the
+// cursors in the Link header, and "around" a note ID to jump to that note.
+// Replies are left out in favor of reply counts on their threads' notes.
+// "pinned=true" lists only pinned notes, which clients show at the top.
 func (s *Server) handleListNotes(w http.ResponseWriter, r *http.Request) {
 	userID, ok := GetUserID(r.Context())
 	if !ok {
@@ -55,11 +71,73 @@ func (s *Server) handleListNotes(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	notes, err := s.store.GetNotesByNotebookID(r.Context(), notebookID, since)
+	limit, err := parseLimit(r, defaultNoteLimit, maxNoteLimit)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	filter, err := parseNoteFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	after, err := decodeNoteCursor(query.Get("after"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid 'after' value")
+		return
+	}
+	before, err := decodeNoteCursor(query.Get("before"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid 'before' value")
+		return
+	}
+
+	var page *notePage
+	if aroundStr := query.Get("around"); aroundStr != "" {
+		if after != nil || before != nil {
+			respondError(w, http.StatusBadRequest, "invalid_request", "'around' can't be combined with 'before' or 'after'")
+			return
+		}
+		aroundID, err := uuid.Parse(aroundStr)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid_request", "invalid 'around' note ID")
+			return
+		}
+		anchor, err := s.store.GetNoteByID(r.Context(), aroundID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to get note")
+			return
+		}
+		if anchor == nil || anchor.NotebookID != notebookID || anchor.DeletedAt != nil {
+			respondError(w, http.StatusNotFound, "not_found", "note not found")
+			return
+		}
+		// Replies aren't on the timeline, so jump to their thread instead
+		if anchor.ParentNoteID != nil {
+			anchor, err = s.store.GetNoteByID(r.Context(), *anchor.ParentNoteID)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, "server_error", "failed to get note")
+				return
+			}
+		}
+		// The page is centered on the anchor, so it has to be one the
+		// filtered timeline would show
+		if !onTimeline(anchor, since, filter) {
+			respondError(w, http.StatusNotFound, "not_found", "note not found")
+			return
+		}
+		page, err = s.notePageAround(r.Context(), anchor, since, filter, limit)
+	} else {
+		page, err = s.readNotePage(r.Context(), notebookID, since, filter, after, before, limit)
+	}
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "server_error", "failed to get notes")
 		return
 	}
+	notes := page.notes
 
 	// Load tags for each note
 	for i := range notes {
@@ -69,13 +147,172 @@ func (s *Server) handleListNotes(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if err := s.setReplyCounts(r.Context(), notes); err != nil {
+		log.Printf("failed to count replies in notebook %s: %v", notebookID, err)
+	}
+	for i := range notes {
+		if notes[i].DeletedAt != nil {
+			tombstoneNote(&notes[i])
+		}
+	}
+
 	if notes == nil {
 		notes = []models.Note{}
 	}
 
+	setNotePageLinks(w, r, page)
 	respondJSON(w, http.StatusOK, notes)
 }
 
+// notePage is a page of a notebook's timeline, in timeline order
+type notePage struct {
+	notes []models.Note
+	// Whether there are notes before the first and after the last one
+	hasOlder bool
+	hasNewer bool
+}
+
+// readNotePage reads a page of a notebook's timeline, asking for one note
+// more than the limit to find out whether the timeline continues
+func (s *Server) readNotePage(ctx context.Context, notebookID uuid.UUID, since *time.Time, filter models.NoteFilter, after, before *models.NoteCursor, limit int) (*notePage, error) {
+	notes, err := s.store.GetNotebookTimeline(ctx, notebookID, since, filter, after, before, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &notePage{notes: notes, hasOlder: after != nil, hasNewer: before != nil}
+	if len(notes) > limit {
+		// The extra note is on the side the page was read towards
+		if after != nil {
+			page.notes, page.hasNewer = notes[:limit], true
+		} else {
+			page.notes, page.hasOlder = notes[1:], true
+		}
+	}
+	return page, nil
+}
+
+// notePageAround reads the page of a notebook's timeline centered on a note
+func (s *Server) notePageAround(ctx context.Context, anchor *models.Note, since *time.Time, filter models.NoteFilter, limit int) (*notePage, error) {
+	cursor := noteCursor(anchor)
+	olderLimit := (limit - 1) / 2
+
+	older, err := s.readNotePage(ctx, anchor.NotebookID, since, filter, nil, &cursor, olderLimit)
+	if err != nil {
+		return nil, err
+	}
+	newer, err := s.readNotePage(ctx, anchor.NotebookID, since, filter, &cursor, nil, limit-1-olderLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	notes := append(older.notes, *anchor)
+	notes = append(notes, newer.notes...)
+	return &notePage{notes: notes, hasOlder: older.hasOlder, hasNewer: newer.hasNewer}, nil
+}
+
+// onTimeline reports whether the filtered timeline shows a note that starts
+// a thread, matching GetNotebookTimeline. The caller makes sure a deleted
+// note still has replies.
+func onTimeline(note *models.Note, since *time.Time, filter models.NoteFilter) bool {
+	if since != nil && !note.UpdatedAt.After(*since) {
+		return false
+	}
+	if filter.PinnedOnly && !note.IsPinned {
+		return false
+	}
+	return filter.IncludeArchived || note.ArchivedAt == nil
+}
+
+// setNotePageLinks points the Link header at the pages either side of page,
+// keeping the request's other parameters
+func setNotePageLinks(w http.ResponseWriter, r *http.Request, page *notePage) {
+	if len(page.notes) == 0 {
+		return
+	}
+
+	var links []string
+	link := func(rel, param string, note *models.Note) {
+		query := r.URL.Query()
+		query.Del("after")
+		query.Del("before")
+		query.Del("around")
+		query.Set(param, encodeNoteCursor(noteCursor(note)))
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, query.Encode(), rel))
+	}
+	if page.hasOlder {
+		link("prev", "before", &page.notes[0])
+	}
+	if page.hasNewer {
+		link("next", "after", &page.notes[len(page.notes)-1])
+	}
+
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// parseNoteFilter reads the "pinned" and "include_archived" parameters that
+// narrow down lists of notes
+func parseNoteFilter(r *http.Request) (models.NoteFilter, error) {
+	var filter models.NoteFilter
+	var err error
+	if filter.PinnedOnly, err = parseBool(r, "pinned", false); err != nil {
+		return filter, err
+	}
+	if filter.IncludeArchived, err = parseBool(r, "include_archived", false); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// noteCursorPrefix versions the cursor format so it can change without
+// confusing older clients
+const noteCursorPrefix = "v1:"
+
+func noteCursor(note *models.Note) models.NoteCursor {
+	return models.NoteCursor{CreatedAt: note.CreatedAt, ID: note.ID}
+}
+
+// encodeNoteCursor turns a timeline position into the opaque cursor handed
+// to clients
+func encodeNoteCursor(cursor models.NoteCursor) string {
+	value := strconv.FormatInt(cursor.CreatedAt.UnixMicro(), 10) + ":" + cursor.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(noteCursorPrefix + value))
+}
+
+// decodeNoteCursor parses a cursor produced by encodeNoteCursor. An empty
+// cursor decodes to nil.
+func decodeNoteCursor(cursor string) (*models.NoteCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+
+	value, ok := strings.CutPrefix(string(raw), noteCursorPrefix)
+	if !ok {
+		return nil, errors.New("unsupported cursor version")
+	}
+
+	microsStr, idStr, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, errors.New("malformed cursor")
+	}
+	micros, err := strconv.ParseInt(microsStr, 10, 64)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	return &models.NoteCursor{CreatedAt: time.UnixMicro(micros), ID: id}, nil
+}
+
 func (s *Server) handleCreateNote(w http.ResponseWriter, r *http.Request) {
 	userID, ok := GetUserID(r.Context())
 	if !ok {
@@ -121,19 +358,36 @@ func (s *Server) handleCreateNote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var parentID *uuid.UUID
+	if req.ParentNoteID != nil {
+		rootID, err := threadRoot(r.Context(), s.store, notebookID, *req.ParentNoteID, false)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				respondError(w, http.StatusBadRequest, "validation_error", "parent note not found in this notebook")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to get parent note")
+			return
+		}
+		parentID = &rootID
+	}
+
 	now := time.Now()
 	note := &models.Note{
-		ID:         uuid.New(),
-		NotebookID: notebookID,
-		UserID:     userID,
-		Content:    req.Content,
-		PlainText:  req.PlainText,
-		IsTodo:     req.IsTodo,
-		IsDone:     false,
-		ReminderAt: req.ReminderAt,
-		Version:    1,
-		CreatedAt:  now,
-		UpdatedAt:  now,
+		ID:           uuid.New(),
+		NotebookID:   notebookID,
+		ParentNoteID: parentID,
+		UserID:       userID,
+		Content:      req.Content,
+		PlainText:    req.PlainText,
+		IsTodo:       req.IsTodo,
+		IsDone:       false,
+		ReminderAt:   req.ReminderAt,
+		IsPinned:     req.IsPinned,
+		IsStarred:    req.IsStarred,
+		Version:      1,
+		CreatedAt:    now,
+		UpdatedAt:    now,
 	}
 
 	if err := s.store.CreateNote(r.Context(), note); err != nil {
@@ -154,6 +408,7 @@ func (s *Server) handleCreateNote(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	w.Header().Set("ETag", etag(note.Version))
 	respondJSON(w, http.StatusCreated, note)
 }
 
@@ -196,6 +451,7 @@ func (s *Server) handleGetNote(w http.ResponseWriter, r *http.Request) {
 		note.Tags = tags
 	}
 
+	w.Header().Set("ETag", etag(note.Version))
 	respondJSON(w, http.StatusOK, note)
 }
 
@@ -238,6 +494,16 @@ func (s *Server) handleUpdateNote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	expected, err := expectedVersion(r, req.Version)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if expected != nil && *expected != note.Version {
+		s.respondNoteConflict(w, r, note)
+		return
+	}
+
 	// Apply updates
 	if req.Content != nil {
 		note.Content = req.Content
@@ -254,11 +520,31 @@ func (s *Server) handleUpdateNote(w http.ResponseWriter, r *http.Request) {
 	if req.ReminderAt != nil {
 		note.ReminderAt = req.ReminderAt
 	}
+	if req.IsPinned != nil {
+		note.IsPinned = *req.IsPinned
+	}
+	if req.IsStarred != nil {
+		note.IsStarred = *req.IsStarred
+	}
+
+	now := time.Now()
+	if req.Archived != nil {
+		switch {
+		case !*req.Archived:
+			note.ArchivedAt = nil
+		case note.ArchivedAt == nil:
+			note.ArchivedAt = &now
+		}
+	}
 
 	note.Version++
-	note.UpdatedAt = time.Now()
+	note.UpdatedAt = now
 
 	if err := s.store.UpdateNote(r.Context(), note); err != nil {
+		if errors.Is(err, store.ErrVersionConflict) {
+			s.respondNoteChanged(w, r, note.ID)
+			return
+		}
 		respondError(w, http.StatusInternalServerError, "server_error", "failed to update note")
 		return
 	}
@@ -278,9 +564,30 @@ func (s *Server) handleUpdateNote(w http.ResponseWriter, r *http.Request) {
 		note.Tags = tags
 	}
 
+	w.Header().Set("ETag", etag(note.Version))
 	respondJSON(w, http.StatusOK, note)
 }
 
+// respondNoteChanged reports an update that lost a race with another one,
+// with the note as that one left it
+func (s *Server) respondNoteChanged(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	current, err := s.store.GetNoteByID(r.Context(), id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get note")
+		return
+	}
+	s.respondNoteConflict(w, r, current)
+}
+
+// respondNoteConflict reports an update based on an older version of a note
+func (s *Server) respondNoteConflict(w http.ResponseWriter, r *http.Request, current *models.Note) {
+	tags, err := s.store.GetTagsForNote(r.Context(), current.ID)
+	if err == nil {
+		current.Tags = tags
+	}
+	respondVersionConflict(w, current.Version, current)
+}
+
 func (s *Server) handleDeleteNote(w http.ResponseWriter, r *http.Request) {
 	userID, ok := GetUserID(r.Context())
 	if !ok {
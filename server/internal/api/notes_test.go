@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"testing"
 	"time"
 
@@ -21,11 +22,10 @@ func setupTestServerWithNotebook(t *testing.T) (*api.Server, string, string) {
 	blobStore := testutil.TestBlobStore(t)
 
 	cfg := &config.Config{
-		JWTSecret:      "test-secret",
 		JWTExpiration:  15 * time.Minute,
 		RefreshExpiry:  7 * 24 * time.Hour,
 	}
-	srv := api.NewServer(db, cfg, blobStore)
+	srv := api.NewServer(db, cfg, blobStore, testutil.TestMailer(t), testutil.TestKeys(t))
 
 	// Register and get token
 	regBody, _ := json.Marshal(map[string]string{"email": "test@example.com", "password": "password123"})
@@ -252,3 +252,214 @@ func TestNoteSearch(t *testing.T) {
 		t.Errorf("expected at least 2 results for 'team', got %d", len(results))
 	}
 }
+
+// linkPattern matches one link of a Link header
+var linkPattern = regexp.MustCompile(`<([^>]*)>; rel="([a-z]+)"`)
+
+// pageLinks maps the rels of a Link header to their URLs
+func pageLinks(rec *httptest.ResponseRecorder) map[string]string {
+	links := map[string]string{}
+	for _, m := range linkPattern.FindAllStringSubmatch(rec.Header().Get("Link"), -1) {
+		links[m[2]] = m[1]
+	}
+	return links
+}
+
+func plainTexts(notes []models.Note) []string {
+	var texts []string
+	for _, n := range notes {
+		texts = append(texts, n.PlainText)
+	}
+	return texts
+}
+
+func TestListNotesTimeline(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+
+	var ids []string
+	for _, text := range []string{"1", "2", "3", "4", "5"} {
+		rec := authedRequest(srv, token, http.MethodPost, "/api/notebooks/"+notebookID+"/notes", map[string]interface{}{
+			"content":    tiptapDoc(text),
+			"plain_text": text,
+		})
+		var note models.Note
+		json.NewDecoder(rec.Body).Decode(&note)
+		ids = append(ids, note.ID.String())
+	}
+
+	page := func(path string) ([]string, map[string]string) {
+		t.Helper()
+		rec := authedRequest(srv, token, http.MethodGet, path, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %d. Body: %s", path, rec.Code, rec.Body.String())
+		}
+		var notes []models.Note
+		json.NewDecoder(rec.Body).Decode(&notes)
+		return plainTexts(notes), pageLinks(rec)
+	}
+
+	// Without a cursor the latest notes come back, oldest first
+	texts, links := page("/api/notebooks/" + notebookID + "/notes?limit=2")
+	if len(texts) != 2 || texts[0] != "4" || texts[1] != "5" {
+		t.Fatalf("got %v, want [4 5]", texts)
+	}
+	if links["next"] != "" || links["prev"] == "" {
+		t.Fatalf("expected only a prev link, got %v", links)
+	}
+
+	texts, links = page(links["prev"])
+	if len(texts) != 2 || texts[0] != "2" || texts[1] != "3" {
+		t.Fatalf("got %v, want [2 3]", texts)
+	}
+	if links["next"] == "" || links["prev"] == "" {
+		t.Fatalf("expected prev and next links, got %v", links)
+	}
+	next := links["next"]
+
+	texts, links = page(links["prev"])
+	if len(texts) != 1 || texts[0] != "1" || links["prev"] != "" {
+		t.Errorf("got %v with links %v, want [1] and no prev link", texts, links)
+	}
+
+	texts, _ = page(next)
+	if len(texts) != 2 || texts[0] != "4" || texts[1] != "5" {
+		t.Errorf("got %v, want [4 5]", texts)
+	}
+
+	// Jumping to a note centers the page on it
+	texts, links = page("/api/notebooks/" + notebookID + "/notes?limit=3&around=" + ids[2])
+	if len(texts) != 3 || texts[0] != "2" || texts[1] != "3" || texts[2] != "4" {
+		t.Errorf("got %v, want [2 3 4]", texts)
+	}
+	if links["next"] == "" || links["prev"] == "" {
+		t.Errorf("expected prev and next links, got %v", links)
+	}
+
+	rec := authedRequest(srv, token, http.MethodGet, "/api/notebooks/"+notebookID+"/notes?before=bogus", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPinStarArchiveNotes(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+
+	var notes []models.Note
+	for _, text := range []string{"pinned team note", "starred team note", "archived team note"} {
+		rec := authedRequest(srv, token, http.MethodPost, "/api/notebooks/"+notebookID+"/notes", map[string]interface{}{
+			"content":    tiptapDoc(text),
+			"plain_text": text,
+		})
+		var note models.Note
+		json.NewDecoder(rec.Body).Decode(&note)
+		notes = append(notes, note)
+	}
+	pinned, starred, archived := notes[0], notes[1], notes[2]
+
+	for _, update := range []struct {
+		id   string
+		body map[string]interface{}
+	}{
+		{pinned.ID.String(), map[string]interface{}{"is_pinned": true}},
+		{starred.ID.String(), map[string]interface{}{"is_starred": true}},
+		{archived.ID.String(), map[string]interface{}{"archived": true, "is_starred": true}},
+	} {
+		rec := authedRequest(srv, token, http.MethodPut, "/api/notes/"+update.id, update.body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("failed to update note: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	list := func(path string) []string {
+		t.Helper()
+		rec := authedRequest(srv, token, http.MethodGet, path, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %d. Body: %s", path, rec.Code, rec.Body.String())
+		}
+		var notes []models.Note
+		json.NewDecoder(rec.Body).Decode(&notes)
+		return plainTexts(notes)
+	}
+
+	// Archived notes are hidden unless asked for
+	if texts := list("/api/notebooks/" + notebookID + "/notes"); len(texts) != 2 {
+		t.Errorf("got %v, want the pinned and starred notes", texts)
+	}
+	if texts := list("/api/notebooks/" + notebookID + "/notes?include_archived=true"); len(texts) != 3 {
+		t.Errorf("got %v, want all three notes", texts)
+	}
+	if texts := list("/api/notebooks/" + notebookID + "/notes?pinned=true"); len(texts) != 1 || texts[0] != pinned.PlainText {
+		t.Errorf("got %v, want only the pinned note", texts)
+	}
+
+	if texts := list("/api/search?q=team"); len(texts) != 2 {
+		t.Errorf("got %v, want the search to leave out the archived note", texts)
+	}
+	if texts := list("/api/search?q=team&pinned=true"); len(texts) != 1 || texts[0] != pinned.PlainText {
+		t.Errorf("got %v, want only the pinned note", texts)
+	}
+
+	if texts := list("/api/starred"); len(texts) != 1 || texts[0] != starred.PlainText {
+		t.Errorf("got %v, want only the starred note", texts)
+	}
+	if texts := list("/api/starred?include_archived=true"); len(texts) != 2 {
+		t.Errorf("got %v, want both starred notes", texts)
+	}
+
+	// Unarchiving brings the note back
+	rec := authedRequest(srv, token, http.MethodPut, "/api/notes/"+archived.ID.String(), map[string]interface{}{"archived": false})
+	var note models.Note
+	json.NewDecoder(rec.Body).Decode(&note)
+	if note.ArchivedAt != nil || !note.IsStarred {
+		t.Errorf("got archived_at %v and is_starred %v, want nil and true", note.ArchivedAt, note.IsStarred)
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/starred?pinned=maybe", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestListNotesAroundWithFilters(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+
+	ids := map[string]string{}
+	for _, text := range []string{"plain", "pinned", "archived"} {
+		rec := authedRequest(srv, token, http.MethodPost, "/api/notebooks/"+notebookID+"/notes", map[string]interface{}{
+			"content":    tiptapDoc(text),
+			"plain_text": text,
+			"is_pinned":  text == "pinned",
+		})
+		var note models.Note
+		json.NewDecoder(rec.Body).Decode(&note)
+		ids[text] = note.ID.String()
+	}
+	rec := authedRequest(srv, token, http.MethodPut, "/api/notes/"+ids["archived"], map[string]interface{}{"archived": true})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("failed to archive note: %d %s", rec.Code, rec.Body.String())
+	}
+
+	path := "/api/notebooks/" + notebookID + "/notes?around="
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		// The anchor has to be on the filtered timeline
+		{ids["plain"] + "&pinned=true", http.StatusNotFound},
+		{ids["archived"], http.StatusNotFound},
+		{ids["pinned"] + "&pinned=true", http.StatusOK},
+		{ids["archived"] + "&include_archived=true", http.StatusOK},
+	} {
+		rec := authedRequest(srv, token, http.MethodGet, path+tc.query, nil)
+		if rec.Code != tc.want {
+			t.Errorf("around=%s: got status %d, want %d. Body: %s", tc.query, rec.Code, tc.want, rec.Body.String())
+		}
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, path+ids["pinned"]+"&pinned=true", nil)
+	var notes []models.Note
+	json.NewDecoder(rec.Body).Decode(&notes)
+	if texts := plainTexts(notes); len(texts) != 1 || texts[0] != "pinned" {
+		t.Errorf("got %v, want only the pinned note", texts)
+	}
+}
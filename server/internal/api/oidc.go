@@ -0,0 +1,326 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/config"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/oidc"
+	"github.com/noted/server/internal/store"
+)
+
+const (
+	// oidcStateCookie carries the state, nonce and PKCE verifier of a
+	// sign-in from the start endpoint to the callback
+	oidcStateCookie = "noted_oidc"
+
+	// oidcStateExpiry is how long a user has to sign in at the provider
+	oidcStateExpiry = 10 * time.Minute
+
+	// oidcAppCallbackPath is the web app page that receives the outcome of
+	// a sign-in
+	oidcAppCallbackPath = "/auth/oidc/callback"
+)
+
+var (
+	errOIDCSignupDisabled = errors.New("signup is disabled for this provider")
+	errOIDCUserNotFound   = errors.New("linked user not found")
+	// errOIDCAccountUnverified means an account with the identity's address
+	// exists but nobody has proven they own it, so it may have been
+	// registered by someone else ahead of the real owner
+	errOIDCAccountUnverified = errors.New("existing account's email is not verified")
+)
+
+// oidcProvider is a configured identity provider
+type oidcProvider struct {
+	*oidc.Provider
+	config config.OIDCProvider
+}
+
+func newOIDCProviders(cfg *config.Config) map[string]*oidcProvider {
+	providers := make(map[string]*oidcProvider)
+	for _, p := range cfg.OIDCProviders {
+		providers[p.Name] = &oidcProvider{
+			Provider: oidc.NewProvider(oidc.Config{
+				IssuerURL:    p.IssuerURL,
+				ClientID:     p.ClientID,
+				ClientSecret: p.ClientSecret,
+				RedirectURL:  cfg.APIURL + "/api/auth/oidc/" + url.PathEscape(p.Name) + "/callback",
+			}),
+			config: p,
+		}
+	}
+	return providers
+}
+
+// oidcStateClaims are the contents of the state cookie
+type oidcStateClaims struct {
+	jwt.RegisteredClaims
+	TokenType string `json:"type"`
+	Provider  string `json:"provider"`
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+}
+
+// handleOIDCStart redirects the browser to the identity provider to sign in
+func (s *Server) handleOIDCStart(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "provider")
+	provider, ok := s.oidcProviders[name]
+	if !ok {
+		respondError(w, http.StatusNotFound, "not_found", "unknown identity provider")
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		v, err := oidc.NewVerifier()
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to start sign-in")
+			return
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	authURL, err := provider.AuthURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("oidc: failed to start sign-in with %s: %v", name, err)
+		respondError(w, http.StatusBadGateway, "provider_unavailable", "identity provider is unavailable")
+		return
+	}
+
+	now := time.Now()
+	cookie, err := s.keys.Sign(&oidcStateClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(oidcStateExpiry)),
+		},
+		TokenType: "oidc_state",
+		Provider:  name,
+		State:     state,
+		Nonce:     nonce,
+		Verifier:  verifier,
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to start sign-in")
+		return
+	}
+	s.setOIDCStateCookie(w, cookie, int(oidcStateExpiry/time.Second))
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handleOIDCCallback finishes a sign-in at the identity provider. The user
+// is found by their linked identity, or else by verified email address,
+// and is created if they are new. The browser is then sent back to the web
+// app with the usual token pair, or an MFA challenge, in the URL fragment.
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "provider")
+	provider, ok := s.oidcProviders[name]
+	if !ok {
+		respondError(w, http.StatusNotFound, "not_found", "unknown identity provider")
+		return
+	}
+
+	// The state is single-use
+	claims, err := s.readOIDCState(r)
+	s.setOIDCStateCookie(w, "", -1)
+	if err != nil || claims.Provider != name ||
+		subtle.ConstantTimeCompare([]byte(claims.State), []byte(r.URL.Query().Get("state"))) != 1 {
+		s.finishOIDCLogin(w, r, url.Values{"error": {"invalid_state"}})
+		return
+	}
+
+	if errCode := r.URL.Query().Get("error"); errCode != "" {
+		s.finishOIDCLogin(w, r, url.Values{"error": {errCode}})
+		return
+	}
+
+	identity, err := provider.Exchange(r.Context(), r.URL.Query().Get("code"), claims.Verifier, claims.Nonce)
+	if err != nil {
+		log.Printf("oidc: sign-in with %s failed: %v", name, err)
+		s.finishOIDCLogin(w, r, url.Values{"error": {"sign_in_failed"}})
+		return
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		s.finishOIDCLogin(w, r, url.Values{"error": {"email_not_verified"}})
+		return
+	}
+
+	user, err := s.oidcUser(r.Context(), provider, identity)
+	if err != nil {
+		switch {
+		case errors.Is(err, errOIDCSignupDisabled):
+			s.finishOIDCLogin(w, r, url.Values{"error": {"signup_disabled"}})
+		case errors.Is(err, errOIDCUserNotFound):
+			s.finishOIDCLogin(w, r, url.Values{"error": {"account_not_found"}})
+		case errors.Is(err, errOIDCAccountUnverified):
+			s.finishOIDCLogin(w, r, url.Values{"error": {"account_not_verified"}})
+		default:
+			log.Printf("oidc: failed to sign in %s user %s: %v", name, identity.Subject, err)
+			s.finishOIDCLogin(w, r, url.Values{"error": {"server_error"}})
+		}
+		return
+	}
+
+	// Two-factor authentication still applies
+	if user.MFAEnabled {
+		mfaToken, _, err := s.generateMFAToken(r.Context(), user)
+		if err != nil {
+			s.finishOIDCLogin(w, r, url.Values{"error": {"server_error"}})
+			return
+		}
+		s.finishOIDCLogin(w, r, url.Values{"mfa_required": {"true"}, "mfa_token": {mfaToken}})
+		return
+	}
+
+	tokens, err := s.startSession(r, user.ID)
+	if err != nil {
+		s.finishOIDCLogin(w, r, url.Values{"error": {"server_error"}})
+		return
+	}
+
+	s.finishOIDCLogin(w, r, url.Values{
+		"access_token":  {tokens.AccessToken},
+		"refresh_token": {tokens.RefreshToken},
+	})
+}
+
+// oidcUser returns the user an identity belongs to, linking it to the
+// account with the same verified address or creating an account if there is
+// none
+func (s *Server) oidcUser(ctx context.Context, provider *oidcProvider, identity *oidc.Identity) (*models.User, error) {
+	now := time.Now()
+
+	linked, err := s.store.GetUserIdentity(ctx, provider.config.Name, identity.Subject)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	if linked != nil {
+		user, err := s.store.GetUserByID(ctx, linked.UserID)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				return nil, errOIDCUserNotFound
+			}
+			return nil, err
+		}
+		if err := s.store.TouchUserIdentity(ctx, provider.config.Name, identity.Subject, identity.Email, now); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+
+	newIdentity := &models.UserIdentity{
+		Provider:    provider.config.Name,
+		Subject:     identity.Subject,
+		Email:       identity.Email,
+		CreatedAt:   now,
+		LastLoginAt: &now,
+	}
+
+	user, err := s.store.GetUserByEmail(ctx, identity.Email)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	if user != nil {
+		// Whoever registered an unverified account chose its password, so
+		// linking it would hand them the provider's user. The owner has to
+		// verify the address first.
+		if user.EmailVerifiedAt == nil {
+			return nil, errOIDCAccountUnverified
+		}
+		newIdentity.UserID = user.ID
+		if err := s.store.CreateUserIdentity(ctx, newIdentity); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+
+	if !provider.config.AllowSignup {
+		return nil, errOIDCSignupDisabled
+	}
+
+	// Accounts created through single sign-on have no password until the
+	// user sets one with a password reset
+	user = &models.User{
+		ID:              uuid.New(),
+		Email:           identity.Email,
+		EmailVerifiedAt: &now,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	newIdentity.UserID = user.ID
+	err = s.store.WithTx(ctx, func(tx store.Store) error {
+		if err := tx.CreateUser(ctx, user); err != nil {
+			return err
+		}
+		if err := tx.SetEmailVerified(ctx, user.ID, user.Email, now); err != nil {
+			return err
+		}
+		if err := tx.CreateUserIdentity(ctx, newIdentity); err != nil {
+			return err
+		}
+		return tx.CreateNotebook(ctx, &models.Notebook{
+			ID:        uuid.New(),
+			UserID:    user.ID,
+			Title:     "Main",
+			SortOrder: 0,
+			Version:   1,
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// finishOIDCLogin sends the browser back to the web app with the outcome of
+// a sign-in in the URL fragment, which browsers don't send on to servers
+func (s *Server) finishOIDCLogin(w http.ResponseWriter, r *http.Request, values url.Values) {
+	http.Redirect(w, r, s.config.AppURL+oidcAppCallbackPath+"#"+values.Encode(), http.StatusFound)
+}
+
+func (s *Server) setOIDCStateCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/api/auth/oidc/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.config.APIURL, "https://"),
+		// Lax lets the cookie through on the provider's redirect back
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *Server) readOIDCState(r *http.Request) (*oidcStateClaims, error) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &oidcStateClaims{}
+	if err := s.keys.Parse(cookie.Value, claims); err != nil {
+		return nil, fmt.Errorf("invalid state")
+	}
+
+	if claims.TokenType != "oidc_state" {
+		return nil, fmt.Errorf("invalid token type")
+	}
+	return claims, nil
+}
@@ -0,0 +1,188 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/noted/server/internal/api"
+	"github.com/noted/server/internal/config"
+	"github.com/noted/server/internal/mail"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/oidc/oidctest"
+	"github.com/noted/server/internal/testutil"
+)
+
+func setupTestServerWithOIDC(t *testing.T, user oidctest.User, allowSignup bool) (*api.Server, *oidctest.Provider, *mail.Outbox) {
+	t.Helper()
+	db := testutil.TestDB(t)
+	testutil.CleanTables(t, db)
+	outbox := testutil.TestMailer(t)
+
+	idp := oidctest.NewProvider(user)
+	t.Cleanup(idp.Close)
+
+	cfg := &config.Config{
+		JWTExpiration:           15 * time.Minute,
+		RefreshExpiry:           7 * 24 * time.Hour,
+		AppURL:                  "http://app.test",
+		APIURL:                  "http://api.test",
+		EmailVerificationExpiry: 48 * time.Hour,
+		OIDCProviders: []config.OIDCProvider{{
+			Name:         "mock",
+			IssuerURL:    idp.URL,
+			ClientID:     oidctest.ClientID,
+			ClientSecret: oidctest.ClientSecret,
+			AllowSignup:  allowSignup,
+		}},
+	}
+	return api.NewServer(db, cfg, testutil.TestBlobStore(t), outbox, testutil.TestKeys(t)), idp, outbox
+}
+
+// oidcSignIn runs the sign-in flow against the mock provider and returns
+// the values the server sent back to the web app
+func oidcSignIn(t *testing.T, srv *api.Server) url.Values {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/mock/start", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("got status %d from start, want %d. Body: %s", rec.Code, http.StatusFound, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+
+	// The mock provider signs the user in straight away
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("authorization request failed: %v", err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid callback URL: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("got status %d from callback, want %d. Body: %s", rec.Code, http.StatusFound, rec.Body.String())
+	}
+
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	if location.Host != "app.test" || location.Path != "/auth/oidc/callback" {
+		t.Fatalf("unexpected redirect to %s", location)
+	}
+	values, _ := url.ParseQuery(location.Fragment)
+	return values
+}
+
+func TestOIDCSignInCreatesUser(t *testing.T) {
+	srv, _, _ := setupTestServerWithOIDC(t, oidctest.User{Subject: "sub-1", Email: "sso@example.com", EmailVerified: true}, true)
+
+	values := oidcSignIn(t, srv)
+	if values.Get("access_token") == "" || values.Get("refresh_token") == "" {
+		t.Fatalf("expected tokens, got %v", values)
+	}
+
+	rec := authedRequest(srv, values.Get("access_token"), http.MethodGet, "/api/auth/me", nil)
+	var user models.User
+	json.NewDecoder(rec.Body).Decode(&user)
+	if user.Email != "sso@example.com" || user.EmailVerifiedAt == nil {
+		t.Errorf("unexpected user %s", rec.Body.String())
+	}
+
+	// Signing in again finds the same user
+	again := oidcSignIn(t, srv)
+	rec = authedRequest(srv, again.Get("access_token"), http.MethodGet, "/api/auth/me", nil)
+	var second models.User
+	json.NewDecoder(rec.Body).Decode(&second)
+	if second.ID != user.ID {
+		t.Errorf("got user %s, want %s", second.ID, user.ID)
+	}
+}
+
+func TestOIDCSignInLinksExistingUser(t *testing.T) {
+	srv, _, outbox := setupTestServerWithOIDC(t, oidctest.User{Subject: "sub-1", Email: "existing@example.com", EmailVerified: true}, false)
+
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/register", map[string]string{
+		"email": "existing@example.com", "password": "password123",
+	})
+	var registered models.AuthResponse
+	json.NewDecoder(rec.Body).Decode(&registered)
+
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/verify-email", map[string]string{"token": lastEmailToken(t, outbox)})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("failed to verify email: %s", rec.Body.String())
+	}
+
+	values := oidcSignIn(t, srv)
+	rec = authedRequest(srv, values.Get("access_token"), http.MethodGet, "/api/auth/me", nil)
+	var user models.User
+	json.NewDecoder(rec.Body).Decode(&user)
+	if user.ID != registered.User.ID {
+		t.Errorf("got user %s, want the existing user %s", user.ID, registered.User.ID)
+	}
+}
+
+func TestOIDCSignInRefusesUnverifiedAccount(t *testing.T) {
+	srv, _, _ := setupTestServerWithOIDC(t, oidctest.User{Subject: "sub-1", Email: "existing@example.com", EmailVerified: true}, true)
+
+	// Someone registers the address ahead of its owner
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/register", map[string]string{
+		"email": "existing@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("failed to register user: %s", rec.Body.String())
+	}
+
+	values := oidcSignIn(t, srv)
+	if got := values.Get("error"); got != "account_not_verified" {
+		t.Fatalf("got %v, want an account_not_verified error", values)
+	}
+
+	// The account is left unverified
+	rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+		"email": "existing@example.com", "password": "password123",
+	})
+	var auth models.AuthResponse
+	json.NewDecoder(rec.Body).Decode(&auth)
+	if auth.User.EmailVerifiedAt != nil {
+		t.Error("expected the account to stay unverified")
+	}
+}
+
+func TestOIDCSignInErrors(t *testing.T) {
+	srv, idp, _ := setupTestServerWithOIDC(t, oidctest.User{Subject: "sub-1", Email: "new@example.com", EmailVerified: true}, false)
+
+	if got := oidcSignIn(t, srv).Get("error"); got != "signup_disabled" {
+		t.Errorf("got error %q, want signup_disabled", got)
+	}
+
+	idp.SetUser(oidctest.User{Subject: "sub-2", Email: "unverified@example.com"})
+	if got := oidcSignIn(t, srv).Get("error"); got != "email_not_verified" {
+		t.Errorf("got error %q, want email_not_verified", got)
+	}
+
+	// A callback without the state cookie is rejected
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/mock/callback?code=x&state=y", nil))
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	if values, _ := url.ParseQuery(location.Fragment); values.Get("error") != "invalid_state" {
+		t.Errorf("got redirect %s, want an invalid_state error", location)
+	}
+
+	rec = authedRequest(srv, "", http.MethodGet, "/api/auth/oidc/unknown/start", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown provider, want %d", rec.Code, http.StatusNotFound)
+	}
+}
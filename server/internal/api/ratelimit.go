@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/noted/server/internal/config"
+	"github.com/noted/server/internal/ratelimit"
+	"github.com/noted/server/internal/store"
+)
+
+var (
+	// authRate limits the public auth endpoints per client address
+	authRate = ratelimit.PerMinute(30)
+
+	// uploadRate limits image uploads per user
+	uploadRate = ratelimit.PerMinute(30)
+)
+
+const (
+	// loginFreeAttempts is how many failed logins an address gets before it
+	// is locked
+	loginFreeAttempts = 5
+
+	// The lockout starts at loginLockoutBase and doubles with every further
+	// failure, up to loginLockoutMax
+	loginLockoutBase = time.Minute
+	loginLockoutMax  = time.Hour
+
+	// loginFailureWindow is how long failed logins are remembered after the
+	// last one
+	loginFailureWindow = 24 * time.Hour
+)
+
+func newLimiter(cfg *config.Config, s store.Store) ratelimit.Limiter {
+	if cfg.RateLimitBackend == "postgres" {
+		return ratelimit.NewStoreLimiter(s)
+	}
+	return ratelimit.NewMemoryLimiter()
+}
+
+// rateLimit limits requests to a group of routes, per user when signed in
+// and otherwise per client address
+func (s *Server) rateLimit(group string, rate ratelimit.Rate) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := group + ":ip:" + clientIP(r)
+			if userID, ok := GetUserID(r.Context()); ok {
+				key = group + ":user:" + userID.String()
+			}
+
+			result, err := s.limiter.Allow(r.Context(), key, rate)
+			if err != nil {
+				// An unavailable limiter shouldn't take the API down with it
+				log.Printf("rate limit: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !result.Allowed {
+				respondRateLimited(w, result.RetryAfter, "too many requests, try again later")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// loginLockedFor returns how much longer logins to an email address are
+// locked after repeated failures, or zero if they aren't
+func (s *Server) loginLockedFor(ctx context.Context, email string) (time.Duration, error) {
+	failures, err := s.store.GetLoginFailures(ctx, loginFailureKey(email))
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	now := time.Now()
+	if failures.ResetAt.Before(now) {
+		return 0, nil
+	}
+	if wait := failures.LastFailedAt.Add(loginLockout(failures.Failures)).Sub(now); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// recordLoginFailure counts a failed login to an email address, whether or
+// not it has an account
+func (s *Server) recordLoginFailure(ctx context.Context, email string) {
+	now := time.Now()
+	if _, err := s.store.RecordLoginFailure(ctx, loginFailureKey(email), now, now.Add(loginFailureWindow)); err != nil {
+		log.Printf("failed to record login failure: %v", err)
+	}
+}
+
+func (s *Server) clearLoginFailures(ctx context.Context, email string) {
+	if err := s.store.ClearLoginFailures(ctx, loginFailureKey(email)); err != nil {
+		log.Printf("failed to clear login failures: %v", err)
+	}
+}
+
+// loginLockout is how long logins are locked after the given number of
+// consecutive failures
+func loginLockout(failures int) time.Duration {
+	if failures < loginFreeAttempts {
+		return 0
+	}
+	lockout := loginLockoutBase
+	for i := loginFreeAttempts; i < failures && lockout < loginLockoutMax; i++ {
+		lockout *= 2
+	}
+	return min(lockout, loginLockoutMax)
+}
+
+// loginFailureKey normalizes an email address so variations of it share a
+// count
+func loginFailureKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,82 @@
+package api_test
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLoginLockout(t *testing.T) {
+	srv, _ := setupTestServerWithSession(t)
+
+	for i := 0; i < 5; i++ {
+		rec := authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+			"email": "sessions@example.com", "password": "wrong-password",
+		})
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got status %d, want %d", i+1, rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// Even the right password is turned away while the address is locked
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+		"email": "Sessions@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusTooManyRequests, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+
+	// Addresses without an account are locked the same way
+	for i := 0; i < 6; i++ {
+		rec = authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+			"email": "nobody@example.com", "password": "password123",
+		})
+	}
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("unknown address: got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestLoginSuccessResetsFailures(t *testing.T) {
+	srv, _ := setupTestServerWithSession(t)
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 4; i++ {
+			authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+				"email": "sessions@example.com", "password": "wrong-password",
+			})
+		}
+		rec := authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+			"email": "sessions@example.com", "password": "password123",
+		})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("round %d: got status %d, want %d", round+1, rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestAuthRateLimit(t *testing.T) {
+	srv, auth := setupTestServerWithSession(t)
+
+	limited := false
+	for i := 0; i < 40 && !limited; i++ {
+		rec := authedRequest(srv, "", http.MethodPost, "/api/auth/forgot-password", map[string]string{"email": "nobody@example.com"})
+		if rec.Code == http.StatusTooManyRequests {
+			limited = true
+			if rec.Header().Get("Retry-After") == "" {
+				t.Error("expected a Retry-After header")
+			}
+		}
+	}
+	if !limited {
+		t.Fatal("expected the auth endpoints to be rate limited")
+	}
+
+	// Other routes have their own limits
+	rec := authedRequest(srv, auth.AccessToken, http.MethodGet, "/api/auth/me", nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("me: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -2,8 +2,13 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // maxBodySize is the maximum allowed request body size (10MB)
@@ -15,6 +20,14 @@ type ErrorResponse struct {
 	Message string `json:"message,omitempty"`
 }
 
+// ConflictResponse is returned with 409 when an update was based on a
+// version that is no longer current. Server is the current copy.
+type ConflictResponse struct {
+	Error   string      `json:"error"`
+	Message string      `json:"message,omitempty"`
+	Server  interface{} `json:"server"`
+}
+
 // respondJSON writes a JSON response
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -31,8 +44,90 @@ func respondError(w http.ResponseWriter, status int, err string, message string)
 	respondJSON(w, status, ErrorResponse{Error: err, Message: message})
 }
 
+// respondRateLimited writes a 429 error telling the client how long to wait
+// before trying again
+func respondRateLimited(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondError(w, http.StatusTooManyRequests, "rate_limited", message)
+}
+
+// respondVersionConflict writes a 409 error with the current copy of an item
+// and its ETag, so the client can reapply its change and try again
+func respondVersionConflict(w http.ResponseWriter, version int64, current interface{}) {
+	w.Header().Set("ETag", etag(version))
+	respondJSON(w, http.StatusConflict, ConflictResponse{
+		Error:   "version_conflict",
+		Message: "the item was changed since the version this update is based on",
+		Server:  current,
+	})
+}
+
+// etag formats an item's version as an entity tag
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// expectedVersion reads the version an update is based on from the
+// If-Match header, or else from the version field of the request body. nil
+// means the update applies to whatever version is current.
+func expectedVersion(r *http.Request, bodyVersion *int64) (*int64, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	switch header {
+	case "":
+		return bodyVersion, nil
+	case "*":
+		return nil, nil
+	}
+
+	tag, ok := strings.CutPrefix(header, `"`)
+	if ok {
+		tag, ok = strings.CutSuffix(tag, `"`)
+	}
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if !ok || err != nil {
+		return nil, errors.New("'If-Match' must be a single ETag from this server")
+	}
+	return &version, nil
+}
+
+// parseBool reads an optional true or false query parameter
+func parseBool(r *http.Request, name string, defaultValue bool) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("'" + name + "' must be true or false")
+	}
+	return b, nil
+}
+
 // decodeJSON decodes a JSON request body with size limit
 func decodeJSON(r *http.Request, v interface{}) error {
 	r.Body = http.MaxBytesReader(nil, r.Body, maxBodySize)
 	return json.NewDecoder(r.Body).Decode(v)
 }
+
+// parseLimit reads the optional "limit" query parameter, falling back to
+// defaultLimit and capping the result at maxLimit
+func parseLimit(r *http.Request, defaultLimit, maxLimit int) (int, error) {
+	limitStr := r.URL.Query().Get("limit")
+	if limitStr == "" {
+		return defaultLimit, nil
+	}
+
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit < 1 {
+		return 0, errors.New("'limit' must be a positive integer")
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return limit, nil
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/store"
+	"github.com/noted/server/internal/tiptap"
+)
+
+// Page sizes for listing note revisions
+const (
+	defaultRevisionLimit = 50
+	maxRevisionLimit     = 200
+)
+
+func (s *Server) handleListNoteRevisions(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.ownedNote(w, r)
+	if !ok {
+		return
+	}
+
+	var before *int64
+	if beforeStr := r.URL.Query().Get("before"); beforeStr != "" {
+		version, err := strconv.ParseInt(beforeStr, 10, 64)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid_request", "'before' must be a version number")
+			return
+		}
+		before = &version
+	}
+
+	limit, err := parseLimit(r, defaultRevisionLimit, maxRevisionLimit)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	revisions, err := s.store.GetNoteRevisions(r.Context(), note.ID, before, limit)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get revisions")
+		return
+	}
+
+	if revisions == nil {
+		revisions = []models.NoteRevision{}
+	}
+
+	respondJSON(w, http.StatusOK, revisions)
+}
+
+func (s *Server) handleGetNoteRevision(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.ownedNote(w, r)
+	if !ok {
+		return
+	}
+
+	rev, ok := s.noteRevision(w, r, note.ID, chi.URLParam(r, "version"))
+	if !ok {
+		return
+	}
+
+	respondJSON(w, http.StatusOK, rev)
+}
+
+// handleDiffNoteRevisions compares the content of two revisions of a note.
+// "to" defaults to the current version.
+func (s *Server) handleDiffNoteRevisions(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.ownedNote(w, r)
+	if !ok {
+		return
+	}
+
+	if r.URL.Query().Get("from") == "" {
+		respondError(w, http.StatusBadRequest, "invalid_request", "'from' is required")
+		return
+	}
+	from, ok := s.noteRevision(w, r, note.ID, r.URL.Query().Get("from"))
+	if !ok {
+		return
+	}
+
+	to := &models.NoteRevision{NoteID: note.ID, Version: note.Version, Content: note.Content}
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		to, ok = s.noteRevision(w, r, note.ID, toStr)
+		if !ok {
+			return
+		}
+	}
+
+	blocks, err := tiptap.Diff(from.Content, to.Content)
+	if err != nil {
+		log.Printf("failed to diff note %s versions %d and %d: %v", note.ID, from.Version, to.Version, err)
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to compare revisions")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, models.NoteDiffResponse{
+		NoteID: note.ID,
+		From:   from.Version,
+		To:     to.Version,
+		Blocks: blocks,
+	})
+}
+
+// handleRestoreNoteRevision saves an old revision as the note's new version,
+// so the restore itself can be undone from the history
+func (s *Server) handleRestoreNoteRevision(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.ownedNote(w, r)
+	if !ok {
+		return
+	}
+
+	rev, ok := s.noteRevision(w, r, note.ID, chi.URLParam(r, "version"))
+	if !ok {
+		return
+	}
+
+	expected, err := expectedVersion(r, nil)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if expected != nil && *expected != note.Version {
+		s.respondNoteConflict(w, r, note)
+		return
+	}
+
+	if rev.Version != note.Version {
+		note.Content = rev.Content
+		note.PlainText = rev.PlainText
+		note.IsTodo = rev.IsTodo
+		note.IsDone = rev.IsDone
+		note.ReminderAt = rev.ReminderAt
+		note.Version++
+		note.UpdatedAt = time.Now()
+
+		if err := s.store.UpdateNote(r.Context(), note); err != nil {
+			if errors.Is(err, store.ErrVersionConflict) {
+				s.respondNoteChanged(w, r, note.ID)
+				return
+			}
+			if errors.Is(err, store.ErrNotFound) {
+				respondError(w, http.StatusNotFound, "not_found", "note not found")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to restore revision")
+			return
+		}
+	}
+
+	// Load tags
+	tags, err := s.store.GetTagsForNote(r.Context(), note.ID)
+	if err != nil {
+		log.Printf("failed to get tags for note %s: %v", note.ID, err)
+	} else {
+		note.Tags = tags
+	}
+
+	w.Header().Set("ETag", etag(note.Version))
+	respondJSON(w, http.StatusOK, note)
+}
+
+// ownedNote loads the note in the URL, writing an error response unless it
+// exists, isn't deleted and belongs to the user
+func (s *Server) ownedNote(w http.ResponseWriter, r *http.Request) (*models.Note, bool) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return nil, false
+	}
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid note ID")
+		return nil, false
+	}
+
+	note, err := s.store.GetNoteByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "note not found")
+			return nil, false
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get note")
+		return nil, false
+	}
+
+	if note.UserID != userID {
+		respondError(w, http.StatusForbidden, "forbidden", "you don't have access to this note")
+		return nil, false
+	}
+
+	if note.DeletedAt != nil {
+		respondError(w, http.StatusNotFound, "not_found", "note not found")
+		return nil, false
+	}
+
+	return note, true
+}
+
+// noteRevision loads a revision of a note by its version number, writing an
+// error response if it doesn't exist or has been thinned out
+func (s *Server) noteRevision(w http.ResponseWriter, r *http.Request, noteID uuid.UUID, versionStr string) (*models.NoteRevision, bool) {
+	version, err := strconv.ParseInt(versionStr, 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid version")
+		return nil, false
+	}
+
+	rev, err := s.store.GetNoteRevision(r.Context(), noteID, version)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "revision not found")
+			return nil, false
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get revision")
+		return nil, false
+	}
+
+	return rev, true
+}
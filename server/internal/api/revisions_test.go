@@ -0,0 +1,167 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/noted/server/internal/api"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/tiptap"
+)
+
+// createNoteWithHistory creates a note and edits it twice, leaving versions
+// 1 to 3
+func createNoteWithHistory(t *testing.T) (*api.Server, string, models.Note) {
+	t.Helper()
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+
+	rec := authedRequest(srv, token, http.MethodPost, "/api/notebooks/"+notebookID+"/notes", map[string]interface{}{
+		"content":    tiptapDoc("first", "second"),
+		"plain_text": "first\n\nsecond",
+	})
+	var note models.Note
+	json.NewDecoder(rec.Body).Decode(&note)
+
+	for _, content := range []json.RawMessage{tiptapDoc("first", "second", "third"), tiptapDoc("first", "changed", "third")} {
+		rec = authedRequest(srv, token, http.MethodPut, "/api/notes/"+note.ID.String(), map[string]interface{}{"content": content})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("failed to update note: %d %s", rec.Code, rec.Body.String())
+		}
+		json.NewDecoder(rec.Body).Decode(&note)
+	}
+	return srv, token, note
+}
+
+func TestListNoteRevisions(t *testing.T) {
+	srv, token, note := createNoteWithHistory(t)
+
+	rec := authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String()+"/revisions", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var revisions []models.NoteRevision
+	json.NewDecoder(rec.Body).Decode(&revisions)
+	if len(revisions) != 3 || revisions[0].Version != 3 || revisions[2].Version != 1 {
+		t.Fatalf("expected versions 3 to 1, got %+v", revisions)
+	}
+	if revisions[0].Content != nil {
+		t.Error("expected listed revisions to leave out content")
+	}
+
+	// Paging backwards
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String()+"/revisions?before=3&limit=1", nil)
+	revisions = nil
+	json.NewDecoder(rec.Body).Decode(&revisions)
+	if len(revisions) != 1 || revisions[0].Version != 2 {
+		t.Errorf("expected version 2, got %+v", revisions)
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String()+"/revisions/1", nil)
+	var rev models.NoteRevision
+	json.NewDecoder(rec.Body).Decode(&rev)
+	if !tiptap.Equal(rev.Content, tiptapDoc("first", "second")) {
+		t.Errorf("got revision content %s", rev.Content)
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String()+"/revisions/9", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestSyncPushRecordsRevision(t *testing.T) {
+	srv, token, note := createNoteWithHistory(t)
+
+	note.Content = tiptapDoc("pushed")
+	rec := authedRequest(srv, token, http.MethodPost, "/api/sync", models.SyncRequest{Notes: []models.SyncNote{{Note: note}}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String()+"/revisions?limit=1", nil)
+	var revisions []models.NoteRevision
+	json.NewDecoder(rec.Body).Decode(&revisions)
+	if len(revisions) != 1 || revisions[0].Version != note.Version+1 {
+		t.Fatalf("expected the pushed edit as version %d, got %+v", note.Version+1, revisions)
+	}
+}
+
+func TestDiffNoteRevisions(t *testing.T) {
+	srv, token, note := createNoteWithHistory(t)
+
+	rec := authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String()+"/diff?from=1", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var diff models.NoteDiffResponse
+	json.NewDecoder(rec.Body).Decode(&diff)
+	if diff.From != 1 || diff.To != 3 {
+		t.Errorf("got diff from %d to %d, want 1 to 3", diff.From, diff.To)
+	}
+	var ops []string
+	for _, b := range diff.Blocks {
+		ops = append(ops, b.Op)
+	}
+	want := []string{tiptap.DiffEqual, tiptap.DiffReplace, tiptap.DiffInsert}
+	if len(ops) != len(want) || ops[0] != want[0] || ops[1] != want[1] || ops[2] != want[2] {
+		t.Errorf("got ops %v, want %v", ops, want)
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String()+"/diff?from=2&to=3", nil)
+	diff = models.NoteDiffResponse{}
+	json.NewDecoder(rec.Body).Decode(&diff)
+	if len(diff.Blocks) != 3 || diff.Blocks[1].Op != tiptap.DiffReplace {
+		t.Errorf("expected the second block replaced, got %+v", diff.Blocks)
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String()+"/diff", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestRestoreNoteRevision(t *testing.T) {
+	srv, token, note := createNoteWithHistory(t)
+
+	rec := authedRequest(srv, token, http.MethodPost, "/api/notes/"+note.ID.String()+"/revisions/1/restore", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var restored models.Note
+	json.NewDecoder(rec.Body).Decode(&restored)
+	if restored.Version != 4 {
+		t.Errorf("expected the restore to be version 4, got %d", restored.Version)
+	}
+	if !tiptap.Equal(restored.Content, tiptapDoc("first", "second")) || restored.PlainText != "first\n\nsecond" {
+		t.Errorf("got restored content %s, text %q", restored.Content, restored.PlainText)
+	}
+
+	// The overwritten version stays in the history
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String()+"/revisions/3", nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestNoteRevisionsAuthorization(t *testing.T) {
+	srv, _, note := createNoteWithHistory(t)
+
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/register", map[string]string{
+		"email":    "other@example.com",
+		"password": "password123",
+	})
+	var other models.AuthResponse
+	json.NewDecoder(rec.Body).Decode(&other)
+
+	for _, path := range []string{"/revisions", "/revisions/1", "/diff?from=1"} {
+		rec := authedRequest(srv, other.AccessToken, http.MethodGet, "/api/notes/"+note.ID.String()+path, nil)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("GET %s: got status %d, want %d", path, rec.Code, http.StatusForbidden)
+		}
+	}
+	rec = authedRequest(srv, other.AccessToken, http.MethodPost, "/api/notes/"+note.ID.String()+"/revisions/1/restore", nil)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("restore: got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
@@ -7,6 +7,10 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 	"github.com/noted/server/internal/config"
+	"github.com/noted/server/internal/mail"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/ratelimit"
+	"github.com/noted/server/internal/signing"
 	"github.com/noted/server/internal/storage"
 	"github.com/noted/server/internal/store"
 )
@@ -17,20 +21,44 @@ type Server struct {
 	store     store.Store
 	config    *config.Config
 	blobStore storage.BlobStore
+	mailer    mail.Mailer
+	keys      *signing.KeySet
+	events    *eventHub
+	limiter   ratelimit.Limiter
+	purger    AccountPurger
+
+	oidcProviders map[string]*oidcProvider
+}
+
+// AccountPurger purges the data of deleted accounts in the background
+type AccountPurger interface {
+	PurgeAccounts()
 }
 
 // NewServer creates a new API server
-func NewServer(s store.Store, cfg *config.Config, blobStore storage.BlobStore) *Server {
+func NewServer(s store.Store, cfg *config.Config, blobStore storage.BlobStore, mailer mail.Mailer, keys *signing.KeySet) *Server {
 	srv := &Server{
 		router:    chi.NewRouter(),
 		store:     s,
 		config:    cfg,
 		blobStore: blobStore,
+		mailer:    mailer,
+		keys:      keys,
+		events:    newEventHub(),
+		limiter:   newLimiter(cfg, s),
+
+		oidcProviders: newOIDCProviders(cfg),
 	}
 	srv.setupRoutes()
 	return srv
 }
 
+// SetAccountPurger has deleted accounts purged straight away. Without one
+// they wait for the next purge pass.
+func (s *Server) SetAccountPurger(p AccountPurger) {
+	s.purger = p
+}
+
 // ServeHTTP implements http.Handler
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.router.ServeHTTP(w, r)
@@ -40,18 +68,25 @@ func (s *Server) setupRoutes() {
 	r := s.router
 
 	// Middleware
+	if s.config.TrustProxyHeaders {
+		r.Use(middleware.RealIP)
+	}
+	r.Use(redactQueryCredentials)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RequestID)
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   s.config.AllowedOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "Idempotency-Key", "If-Match", "X-Device-ID"},
+		ExposedHeaders:   []string{"ETag", "Link", "Idempotent-Replayed", "Retry-After"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
+	// Public keys that verify the server's tokens
+	r.Get("/.well-known/jwks.json", s.handleJWKS)
+
 	// Health check
 	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -65,23 +100,64 @@ func (s *Server) setupRoutes() {
 
 		// Auth routes (public)
 		r.Route("/auth", func(r chi.Router) {
-			r.Post("/register", s.handleRegister)
-			r.Post("/login", s.handleLogin)
-			r.Post("/refresh", s.handleRefresh)
+			r.Group(func(r chi.Router) {
+				r.Use(s.rateLimit("auth", authRate))
+				r.Post("/register", s.handleRegister)
+				r.Post("/login", s.handleLogin)
+				r.Post("/login/mfa", s.handleMFALogin)
+				r.Post("/refresh", s.handleRefresh)
+				r.Post("/logout", s.handleLogout)
+				r.Post("/forgot-password", s.handleForgotPassword)
+				r.Post("/reset-password", s.handleResetPassword)
+				r.Post("/verify-email", s.handleVerifyEmail)
+				r.Post("/confirm-email", s.handleConfirmEmailChange)
+				r.Get("/oidc/{provider}/start", s.handleOIDCStart)
+				r.Get("/oidc/{provider}/callback", s.handleOIDCCallback)
+			})
 
 			// Protected auth routes
 			r.Group(func(r chi.Router) {
 				r.Use(s.authMiddleware)
 				r.Get("/me", s.handleGetMe)
+
+				// Account management needs a signed-in session
+				r.Group(func(r chi.Router) {
+					r.Use(sessionOnly)
+					r.Post("/resend-verification", s.handleResendVerification)
+					r.Put("/me/password", s.handleChangePassword)
+					r.Put("/me/email", s.handleChangeEmail)
+					r.Delete("/me", s.handleDeleteAccount)
+					r.Get("/sessions", s.handleListSessions)
+					r.Delete("/sessions", s.handleRevokeOtherSessions)
+					r.Delete("/sessions/{id}", s.handleRevokeSession)
+					r.Get("/mfa", s.handleGetMFA)
+					r.Post("/mfa/setup", s.handleSetupMFA)
+					r.Post("/mfa/enable", s.handleEnableMFA)
+					r.Post("/mfa/disable", s.handleDisableMFA)
+					r.Post("/mfa/recovery-codes", s.handleRegenerateRecoveryCodes)
+					r.Get("/tokens", s.handleListPersonalAccessTokens)
+					r.Post("/tokens", s.handleCreatePersonalAccessToken)
+					r.Delete("/tokens/{id}", s.handleRevokePersonalAccessToken)
+				})
 			})
 		})
 
 		// Protected routes
 		r.Group(func(r chi.Router) {
 			r.Use(s.authMiddleware)
+			r.Use(s.deviceMiddleware)
+
+			// Devices
+			r.Route("/devices", func(r chi.Router) {
+				r.Use(requireScope(models.ScopeSync, models.ScopeSync))
+				r.Get("/", s.handleListDevices)
+				r.Post("/", s.handleRegisterDevice)
+				r.Delete("/{id}", s.handleRevokeDevice)
+			})
 
 			// Notebooks
 			r.Route("/notebooks", func(r chi.Router) {
+				r.Use(requireScope(models.ScopeNotesRead, models.ScopeNotesWrite))
 				r.Get("/", s.handleListNotebooks)
 				r.Post("/", s.handleCreateNotebook)
 				r.Get("/{id}", s.handleGetNotebook)
@@ -95,13 +171,24 @@ func (s *Server) setupRoutes() {
 
 			// Notes
 			r.Route("/notes", func(r chi.Router) {
+				r.Use(requireScope(models.ScopeNotesRead, models.ScopeNotesWrite))
 				r.Get("/{id}", s.handleGetNote)
 				r.Put("/{id}", s.handleUpdateNote)
 				r.Delete("/{id}", s.handleDeleteNote)
+
+				// Revision history
+				r.Get("/{id}/revisions", s.handleListNoteRevisions)
+				r.Get("/{id}/revisions/{version}", s.handleGetNoteRevision)
+				r.Post("/{id}/revisions/{version}/restore", s.handleRestoreNoteRevision)
+				r.Get("/{id}/diff", s.handleDiffNoteRevisions)
+
+				// Threads
+				r.Get("/{id}/thread", s.handleGetNoteThread)
 			})
 
 			// Tags
 			r.Route("/tags", func(r chi.Router) {
+				r.Use(requireScope(models.ScopeNotesRead, models.ScopeNotesWrite))
 				r.Get("/", s.handleListTags)
 				r.Post("/", s.handleCreateTag)
 				r.Get("/{id}", s.handleGetTag)
@@ -111,19 +198,47 @@ func (s *Server) setupRoutes() {
 
 			// Images (upload and URL refresh require auth)
 			r.Route("/images", func(r chi.Router) {
-				r.Post("/", s.handleUploadImage)
+				r.Use(requireScope(models.ScopeNotesRead, models.ScopeImagesWrite))
+				r.With(s.rateLimit("uploads", uploadRate)).Post("/", s.handleUploadImage)
+				r.Delete("/{id}", s.handleDeleteImage)
 				r.Get("/{id}/url", s.handleGetImageURL)
 			})
 
 			// Note images
-			r.Get("/notes/{noteId}/images", s.handleListNoteImages)
+			r.With(requireScope(models.ScopeNotesRead, models.ScopeNotesWrite)).
+				Get("/notes/{noteId}/images", s.handleListNoteImages)
+
+			// Trash
+			r.Route("/trash", func(r chi.Router) {
+				r.Use(requireScope(models.ScopeNotesRead, models.ScopeNotesWrite))
+				r.Get("/", s.handleListTrash)
+				r.Delete("/", s.handleEmptyTrash)
+				r.Post("/{type}/{id}/restore", s.handleRestoreTrashItem)
+				r.Delete("/{type}/{id}", s.handleDeleteTrashItem)
+			})
 
 			// Search
-			r.Get("/search", s.handleSearch)
+			r.With(requireScope(models.ScopeNotesRead, models.ScopeNotesRead)).
+				Get("/search", s.handleSearch)
+
+			// Starred notes across notebooks
+			r.With(requireScope(models.ScopeNotesRead, models.ScopeNotesRead)).
+				Get("/starred", s.handleListStarredNotes)
 
 			// Sync
-			r.Get("/sync", s.handleSyncGet)
-			r.Post("/sync", s.handleSyncPost)
+			r.Route("/sync", func(r chi.Router) {
+				r.Use(requireScope(models.ScopeSync, models.ScopeSync))
+				r.Get("/", s.handleSyncGet)
+				r.Post("/", s.handleSyncPost)
+			})
+		})
+
+		// Change notifications (EventSource can't send headers, so browsers
+		// open the stream with a single-use ticket in the query string)
+		r.Route("/events", func(r chi.Router) {
+			r.With(s.eventStreamAuth, requireScope(models.ScopeSync, models.ScopeSync)).
+				Get("/", s.handleEvents)
+			r.With(s.authMiddleware, sessionOnly).Post("/ticket", s.handleCreateEventTicket)
 		})
 	})
 }
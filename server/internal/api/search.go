@@ -3,6 +3,9 @@ package api
 import (
 	"log"
 	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/models"
 )
 
 func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
@@ -18,7 +21,13 @@ func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	notes, err := s.store.SearchNotes(r.Context(), userID, query)
+	filter, err := parseNoteFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	notes, err := s.store.SearchNotes(r.Context(), userID, query, filter)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "server_error", "failed to search notes")
 		return
@@ -36,3 +45,47 @@ func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
 
 	respondJSON(w, http.StatusOK, notes)
 }
+
+// handleListStarredNotes returns the user's starred notes from every
+// notebook, most recently updated first
+func (s *Server) handleListStarredNotes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	filter, err := parseNoteFilter(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	notes, err := s.store.GetStarredNotes(r.Context(), userID, filter)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get starred notes")
+		return
+	}
+
+	// Load tags for all notes at once
+	if len(notes) > 0 {
+		noteIDs := make([]uuid.UUID, len(notes))
+		for i := range notes {
+			noteIDs[i] = notes[i].ID
+		}
+		tagsByNote, err := s.store.GetTagsForNotes(r.Context(), noteIDs)
+		if err != nil {
+			log.Printf("failed to get tags for starred notes: %v", err)
+		} else {
+			for i := range notes {
+				notes[i].Tags = tagsByNote[notes[i].ID]
+			}
+		}
+	}
+
+	if notes == nil {
+		notes = []models.Note{}
+	}
+
+	respondJSON(w, http.StatusOK, notes)
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/store"
+)
+
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	sessions, err := s.store.GetSessionsByUserID(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get sessions")
+		return
+	}
+
+	if sessions == nil {
+		sessions = []models.Session{}
+	}
+
+	// Flag the session making the request
+	if currentID, ok := GetSessionID(r.Context()); ok {
+		for i := range sessions {
+			sessions[i].IsCurrent = sessions[i].ID == currentID
+		}
+	}
+
+	respondJSON(w, http.StatusOK, sessions)
+}
+
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid session ID")
+		return
+	}
+
+	session, err := s.store.GetSessionByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "session not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get session")
+		return
+	}
+
+	// Check ownership and revocation (return 404 for both to prevent enumeration)
+	if session.UserID != userID || session.RevokedAt != nil {
+		respondError(w, http.StatusNotFound, "not_found", "session not found")
+		return
+	}
+
+	if err := s.store.RevokeSession(r.Context(), id); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "session not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to revoke session")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRevokeOtherSessions signs out every session except the one making
+// the request
+func (s *Server) handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	currentID, _ := GetSessionID(r.Context())
+	if _, err := s.store.RevokeOtherSessions(r.Context(), userID, currentID); err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to revoke sessions")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
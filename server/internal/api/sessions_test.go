@@ -0,0 +1,120 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/noted/server/internal/api"
+	"github.com/noted/server/internal/config"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/testutil"
+)
+
+func setupTestServerWithSession(t *testing.T) (*api.Server, models.AuthResponse) {
+	t.Helper()
+	db := testutil.TestDB(t)
+	testutil.CleanTables(t, db)
+
+	cfg := &config.Config{
+		JWTExpiration: 15 * time.Minute,
+		RefreshExpiry: 7 * 24 * time.Hour,
+	}
+	srv := api.NewServer(db, cfg, testutil.TestBlobStore(t), testutil.TestMailer(t), testutil.TestKeys(t))
+
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/register", map[string]string{
+		"email": "sessions@example.com", "password": "password123",
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("failed to register user: %s", rec.Body.String())
+	}
+	var auth models.AuthResponse
+	json.NewDecoder(rec.Body).Decode(&auth)
+	return srv, auth
+}
+
+func refreshTokens(srv *api.Server, refreshToken string) (int, models.AuthResponse) {
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/refresh", map[string]string{"refresh_token": refreshToken})
+	var auth models.AuthResponse
+	json.NewDecoder(rec.Body).Decode(&auth)
+	return rec.Code, auth
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	srv, auth := setupTestServerWithSession(t)
+
+	code, rotated := refreshTokens(srv, auth.RefreshToken)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if rotated.RefreshToken == "" || rotated.RefreshToken == auth.RefreshToken {
+		t.Fatal("expected a new refresh token")
+	}
+
+	// Replaying the old token revokes the whole family, including the
+	// token it was exchanged for
+	if code, _ := refreshTokens(srv, auth.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("reused token: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code, _ := refreshTokens(srv, rotated.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("token from revoked family: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	srv, auth := setupTestServerWithSession(t)
+
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/logout", map[string]string{"refresh_token": auth.RefreshToken})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	if code, _ := refreshTokens(srv, auth.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestSessionsListAndRevoke(t *testing.T) {
+	srv, auth := setupTestServerWithSession(t)
+
+	// A second sign-in starts another session
+	rec := authedRequest(srv, "", http.MethodPost, "/api/auth/login", map[string]string{
+		"email": "sessions@example.com", "password": "password123",
+	})
+	var other models.AuthResponse
+	json.NewDecoder(rec.Body).Decode(&other)
+
+	rec = authedRequest(srv, auth.AccessToken, http.MethodGet, "/api/auth/sessions", nil)
+	var sessions []models.Session
+	json.NewDecoder(rec.Body).Decode(&sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions))
+	}
+
+	var otherID string
+	for _, session := range sessions {
+		if !session.IsCurrent {
+			otherID = session.ID.String()
+		}
+	}
+	if otherID == "" {
+		t.Fatal("expected one session to be marked current")
+	}
+
+	rec = authedRequest(srv, auth.AccessToken, http.MethodDelete, "/api/auth/sessions/"+otherID, nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	if code, _ := refreshTokens(srv, other.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("revoked session: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+	rec = authedRequest(srv, other.AccessToken, http.MethodGet, "/api/auth/me", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("revoked session's access token: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if code, _ := refreshTokens(srv, auth.RefreshToken); code != http.StatusOK {
+		t.Errorf("current session: got status %d, want %d", code, http.StatusOK)
+	}
+}
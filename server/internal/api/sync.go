@@ -1,13 +1,37 @@
 package api
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/store"
+	"github.com/noted/server/internal/tiptap"
 )
 
+// Page sizes for the sync change feed
+const (
+	defaultSyncLimit = 500
+	maxSyncLimit     = 1000
+)
+
+// maxIdempotencyKeyLength matches the idempotency_keys.key column
+const maxIdempotencyKeyLength = 255
+
+// errSyncItemFailed rolls back the savepoint of a pushed item that failed
+var errSyncItemFailed = errors.New("sync item failed")
+
 func (s *Server) handleSyncGet(w http.ResponseWriter, r *http.Request) {
 	userID, ok := GetUserID(r.Context())
 	if !ok {
@@ -15,196 +39,896 @@ func (s *Server) handleSyncGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse since parameter
-	sinceStr := r.URL.Query().Get("since")
-	var since time.Time
-	if sinceStr != "" {
-		var err error
-		since, err = time.Parse(time.RFC3339, sinceStr)
-		if err != nil {
-			respondError(w, http.StatusBadRequest, "invalid_request", "invalid 'since' timestamp format")
+	// Parse cursor parameter (empty means a full sync)
+	cursor, err := decodeSyncCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid 'cursor' value")
+		return
+	}
+
+	limit, err := parseLimit(r, defaultSyncLimit, maxSyncLimit)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	includeArchived, err := parseBool(r, "include_archived", true)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	resp, err := s.loadSyncChanges(r.Context(), s.store, userID, cursor, limit, includeArchived)
+	if err != nil {
+		if errors.Is(err, store.ErrCursorExpired) {
+			respondResyncRequired(w)
 			return
 		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get changes")
+		return
 	}
 
-	// Get all changes since the timestamp
-	notebooks, err := s.store.GetNotebooksSince(r.Context(), userID, since)
+	s.markDeviceSynced(r.Context())
+	respondJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleSyncPost(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	// Keep the raw body to fingerprint the request for idempotent retries
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+	var req models.SyncRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	cursor, err := decodeSyncCursor(req.Cursor)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "server_error", "failed to get notebooks")
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid 'cursor' value")
 		return
 	}
 
-	notes, err := s.store.GetNotesSince(r.Context(), userID, since)
+	limit, err := parseLimit(r, defaultSyncLimit, maxSyncLimit)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "server_error", "failed to get notes")
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
 		return
 	}
 
-	tags, err := s.store.GetTagsSince(r.Context(), userID, since)
+	includeArchived, err := parseBool(r, "include_archived", true)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "server_error", "failed to get tags")
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLength {
+		respondError(w, http.StatusBadRequest, "invalid_request", "'Idempotency-Key' is too long")
 		return
 	}
+	hash := sha256.Sum256(append([]byte(r.URL.RawQuery+"\n"), body...))
+	requestHash := hex.EncodeToString(hash[:])
 
-	// Load tags for each note
-	for i := range notes {
-		noteTags, err := s.store.GetTagsForNote(r.Context(), notes[i].ID)
+	// The whole batch, the returned changes and the stored idempotent
+	// response are committed together
+	var resp *models.SyncResponse
+	var replay *models.IdempotencyKey
+	err = s.store.WithTx(r.Context(), func(tx store.Store) error {
+		if key != "" {
+			existing, err := tx.ClaimIdempotencyKey(r.Context(), userID, key, requestHash)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				replay = existing
+				return nil
+			}
+		}
+
+		// Tags are applied before notes and notes before images, so items
+		// created offline can refer to each other within one batch
+		outcome := &syncOutcome{}
+		for _, nb := range req.Notebooks {
+			if err := outcome.apply(r.Context(), tx, func(st store.Store) {
+				s.applySyncNotebook(r.Context(), st, userID, nb, outcome)
+			}); err != nil {
+				return err
+			}
+		}
+		for _, tag := range req.Tags {
+			if err := outcome.apply(r.Context(), tx, func(st store.Store) {
+				s.applySyncTag(r.Context(), st, userID, tag, outcome)
+			}); err != nil {
+				return err
+			}
+		}
+		for _, note := range req.Notes {
+			if err := outcome.apply(r.Context(), tx, func(st store.Store) {
+				s.applySyncNote(r.Context(), st, userID, note, outcome)
+			}); err != nil {
+				return err
+			}
+		}
+		for _, img := range req.Images {
+			if err := outcome.apply(r.Context(), tx, func(st store.Store) {
+				s.applySyncImage(r.Context(), st, userID, img, outcome)
+			}); err != nil {
+				return err
+			}
+		}
+
+		// Return everything changed since the client's last cursor,
+		// including the changes just applied
+		var err error
+		resp, err = s.loadSyncChanges(r.Context(), tx, userID, cursor, limit, includeArchived)
 		if err != nil {
-			log.Printf("sync: failed to get tags for note %s: %v", notes[i].ID, err)
-		} else {
-			notes[i].Tags = noteTags
+			return err
+		}
+		resp.HasConflict = len(outcome.conflicts) > 0
+		resp.Results = outcome.results
+		resp.Conflicts = outcome.conflicts
+
+		if key != "" {
+			stored, err := json.Marshal(resp)
+			if err != nil {
+				return err
+			}
+			return tx.SaveIdempotencyResponse(r.Context(), userID, key, http.StatusOK, stored)
+		}
+		return nil
+	})
+	if err != nil {
+		// Nothing was applied; the client resyncs and pushes again
+		if errors.Is(err, store.ErrCursorExpired) {
+			respondResyncRequired(w)
+			return
 		}
+		log.Printf("sync: failed to apply batch: %v", err)
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to apply changes")
+		return
 	}
 
-	if notebooks == nil {
-		notebooks = []models.Notebook{}
+	if replay != nil {
+		if replay.RequestHash != requestHash {
+			respondError(w, http.StatusUnprocessableEntity, "idempotency_key_reused", "'Idempotency-Key' was already used for a different request")
+			return
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		respondJSON(w, replay.StatusCode, replay.ResponseBody)
+		return
 	}
-	if notes == nil {
-		notes = []models.Note{}
+
+	s.markDeviceSynced(r.Context())
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// syncOutcome collects per-item results while a pushed batch is applied
+type syncOutcome struct {
+	results   []models.SyncResult
+	conflicts []models.SyncConflict
+	failures  int
+}
+
+// apply runs fn in a savepoint. If the item fails, only its own writes are
+// rolled back and the rest of the batch carries on.
+func (o *syncOutcome) apply(ctx context.Context, st store.Store, fn func(store.Store)) error {
+	failures := o.failures
+	err := st.WithTx(ctx, func(tx store.Store) error {
+		fn(tx)
+		if o.failures > failures {
+			return errSyncItemFailed
+		}
+		return nil
+	})
+	if errors.Is(err, errSyncItemFailed) {
+		return nil
 	}
-	if tags == nil {
-		tags = []models.Tag{}
+	return err
+}
+
+func (o *syncOutcome) applied(entityType, op string, id uuid.UUID, version *int64) {
+	o.results = append(o.results, models.SyncResult{
+		EntityType: entityType,
+		ID:         id,
+		Operation:  op,
+		Status:     models.SyncStatusApplied,
+		Version:    version,
+	})
+}
+
+func (o *syncOutcome) merged(entityType, op string, id uuid.UUID, version *int64) {
+	o.results = append(o.results, models.SyncResult{
+		EntityType: entityType,
+		ID:         id,
+		Operation:  op,
+		Status:     models.SyncStatusMerged,
+		Version:    version,
+	})
+}
+
+func (o *syncOutcome) failed(entityType, op string, id uuid.UUID, err error) {
+	log.Printf("sync: failed to %s %s %s: %v", op, entityType, id, err)
+	o.failures++
+	o.results = append(o.results, models.SyncResult{
+		EntityType: entityType,
+		ID:         id,
+		Operation:  op,
+		Status:     models.SyncStatusFailed,
+		Reason:     "server_error",
+	})
+}
+
+func (o *syncOutcome) rejected(entityType, op string, id uuid.UUID, reason string) {
+	o.results = append(o.results, models.SyncResult{
+		EntityType: entityType,
+		ID:         id,
+		Operation:  op,
+		Status:     models.SyncStatusRejected,
+		Reason:     reason,
+	})
+	o.conflicts = append(o.conflicts, models.SyncConflict{
+		EntityType: entityType,
+		ID:         id,
+		Reason:     reason,
+	})
+}
+
+func (o *syncOutcome) conflict(op string, c models.SyncConflict) {
+	o.results = append(o.results, models.SyncResult{
+		EntityType: c.EntityType,
+		ID:         c.ID,
+		Operation:  op,
+		Status:     models.SyncStatusConflict,
+		Version:    c.ServerVersion,
+		Reason:     c.Reason,
+	})
+	o.conflicts = append(o.conflicts, c)
+}
+
+// mergeSyncNote reconciles an edit made against an older version of a note
+// with the newer server copy. Changes are merged three ways against the
+// revision the client started from; when they collide, the server copy is
+// kept and the client's edit is saved as a new note next to it.
+func (s *Server) mergeSyncNote(ctx context.Context, st store.Store, existing *models.Note, note models.Note, tagIDs []uuid.UUID, outcome *syncOutcome) {
+	const entity = models.SyncEntityNote
+	const op = models.SyncOpUpdate
+
+	base, err := st.GetNoteRevision(ctx, note.ID, note.Version)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		outcome.failed(entity, op, note.ID, err)
+		return
 	}
 
-	respondJSON(w, http.StatusOK, models.SyncResponse{
-		Notes:      notes,
-		Notebooks:  notebooks,
-		Tags:       tags,
-		ServerTime: time.Now(),
+	// The pushing device hasn't seen the merged note or the conflict copy
+	// yet, so don't attribute them to it
+	ctx = store.WithoutDeviceID(ctx)
+
+	if base != nil {
+		merged, err := mergeNote(base, existing, &note)
+		if err == nil {
+			merged.Version = existing.Version + 1
+			merged.UpdatedAt = time.Now()
+			if err := st.UpdateNote(ctx, merged); err != nil {
+				outcome.failed(entity, op, note.ID, err)
+				return
+			}
+			if err := setSyncNoteTags(ctx, st, note.ID, tagIDs); err != nil {
+				outcome.failed(entity, op, note.ID, err)
+				return
+			}
+			outcome.merged(entity, op, note.ID, &merged.Version)
+			return
+		}
+		if !errors.Is(err, tiptap.ErrConflict) {
+			log.Printf("sync: failed to merge note %s: %v", note.ID, err)
+		}
+	}
+
+	// Save the client's edit as a conflict copy in the same notebook
+	now := time.Now()
+	conflictCopy := note
+	conflictCopy.ID = uuid.New()
+	conflictCopy.NotebookID = existing.NotebookID
+	conflictCopy.Version = 1
+	conflictCopy.CreatedAt = now
+	conflictCopy.UpdatedAt = now
+	if err := st.CreateNote(ctx, &conflictCopy); err != nil {
+		outcome.failed(entity, op, note.ID, err)
+		return
+	}
+	if err := setSyncNoteTags(ctx, st, conflictCopy.ID, tagIDs); err != nil {
+		outcome.failed(entity, op, note.ID, err)
+		return
+	}
+
+	outcome.conflict(op, models.SyncConflict{
+		EntityType:    entity,
+		ID:            note.ID,
+		ClientVersion: &note.Version,
+		ServerVersion: &existing.Version,
+		Server:        existing,
+		CopyID:        &conflictCopy.ID,
+		Reason:        "merge_conflict",
 	})
 }
 
-func (s *Server) handleSyncPost(w http.ResponseWriter, r *http.Request) {
-	userID, ok := GetUserID(r.Context())
+// syncNoteTagIDs checks that the tags pushed with a note exist and belong to
+// the user, returning store.ErrNotFound otherwise. A nil result means the
+// client sent no tags and the note's tags are left as they are; an empty
+// list clears them.
+func syncNoteTagIDs(ctx context.Context, st store.Store, userID uuid.UUID, tags []models.Tag) ([]uuid.UUID, error) {
+	if tags == nil {
+		return nil, nil
+	}
+	tagIDs := make([]uuid.UUID, 0, len(tags))
+	for _, t := range tags {
+		tag, err := st.GetTagByID(ctx, t.ID)
+		if err != nil {
+			return nil, err
+		}
+		if tag.UserID != userID || tag.DeletedAt != nil {
+			return nil, store.ErrNotFound
+		}
+		tagIDs = append(tagIDs, tag.ID)
+	}
+	return tagIDs, nil
+}
+
+func setSyncNoteTags(ctx context.Context, st store.Store, noteID uuid.UUID, tagIDs []uuid.UUID) error {
+	if tagIDs == nil {
+		return nil
+	}
+	return st.SetNoteTags(ctx, noteID, tagIDs)
+}
+
+// mergeNote combines the changes made to a note on the server (ours) and on
+// the client (theirs) since base. Content merges by block; for the other
+// fields the client wins if it changed them. Revisions don't keep whether a
+// note is pinned, starred or archived, so there the client wins wherever it
+// differs from ours.
+func mergeNote(base *models.NoteRevision, ours, theirs *models.Note) (*models.Note, error) {
+	content, err := tiptap.Merge(base.Content, ours.Content, theirs.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := *ours
+	merged.Content = content
+	switch {
+	case tiptap.Equal(content, ours.Content):
+		merged.PlainText = ours.PlainText
+	case tiptap.Equal(content, theirs.Content):
+		merged.PlainText = theirs.PlainText
+	default:
+		merged.PlainText = tiptap.PlainText(content)
+	}
+
+	if theirs.IsTodo != base.IsTodo {
+		merged.IsTodo = theirs.IsTodo
+	}
+	if theirs.IsDone != base.IsDone {
+		merged.IsDone = theirs.IsDone
+	}
+	if !sameTime(theirs.ReminderAt, base.ReminderAt) {
+		merged.ReminderAt = theirs.ReminderAt
+	}
+	merged.IsPinned = theirs.IsPinned
+	merged.IsStarred = theirs.IsStarred
+	if (theirs.ArchivedAt == nil) != (ours.ArchivedAt == nil) {
+		merged.ArchivedAt = theirs.ArchivedAt
+	}
+	return &merged, nil
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// applySyncImage applies a pushed image record. Image files are uploaded
+// through POST /api/images, so sync only acknowledges images that already
+// exist and propagates deletions.
+func (s *Server) applySyncImage(ctx context.Context, st store.Store, userID uuid.UUID, img models.Image, outcome *syncOutcome) {
+	const entity = models.SyncEntityImage
+
+	existing, err := st.GetImageByID(ctx, img.ID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		outcome.failed(entity, syncOperation(false, img.DeletedAt), img.ID, err)
+		return
+	}
+	op := syncOperation(existing != nil, img.DeletedAt)
+
+	// Images belong to whoever owns their note
+	noteID := img.NoteID
+	if existing != nil {
+		noteID = existing.NoteID
+	}
+	note, err := st.GetNoteByID(ctx, noteID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		outcome.failed(entity, op, img.ID, err)
+		return
+	}
+	if note == nil || note.UserID != userID {
+		outcome.rejected(entity, op, img.ID, "not_found")
+		return
+	}
+
+	if existing == nil {
+		if img.DeletedAt != nil {
+			// Uploaded and deleted while offline; nothing to store
+			outcome.applied(entity, op, img.ID, nil)
+			return
+		}
+		outcome.rejected(entity, op, img.ID, "upload_required")
+		return
+	}
+
+	if existing.DeletedAt != nil {
+		if op == models.SyncOpDelete {
+			outcome.applied(entity, op, img.ID, nil)
+			return
+		}
+		outcome.conflict(op, models.SyncConflict{
+			EntityType: entity,
+			ID:         img.ID,
+			Server:     existing,
+			Reason:     "deleted_on_server",
+		})
+		return
+	}
+
+	// Image metadata can't change, so only deletes need applying
+	if op == models.SyncOpDelete {
+		if err := st.DeleteImage(ctx, img.ID); err != nil {
+			outcome.failed(entity, op, img.ID, err)
+			return
+		}
+	}
+	outcome.applied(entity, op, img.ID, nil)
+}
+
+// respondResyncRequired tells a client its cursor is older than the purge
+// window, so it has to discard its cursor and do a full sync
+func respondResyncRequired(w http.ResponseWriter) {
+	respondError(w, http.StatusGone, "resync_required", "cursor is too old; sync again without a cursor")
+}
+
+// markDeviceSynced records a completed sync for the requesting device
+func (s *Server) markDeviceSynced(ctx context.Context) {
+	deviceID, ok := store.DeviceIDFromContext(ctx)
 	if !ok {
-		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
 		return
 	}
+	if err := s.store.MarkDeviceSynced(ctx, deviceID); err != nil {
+		log.Printf("sync: failed to mark device %s synced: %v", deviceID, err)
+	}
+}
+
+// syncOperation classifies a pushed item by whether the server already has it
+// and whether the client marked it deleted
+func syncOperation(exists bool, deletedAt *time.Time) string {
+	switch {
+	case deletedAt != nil:
+		return models.SyncOpDelete
+	case exists:
+		return models.SyncOpUpdate
+	default:
+		return models.SyncOpCreate
+	}
+}
 
-	var req models.SyncRequest
-	if err := decodeJSON(r, &req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+func (s *Server) applySyncNotebook(ctx context.Context, st store.Store, userID uuid.UUID, nb models.Notebook, outcome *syncOutcome) {
+	const entity = models.SyncEntityNotebook
+
+	existing, err := st.GetNotebookByID(ctx, nb.ID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		outcome.failed(entity, syncOperation(false, nb.DeletedAt), nb.ID, err)
 		return
 	}
+	op := syncOperation(existing != nil, nb.DeletedAt)
 
-	hasConflict := false
+	// Notebooks owned by someone else look like they don't exist
+	if nb.UserID != userID || (existing != nil && existing.UserID != userID) {
+		outcome.rejected(entity, op, nb.ID, "not_found")
+		return
+	}
 
-	// Process notebooks
-	for _, nb := range req.Notebooks {
-		if nb.UserID != userID {
-			continue
+	if existing == nil {
+		if nb.DeletedAt != nil {
+			// Created and deleted while offline; nothing to store
+			outcome.applied(entity, op, nb.ID, nil)
+			return
 		}
+		nb.Version = 1
+		if err := st.CreateNotebook(ctx, &nb); err != nil {
+			outcome.failed(entity, op, nb.ID, err)
+			return
+		}
+		outcome.applied(entity, op, nb.ID, &nb.Version)
+		return
+	}
 
-		existing, err := s.store.GetNotebookByID(r.Context(), nb.ID)
-		if err != nil {
-			// New notebook, create it
-			nb.UserID = userID
-			if err := s.store.CreateNotebook(r.Context(), &nb); err != nil {
-				log.Printf("sync: failed to create notebook %s: %v", nb.ID, err)
-			}
-		} else {
-			// Check version/timestamps for conflicts
-			if existing.UpdatedAt.After(nb.UpdatedAt) {
-				hasConflict = true
-			} else if nb.DeletedAt != nil {
-				if err := s.store.DeleteNotebook(r.Context(), nb.ID); err != nil {
-					log.Printf("sync: failed to delete notebook %s: %v", nb.ID, err)
-				}
-			} else {
-				if err := s.store.UpdateNotebook(r.Context(), &nb); err != nil {
-					log.Printf("sync: failed to update notebook %s: %v", nb.ID, err)
+	// Check version for conflicts
+	if existing.Version > nb.Version {
+		outcome.conflict(op, models.SyncConflict{
+			EntityType:    entity,
+			ID:            nb.ID,
+			ClientVersion: &nb.Version,
+			ServerVersion: &existing.Version,
+			Server:        existing,
+			Reason:        "stale_version",
+		})
+		return
+	}
+
+	if existing.DeletedAt != nil {
+		if op == models.SyncOpDelete {
+			outcome.applied(entity, op, nb.ID, nil)
+			return
+		}
+		outcome.conflict(op, models.SyncConflict{
+			EntityType:    entity,
+			ID:            nb.ID,
+			ClientVersion: &nb.Version,
+			ServerVersion: &existing.Version,
+			Server:        existing,
+			Reason:        "deleted_on_server",
+		})
+		return
+	}
+
+	if op == models.SyncOpDelete {
+		err = st.DeleteNotebook(ctx, nb.ID)
+	} else {
+		nb.Version = existing.Version + 1
+		err = st.UpdateNotebook(ctx, &nb)
+	}
+	if err != nil {
+		outcome.failed(entity, op, nb.ID, err)
+		return
+	}
+	if op == models.SyncOpDelete {
+		outcome.applied(entity, op, nb.ID, &existing.Version)
+		return
+	}
+	outcome.applied(entity, op, nb.ID, &nb.Version)
+}
+
+func (s *Server) applySyncNote(ctx context.Context, st store.Store, userID uuid.UUID, pushed models.SyncNote, outcome *syncOutcome) {
+	const entity = models.SyncEntityNote
+	note := pushed.Note
+
+	existing, err := st.GetNoteByID(ctx, note.ID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		outcome.failed(entity, syncOperation(false, note.DeletedAt), note.ID, err)
+		return
+	}
+	op := syncOperation(existing != nil, note.DeletedAt)
+
+	// Notes owned by someone else look like they don't exist
+	if note.UserID != userID || (existing != nil && existing.UserID != userID) {
+		outcome.rejected(entity, op, note.ID, "not_found")
+		return
+	}
+
+	tagIDs, err := syncNoteTagIDs(ctx, st, userID, note.Tags)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			outcome.rejected(entity, op, note.ID, "tag_not_found")
+			return
+		}
+		outcome.failed(entity, op, note.ID, err)
+		return
+	}
+
+	if existing == nil {
+		if note.DeletedAt != nil {
+			// Created and deleted while offline; nothing to store
+			outcome.applied(entity, op, note.ID, nil)
+			return
+		}
+
+		notebook, err := st.GetNotebookByID(ctx, note.NotebookID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			outcome.failed(entity, op, note.ID, err)
+			return
+		}
+		if notebook == nil || notebook.UserID != userID || notebook.DeletedAt != nil {
+			outcome.rejected(entity, op, note.ID, "notebook_not_found")
+			return
+		}
+
+		if note.ParentNoteID != nil {
+			rootID, err := threadRoot(ctx, st, note.NotebookID, *note.ParentNoteID, true)
+			if err != nil {
+				if errors.Is(err, store.ErrNotFound) {
+					outcome.rejected(entity, op, note.ID, "parent_not_found")
+					return
 				}
+				outcome.failed(entity, op, note.ID, err)
+				return
 			}
+			note.ParentNoteID = &rootID
 		}
+
+		if err := st.CreateNote(ctx, &note); err != nil {
+			outcome.failed(entity, op, note.ID, err)
+			return
+		}
+		if err := setSyncNoteTags(ctx, st, note.ID, tagIDs); err != nil {
+			outcome.failed(entity, op, note.ID, err)
+			return
+		}
+		outcome.applied(entity, op, note.ID, &note.Version)
+		return
 	}
 
-	// Process notes
-	for _, note := range req.Notes {
-		if note.UserID != userID {
-			continue
+	// A note stays in the thread it was created in
+	note.ParentNoteID = existing.ParentNoteID
+
+	// Fields the client left out keep the server's values
+	if !pushed.HasPinned {
+		note.IsPinned = existing.IsPinned
+	}
+	if !pushed.HasStarred {
+		note.IsStarred = existing.IsStarred
+	}
+	if !pushed.HasArchived {
+		note.ArchivedAt = existing.ArchivedAt
+	}
+
+	// Check version for conflicts
+	if existing.Version > note.Version {
+		if op == models.SyncOpUpdate && existing.DeletedAt == nil {
+			s.mergeSyncNote(ctx, st, existing, note, tagIDs, outcome)
+			return
+		}
+		outcome.conflict(op, models.SyncConflict{
+			EntityType:    entity,
+			ID:            note.ID,
+			ClientVersion: &note.Version,
+			ServerVersion: &existing.Version,
+			Server:        existing,
+			Reason:        "stale_version",
+		})
+		return
+	}
+
+	if existing.DeletedAt != nil {
+		if op == models.SyncOpDelete {
+			outcome.applied(entity, op, note.ID, &existing.Version)
+			return
+		}
+		outcome.conflict(op, models.SyncConflict{
+			EntityType:    entity,
+			ID:            note.ID,
+			ClientVersion: &note.Version,
+			ServerVersion: &existing.Version,
+			Server:        existing,
+			Reason:        "deleted_on_server",
+		})
+		return
+	}
+
+	if op == models.SyncOpDelete {
+		if err := st.DeleteNote(ctx, note.ID); err != nil {
+			outcome.failed(entity, op, note.ID, err)
+			return
+		}
+		outcome.applied(entity, op, note.ID, &existing.Version)
+		return
+	}
+
+	note.Version = existing.Version + 1
+	if err := st.UpdateNote(ctx, &note); err != nil {
+		outcome.failed(entity, op, note.ID, err)
+		return
+	}
+	if err := setSyncNoteTags(ctx, st, note.ID, tagIDs); err != nil {
+		outcome.failed(entity, op, note.ID, err)
+		return
+	}
+	outcome.applied(entity, op, note.ID, &note.Version)
+}
+
+func (s *Server) applySyncTag(ctx context.Context, st store.Store, userID uuid.UUID, tag models.Tag, outcome *syncOutcome) {
+	const entity = models.SyncEntityTag
+
+	existing, err := st.GetTagByID(ctx, tag.ID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		outcome.failed(entity, syncOperation(false, tag.DeletedAt), tag.ID, err)
+		return
+	}
+	op := syncOperation(existing != nil, tag.DeletedAt)
+
+	// Tags owned by someone else look like they don't exist
+	if tag.UserID != userID || (existing != nil && existing.UserID != userID) {
+		outcome.rejected(entity, op, tag.ID, "not_found")
+		return
+	}
+
+	if existing == nil {
+		if tag.DeletedAt != nil {
+			// Created and deleted while offline; nothing to store
+			outcome.applied(entity, op, tag.ID, nil)
+			return
+		}
+		tag.Version = 1
+		if err := st.CreateTag(ctx, &tag); err != nil {
+			outcome.failed(entity, op, tag.ID, err)
+			return
+		}
+		outcome.applied(entity, op, tag.ID, &tag.Version)
+		return
+	}
+
+	// Check version for conflicts
+	if existing.Version > tag.Version {
+		outcome.conflict(op, models.SyncConflict{
+			EntityType:    entity,
+			ID:            tag.ID,
+			ClientVersion: &tag.Version,
+			ServerVersion: &existing.Version,
+			Server:        existing,
+			Reason:        "stale_version",
+		})
+		return
+	}
+
+	if existing.DeletedAt != nil {
+		if op == models.SyncOpDelete {
+			outcome.applied(entity, op, tag.ID, nil)
+			return
 		}
+		outcome.conflict(op, models.SyncConflict{
+			EntityType:    entity,
+			ID:            tag.ID,
+			ClientVersion: &tag.Version,
+			ServerVersion: &existing.Version,
+			Server:        existing,
+			Reason:        "deleted_on_server",
+		})
+		return
+	}
+
+	if op == models.SyncOpDelete {
+		err = st.DeleteTag(ctx, tag.ID)
+	} else {
+		tag.Version = existing.Version + 1
+		err = st.UpdateTag(ctx, &tag)
+	}
+	if err != nil {
+		outcome.failed(entity, op, tag.ID, err)
+		return
+	}
+	if op == models.SyncOpDelete {
+		outcome.applied(entity, op, tag.ID, &existing.Version)
+		return
+	}
+	outcome.applied(entity, op, tag.ID, &tag.Version)
+}
+
+// loadSyncChanges reads one page of the change feed after cursor and builds
+// the sync response for it. Without includeArchived, archived notes are
+// listed by ID only, so devices that don't keep them know to drop them.
+func (s *Server) loadSyncChanges(ctx context.Context, st store.Store, userID uuid.UUID, cursor int64, limit int, includeArchived bool) (*models.SyncResponse, error) {
+	// A device already has the changes it made itself
+	var excludeDeviceID *uuid.UUID
+	if deviceID, ok := store.DeviceIDFromContext(ctx); ok {
+		excludeDeviceID = &deviceID
+	}
+
+	changes, err := st.GetChangesSince(ctx, userID, cursor, limit, excludeDeviceID)
+	if err != nil {
+		return nil, err
+	}
 
-		existing, err := s.store.GetNoteByID(r.Context(), note.ID)
+	resp := &models.SyncResponse{
+		Notes:      changes.Notes,
+		Notebooks:  changes.Notebooks,
+		Tags:       changes.Tags,
+		Images:     changes.Images,
+		Cursor:     encodeSyncCursor(changes.Cursor),
+		HasMore:    changes.HasMore,
+		ServerTime: time.Now(),
+	}
+
+	// Load tags for all notes in the page at once
+	if len(resp.Notes) > 0 {
+		noteIDs := make([]uuid.UUID, len(resp.Notes))
+		for i := range resp.Notes {
+			noteIDs[i] = resp.Notes[i].ID
+		}
+		tagsByNote, err := st.GetTagsForNotes(ctx, noteIDs)
 		if err != nil {
-			// New note, create it
-			note.UserID = userID
-			if err := s.store.CreateNote(r.Context(), &note); err != nil {
-				log.Printf("sync: failed to create note %s: %v", note.ID, err)
-			}
+			log.Printf("sync: failed to get tags for notes: %v", err)
 		} else {
-			// Check version for conflicts (last-write-wins)
-			if existing.Version > note.Version {
-				hasConflict = true
-			} else if note.DeletedAt != nil {
-				if err := s.store.DeleteNote(r.Context(), note.ID); err != nil {
-					log.Printf("sync: failed to delete note %s: %v", note.ID, err)
-				}
-			} else {
-				note.Version = existing.Version + 1
-				if err := s.store.UpdateNote(r.Context(), &note); err != nil {
-					log.Printf("sync: failed to update note %s: %v", note.ID, err)
-				}
+			for i := range resp.Notes {
+				resp.Notes[i].Tags = tagsByNote[resp.Notes[i].ID]
 			}
 		}
 	}
 
-	// Process tags
-	for _, tag := range req.Tags {
-		if tag.UserID != userID {
-			continue
+	if !includeArchived {
+		notes := resp.Notes[:0]
+		for _, note := range resp.Notes {
+			if note.ArchivedAt != nil {
+				resp.Archived = append(resp.Archived, note.ID)
+				continue
+			}
+			notes = append(notes, note)
 		}
+		resp.Notes = notes
+	}
 
-		existing, err := s.store.GetTagByID(r.Context(), tag.ID)
+	// Signed URLs use the image ID, not the storage key
+	for i := range resp.Images {
+		if resp.Images[i].DeletedAt != nil {
+			continue
+		}
+		signedURL, err := s.blobStore.GetSignedURL(ctx, resp.Images[i].ID.String(), s.config.StorageURLExpiry)
 		if err != nil {
-			// New tag, create it
-			tag.UserID = userID
-			if err := s.store.CreateTag(r.Context(), &tag); err != nil {
-				log.Printf("sync: failed to create tag %s: %v", tag.ID, err)
-			}
-		} else {
-			if existing.UpdatedAt.After(tag.UpdatedAt) {
-				hasConflict = true
-			} else if tag.DeletedAt != nil {
-				if err := s.store.DeleteTag(r.Context(), tag.ID); err != nil {
-					log.Printf("sync: failed to delete tag %s: %v", tag.ID, err)
-				}
-			} else {
-				if err := s.store.UpdateTag(r.Context(), &tag); err != nil {
-					log.Printf("sync: failed to update tag %s: %v", tag.ID, err)
-				}
-			}
+			log.Printf("sync: failed to sign URL for image %s: %v", resp.Images[i].ID, err)
+			continue
 		}
+		resp.Images[i].URL = signedURL
 	}
 
-	// Return current state
-	notebooks, err := s.store.GetNotebooksByUserID(r.Context(), userID)
-	if err != nil {
-		log.Printf("sync: failed to get notebooks for response: %v", err)
+	if resp.Notebooks == nil {
+		resp.Notebooks = []models.Notebook{}
 	}
-	notes, err := s.store.GetNotesByUserID(r.Context(), userID, nil)
-	if err != nil {
-		log.Printf("sync: failed to get notes for response: %v", err)
+	if resp.Notes == nil {
+		resp.Notes = []models.Note{}
 	}
-	tags, err := s.store.GetTagsByUserID(r.Context(), userID)
-	if err != nil {
-		log.Printf("sync: failed to get tags for response: %v", err)
+	if resp.Tags == nil {
+		resp.Tags = []models.Tag{}
+	}
+	if resp.Images == nil {
+		resp.Images = []models.Image{}
 	}
 
-	if notebooks == nil {
-		notebooks = []models.Notebook{}
+	return resp, nil
+}
+
+// syncCursorPrefix versions the cursor format so it can change without
+// confusing older clients
+const syncCursorPrefix = "v1:"
+
+// encodeSyncCursor turns a change sequence into the opaque cursor handed to clients
+func encodeSyncCursor(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(syncCursorPrefix + strconv.FormatInt(seq, 10)))
+}
+
+// decodeSyncCursor parses a cursor produced by encodeSyncCursor. An empty
+// cursor decodes to zero, which selects every change.
+func decodeSyncCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
 	}
-	if notes == nil {
-		notes = []models.Note{}
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("malformed cursor")
 	}
-	if tags == nil {
-		tags = []models.Tag{}
+
+	value, ok := strings.CutPrefix(string(raw), syncCursorPrefix)
+	if !ok {
+		return 0, errors.New("unsupported cursor version")
 	}
 
-	respondJSON(w, http.StatusOK, models.SyncResponse{
-		Notes:       notes,
-		Notebooks:   notebooks,
-		Tags:        tags,
-		ServerTime:  time.Now(),
-		HasConflict: hasConflict,
-	})
+	seq, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, errors.New("malformed cursor")
+	}
+	return seq, nil
 }
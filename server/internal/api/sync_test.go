@@ -0,0 +1,613 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/api"
+	"github.com/noted/server/internal/models"
+)
+
+func syncGet(t *testing.T, srv *api.Server, token, cursor string) models.SyncResponse {
+	t.Helper()
+	return syncGetPath(t, srv, token, "/api/sync?cursor="+cursor)
+}
+
+func syncGetPath(t *testing.T, srv *api.Server, token, path string) models.SyncResponse {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	var resp models.SyncResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode sync response: %v", err)
+	}
+	return resp
+}
+
+func TestSyncCursor(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+
+	// Create a note
+	body, _ := json.Marshal(map[string]interface{}{
+		"content":    map[string]interface{}{"type": "doc"},
+		"plain_text": "First",
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/notebooks/"+notebookID+"/notes", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	var note models.Note
+	json.NewDecoder(rec.Body).Decode(&note)
+
+	// Full sync returns everything and a cursor
+	full := syncGet(t, srv, token, "")
+	if full.Cursor == "" {
+		t.Fatal("expected a cursor in full sync response")
+	}
+	if len(full.Notes) != 1 {
+		t.Errorf("got %d notes, want 1", len(full.Notes))
+	}
+	if len(full.Notebooks) != 2 {
+		t.Errorf("got %d notebooks, want 2 (default + created)", len(full.Notebooks))
+	}
+
+	// Nothing has changed since the cursor
+	empty := syncGet(t, srv, token, full.Cursor)
+	if len(empty.Notes) != 0 || len(empty.Notebooks) != 0 || len(empty.Tags) != 0 {
+		t.Errorf("expected no changes, got %d notes, %d notebooks, %d tags",
+			len(empty.Notes), len(empty.Notebooks), len(empty.Tags))
+	}
+	if empty.Cursor != full.Cursor {
+		t.Errorf("cursor moved without changes: %s -> %s", full.Cursor, empty.Cursor)
+	}
+
+	// An update shows up after the cursor
+	updateBody, _ := json.Marshal(map[string]interface{}{"plain_text": "Second"})
+	req = httptest.NewRequest(http.MethodPut, "/api/notes/"+note.ID.String(), bytes.NewReader(updateBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	delta := syncGet(t, srv, token, full.Cursor)
+	if len(delta.Notes) != 1 || delta.Notes[0].PlainText != "Second" {
+		t.Errorf("expected the updated note after cursor, got %+v", delta.Notes)
+	}
+	if delta.Cursor == full.Cursor {
+		t.Error("expected cursor to advance after a change")
+	}
+}
+
+func TestSyncInvalidCursor(t *testing.T) {
+	srv, token, _ := setupTestServerWithNotebook(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/sync?cursor=not-a-cursor", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSyncPagination(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+
+	for _, text := range []string{"one", "two", "three", "four", "five"} {
+		body, _ := json.Marshal(map[string]interface{}{
+			"content":    map[string]interface{}{"type": "doc"},
+			"plain_text": text,
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/notebooks/"+notebookID+"/notes", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+	}
+
+	// 2 notebooks + 5 notes, fetched 3 at a time
+	cursor := ""
+	seen := 0
+	pages := 0
+	for {
+		page := syncGetPath(t, srv, token, "/api/sync?limit=3&cursor="+cursor)
+		pages++
+		count := len(page.Notes) + len(page.Notebooks) + len(page.Tags)
+		if count > 3 {
+			t.Fatalf("page %d has %d items, want at most 3", pages, count)
+		}
+		seen += count
+		cursor = page.Cursor
+		if !page.HasMore {
+			break
+		}
+		if pages > 10 {
+			t.Fatal("pagination did not terminate")
+		}
+	}
+
+	if seen != 7 {
+		t.Errorf("saw %d changes across pages, want 7", seen)
+	}
+	if pages != 3 {
+		t.Errorf("got %d pages, want 3", pages)
+	}
+}
+
+func TestSyncPostReturnsDelta(t *testing.T) {
+	srv, token, _ := setupTestServerWithNotebook(t)
+
+	full := syncGet(t, srv, token, "")
+
+	// Push with the latest cursor; only the pushed change should come back
+	nb := full.Notebooks[0]
+	nb.Title = "Renamed"
+	nb.UpdatedAt = nb.UpdatedAt.Add(time.Second)
+	body, _ := json.Marshal(models.SyncRequest{
+		Cursor:    full.Cursor,
+		Notebooks: []models.Notebook{nb},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/sync", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	var resp models.SyncResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Notebooks) != 1 || resp.Notebooks[0].Title != "Renamed" {
+		t.Errorf("expected only the renamed notebook in the delta, got %+v", resp.Notebooks)
+	}
+	if len(resp.Notes) != 0 {
+		t.Errorf("expected no notes in the delta, got %d", len(resp.Notes))
+	}
+}
+
+func TestSyncPostReportsConflicts(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"content":    map[string]interface{}{"type": "doc"},
+		"plain_text": "Original",
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/notebooks/"+notebookID+"/notes", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	var note models.Note
+	json.NewDecoder(rec.Body).Decode(&note)
+
+	// Bump the server copy to version 2
+	updateBody, _ := json.Marshal(map[string]interface{}{"plain_text": "Server edit"})
+	req = httptest.NewRequest(http.MethodPut, "/api/notes/"+note.ID.String(), bytes.NewReader(updateBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	srv.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Push an edit based on version 0, which has no revision to merge
+	// against, plus a brand new tag
+	stale := note
+	stale.Version = 0
+	stale.PlainText = "Offline edit"
+	now := time.Now()
+	newTag := models.Tag{ID: uuid.New(), UserID: note.UserID, Name: "offline", CreatedAt: now, UpdatedAt: now}
+	pushBody, _ := json.Marshal(models.SyncRequest{
+		Notes: []models.SyncNote{{Note: stale}},
+		Tags:  []models.Tag{newTag},
+	})
+	req = httptest.NewRequest(http.MethodPost, "/api/sync", bytes.NewReader(pushBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	var resp models.SyncResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+
+	if !resp.HasConflict || len(resp.Conflicts) != 1 {
+		t.Fatalf("expected one conflict, got %+v", resp.Conflicts)
+	}
+	conflict := resp.Conflicts[0]
+	if conflict.ID != note.ID || conflict.Reason != "merge_conflict" {
+		t.Errorf("unexpected conflict %+v", conflict)
+	}
+	if conflict.CopyID == nil {
+		t.Error("expected the offline edit to be saved as a conflict copy")
+	}
+	if conflict.ServerVersion == nil || *conflict.ServerVersion != 2 {
+		t.Errorf("expected server version 2, got %v", conflict.ServerVersion)
+	}
+
+	statuses := map[uuid.UUID]string{}
+	for _, result := range resp.Results {
+		statuses[result.ID] = result.Status
+	}
+	if statuses[note.ID] != models.SyncStatusConflict {
+		t.Errorf("got note status %q, want %q", statuses[note.ID], models.SyncStatusConflict)
+	}
+	if statuses[newTag.ID] != models.SyncStatusApplied {
+		t.Errorf("got tag status %q, want %q", statuses[newTag.ID], models.SyncStatusApplied)
+	}
+}
+
+func tiptapDoc(paragraphs ...string) json.RawMessage {
+	content := make([]map[string]interface{}, len(paragraphs))
+	for i, text := range paragraphs {
+		content[i] = map[string]interface{}{
+			"type":    "paragraph",
+			"content": []map[string]interface{}{{"type": "text", "text": text}},
+		}
+	}
+	raw, _ := json.Marshal(map[string]interface{}{"type": "doc", "content": content})
+	return raw
+}
+
+func pushStaleNoteEdit(t *testing.T, serverContent, clientContent json.RawMessage) (models.Note, models.SyncResponse) {
+	t.Helper()
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"content":    tiptapDoc("first", "second"),
+		"plain_text": "first\n\nsecond",
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/notebooks/"+notebookID+"/notes", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	var note models.Note
+	json.NewDecoder(rec.Body).Decode(&note)
+
+	// Another device edits the note, moving it to version 2
+	updateBody, _ := json.Marshal(map[string]interface{}{"content": serverContent})
+	req = httptest.NewRequest(http.MethodPut, "/api/notes/"+note.ID.String(), bytes.NewReader(updateBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	srv.ServeHTTP(httptest.NewRecorder(), req)
+
+	// This device pushes its own edit of version 1
+	stale := note
+	stale.Content = clientContent
+	pushBody, _ := json.Marshal(models.SyncRequest{Notes: []models.SyncNote{{Note: stale}}})
+	req = httptest.NewRequest(http.MethodPost, "/api/sync", bytes.NewReader(pushBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	var resp models.SyncResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return note, resp
+}
+
+func TestSyncPostMergesNoteEdits(t *testing.T) {
+	note, resp := pushStaleNoteEdit(t, tiptapDoc("first (server)", "second"), tiptapDoc("first", "second (client)"))
+
+	if resp.HasConflict {
+		t.Fatalf("expected a clean merge, got conflicts %+v", resp.Conflicts)
+	}
+	if len(resp.Results) != 1 || resp.Results[0].Status != models.SyncStatusMerged {
+		t.Fatalf("expected a merged result, got %+v", resp.Results)
+	}
+	if v := resp.Results[0].Version; v == nil || *v != 3 {
+		t.Errorf("expected merged version 3, got %v", v)
+	}
+
+	var merged *models.Note
+	for i := range resp.Notes {
+		if resp.Notes[i].ID == note.ID {
+			merged = &resp.Notes[i]
+		}
+	}
+	if merged == nil {
+		t.Fatal("expected the merged note in the delta")
+	}
+	if merged.PlainText != "first (server)\n\nsecond (client)" {
+		t.Errorf("got merged text %q", merged.PlainText)
+	}
+}
+
+func TestSyncPostCreatesConflictCopy(t *testing.T) {
+	note, resp := pushStaleNoteEdit(t, tiptapDoc("first", "server"), tiptapDoc("first", "client"))
+
+	if len(resp.Conflicts) != 1 {
+		t.Fatalf("expected one conflict, got %+v", resp.Conflicts)
+	}
+	conflict := resp.Conflicts[0]
+	if conflict.Reason != "merge_conflict" || conflict.CopyID == nil {
+		t.Fatalf("unexpected conflict %+v", conflict)
+	}
+
+	notes := map[uuid.UUID]models.Note{}
+	for _, n := range resp.Notes {
+		notes[n.ID] = n
+	}
+	if notes[note.ID].Version != 2 {
+		t.Errorf("expected the server copy to stay at version 2, got %d", notes[note.ID].Version)
+	}
+	conflictCopy, ok := notes[*conflict.CopyID]
+	if !ok {
+		t.Fatal("expected the conflict copy in the delta")
+	}
+	if conflictCopy.NotebookID != note.NotebookID {
+		t.Errorf("conflict copy is in notebook %s, want %s", conflictCopy.NotebookID, note.NotebookID)
+	}
+}
+
+func TestSyncPostIdempotencyKey(t *testing.T) {
+	srv, token, _ := setupTestServerWithNotebook(t)
+
+	me := syncGet(t, srv, token, "")
+	now := time.Now()
+	tag := models.Tag{ID: uuid.New(), UserID: me.Notebooks[0].UserID, Name: "retried", CreatedAt: now, UpdatedAt: now}
+	body, _ := json.Marshal(models.SyncRequest{Tags: []models.Tag{tag}})
+
+	push := func(body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/sync", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Idempotency-Key", "batch-1")
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := push(body)
+	if first.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", first.Code, http.StatusOK, first.Body.String())
+	}
+
+	// A retry of the same batch replays the stored response
+	retry := push(body)
+	if retry.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", retry.Code, http.StatusOK, retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("expected the retry to be marked as replayed")
+	}
+	var firstResp, retryResp models.SyncResponse
+	json.NewDecoder(first.Body).Decode(&firstResp)
+	json.NewDecoder(retry.Body).Decode(&retryResp)
+	if firstResp.Cursor != retryResp.Cursor || len(retryResp.Results) != 1 {
+		t.Errorf("replayed response differs: %+v vs %+v", firstResp, retryResp)
+	}
+
+	// Reusing the key for a different batch is an error
+	tag.Name = "different"
+	otherBody, _ := json.Marshal(models.SyncRequest{Tags: []models.Tag{tag}})
+	if rec := push(otherBody); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestSyncPostNoteTags(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+
+	full := syncGet(t, srv, token, "")
+	userID := full.Notebooks[0].UserID
+	now := time.Now()
+
+	// Tag a note created offline with a tag also created offline
+	tag := models.Tag{ID: uuid.New(), UserID: userID, Name: "offline", CreatedAt: now, UpdatedAt: now}
+	note := models.Note{
+		ID:         uuid.New(),
+		NotebookID: uuid.MustParse(notebookID),
+		UserID:     userID,
+		Content:    tiptapDoc("tagged"),
+		PlainText:  "tagged",
+		Version:    1,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Tags:       []models.Tag{{ID: tag.ID}},
+	}
+	body, _ := json.Marshal(models.SyncRequest{
+		Cursor: full.Cursor,
+		Notes:  []models.SyncNote{{Note: note}},
+		Tags:   []models.Tag{tag},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/sync", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	var resp models.SyncResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.HasConflict {
+		t.Fatalf("unexpected conflicts %+v", resp.Conflicts)
+	}
+	if len(resp.Notes) != 1 || len(resp.Notes[0].Tags) != 1 || resp.Notes[0].Tags[0].ID != tag.ID {
+		t.Errorf("expected the note with its tag in the delta, got %+v", resp.Notes)
+	}
+}
+
+func TestSyncArchivedNotes(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	note := createTestNote(t, srv, token, notebookID)
+
+	rec := authedRequest(srv, token, http.MethodPut, "/api/notes/"+note.ID.String(), map[string]interface{}{"archived": true})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("failed to archive note: %d %s", rec.Code, rec.Body.String())
+	}
+
+	resp := syncGet(t, srv, token, "")
+	if len(resp.Notes) != 1 || resp.Notes[0].ArchivedAt == nil || resp.Notes[0].PlainText != note.PlainText {
+		t.Errorf("expected the archived note in full, got %+v", resp.Notes)
+	}
+
+	// Devices that don't keep archived notes only get the ID to drop
+	resp = syncGetPath(t, srv, token, "/api/sync?include_archived=false")
+	if len(resp.Notes) != 0 || len(resp.Archived) != 1 || resp.Archived[0] != note.ID {
+		t.Errorf("expected only the archived note's ID, got notes %+v and archived %v", resp.Notes, resp.Archived)
+	}
+}
+
+func TestSyncPushKeepsUnsentNoteFlags(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	note := createTestNote(t, srv, token, notebookID)
+
+	rec := authedRequest(srv, token, http.MethodPut, "/api/notes/"+note.ID.String(), map[string]interface{}{
+		"is_pinned":  true,
+		"is_starred": true,
+		"archived":   true,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("failed to update note: %d %s", rec.Code, rec.Body.String())
+	}
+	json.NewDecoder(rec.Body).Decode(&note)
+
+	// A client that doesn't know about the flags pushes an edit without them
+	rec = authedRequest(srv, token, http.MethodPost, "/api/sync", map[string]interface{}{
+		"notes": []map[string]interface{}{{
+			"id":          note.ID,
+			"notebook_id": note.NotebookID,
+			"user_id":     note.UserID,
+			"content":     tiptapDoc("edited"),
+			"plain_text":  "edited",
+			"version":     note.Version,
+			"created_at":  note.CreatedAt,
+			"updated_at":  time.Now(),
+		}},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String(), nil)
+	var got models.Note
+	json.NewDecoder(rec.Body).Decode(&got)
+	if got.PlainText != "edited" || !got.IsPinned || !got.IsStarred || got.ArchivedAt == nil {
+		t.Errorf("expected the edit to keep the note pinned, starred and archived, got %+v", got)
+	}
+
+	// Sending them still changes them
+	got.IsPinned = false
+	got.ArchivedAt = nil
+	rec = authedRequest(srv, token, http.MethodPost, "/api/sync", models.SyncRequest{Notes: []models.SyncNote{{Note: got}}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String(), nil)
+	json.NewDecoder(rec.Body).Decode(&got)
+	if got.IsPinned || !got.IsStarred || got.ArchivedAt != nil {
+		t.Errorf("expected the note unpinned and unarchived, got %+v", got)
+	}
+}
+
+func TestSyncPostMergeKeepsNoteFlags(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	note := createTestNote(t, srv, token, notebookID)
+
+	// Another device edits the note, moving it to version 2
+	rec := authedRequest(srv, token, http.MethodPut, "/api/notes/"+note.ID.String(), map[string]interface{}{"content": tiptapDoc("server")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("failed to update note: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// This device pins, stars and archives its copy of version 1
+	now := time.Now()
+	stale := note
+	stale.IsPinned = true
+	stale.IsStarred = true
+	stale.ArchivedAt = &now
+	rec = authedRequest(srv, token, http.MethodPost, "/api/sync", models.SyncRequest{Notes: []models.SyncNote{{Note: stale}}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var resp models.SyncResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Results) != 1 || resp.Results[0].Status != models.SyncStatusMerged {
+		t.Fatalf("expected a merged result, got %+v", resp.Results)
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String(), nil)
+	var got models.Note
+	json.NewDecoder(rec.Body).Decode(&got)
+	if !got.IsPinned || !got.IsStarred || got.ArchivedAt == nil {
+		t.Errorf("expected the merge to keep the client's flags, got %+v", got)
+	}
+}
+
+func TestSyncPushStaleNotebookAndTag(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+
+	rec := authedRequest(srv, token, http.MethodPost, "/api/tags", map[string]string{"name": "work"})
+	var tag models.Tag
+	json.NewDecoder(rec.Body).Decode(&tag)
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notebooks/"+notebookID, nil)
+	var nb models.Notebook
+	json.NewDecoder(rec.Body).Decode(&nb)
+
+	// Another client renames both, moving them to version 2
+	authedRequest(srv, token, http.MethodPut, "/api/notebooks/"+notebookID, map[string]string{"title": "Renamed"})
+	authedRequest(srv, token, http.MethodPut, "/api/tags/"+tag.ID.String(), map[string]string{"name": "office"})
+
+	// A push of version 1 loses even with a later clock
+	nb.Title = "Stale"
+	nb.UpdatedAt = time.Now().Add(time.Hour)
+	tag.Name = "stale"
+	tag.UpdatedAt = time.Now().Add(time.Hour)
+	rec = authedRequest(srv, token, http.MethodPost, "/api/sync", models.SyncRequest{
+		Notebooks: []models.Notebook{nb},
+		Tags:      []models.Tag{tag},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var resp models.SyncResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Conflicts) != 2 {
+		t.Fatalf("expected two conflicts, got %+v", resp.Conflicts)
+	}
+	for _, conflict := range resp.Conflicts {
+		if conflict.Reason != "stale_version" || conflict.ClientVersion == nil || *conflict.ClientVersion != 1 ||
+			conflict.ServerVersion == nil || *conflict.ServerVersion != 2 {
+			t.Errorf("unexpected conflict %+v", conflict)
+		}
+	}
+
+	// Pushing the current version applies
+	nb.Version = 2
+	rec = authedRequest(srv, token, http.MethodPost, "/api/sync", models.SyncRequest{Notebooks: []models.Notebook{nb}})
+	var applied models.SyncResponse
+	json.NewDecoder(rec.Body).Decode(&applied)
+	if len(applied.Results) != 1 || applied.Results[0].Status != models.SyncStatusApplied ||
+		applied.Results[0].Version == nil || *applied.Results[0].Version != 3 {
+		t.Errorf("expected the notebook to be applied at version 3, got %+v", applied.Results)
+	}
+}
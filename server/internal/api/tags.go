@@ -58,6 +58,7 @@ func (s *Server) handleCreateTag(w http.ResponseWriter, r *http.Request) {
 		UserID:    userID,
 		Name:      req.Name,
 		Color:     req.Color,
+		Version:   1,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
@@ -67,6 +68,7 @@ func (s *Server) handleCreateTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", etag(tag.Version))
 	respondJSON(w, http.StatusCreated, tag)
 }
 
@@ -99,6 +101,7 @@ func (s *Server) handleGetTag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", etag(tag.Version))
 	respondJSON(w, http.StatusOK, tag)
 }
 
@@ -132,27 +135,49 @@ func (s *Server) handleUpdateTag(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Name  string `json:"name"`
-		Color string `json:"color,omitempty"`
+		Name    string `json:"name"`
+		Color   string `json:"color,omitempty"`
+		Version *int64 `json:"version,omitempty"`
 	}
 	if err := decodeJSON(r, &req); err != nil {
 		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
 		return
 	}
 
+	expected, err := expectedVersion(r, req.Version)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if expected != nil && *expected != tag.Version {
+		respondVersionConflict(w, tag.Version, tag)
+		return
+	}
+
 	if req.Name != "" {
 		tag.Name = req.Name
 	}
 	if req.Color != "" {
 		tag.Color = req.Color
 	}
+	tag.Version++
 	tag.UpdatedAt = time.Now()
 
 	if err := s.store.UpdateTag(r.Context(), tag); err != nil {
+		if errors.Is(err, store.ErrVersionConflict) {
+			current, err := s.store.GetTagByID(r.Context(), id)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, "server_error", "failed to get tag")
+				return
+			}
+			respondVersionConflict(w, current.Version, current)
+			return
+		}
 		respondError(w, http.StatusInternalServerError, "server_error", "failed to update tag")
 		return
 	}
 
+	w.Header().Set("ETag", etag(tag.Version))
 	respondJSON(w, http.StatusOK, tag)
 }
 
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/store"
+)
+
+// handleGetNoteThread returns the thread a note starts or replies to. The
+// thread outlives its first note, which is then shown as a tombstone.
+func (s *Server) handleGetNoteThread(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid note ID")
+		return
+	}
+
+	note, err := s.store.GetNoteByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "note not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get note")
+		return
+	}
+
+	if note.UserID != userID {
+		respondError(w, http.StatusForbidden, "forbidden", "you don't have access to this note")
+		return
+	}
+
+	if note.ParentNoteID != nil {
+		if note.DeletedAt != nil {
+			respondError(w, http.StatusNotFound, "not_found", "note not found")
+			return
+		}
+		note, err = s.store.GetNoteByID(r.Context(), *note.ParentNoteID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to get note")
+			return
+		}
+	}
+
+	replies, err := s.store.GetNoteReplies(r.Context(), note.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get replies")
+		return
+	}
+
+	if note.DeletedAt != nil && len(replies) == 0 {
+		respondError(w, http.StatusNotFound, "not_found", "note not found")
+		return
+	}
+
+	// Load tags
+	noteIDs := []uuid.UUID{note.ID}
+	for _, reply := range replies {
+		noteIDs = append(noteIDs, reply.ID)
+	}
+	tagsByNote, err := s.store.GetTagsForNotes(r.Context(), noteIDs)
+	if err != nil {
+		log.Printf("failed to get tags for thread %s: %v", note.ID, err)
+	} else {
+		note.Tags = tagsByNote[note.ID]
+		for i := range replies {
+			replies[i].Tags = tagsByNote[replies[i].ID]
+		}
+	}
+
+	if note.DeletedAt != nil {
+		tombstoneNote(note)
+	}
+	note.ReplyCount = len(replies)
+
+	if replies == nil {
+		replies = []models.Note{}
+	}
+
+	respondJSON(w, http.StatusOK, models.ThreadResponse{Parent: *note, Replies: replies})
+}
+
+// setReplyCounts sets how many replies each of the notes has
+func (s *Server) setReplyCounts(ctx context.Context, notes []models.Note) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	noteIDs := make([]uuid.UUID, len(notes))
+	for i := range notes {
+		noteIDs[i] = notes[i].ID
+	}
+	counts, err := s.store.CountNoteReplies(ctx, noteIDs)
+	if err != nil {
+		return err
+	}
+	for i := range notes {
+		notes[i].ReplyCount = counts[notes[i].ID]
+	}
+	return nil
+}
+
+// threadRoot resolves the note a new note replies to into the note that
+// starts its thread, so threads are one level deep. It returns
+// store.ErrNotFound unless the parent is in the notebook. Only sync may
+// reply to a deleted note, since the device may have been offline when it
+// was deleted.
+func threadRoot(ctx context.Context, st store.Store, notebookID, parentID uuid.UUID, allowDeleted bool) (uuid.UUID, error) {
+	parent, err := st.GetNoteByID(ctx, parentID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if parent.NotebookID != notebookID || (parent.DeletedAt != nil && !allowDeleted) {
+		return uuid.Nil, store.ErrNotFound
+	}
+	if parent.ParentNoteID != nil {
+		return *parent.ParentNoteID, nil
+	}
+	return parent.ID, nil
+}
+
+// tombstoneNote clears the content of a deleted note that is still shown,
+// such as at the start of a thread that has replies
+func tombstoneNote(note *models.Note) {
+	note.Content = nil
+	note.PlainText = ""
+	note.IsTodo = false
+	note.IsDone = false
+	note.ReminderAt = nil
+	note.Tags = nil
+}
@@ -0,0 +1,140 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/api"
+	"github.com/noted/server/internal/models"
+)
+
+func createReply(t *testing.T, srv *api.Server, token, notebookID string, parentID uuid.UUID, text string) models.Note {
+	t.Helper()
+	rec := authedRequest(srv, token, http.MethodPost, "/api/notebooks/"+notebookID+"/notes", map[string]interface{}{
+		"content":        tiptapDoc(text),
+		"plain_text":     text,
+		"parent_note_id": parentID,
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("failed to create reply: %d %s", rec.Code, rec.Body.String())
+	}
+	var note models.Note
+	json.NewDecoder(rec.Body).Decode(&note)
+	return note
+}
+
+func TestNoteThread(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	parent := createTestNote(t, srv, token, notebookID)
+	first := createReply(t, srv, token, notebookID, parent.ID, "first")
+
+	// Replying to a reply adds to the same thread
+	second := createReply(t, srv, token, notebookID, first.ID, "second")
+	if second.ParentNoteID == nil || *second.ParentNoteID != parent.ID {
+		t.Errorf("got parent %v, want %s", second.ParentNoteID, parent.ID)
+	}
+
+	// The timeline shows the thread's first note with its reply count
+	rec := authedRequest(srv, token, http.MethodGet, "/api/notebooks/"+notebookID+"/notes", nil)
+	var notes []models.Note
+	json.NewDecoder(rec.Body).Decode(&notes)
+	if len(notes) != 1 || notes[0].ID != parent.ID || notes[0].ReplyCount != 2 {
+		t.Fatalf("expected only the parent with 2 replies, got %+v", notes)
+	}
+
+	for _, id := range []uuid.UUID{parent.ID, second.ID} {
+		rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+id.String()+"/thread", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+		}
+		var thread models.ThreadResponse
+		json.NewDecoder(rec.Body).Decode(&thread)
+		if thread.Parent.ID != parent.ID || len(thread.Replies) != 2 || thread.Replies[0].PlainText != "first" {
+			t.Errorf("got thread %+v", thread)
+		}
+	}
+}
+
+func TestNoteThreadDeletedParent(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	parent := createTestNote(t, srv, token, notebookID)
+	createReply(t, srv, token, notebookID, parent.ID, "reply")
+
+	rec := authedRequest(srv, token, http.MethodDelete, "/api/notes/"+parent.ID.String(), nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("failed to delete note: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// The thread remains, led by a tombstone
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+parent.ID.String()+"/thread", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var thread models.ThreadResponse
+	json.NewDecoder(rec.Body).Decode(&thread)
+	if thread.Parent.DeletedAt == nil || thread.Parent.PlainText != "" || len(thread.Replies) != 1 {
+		t.Errorf("expected a tombstone with one reply, got %+v", thread)
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notebooks/"+notebookID+"/notes", nil)
+	var notes []models.Note
+	json.NewDecoder(rec.Body).Decode(&notes)
+	if len(notes) != 1 || notes[0].DeletedAt == nil || notes[0].ReplyCount != 1 {
+		t.Errorf("expected the tombstone on the timeline, got %+v", notes)
+	}
+
+	// New replies to a deleted note are turned away
+	rec = authedRequest(srv, token, http.MethodPost, "/api/notebooks/"+notebookID+"/notes", map[string]interface{}{
+		"content":        tiptapDoc("late"),
+		"parent_note_id": parent.ID,
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSyncPushReply(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	parent := createTestNote(t, srv, token, notebookID)
+
+	now := time.Now()
+	reply := models.Note{
+		ID:           uuid.New(),
+		NotebookID:   parent.NotebookID,
+		ParentNoteID: &parent.ID,
+		UserID:       parent.UserID,
+		Content:      tiptapDoc("from a device"),
+		Version:      1,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	orphan := reply
+	orphan.ID = uuid.New()
+	missing := uuid.New()
+	orphan.ParentNoteID = &missing
+
+	rec := authedRequest(srv, token, http.MethodPost, "/api/sync", models.SyncRequest{Notes: []models.SyncNote{{Note: reply}, {Note: orphan}}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var resp models.SyncResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	for _, result := range resp.Results {
+		if result.ID == reply.ID && result.Status != models.SyncStatusApplied {
+			t.Errorf("expected the reply to be applied, got %+v", result)
+		}
+		if result.ID == orphan.ID && result.Status != models.SyncStatusRejected {
+			t.Errorf("expected the reply to a missing note to be rejected, got %+v", result)
+		}
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+parent.ID.String()+"/thread", nil)
+	var thread models.ThreadResponse
+	json.NewDecoder(rec.Body).Decode(&thread)
+	if len(thread.Replies) != 1 || thread.Replies[0].ID != reply.ID {
+		t.Errorf("got thread %+v", thread)
+	}
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/store"
+)
+
+// patPrefix marks personal access tokens so they can be told apart from
+// JWTs, and recognized by secret scanners
+const patPrefix = "noted_pat_"
+
+func (s *Server) handleListPersonalAccessTokens(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	tokens, err := s.store.GetPersonalAccessTokensByUserID(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get tokens")
+		return
+	}
+
+	if tokens == nil {
+		tokens = []models.PersonalAccessToken{}
+	}
+
+	respondJSON(w, http.StatusOK, tokens)
+}
+
+// handleCreatePersonalAccessToken creates a token and returns it. Only its
+// hash is kept, so it can't be shown again.
+func (s *Server) handleCreatePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	var req models.CreatePersonalAccessTokenRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		respondError(w, http.StatusBadRequest, "validation_error", "name is required")
+		return
+	}
+
+	if len(req.Name) > 100 {
+		respondError(w, http.StatusBadRequest, "validation_error", "name must be at most 100 characters")
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		respondError(w, http.StatusBadRequest, "validation_error", "at least one scope is required")
+		return
+	}
+
+	var scopes []string
+	for _, scope := range req.Scopes {
+		if !slices.Contains(models.Scopes, scope) {
+			respondError(w, http.StatusBadRequest, "validation_error", "unknown scope "+scope)
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	now := time.Now()
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		respondError(w, http.StatusBadRequest, "validation_error", "expires_at must be in the future")
+		return
+	}
+
+	random, _, err := newOpaqueToken()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to generate token")
+		return
+	}
+	secret := patPrefix + random
+
+	pat := &models.PersonalAccessToken{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Name:      req.Name,
+		TokenHash: hashToken(secret),
+		Prefix:    secret[:len(patPrefix)+4],
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := s.store.CreatePersonalAccessToken(r.Context(), pat); err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to create token")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, models.CreatePersonalAccessTokenResponse{
+		PersonalAccessToken: pat,
+		Token:               secret,
+	})
+}
+
+func (s *Server) handleRevokePersonalAccessToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid token ID")
+		return
+	}
+
+	pat, err := s.store.GetPersonalAccessTokenByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "token not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get token")
+		return
+	}
+
+	// Check ownership and revocation (return 404 for both to prevent enumeration)
+	if pat.UserID != userID || pat.RevokedAt != nil {
+		respondError(w, http.StatusNotFound, "not_found", "token not found")
+		return
+	}
+
+	if err := s.store.RevokePersonalAccessToken(r.Context(), id); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			respondError(w, http.StatusNotFound, "not_found", "token not found")
+			return
+		}
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to revoke token")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,95 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/noted/server/internal/api"
+	"github.com/noted/server/internal/models"
+)
+
+func createPersonalAccessToken(t *testing.T, srv *api.Server, token string, scopes ...string) models.CreatePersonalAccessTokenResponse {
+	t.Helper()
+	rec := authedRequest(srv, token, http.MethodPost, "/api/auth/tokens", map[string]interface{}{
+		"name": "cron", "scopes": scopes,
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("failed to create token: %d %s", rec.Code, rec.Body.String())
+	}
+	var created models.CreatePersonalAccessTokenResponse
+	json.NewDecoder(rec.Body).Decode(&created)
+	return created
+}
+
+func TestPersonalAccessTokenScopes(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	pat := createPersonalAccessToken(t, srv, token, "notes:read", "notes:write")
+	if !strings.HasPrefix(pat.Token, "noted_pat_") || !strings.HasPrefix(pat.Token, pat.Prefix) {
+		t.Fatalf("unexpected token %q with prefix %q", pat.Token, pat.Prefix)
+	}
+
+	// Covered by the token's scopes
+	createTestNote(t, srv, pat.Token, notebookID)
+
+	rec := authedRequest(srv, pat.Token, http.MethodGet, "/api/sync", nil)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d for a missing scope, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	// Tokens can't manage the account
+	rec = authedRequest(srv, pat.Token, http.MethodPost, "/api/auth/tokens", map[string]interface{}{
+		"name": "escalate", "scopes": []string{"sync"},
+	})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d creating a token with a token, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/auth/tokens", nil)
+	var tokens []models.PersonalAccessToken
+	json.NewDecoder(rec.Body).Decode(&tokens)
+	if len(tokens) != 1 || tokens[0].LastUsedAt == nil {
+		t.Errorf("expected one used token, got %s", rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), pat.Token) {
+		t.Error("expected the token not to be listed")
+	}
+}
+
+func TestPersonalAccessTokenRevoke(t *testing.T) {
+	srv, token, _ := setupTestServerWithNotebook(t)
+	pat := createPersonalAccessToken(t, srv, token, "sync")
+
+	rec := authedRequest(srv, pat.Token, http.MethodGet, "/api/sync", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, token, http.MethodDelete, "/api/auth/tokens/"+pat.ID.String(), nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	rec = authedRequest(srv, pat.Token, http.MethodGet, "/api/sync", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for a revoked token, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestCreatePersonalAccessTokenValidation(t *testing.T) {
+	srv, token, _ := setupTestServerWithNotebook(t)
+
+	tests := []map[string]interface{}{
+		{"name": "", "scopes": []string{"sync"}},
+		{"name": "no scopes", "scopes": []string{}},
+		{"name": "bad scope", "scopes": []string{"admin"}},
+		{"name": "expired", "scopes": []string{"sync"}, "expires_at": "2000-01-01T00:00:00Z"},
+	}
+	for _, body := range tests {
+		rec := authedRequest(srv, token, http.MethodPost, "/api/auth/tokens", body)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: got status %d, want %d", body["name"], rec.Code, http.StatusBadRequest)
+		}
+	}
+}
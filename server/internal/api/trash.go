@@ -0,0 +1,271 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/store"
+)
+
+// Item types accepted in /api/trash/{type}/{id}
+const (
+	trashTypeNotebooks = "notebooks"
+	trashTypeNotes     = "notes"
+)
+
+func (s *Server) handleListTrash(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	notebooks, err := s.store.GetDeletedNotebooks(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get deleted notebooks")
+		return
+	}
+
+	notes, err := s.store.GetDeletedNotes(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get deleted notes")
+		return
+	}
+
+	if len(notes) > 0 {
+		noteIDs := make([]uuid.UUID, len(notes))
+		for i := range notes {
+			noteIDs[i] = notes[i].ID
+		}
+		tagsByNote, err := s.store.GetTagsForNotes(r.Context(), noteIDs)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to get tags")
+			return
+		}
+		for i := range notes {
+			notes[i].Tags = tagsByNote[notes[i].ID]
+		}
+	}
+
+	resp := models.TrashResponse{Notebooks: notebooks, Notes: notes}
+	if resp.Notebooks == nil {
+		resp.Notebooks = []models.Notebook{}
+	}
+	if resp.Notes == nil {
+		resp.Notes = []models.Note{}
+	}
+
+	respondJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleRestoreTrashItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	itemType, id, ok := parseTrashItem(w, r)
+	if !ok {
+		return
+	}
+
+	switch itemType {
+	case trashTypeNotebooks:
+		if !s.deletedNotebookOwnedBy(r.Context(), w, id, userID) {
+			return
+		}
+		if err := s.store.RestoreNotebook(r.Context(), id); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				respondError(w, http.StatusNotFound, "not_found", "notebook not found in trash")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to restore notebook")
+			return
+		}
+
+		notebook, err := s.store.GetNotebookByID(r.Context(), id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to get notebook")
+			return
+		}
+		respondJSON(w, http.StatusOK, notebook)
+
+	case trashTypeNotes:
+		note, ok := s.deletedNoteOwnedBy(r.Context(), w, id, userID)
+		if !ok {
+			return
+		}
+
+		// A note can't come back into a notebook that is itself deleted
+		notebook, err := s.store.GetNotebookByID(r.Context(), note.NotebookID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to get notebook")
+			return
+		}
+		if notebook.DeletedAt != nil {
+			respondError(w, http.StatusConflict, "notebook_deleted", "restore the note's notebook first")
+			return
+		}
+
+		if err := s.store.RestoreNote(r.Context(), id); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				respondError(w, http.StatusNotFound, "not_found", "note not found in trash")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to restore note")
+			return
+		}
+
+		note, err = s.store.GetNoteByID(r.Context(), id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to get note")
+			return
+		}
+		tags, err := s.store.GetTagsForNote(r.Context(), id)
+		if err == nil {
+			note.Tags = tags
+		}
+		respondJSON(w, http.StatusOK, note)
+	}
+}
+
+func (s *Server) handleDeleteTrashItem(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	itemType, id, ok := parseTrashItem(w, r)
+	if !ok {
+		return
+	}
+
+	var result *models.PurgeResult
+	var err error
+	switch itemType {
+	case trashTypeNotebooks:
+		if !s.deletedNotebookOwnedBy(r.Context(), w, id, userID) {
+			return
+		}
+
+		// Notes still in use keep the notebook from being purged
+		live, err := s.store.GetNotesByNotebookID(r.Context(), id, nil)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to get notes")
+			return
+		}
+		if len(live) > 0 {
+			respondError(w, http.StatusConflict, "notebook_not_empty", "notebook still contains notes that aren't deleted")
+			return
+		}
+
+		result, err = s.store.PurgeNotebook(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				respondError(w, http.StatusNotFound, "not_found", "notebook not found in trash")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to delete notebook")
+			return
+		}
+
+	case trashTypeNotes:
+		if _, ok := s.deletedNoteOwnedBy(r.Context(), w, id, userID); !ok {
+			return
+		}
+
+		result, err = s.store.PurgeNote(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				respondError(w, http.StatusNotFound, "not_found", "note not found in trash")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, "server_error", "failed to delete note")
+			return
+		}
+	}
+
+	s.deletePurgedBlobs(r.Context(), result)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserID(r.Context())
+	if !ok {
+		respondError(w, http.StatusUnauthorized, "unauthorized", "user not found in context")
+		return
+	}
+
+	result, err := s.store.EmptyTrash(r.Context(), userID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to empty trash")
+		return
+	}
+
+	s.deletePurgedBlobs(r.Context(), result)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseTrashItem reads the {type} and {id} URL parameters, responding with
+// an error if either is invalid
+func parseTrashItem(w http.ResponseWriter, r *http.Request) (string, uuid.UUID, bool) {
+	itemType := chi.URLParam(r, "type")
+	if itemType != trashTypeNotebooks && itemType != trashTypeNotes {
+		respondError(w, http.StatusNotFound, "not_found", "unknown trash item type")
+		return "", uuid.Nil, false
+	}
+
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "invalid_request", "invalid ID")
+		return "", uuid.Nil, false
+	}
+	return itemType, id, true
+}
+
+// deletedNotebookOwnedBy checks that a notebook is in the user's trash,
+// responding with 404 if it isn't
+func (s *Server) deletedNotebookOwnedBy(ctx context.Context, w http.ResponseWriter, id, userID uuid.UUID) bool {
+	notebook, err := s.store.GetNotebookByID(ctx, id)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get notebook")
+		return false
+	}
+	if err != nil || notebook.UserID != userID || notebook.DeletedAt == nil {
+		respondError(w, http.StatusNotFound, "not_found", "notebook not found in trash")
+		return false
+	}
+	return true
+}
+
+// deletedNoteOwnedBy returns a note in the user's trash, responding with 404
+// if it isn't there
+func (s *Server) deletedNoteOwnedBy(ctx context.Context, w http.ResponseWriter, id, userID uuid.UUID) (*models.Note, bool) {
+	note, err := s.store.GetNoteByID(ctx, id)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		respondError(w, http.StatusInternalServerError, "server_error", "failed to get note")
+		return nil, false
+	}
+	if err != nil || note.UserID != userID || note.DeletedAt == nil {
+		respondError(w, http.StatusNotFound, "not_found", "note not found in trash")
+		return nil, false
+	}
+	return note, true
+}
+
+// deletePurgedBlobs removes the stored files of purged images. The records
+// are already gone, so failures only leave orphaned storage and are logged.
+func (s *Server) deletePurgedBlobs(ctx context.Context, result *models.PurgeResult) {
+	for _, key := range result.StorageKeys {
+		if err := s.blobStore.Delete(ctx, key); err != nil {
+			log.Printf("trash: failed to delete blob %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/noted/server/internal/api"
+	"github.com/noted/server/internal/models"
+)
+
+func authedRequest(srv *api.Server, token, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func createTestNote(t *testing.T, srv *api.Server, token, notebookID string) models.Note {
+	t.Helper()
+	rec := authedRequest(srv, token, http.MethodPost, "/api/notebooks/"+notebookID+"/notes", map[string]interface{}{
+		"content":    map[string]interface{}{"type": "doc"},
+		"plain_text": "Hello",
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("failed to create note: %d %s", rec.Code, rec.Body.String())
+	}
+	var note models.Note
+	json.NewDecoder(rec.Body).Decode(&note)
+	return note
+}
+
+func TestTrashRestoreNote(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	note := createTestNote(t, srv, token, notebookID)
+
+	authedRequest(srv, token, http.MethodDelete, "/api/notes/"+note.ID.String(), nil)
+
+	rec := authedRequest(srv, token, http.MethodGet, "/api/trash", nil)
+	var trash models.TrashResponse
+	json.NewDecoder(rec.Body).Decode(&trash)
+	if len(trash.Notes) != 1 || trash.Notes[0].ID != note.ID {
+		t.Fatalf("expected the deleted note in the trash, got %+v", trash.Notes)
+	}
+
+	rec = authedRequest(srv, token, http.MethodPost, "/api/trash/notes/"+note.ID.String()+"/restore", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String(), nil)
+	var restored models.Note
+	json.NewDecoder(rec.Body).Decode(&restored)
+	if restored.DeletedAt != nil {
+		t.Errorf("expected the note to be restored, got deleted_at %v", restored.DeletedAt)
+	}
+
+	// Restoring something that isn't in the trash
+	rec = authedRequest(srv, token, http.MethodPost, "/api/trash/notes/"+note.ID.String()+"/restore", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestTrashRestoreNoteInDeletedNotebook(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	note := createTestNote(t, srv, token, notebookID)
+
+	authedRequest(srv, token, http.MethodDelete, "/api/notes/"+note.ID.String(), nil)
+	authedRequest(srv, token, http.MethodDelete, "/api/notebooks/"+notebookID, nil)
+
+	rec := authedRequest(srv, token, http.MethodPost, "/api/trash/notes/"+note.ID.String()+"/restore", nil)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestTrashDeleteForever(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	note := createTestNote(t, srv, token, notebookID)
+
+	// Only deleted items can be removed permanently
+	rec := authedRequest(srv, token, http.MethodDelete, "/api/trash/notes/"+note.ID.String(), nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	authedRequest(srv, token, http.MethodDelete, "/api/notes/"+note.ID.String(), nil)
+
+	rec = authedRequest(srv, token, http.MethodDelete, "/api/trash/notes/"+note.ID.String(), nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusNoContent, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String(), nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestTrashEmpty(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	note := createTestNote(t, srv, token, notebookID)
+
+	authedRequest(srv, token, http.MethodDelete, "/api/notes/"+note.ID.String(), nil)
+	authedRequest(srv, token, http.MethodDelete, "/api/notebooks/"+notebookID, nil)
+
+	rec := authedRequest(srv, token, http.MethodDelete, "/api/trash", nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/trash", nil)
+	var trash models.TrashResponse
+	json.NewDecoder(rec.Body).Decode(&trash)
+	if len(trash.Notebooks) != 0 || len(trash.Notes) != 0 {
+		t.Errorf("expected an empty trash, got %+v", trash)
+	}
+}
+
+func TestTrashRestoreNotebookRestoresItsNotes(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	separate := createTestNote(t, srv, token, notebookID)
+	cascaded := createTestNote(t, srv, token, notebookID)
+
+	// One note is deleted on its own before the notebook goes
+	authedRequest(srv, token, http.MethodDelete, "/api/notes/"+separate.ID.String(), nil)
+	authedRequest(srv, token, http.MethodDelete, "/api/notebooks/"+notebookID, nil)
+
+	rec := authedRequest(srv, token, http.MethodGet, "/api/notes/"+cascaded.ID.String(), nil)
+	var note models.Note
+	json.NewDecoder(rec.Body).Decode(&note)
+	if note.DeletedAt == nil {
+		t.Fatal("expected deleting the notebook to delete its notes")
+	}
+
+	rec = authedRequest(srv, token, http.MethodPost, "/api/trash/notebooks/"+notebookID+"/restore", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/trash", nil)
+	var trash models.TrashResponse
+	json.NewDecoder(rec.Body).Decode(&trash)
+	if len(trash.Notebooks) != 0 {
+		t.Errorf("expected the notebook to leave the trash, got %+v", trash.Notebooks)
+	}
+	if len(trash.Notes) != 1 || trash.Notes[0].ID != separate.ID {
+		t.Errorf("expected only the separately deleted note to stay in the trash, got %+v", trash.Notes)
+	}
+}
+
+func TestTrashRestoreNotebookRestoresTagLinks(t *testing.T) {
+	srv, token, notebookID := setupTestServerWithNotebook(t)
+	note := createTestNote(t, srv, token, notebookID)
+
+	rec := authedRequest(srv, token, http.MethodPost, "/api/tags", map[string]string{"name": "work"})
+	var tag models.Tag
+	json.NewDecoder(rec.Body).Decode(&tag)
+	rec = authedRequest(srv, token, http.MethodPut, "/api/notes/"+note.ID.String(), map[string]interface{}{"tag_ids": []uuid.UUID{tag.ID}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("failed to tag note: %d %s", rec.Code, rec.Body.String())
+	}
+
+	authedRequest(srv, token, http.MethodDelete, "/api/notebooks/"+notebookID, nil)
+
+	// The note keeps its tags in the trash
+	rec = authedRequest(srv, token, http.MethodGet, "/api/trash", nil)
+	var trash models.TrashResponse
+	json.NewDecoder(rec.Body).Decode(&trash)
+	if len(trash.Notes) != 1 || len(trash.Notes[0].Tags) != 1 || trash.Notes[0].Tags[0].ID != tag.ID {
+		t.Fatalf("expected the trashed note with its tag, got %+v", trash.Notes)
+	}
+
+	rec = authedRequest(srv, token, http.MethodPost, "/api/trash/notebooks/"+notebookID+"/restore", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d. Body: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	rec = authedRequest(srv, token, http.MethodGet, "/api/notes/"+note.ID.String(), nil)
+	var restored models.Note
+	json.NewDecoder(rec.Body).Decode(&restored)
+	if len(restored.Tags) != 1 || restored.Tags[0].ID != tag.ID {
+		t.Errorf("expected the restored note to keep its tag, got %+v", restored.Tags)
+	}
+}
@@ -0,0 +1,48 @@
+package mail
+
+import (
+	"fmt"
+)
+
+// Transport represents a mail transport type
+type Transport string
+
+const (
+	TransportSMTP   Transport = "smtp"
+	TransportOutbox Transport = "outbox"
+)
+
+// Config holds configuration for creating a Mailer
+type Config struct {
+	Transport Transport
+	From      string
+
+	// SMTP config
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+
+	// Outbox config
+	OutboxDir string
+}
+
+// New creates a new Mailer based on the configuration
+func New(cfg Config) (Mailer, error) {
+	switch cfg.Transport {
+	case TransportOutbox, "":
+		return NewOutbox(cfg.OutboxDir)
+
+	case TransportSMTP:
+		return NewSMTPMailer(SMTPConfig{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.From,
+		})
+
+	default:
+		return nil, fmt.Errorf("unsupported mail transport: %s", cfg.Transport)
+	}
+}
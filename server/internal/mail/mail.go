@@ -0,0 +1,40 @@
+// Package mail sends the emails the server needs, such as password resets
+// and address verification, through a pluggable transport.
+package mail
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrNoRecipient is returned when a message has no recipient
+	ErrNoRecipient = errors.New("mail: message has no recipient")
+	// ErrInvalidHeader is returned when a header value spans several lines
+	ErrInvalidHeader = errors.New("mail: header contains a line break")
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer defines the interface for mail transports
+type Mailer interface {
+	// Send delivers a message, returning once the transport has accepted it
+	Send(ctx context.Context, msg Message) error
+}
+
+// validate checks that a message can be sent safely
+func validate(msg Message) error {
+	if msg.To == "" {
+		return ErrNoRecipient
+	}
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return ErrInvalidHeader
+	}
+	return nil
+}
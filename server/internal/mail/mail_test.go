@@ -0,0 +1,159 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// smtpStandIn is a minimal SMTP server that accepts every message
+type smtpStandIn struct {
+	ln       net.Listener
+	senders  chan string
+	received chan string
+}
+
+func startSMTPStandIn(t *testing.T) *smtpStandIn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &smtpStandIn{ln: ln, senders: make(chan string, 1), received: make(chan string, 1)}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s.serve(textproto.NewConn(conn))
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(c *textproto.Conn) {
+	c.PrintfLine("220 localhost ready")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		switch verb := strings.ToUpper(strings.Fields(line + " ")[0]); verb {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 localhost")
+		case "MAIL":
+			s.senders <- line
+			c.PrintfLine("250 OK")
+		case "RCPT", "RSET", "NOOP":
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.received <- string(data)
+			c.PrintfLine("250 queued")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	standIn := startSMTPStandIn(t)
+	host, portStr, _ := net.SplitHostPort(standIn.ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	m, err := NewSMTPMailer(SMTPConfig{Host: host, Port: port, From: "noted@example.com"})
+	if err != nil {
+		t.Fatalf("failed to create mailer: %v", err)
+	}
+
+	err = m.Send(context.Background(), Message{To: "user@example.com", Subject: "Hello", Body: "line one\nline two"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data := <-standIn.received
+	for _, want := range []string{"To: user@example.com", "Subject: Hello", "line one\nline two"} {
+		if !strings.Contains(data, want) {
+			t.Errorf("expected message to contain %q, got:\n%s", want, data)
+		}
+	}
+}
+
+func TestSMTPMailerSendDisplayName(t *testing.T) {
+	standIn := startSMTPStandIn(t)
+	host, portStr, _ := net.SplitHostPort(standIn.ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	m, err := NewSMTPMailer(SMTPConfig{Host: host, Port: port, From: "Noted <noreply@example.com>"})
+	if err != nil {
+		t.Fatalf("failed to create mailer: %v", err)
+	}
+
+	err = m.Send(context.Background(), Message{To: "user@example.com", Subject: "Hello", Body: "hi"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The envelope takes the bare address; the header keeps the name
+	if sender := <-standIn.senders; sender != "MAIL FROM:<noreply@example.com>" {
+		t.Errorf("got %q, want MAIL FROM:<noreply@example.com>", sender)
+	}
+	data := <-standIn.received
+	if !strings.Contains(data, `From: "Noted" <noreply@example.com>`) {
+		t.Errorf("expected the From header with its display name, got:\n%s", data)
+	}
+
+	if _, err := NewSMTPMailer(SMTPConfig{Host: host, From: "not an address"}); err == nil {
+		t.Error("expected an invalid sender address to be rejected")
+	}
+}
+
+func TestOutboxWritesMessages(t *testing.T) {
+	dir := t.TempDir()
+	o, err := NewOutbox(dir)
+	if err != nil {
+		t.Fatalf("failed to create outbox: %v", err)
+	}
+
+	if err := o.Send(context.Background(), Message{To: "user@example.com", Subject: "Hi", Body: "Hello"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if sent := o.Sent(); len(sent) != 1 || sent[0].To != "user@example.com" {
+		t.Errorf("got sent messages %+v", sent)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("got %d files in the outbox, want 1", len(entries))
+	}
+	f, _ := os.Open(dir + "/" + entries[0].Name())
+	defer f.Close()
+	header, _ := textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+	if got := header.Get("To"); got != "user@example.com" {
+		t.Errorf("got To header %q", got)
+	}
+}
+
+func TestSendRejectsHeaderInjection(t *testing.T) {
+	o, _ := NewOutbox("")
+	err := o.Send(context.Background(), Message{To: "user@example.com\r\nBcc: other@example.com", Subject: "Hi"})
+	if !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidHeader)
+	}
+}
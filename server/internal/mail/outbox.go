@@ -0,0 +1,68 @@
+package mail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Outbox is a Mailer for development and tests. It logs each message and
+// keeps it in memory, and also writes it to a directory when one is set.
+type Outbox struct {
+	dir string
+
+	mu   sync.Mutex
+	sent []Message
+}
+
+// NewOutbox creates an outbox, writing messages under dir unless it is empty
+func NewOutbox(dir string) (*Outbox, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create outbox directory: %w", err)
+		}
+	}
+	return &Outbox{dir: dir}, nil
+}
+
+// Send implements Mailer
+func (o *Outbox) Send(ctx context.Context, msg Message) error {
+	if err := validate(msg); err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	o.sent = append(o.sent, msg)
+	o.mu.Unlock()
+
+	if o.dir == "" {
+		log.Printf("mail: outbox message to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("failed to name outbox message: %w", err)
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	path := filepath.Join(o.dir, name)
+
+	if err := os.WriteFile(path, formatMessage("outbox@localhost", msg), 0644); err != nil {
+		return fmt.Errorf("failed to write outbox message: %w", err)
+	}
+	log.Printf("mail: wrote message to %s (%s) to %s", msg.To, msg.Subject, path)
+	return nil
+}
+
+// Sent returns the messages sent so far, oldest first
+func (o *Outbox) Sent() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Message(nil), o.sent...)
+}
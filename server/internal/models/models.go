@@ -5,16 +5,72 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/noted/server/internal/tiptap"
 )
 
 // User represents a user account
 type User struct {
-	ID           uuid.UUID  `json:"id"`
-	Email        string     `json:"email"`
-	PasswordHash string     `json:"-"`
-	CreatedAt    time.Time  `json:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at"`
-	DeletedAt    *time.Time `json:"-"`
+	ID              uuid.UUID  `json:"id"`
+	Email           string     `json:"email"`
+	PasswordHash    string     `json:"-"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	MFAEnabled      bool       `json:"mfa_enabled"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	DeletedAt       *time.Time `json:"-"`
+}
+
+// Purposes of the single-use tokens sent to users by email, of the tickets
+// clients open event streams with, and of pending MFA challenges
+const (
+	UserTokenPasswordReset = "password_reset"
+	UserTokenVerifyEmail   = "verify_email"
+	UserTokenChangeEmail   = "change_email"
+	UserTokenEventStream   = "event_stream"
+	UserTokenMFAChallenge  = "mfa_challenge"
+)
+
+// UserToken is a single-use token emailed to a user or handed to a client,
+// identified by its hash
+type UserToken struct {
+	TokenHash []byte
+	UserID    uuid.UUID
+	Purpose   string
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	Attempts  int
+}
+
+// UserIdentity links a user to their account at an external identity
+// provider
+type UserIdentity struct {
+	Provider    string
+	Subject     string
+	UserID      uuid.UUID
+	Email       string
+	CreatedAt   time.Time
+	LastLoginAt *time.Time
+}
+
+// LoginFailures counts the failed logins for an email address since the
+// last successful one. The count is forgotten at ResetAt.
+type LoginFailures struct {
+	Email        string
+	Failures     int
+	LastFailedAt time.Time
+	ResetAt      time.Time
+}
+
+// UserTOTP is a user's authenticator app secret. It only protects sign-ins
+// once EnabledAt is set.
+type UserTOTP struct {
+	UserID    uuid.UUID
+	Secret    string
+	LastStep  int64
+	CreatedAt time.Time
+	EnabledAt *time.Time
 }
 
 // Notebook represents a collection of notes
@@ -23,26 +79,71 @@ type Notebook struct {
 	UserID    uuid.UUID  `json:"user_id"`
 	Title     string     `json:"title"`
 	SortOrder int        `json:"sort_order"`
+	Version   int64      `json:"version"`
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
-// Note represents a single note entry
+// Note represents a single note entry. A reply has the note at the start of
+// its thread, in the same notebook, as its parent. Pinned notes stay in
+// their place on the timeline and are also listed on their own for clients
+// to show above it, starred ones are listed across notebooks, and archived
+// ones are hidden from lists unless asked for. ReplyCount is only set when
+// listing a notebook's timeline.
 type Note struct {
-	ID         uuid.UUID       `json:"id"`
-	NotebookID uuid.UUID       `json:"notebook_id"`
-	UserID     uuid.UUID       `json:"user_id"`
-	Content    json.RawMessage `json:"content"`
+	ID           uuid.UUID       `json:"id"`
+	NotebookID   uuid.UUID       `json:"notebook_id"`
+	ParentNoteID *uuid.UUID      `json:"parent_note_id,omitempty"`
+	UserID       uuid.UUID       `json:"user_id"`
+	Content      json.RawMessage `json:"content"`
+	PlainText    string          `json:"plain_text,omitempty"`
+	IsTodo       bool            `json:"is_todo"`
+	IsDone       bool            `json:"is_done"`
+	ReminderAt   *time.Time      `json:"reminder_at,omitempty"`
+	IsPinned     bool            `json:"is_pinned"`
+	IsStarred    bool            `json:"is_starred"`
+	ArchivedAt   *time.Time      `json:"archived_at"`
+	Version      int64           `json:"version"`
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+	DeletedAt    *time.Time      `json:"deleted_at,omitempty"`
+	Tags         []Tag           `json:"tags,omitempty"`
+	ReplyCount   int             `json:"reply_count,omitempty"`
+}
+
+// ThreadResponse is a note at the start of a thread with its replies, oldest
+// first. If the note has been deleted it is a tombstone.
+type ThreadResponse struct {
+	Parent  Note   `json:"parent"`
+	Replies []Note `json:"replies"`
+}
+
+// NoteFilter narrows down a list of notes. Archived notes are left out
+// unless IncludeArchived is set.
+type NoteFilter struct {
+	PinnedOnly      bool
+	IncludeArchived bool
+}
+
+// NoteCursor is a position in a notebook's timeline, which orders notes by
+// creation time and then by ID
+type NoteCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// NoteRevision is a saved version of a note's content. Content is left out
+// when revisions are listed.
+type NoteRevision struct {
+	NoteID     uuid.UUID       `json:"note_id"`
+	Version    int64           `json:"version"`
+	Content    json.RawMessage `json:"content,omitempty"`
 	PlainText  string          `json:"plain_text,omitempty"`
 	IsTodo     bool            `json:"is_todo"`
 	IsDone     bool            `json:"is_done"`
 	ReminderAt *time.Time      `json:"reminder_at,omitempty"`
-	Version    int64           `json:"version"`
 	CreatedAt  time.Time       `json:"created_at"`
-	UpdatedAt  time.Time       `json:"updated_at"`
-	DeletedAt  *time.Time      `json:"deleted_at,omitempty"`
-	Tags       []Tag           `json:"tags,omitempty"`
 }
 
 // Tag represents a label for notes
@@ -51,6 +152,7 @@ type Tag struct {
 	UserID    uuid.UUID  `json:"user_id"`
 	Name      string     `json:"name"`
 	Color     string     `json:"color,omitempty"`
+	Version   int64      `json:"version"`
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"deleted_at,omitempty"`
@@ -64,13 +166,75 @@ type NoteTag struct {
 
 // Image represents an uploaded image attachment
 type Image struct {
-	ID         uuid.UUID `json:"id"`
-	NoteID     uuid.UUID `json:"note_id"`
-	Filename   string    `json:"filename"`
-	MimeType   string    `json:"mime_type"`
-	StorageKey string    `json:"-"`
-	Size       int64     `json:"size"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID         uuid.UUID  `json:"id"`
+	NoteID     uuid.UUID  `json:"note_id"`
+	Filename   string     `json:"filename"`
+	MimeType   string     `json:"mime_type"`
+	StorageKey string     `json:"-"`
+	Size       int64      `json:"size"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+	URL        string     `json:"url,omitempty"`
+}
+
+// Device represents a client installation registered by a user
+type Device struct {
+	ID           uuid.UUID  `json:"id"`
+	UserID       uuid.UUID  `json:"user_id"`
+	Name         string     `json:"name"`
+	Platform     string     `json:"platform"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastSeenAt   *time.Time `json:"last_seen_at,omitempty"`
+	LastSyncedAt *time.Time `json:"last_synced_at,omitempty"`
+	RevokedAt    *time.Time `json:"-"`
+	IsCurrent    bool       `json:"is_current"`
+}
+
+// CreateDeviceRequest represents a request to register a device
+type CreateDeviceRequest struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform"`
+}
+
+// Session is a signed-in client. Its refresh tokens are rotated on every
+// use and it stays valid until it expires or is revoked.
+type Session struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	DeviceID   *uuid.UUID `json:"device_id,omitempty"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"-"`
+	IsCurrent  bool       `json:"is_current"`
+}
+
+// Scopes a personal access token can be granted
+const (
+	ScopeNotesRead   = "notes:read"
+	ScopeNotesWrite  = "notes:write"
+	ScopeImagesWrite = "images:write"
+	ScopeSync        = "sync"
+)
+
+// Scopes lists every scope in the order they are documented
+var Scopes = []string{ScopeNotesRead, ScopeNotesWrite, ScopeImagesWrite, ScopeSync}
+
+// PersonalAccessToken is a long-lived token for scripts and integrations.
+// The token itself is only shown when it is created.
+type PersonalAccessToken struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"-"`
+	Name       string     `json:"name"`
+	TokenHash  []byte     `json:"-"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"-"`
 }
 
 // CreateUserRequest represents a registration request
@@ -79,6 +243,34 @@ type CreateUserRequest struct {
 	Password string `json:"password"`
 }
 
+// ForgotPasswordRequest asks for a password reset link
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordRequest sets a new password using an emailed token
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// VerifyEmailRequest confirms an email address using an emailed token
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// ChangePasswordRequest sets a new password for the signed-in user
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ChangeEmailRequest moves the signed-in user to a new email address
+type ChangeEmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
 // LoginRequest represents a login request
 type LoginRequest struct {
 	Email    string `json:"email"`
@@ -92,6 +284,76 @@ type AuthResponse struct {
 	RefreshToken string `json:"refresh_token"`
 }
 
+// MFAChallengeResponse is returned by login instead of an AuthResponse when
+// the user has two-factor authentication enabled. The token is exchanged,
+// together with a code, at POST /api/auth/login/mfa.
+type MFAChallengeResponse struct {
+	MFARequired bool      `json:"mfa_required"`
+	MFAToken    string    `json:"mfa_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// MFALoginRequest completes a login with an authenticator code or a
+// recovery code
+type MFALoginRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MFAStatusResponse describes a user's two-factor authentication setup
+type MFAStatusResponse struct {
+	Enabled                bool       `json:"enabled"`
+	EnabledAt              *time.Time `json:"enabled_at,omitempty"`
+	RecoveryCodesRemaining int        `json:"recovery_codes_remaining"`
+}
+
+// MFASetupResponse holds a new authenticator secret and the otpauth:// URI
+// to show as a QR code
+type MFASetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// EnableMFARequest confirms an authenticator secret with a code from it
+type EnableMFARequest struct {
+	Code string `json:"code"`
+}
+
+// PasswordConfirmRequest carries the current password for actions that
+// need it re-entered
+type PasswordConfirmRequest struct {
+	Password string `json:"password"`
+}
+
+// RecoveryCodesResponse holds newly generated recovery codes. They are only
+// ever shown once.
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// CreatePersonalAccessTokenRequest represents a request to create a personal
+// access token. Tokens without an expiry last until they are revoked.
+type CreatePersonalAccessTokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// CreatePersonalAccessTokenResponse includes the token, which is not shown
+// again
+type CreatePersonalAccessTokenResponse struct {
+	*PersonalAccessToken
+	Token string `json:"token"`
+}
+
+// EventTicketResponse carries a single-use ticket for opening an event
+// stream from clients that can't send an Authorization header
+type EventTicketResponse struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 // CreateNotebookRequest represents a request to create a notebook
 type CreateNotebookRequest struct {
 	Title string `json:"title"`
@@ -101,6 +363,9 @@ type CreateNotebookRequest struct {
 type UpdateNotebookRequest struct {
 	Title     string `json:"title"`
 	SortOrder *int   `json:"sort_order,omitempty"`
+	// Version, like an If-Match header, applies the update only if the
+	// notebook is still at this version
+	Version *int64 `json:"version,omitempty"`
 }
 
 // CreateNoteRequest represents a request to create a note
@@ -109,7 +374,11 @@ type CreateNoteRequest struct {
 	PlainText  string          `json:"plain_text,omitempty"`
 	IsTodo     bool            `json:"is_todo"`
 	ReminderAt *time.Time      `json:"reminder_at,omitempty"`
+	IsPinned   bool            `json:"is_pinned"`
+	IsStarred  bool            `json:"is_starred"`
 	TagIDs     []uuid.UUID     `json:"tag_ids,omitempty"`
+	// ParentNoteID makes the note a reply in the thread of that note
+	ParentNoteID *uuid.UUID `json:"parent_note_id,omitempty"`
 }
 
 // UpdateNoteRequest represents a request to update a note
@@ -119,21 +388,152 @@ type UpdateNoteRequest struct {
 	IsTodo     *bool           `json:"is_todo,omitempty"`
 	IsDone     *bool           `json:"is_done,omitempty"`
 	ReminderAt *time.Time      `json:"reminder_at,omitempty"`
+	IsPinned   *bool           `json:"is_pinned,omitempty"`
+	IsStarred  *bool           `json:"is_starred,omitempty"`
 	TagIDs     []uuid.UUID     `json:"tag_ids,omitempty"`
+	// Archived archives the note when true and brings it back when false
+	Archived *bool `json:"archived,omitempty"`
+	// Version, like an If-Match header, applies the update only if the note
+	// is still at this version
+	Version *int64 `json:"version,omitempty"`
 }
 
 // SyncRequest represents a request to sync changes
 type SyncRequest struct {
-	Notes     []Note     `json:"notes,omitempty"`
+	Cursor    string     `json:"cursor,omitempty"`
+	Notes     []SyncNote `json:"notes,omitempty"`
 	Notebooks []Notebook `json:"notebooks,omitempty"`
 	Tags      []Tag      `json:"tags,omitempty"`
+	Images    []Image    `json:"images,omitempty"`
+}
+
+// SyncNote is a note pushed to POST /api/sync. Clients from before notes
+// could be pinned, starred and archived leave those fields out, so the ones
+// a client sent are recorded and the rest keep the server's values.
+type SyncNote struct {
+	Note
+	HasPinned   bool `json:"-"`
+	HasStarred  bool `json:"-"`
+	HasArchived bool `json:"-"`
+}
+
+// UnmarshalJSON decodes the note and records which of the pinned, starred
+// and archived fields it carried
+func (n *SyncNote) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &n.Note); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	_, n.HasPinned = fields["is_pinned"]
+	_, n.HasStarred = fields["is_starred"]
+	_, n.HasArchived = fields["archived_at"]
+	return nil
+}
+
+// TrashResponse lists the notebooks and notes a user has deleted that
+// haven't been purged yet
+type TrashResponse struct {
+	Notebooks []Notebook `json:"notebooks"`
+	Notes     []Note     `json:"notes"`
+}
+
+// NoteDiffResponse compares the content of two revisions of a note block by
+// block
+type NoteDiffResponse struct {
+	NoteID uuid.UUID          `json:"note_id"`
+	From   int64              `json:"from"`
+	To     int64              `json:"to"`
+	Blocks []tiptap.BlockDiff `json:"blocks"`
 }
 
-// SyncResponse represents the response with changes since a timestamp
+// SyncResponse represents the response with changes since a sync cursor.
+// Archived lists the IDs of archived notes left out of Notes when a device
+// asks not to receive them, so it knows to drop its copies.
 type SyncResponse struct {
-	Notes       []Note     `json:"notes"`
-	Notebooks   []Notebook `json:"notebooks"`
-	Tags        []Tag      `json:"tags"`
-	ServerTime  time.Time  `json:"server_time"`
-	HasConflict bool       `json:"has_conflict"`
+	Notes       []Note         `json:"notes"`
+	Archived    []uuid.UUID    `json:"archived,omitempty"`
+	Notebooks   []Notebook     `json:"notebooks"`
+	Tags        []Tag          `json:"tags"`
+	Images      []Image        `json:"images"`
+	Cursor      string         `json:"cursor"`
+	HasMore     bool           `json:"has_more"`
+	ServerTime  time.Time      `json:"server_time"`
+	HasConflict bool           `json:"has_conflict"`
+	Results     []SyncResult   `json:"results,omitempty"`
+	Conflicts   []SyncConflict `json:"conflicts,omitempty"`
+}
+
+// Entity types, operations and statuses reported for pushed sync items
+const (
+	SyncEntityNotebook = "notebook"
+	SyncEntityNote     = "note"
+	SyncEntityTag      = "tag"
+	SyncEntityImage    = "image"
+
+	SyncOpCreate = "create"
+	SyncOpUpdate = "update"
+	SyncOpDelete = "delete"
+
+	SyncStatusApplied  = "applied"
+	SyncStatusMerged   = "merged"
+	SyncStatusConflict = "conflict"
+	SyncStatusRejected = "rejected"
+	SyncStatusFailed   = "failed"
+)
+
+// SyncResult reports the outcome of one item pushed to POST /api/sync
+type SyncResult struct {
+	EntityType string    `json:"entity_type"`
+	ID         uuid.UUID `json:"id"`
+	Operation  string    `json:"operation"`
+	Status     string    `json:"status"`
+	Version    *int64    `json:"version,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// SyncConflict describes a pushed item the server did not apply, along with
+// the server's copy so the client can resolve it
+type SyncConflict struct {
+	EntityType    string      `json:"entity_type"`
+	ID            uuid.UUID   `json:"id"`
+	ClientVersion *int64      `json:"client_version,omitempty"`
+	ServerVersion *int64      `json:"server_version,omitempty"`
+	Server        interface{} `json:"server,omitempty"`
+	CopyID        *uuid.UUID  `json:"copy_id,omitempty"`
+	Reason        string      `json:"reason"`
+}
+
+// IdempotencyKey is the stored result of a request sent with an
+// Idempotency-Key header
+type IdempotencyKey struct {
+	UserID       uuid.UUID
+	Key          string
+	RequestHash  string
+	StatusCode   int
+	ResponseBody json.RawMessage
+	CreatedAt    time.Time
+}
+
+// PurgeResult reports what a purge removed
+type PurgeResult struct {
+	Notebooks   int
+	Notes       int
+	Tags        int
+	Images      int
+	StorageKeys []string
+}
+
+// ChangeSet holds one page of entities changed after a sync cursor, as read
+// from the change feed. Cursor is the change sequence to resume from next
+// time and HasMore reports whether further pages remain.
+type ChangeSet struct {
+	Notebooks []Notebook
+	Notes     []Note
+	Tags      []Tag
+	Images    []Image
+	Cursor    int64
+	HasMore   bool
 }
@@ -0,0 +1,102 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/noted/server/internal/oidc"
+	"github.com/noted/server/internal/oidc/oidctest"
+)
+
+const redirectURL = "http://app.test/callback"
+
+func newProvider(idp *oidctest.Provider, clientID string) *oidc.Provider {
+	return oidc.NewProvider(oidc.Config{
+		IssuerURL:    idp.URL,
+		ClientID:     clientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  redirectURL,
+	})
+}
+
+// authorize follows the provider's authorization endpoint and returns the
+// code it redirects back with
+func authorize(t *testing.T, authURL, wantState string) string {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorization request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d", resp.StatusCode)
+	}
+	if got := location.Query().Get("state"); got != wantState {
+		t.Fatalf("got state %q, want %q", got, wantState)
+	}
+	return location.Query().Get("code")
+}
+
+func TestExchange(t *testing.T) {
+	idp := oidctest.NewProvider(oidctest.User{Subject: "user-1", Email: "sso@example.com", EmailVerified: true})
+	defer idp.Close()
+	ctx := context.Background()
+
+	p := newProvider(idp, oidctest.ClientID)
+	verifier, _ := oidc.NewVerifier()
+	authURL, err := p.AuthURL(ctx, "state-1", "nonce-1", verifier)
+	if err != nil {
+		t.Fatalf("failed to build auth URL: %v", err)
+	}
+	code := authorize(t, authURL, "state-1")
+
+	identity, err := p.Exchange(ctx, code, verifier, "nonce-1")
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+	if identity.Subject != "user-1" || identity.Email != "sso@example.com" || !identity.EmailVerified {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+
+	// Codes are single-use
+	if _, err := p.Exchange(ctx, code, verifier, "nonce-1"); err == nil {
+		t.Error("expected a reused code to fail")
+	}
+}
+
+func TestExchangeRejectsWrongVerifierAndNonce(t *testing.T) {
+	idp := oidctest.NewProvider(oidctest.User{Subject: "user-1", Email: "sso@example.com", EmailVerified: true})
+	defer idp.Close()
+	ctx := context.Background()
+
+	p := newProvider(idp, oidctest.ClientID)
+	verifier, _ := oidc.NewVerifier()
+	other, _ := oidc.NewVerifier()
+
+	authURL, _ := p.AuthURL(ctx, "state", "nonce", verifier)
+	if _, err := p.Exchange(ctx, authorize(t, authURL, "state"), other, "nonce"); err == nil {
+		t.Error("expected a wrong code verifier to fail")
+	}
+
+	authURL, _ = p.AuthURL(ctx, "state", "nonce", verifier)
+	_, err := p.Exchange(ctx, authorize(t, authURL, "state"), verifier, "other-nonce")
+	if !errors.Is(err, oidc.ErrInvalidIDToken) {
+		t.Errorf("got error %v, want %v", err, oidc.ErrInvalidIDToken)
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	// The example from RFC 7636 appendix B
+	got := oidc.Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,179 @@
+// Package purge permanently removes soft-deleted data once it has been kept
+// for the configured retention period.
+package purge
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/storage"
+)
+
+// idempotencyKeyTTL is how long stored sync responses can be replayed
+const idempotencyKeyTTL = 24 * time.Hour
+
+// Store is the subset of store.Store the worker needs
+type Store interface {
+	PurgeDeleted(ctx context.Context, before time.Time) (*models.PurgeResult, error)
+	PurgeDeletedUsers(ctx context.Context) (*models.PurgeResult, error)
+	DeleteIdempotencyKeysBefore(ctx context.Context, before time.Time) (int, error)
+	ThinNoteRevisions(ctx context.Context, hourlyBefore, dailyBefore time.Time, deleteBefore *time.Time) (int, error)
+	DeleteSessionsBefore(ctx context.Context, before time.Time) (int, error)
+	DeleteUserTokensBefore(ctx context.Context, before time.Time) (int, error)
+	DeleteRateLimitsBefore(ctx context.Context, before time.Time) (int, error)
+}
+
+// RevisionPolicy decides which note revisions are kept. All revisions are
+// kept for KeepAll, then one per hour until KeepHourly and one per day after
+// that. Daily revisions are removed after Retention, unless it is 0.
+type RevisionPolicy struct {
+	KeepAll    time.Duration
+	KeepHourly time.Duration
+	Retention  time.Duration
+}
+
+// Worker periodically purges tombstones older than the retention period,
+// along with the blobs of the images removed with them, and thins out old
+// note revisions
+type Worker struct {
+	store     Store
+	blobStore storage.BlobStore
+	retention time.Duration
+	interval  time.Duration
+	revisions RevisionPolicy
+	now       func() time.Time
+
+	// accounts asks Run to purge deleted accounts ahead of the next pass
+	accounts chan struct{}
+}
+
+// NewWorker creates a purge worker
+func NewWorker(s Store, blobStore storage.BlobStore, retention, interval time.Duration, revisions RevisionPolicy) *Worker {
+	return &Worker{
+		store:     s,
+		blobStore: blobStore,
+		retention: retention,
+		interval:  interval,
+		revisions: revisions,
+		now:       time.Now,
+		accounts:  make(chan struct{}, 1),
+	}
+}
+
+// PurgeAccounts asks the worker to purge deleted accounts now rather than at
+// its next pass. It doesn't wait for the purge, and requests made while one
+// is pending are merged into it.
+func (w *Worker) PurgeAccounts() {
+	select {
+	case w.accounts <- struct{}{}:
+	default:
+	}
+}
+
+// Run purges once immediately and then every interval until ctx is
+// cancelled, purging deleted accounts in between when asked to
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	run := func(purge func(context.Context) error) {
+		if err := purge(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("purge: %v", err)
+		}
+	}
+
+	run(w.RunOnce)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.accounts:
+			run(w.purgeAccounts)
+		case <-ticker.C:
+			run(w.RunOnce)
+		}
+	}
+}
+
+// RunOnce performs a single purge pass
+func (w *Worker) RunOnce(ctx context.Context) error {
+	now := w.now()
+
+	result, err := w.store.PurgeDeleted(ctx, now.Add(-w.retention))
+	if err != nil {
+		return err
+	}
+
+	w.deleteBlobs(ctx, result.StorageKeys)
+
+	// Deleted accounts are purged when they are deleted; this catches
+	// anything that was interrupted or written afterwards
+	if err := w.purgeAccounts(ctx); err != nil {
+		return err
+	}
+
+	keys, err := w.store.DeleteIdempotencyKeysBefore(ctx, now.Add(-idempotencyKeyTTL))
+	if err != nil {
+		return err
+	}
+
+	var deleteRevisionsBefore *time.Time
+	if w.revisions.Retention > 0 {
+		before := now.Add(-w.revisions.Retention)
+		deleteRevisionsBefore = &before
+	}
+	revisions, err := w.store.ThinNoteRevisions(ctx,
+		now.Add(-w.revisions.KeepAll), now.Add(-w.revisions.KeepHourly), deleteRevisionsBefore)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := w.store.DeleteSessionsBefore(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := w.store.DeleteUserTokensBefore(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	limits, err := w.store.DeleteRateLimitsBefore(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	if result.Notebooks+result.Notes+result.Tags+result.Images+keys+revisions+sessions+tokens+limits > 0 {
+		log.Printf("purge: removed %d notebooks, %d notes, %d tags, %d images, %d idempotency keys, %d note revisions, %d ended sessions, %d emailed tokens and %d rate limits",
+			result.Notebooks, result.Notes, result.Tags, result.Images, keys, revisions, sessions, tokens, limits)
+	}
+	return nil
+}
+
+// purgeAccounts removes everything deleted accounts owned
+func (w *Worker) purgeAccounts(ctx context.Context) error {
+	accounts, err := w.store.PurgeDeletedUsers(ctx)
+	if err != nil {
+		return err
+	}
+	w.deleteBlobs(ctx, accounts.StorageKeys)
+
+	if accounts.Notebooks+accounts.Notes+accounts.Tags+accounts.Images > 0 {
+		log.Printf("purge: removed %d notebooks, %d notes, %d tags and %d images of deleted accounts",
+			accounts.Notebooks, accounts.Notes, accounts.Tags, accounts.Images)
+	}
+	return nil
+}
+
+// deleteBlobs removes the blobs of purged images. Rows are gone at this
+// point, so a blob that fails to delete is only orphaned storage; log it
+// and carry on.
+func (w *Worker) deleteBlobs(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := w.blobStore.Delete(ctx, key); err != nil {
+			log.Printf("purge: failed to delete blob %s: %v", key, err)
+		}
+	}
+}
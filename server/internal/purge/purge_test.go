@@ -0,0 +1,180 @@
+package purge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/noted/server/internal/models"
+	"github.com/noted/server/internal/testutil"
+)
+
+type fakeStore struct {
+	result         *models.PurgeResult
+	accounts       *models.PurgeResult
+	err            error
+	purgedBefore   time.Time
+	keysBefore     time.Time
+	sessionsBefore time.Time
+	tokensBefore   time.Time
+	limitsBefore   time.Time
+
+	// accountPurges receives a value each time deleted accounts are purged
+	accountPurges chan struct{}
+
+	revisionsHourlyBefore time.Time
+	revisionsDailyBefore  time.Time
+	revisionsDeleteBefore *time.Time
+}
+
+func (f *fakeStore) PurgeDeleted(ctx context.Context, before time.Time) (*models.PurgeResult, error) {
+	f.purgedBefore = before
+	return f.result, f.err
+}
+
+func (f *fakeStore) PurgeDeletedUsers(ctx context.Context) (*models.PurgeResult, error) {
+	if f.accountPurges != nil {
+		f.accountPurges <- struct{}{}
+	}
+	if f.accounts == nil {
+		return &models.PurgeResult{}, nil
+	}
+	return f.accounts, nil
+}
+
+func (f *fakeStore) DeleteIdempotencyKeysBefore(ctx context.Context, before time.Time) (int, error) {
+	f.keysBefore = before
+	return 0, nil
+}
+
+func (f *fakeStore) ThinNoteRevisions(ctx context.Context, hourlyBefore, dailyBefore time.Time, deleteBefore *time.Time) (int, error) {
+	f.revisionsHourlyBefore = hourlyBefore
+	f.revisionsDailyBefore = dailyBefore
+	f.revisionsDeleteBefore = deleteBefore
+	return 0, nil
+}
+
+func (f *fakeStore) DeleteSessionsBefore(ctx context.Context, before time.Time) (int, error) {
+	f.sessionsBefore = before
+	return 0, nil
+}
+
+func (f *fakeStore) DeleteUserTokensBefore(ctx context.Context, before time.Time) (int, error) {
+	f.tokensBefore = before
+	return 0, nil
+}
+
+func (f *fakeStore) DeleteRateLimitsBefore(ctx context.Context, before time.Time) (int, error) {
+	f.limitsBefore = before
+	return 0, nil
+}
+
+func TestRunOnceDeletesBlobs(t *testing.T) {
+	ctx := context.Background()
+	blobStore := testutil.TestBlobStore(t)
+
+	for _, key := range []string{"purged.png", "account.png", "kept.png"} {
+		if err := blobStore.Put(ctx, key, bytes.NewReader([]byte("img")), "image/png", 3); err != nil {
+			t.Fatalf("failed to put blob: %v", err)
+		}
+	}
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := &fakeStore{
+		result:   &models.PurgeResult{Images: 1, StorageKeys: []string{"purged.png"}},
+		accounts: &models.PurgeResult{Images: 1, StorageKeys: []string{"account.png"}},
+	}
+	w := NewWorker(s, blobStore, 30*24*time.Hour, time.Hour, RevisionPolicy{
+		KeepAll:    24 * time.Hour,
+		KeepHourly: 7 * 24 * time.Hour,
+		Retention:  365 * 24 * time.Hour,
+	})
+	w.now = func() time.Time { return now }
+
+	if err := w.RunOnce(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := now.Add(-30 * 24 * time.Hour); !s.purgedBefore.Equal(want) {
+		t.Errorf("purged before %v, want %v", s.purgedBefore, want)
+	}
+	if want := now.Add(-idempotencyKeyTTL); !s.keysBefore.Equal(want) {
+		t.Errorf("expired idempotency keys before %v, want %v", s.keysBefore, want)
+	}
+	if want := now.Add(-24 * time.Hour); !s.revisionsHourlyBefore.Equal(want) {
+		t.Errorf("thinned revisions to hourly before %v, want %v", s.revisionsHourlyBefore, want)
+	}
+	if want := now.Add(-7 * 24 * time.Hour); !s.revisionsDailyBefore.Equal(want) {
+		t.Errorf("thinned revisions to daily before %v, want %v", s.revisionsDailyBefore, want)
+	}
+	if want := now.Add(-365 * 24 * time.Hour); s.revisionsDeleteBefore == nil || !s.revisionsDeleteBefore.Equal(want) {
+		t.Errorf("deleted revisions before %v, want %v", s.revisionsDeleteBefore, want)
+	}
+	if !s.sessionsBefore.Equal(now) {
+		t.Errorf("deleted sessions ended before %v, want %v", s.sessionsBefore, now)
+	}
+	if !s.tokensBefore.Equal(now) {
+		t.Errorf("deleted emailed tokens before %v, want %v", s.tokensBefore, now)
+	}
+	if !s.limitsBefore.Equal(now) {
+		t.Errorf("deleted rate limits before %v, want %v", s.limitsBefore, now)
+	}
+
+	if exists, _ := blobStore.Exists(ctx, "purged.png"); exists {
+		t.Error("expected the purged image's blob to be deleted")
+	}
+	if exists, _ := blobStore.Exists(ctx, "account.png"); exists {
+		t.Error("expected the deleted account's blob to be deleted")
+	}
+	if exists, _ := blobStore.Exists(ctx, "kept.png"); !exists {
+		t.Error("expected other blobs to be kept")
+	}
+}
+
+func TestRunOnceReportsStoreErrors(t *testing.T) {
+	s := &fakeStore{err: errors.New("database unavailable")}
+	w := NewWorker(s, testutil.TestBlobStore(t), time.Hour, time.Hour, RevisionPolicy{})
+
+	if err := w.RunOnce(context.Background()); err == nil {
+		t.Error("expected the store error to be returned")
+	}
+}
+
+func TestRunOnceKeepsRevisionsWithoutRetention(t *testing.T) {
+	s := &fakeStore{result: &models.PurgeResult{}}
+	w := NewWorker(s, testutil.TestBlobStore(t), time.Hour, time.Hour, RevisionPolicy{
+		KeepAll:    time.Hour,
+		KeepHourly: 24 * time.Hour,
+	})
+
+	if err := w.RunOnce(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.revisionsDeleteBefore != nil {
+		t.Errorf("expected daily revisions to be kept, got deleted before %v", s.revisionsDeleteBefore)
+	}
+}
+
+func TestPurgeAccountsRunsBeforeNextPass(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &fakeStore{result: &models.PurgeResult{}, accountPurges: make(chan struct{}, 1)}
+	w := NewWorker(s, testutil.TestBlobStore(t), time.Hour, time.Hour, RevisionPolicy{})
+	go w.Run(ctx)
+
+	waitForPurge := func(what string) {
+		t.Helper()
+		select {
+		case <-s.accountPurges:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the %s", what)
+		}
+	}
+
+	waitForPurge("first pass")
+	w.PurgeAccounts()
+	waitForPurge("requested account purge")
+}
@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often full buckets are dropped from memory
+const sweepInterval = time.Minute
+
+// memoryLimiter keeps buckets in memory, so each server instance has its
+// own limits
+type memoryLimiter struct {
+	mu      sync.Mutex
+	tats    map[string]time.Time
+	sweptAt time.Time
+	now     func() time.Time
+}
+
+// NewMemoryLimiter returns a limiter for a single server instance
+func NewMemoryLimiter() Limiter {
+	return &memoryLimiter{tats: make(map[string]time.Time), now: time.Now}
+}
+
+func (l *memoryLimiter) Allow(ctx context.Context, key string, rate Rate) (Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.sweptAt) >= sweepInterval {
+		// A bucket whose arrival time has passed is full, the same as a
+		// missing one
+		for k, tat := range l.tats {
+			if tat.Before(now) {
+				delete(l.tats, k)
+			}
+		}
+		l.sweptAt = now
+	}
+
+	tat, result := take(l.tats[key], now, rate)
+	l.tats[key] = tat
+	return result, nil
+}
@@ -0,0 +1,51 @@
+// Package ratelimit limits how often clients can make requests using token
+// buckets. Buckets are tracked with the generic cell rate algorithm, which
+// needs a single timestamp per key, so they can be kept in memory or shared
+// between instances through the database.
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Rate is the size of a bucket and how quickly it refills
+type Rate struct {
+	Limit  int           // Requests allowed in a burst
+	Period time.Duration // Time for an empty bucket to refill
+}
+
+// PerMinute returns a rate of n requests a minute, all of which can be made
+// at once
+func PerMinute(n int) Rate {
+	return Rate{Limit: n, Period: time.Minute}
+}
+
+// interval is the time it takes to refill one token
+func (r Rate) interval() time.Duration {
+	return r.Period / time.Duration(r.Limit)
+}
+
+// Result is the outcome of taking a token
+type Result struct {
+	Allowed    bool
+	RetryAfter time.Duration // How long until a token is available, when not allowed
+}
+
+// Limiter takes tokens from buckets identified by key
+type Limiter interface {
+	Allow(ctx context.Context, key string, rate Rate) (Result, error)
+}
+
+// take works out the bucket's next theoretical arrival time after taking a
+// token at now. The bucket is empty once tat is a whole period ahead of now.
+func take(tat, now time.Time, rate Rate) (time.Time, Result) {
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(rate.interval())
+	if wait := next.Sub(now) - rate.Period; wait > 0 {
+		return tat, Result{RetryAfter: wait}
+	}
+	return next, Result{Allowed: true}
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiterBurst(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := NewMemoryLimiter().(*memoryLimiter)
+	l.now = func() time.Time { return now }
+	rate := PerMinute(3)
+
+	for i := 0; i < 3; i++ {
+		result, err := l.Allow(ctx, "login:ip:192.0.2.1", rate)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !result.Allowed {
+			t.Fatalf("request %d: expected to be allowed", i+1)
+		}
+	}
+
+	result, _ := l.Allow(ctx, "login:ip:192.0.2.1", rate)
+	if result.Allowed {
+		t.Fatal("expected the fourth request to be limited")
+	}
+	if result.RetryAfter != 20*time.Second {
+		t.Errorf("got retry after %v, want %v", result.RetryAfter, 20*time.Second)
+	}
+
+	// Other keys have their own buckets
+	if result, _ := l.Allow(ctx, "login:ip:192.0.2.2", rate); !result.Allowed {
+		t.Error("expected another address to be allowed")
+	}
+}
+
+func TestMemoryLimiterRefills(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := NewMemoryLimiter().(*memoryLimiter)
+	l.now = func() time.Time { return now }
+	rate := PerMinute(2)
+
+	l.Allow(ctx, "key", rate)
+	l.Allow(ctx, "key", rate)
+	if result, _ := l.Allow(ctx, "key", rate); result.Allowed {
+		t.Fatal("expected the bucket to be empty")
+	}
+
+	// One token comes back every 30 seconds
+	now = now.Add(30 * time.Second)
+	if result, _ := l.Allow(ctx, "key", rate); !result.Allowed {
+		t.Error("expected a token after one interval")
+	}
+	if result, _ := l.Allow(ctx, "key", rate); result.Allowed {
+		t.Error("expected only one token after one interval")
+	}
+
+	// Full buckets are swept from memory
+	now = now.Add(time.Hour)
+	l.Allow(ctx, "other", rate)
+	if _, ok := l.tats["key"]; ok {
+		t.Error("expected the full bucket to be swept")
+	}
+}
+
+func TestTakeLimitedDoesNotAdvance(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	rate := Rate{Limit: 1, Period: time.Minute}
+
+	tat, result := take(time.Time{}, now, rate)
+	if !result.Allowed || !tat.Equal(now.Add(time.Minute)) {
+		t.Fatalf("got %v, %+v; want an allowed request and the bucket a minute ahead", tat, result)
+	}
+
+	// Limited requests don't push the bucket further back
+	next, result := take(tat, now.Add(10*time.Second), rate)
+	if result.Allowed || !next.Equal(tat) {
+		t.Errorf("got %v, %+v; want a limited request and the bucket unchanged", next, result)
+	}
+	if result.RetryAfter != 50*time.Second {
+		t.Errorf("got retry after %v, want %v", result.RetryAfter, 50*time.Second)
+	}
+}
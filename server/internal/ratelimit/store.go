@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the subset of store.Store the shared limiter needs
+type Store interface {
+	// TakeRateLimit takes a token from the bucket for key if one is left
+	// within tolerance, returning the bucket's arrival time afterwards
+	TakeRateLimit(ctx context.Context, key string, now time.Time, interval, tolerance time.Duration) (bool, time.Time, error)
+}
+
+// storeLimiter keeps buckets in the database, so limits hold across every
+// server instance
+type storeLimiter struct {
+	store Store
+	now   func() time.Time
+}
+
+// NewStoreLimiter returns a limiter shared through the database
+func NewStoreLimiter(s Store) Limiter {
+	return &storeLimiter{store: s, now: time.Now}
+}
+
+func (l *storeLimiter) Allow(ctx context.Context, key string, rate Rate) (Result, error) {
+	now := l.now()
+	allowed, tat, err := l.store.TakeRateLimit(ctx, key, now, rate.interval(), rate.Period)
+	if err != nil {
+		return Result{}, err
+	}
+	if allowed {
+		return Result{Allowed: true}, nil
+	}
+
+	// The bucket is unchanged; work out the wait as take would
+	_, result := take(tat, now, rate)
+	return Result{RetryAfter: result.RetryAfter}, nil
+}
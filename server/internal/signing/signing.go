@@ -0,0 +1,340 @@
+// Package signing signs and verifies the server's JWTs with asymmetric
+// keys. Tokens name their key in the kid header, so several keys can verify
+// tokens at once and keys can be rotated without signing anyone out. The
+// public keys are published as a JWKS for other services.
+package signing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// reloadInterval is how often the key directory is read again, picking
+	// up keys generated by other instances
+	reloadInterval = time.Minute
+
+	// activationDelay is how long a new key is published before it signs
+	// tokens, so other instances and services caching the key set have it
+	// by the time tokens signed with it arrive
+	activationDelay = 10 * time.Minute
+)
+
+// ErrInvalidToken is returned by Parse for tokens that fail verification
+var ErrInvalidToken = errors.New("signing: invalid token")
+
+// Config configures a KeySet. With neither Dir nor SigningKeyFile set, a
+// key is generated in memory and tokens don't outlive the process.
+type Config struct {
+	// Dir holds the keys as PEM files, shared by every instance. A new key
+	// is generated there every Rotation, and retired keys are removed once
+	// their tokens have expired.
+	Dir       string
+	Rotation  time.Duration // Zero keeps the first key
+	Algorithm string        // Algorithm of generated keys: EdDSA (default) or RS256
+
+	// Alternatively, SigningKeyFile is a fixed PEM private key, and
+	// VerificationKeyFiles are retired keys whose tokens are still accepted
+	SigningKeyFile       string
+	VerificationKeyFiles []string
+
+	// Retention is the longest lifetime of a signed token, which is how
+	// long a key keeps verifying tokens after it stops signing them
+	Retention time.Duration
+}
+
+// KeySet is the key that signs new tokens and the keys that verify them
+type KeySet struct {
+	config Config
+	now    func() time.Time
+
+	mu      sync.RWMutex
+	signing *Key
+	keys    map[string]*Key
+}
+
+// New loads or creates the keys described by cfg
+func New(cfg Config) (*KeySet, error) {
+	ks := &KeySet{config: cfg, now: time.Now}
+
+	switch {
+	case cfg.Dir != "" && cfg.SigningKeyFile != "":
+		return nil, fmt.Errorf("signing: a key directory and a signing key file can't both be set")
+
+	case cfg.Dir != "":
+		if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+			return nil, fmt.Errorf("signing: failed to create key directory: %w", err)
+		}
+		if err := ks.Rotate(); err != nil {
+			return nil, err
+		}
+
+	case cfg.SigningKeyFile != "":
+		key, err := readKeyFile(cfg.SigningKeyFile, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		if key.private == nil {
+			return nil, fmt.Errorf("signing: %s is not a private key", cfg.SigningKeyFile)
+		}
+		keys := []*Key{key}
+		for _, path := range cfg.VerificationKeyFiles {
+			key, err := readKeyFile(path, time.Time{})
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		ks.setKeys(keys[0], keys)
+
+	default:
+		key, err := generateKey(cfg.Algorithm, ks.now())
+		if err != nil {
+			return nil, fmt.Errorf("signing: failed to generate key: %w", err)
+		}
+		ks.setKeys(key, []*Key{key})
+	}
+
+	return ks, nil
+}
+
+// Sign returns a token for claims signed with the current key
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	ks.mu.RLock()
+	key := ks.signing
+	ks.mu.RUnlock()
+
+	token := jwt.NewWithClaims(key.signingMethod(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.private)
+}
+
+// Parse verifies a token signed by one of the set's keys and decodes its
+// claims
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(tokenString, claims, ks.verificationKey,
+		jwt.WithValidMethods([]string{AlgorithmEdDSA, AlgorithmRS256}),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return nil
+}
+
+func (ks *KeySet) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	ks.mu.RLock()
+	key, ok := ks.keys[kid]
+	ks.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	// A key only verifies tokens signed with its own algorithm
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+// Keys returns the public keys that verify tokens, newest first
+func (ks *KeySet) Keys() []JWK {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	keys := make([]*Key, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		keys = append(keys, key)
+	}
+	sortNewestFirst(keys)
+
+	jwks := make([]JWK, len(keys))
+	for i, key := range keys {
+		jwks[i] = key.JWK()
+	}
+	return jwks
+}
+
+// Run rotates the keys in the key directory until ctx is cancelled. It
+// returns straight away for keys that don't come from a directory.
+func (ks *KeySet) Run(ctx context.Context) {
+	if ks.config.Dir == "" {
+		return
+	}
+
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ks.Rotate(); err != nil {
+				log.Printf("signing: %v", err)
+			}
+		}
+	}
+}
+
+// Rotate reads the key directory, generating a key if the newest one is due
+// for rotation and removing keys whose tokens have all expired
+func (ks *KeySet) Rotate() error {
+	now := ks.now()
+
+	keys, err := ks.readDir()
+	if err != nil {
+		return err
+	}
+	sortNewestFirst(keys)
+
+	if len(keys) == 0 || (ks.config.Rotation > 0 && now.Sub(keys[0].CreatedAt) >= ks.config.Rotation) {
+		key, err := ks.writeNewKey(now)
+		if err != nil {
+			return err
+		}
+		keys = append([]*Key{key}, keys...)
+	}
+
+	// The newest key that has been published long enough signs. Until one
+	// has, which is only the case for the very first key, the oldest does.
+	signing := keys[len(keys)-1]
+	for _, key := range keys {
+		if now.Sub(key.CreatedAt) >= activationDelay {
+			signing = key
+			break
+		}
+	}
+
+	// Older keys stopped signing when the signing key became active, and
+	// are removed once the last of their tokens has expired
+	retiredAt := signing.CreatedAt.Add(activationDelay)
+	var kept []*Key
+	for _, key := range keys {
+		if key.CreatedAt.Before(signing.CreatedAt) && now.Sub(retiredAt) > ks.config.Retention {
+			// Another instance may have removed it already
+			if err := os.Remove(key.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("signing: failed to remove retired key: %v", err)
+			}
+			continue
+		}
+		kept = append(kept, key)
+	}
+
+	ks.setKeys(signing, kept)
+	return nil
+}
+
+func (ks *KeySet) setKeys(signing *Key, keys []*Key) {
+	byID := make(map[string]*Key, len(keys))
+	for _, key := range keys {
+		byID[key.ID] = key
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.signing = signing
+	ks.keys = byID
+}
+
+// readDir loads the keys in the key directory. Files are named after the
+// time the key was created, as <unix seconds>-<key ID prefix>.pem.
+func (ks *KeySet) readDir() ([]*Key, error) {
+	entries, err := os.ReadDir(ks.config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("signing: failed to read key directory: %w", err)
+	}
+
+	var keys []*Key
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".pem") {
+			continue
+		}
+		created, _, _ := strings.Cut(strings.TrimSuffix(name, ".pem"), "-")
+		unix, err := strconv.ParseInt(created, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("signing: unexpected file %s in key directory", name)
+		}
+
+		key, err := readKeyFile(filepath.Join(ks.config.Dir, name), time.Unix(unix, 0))
+		if err != nil {
+			return nil, err
+		}
+		if key.private == nil {
+			return nil, fmt.Errorf("signing: %s is not a private key", name)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// writeNewKey generates a key in the key directory. The file is renamed
+// into place so other instances never read it half-written.
+func (ks *KeySet) writeNewKey(now time.Time) (*Key, error) {
+	key, err := generateKey(ks.config.Algorithm, now.Truncate(time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("signing: failed to generate key: %w", err)
+	}
+	data, err := key.marshalPrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("signing: failed to encode key: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(ks.config.Dir, ".key-*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("signing: failed to write key: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("signing: failed to write key: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("signing: failed to write key: %w", err)
+	}
+
+	key.path = filepath.Join(ks.config.Dir, fmt.Sprintf("%d-%s.pem", key.CreatedAt.Unix(), key.ID[:8]))
+	if err := os.Rename(tmp.Name(), key.path); err != nil {
+		return nil, fmt.Errorf("signing: failed to write key: %w", err)
+	}
+	return key, nil
+}
+
+func readKeyFile(path string, createdAt time.Time) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("signing: failed to read key: %w", err)
+	}
+	key, err := parseKey(data, createdAt)
+	if err != nil {
+		return nil, fmt.Errorf("signing: invalid key in %s: %w", path, err)
+	}
+	key.path = path
+	return key, nil
+}
+
+// sortNewestFirst orders keys by creation time, breaking ties by ID so
+// every instance picks the same signing key
+func sortNewestFirst(keys []*Key) {
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.After(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+}
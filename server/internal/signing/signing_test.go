@@ -0,0 +1,176 @@
+package signing
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testClaims() *jwt.RegisteredClaims {
+	return &jwt.RegisteredClaims{
+		Subject:   "user",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+}
+
+func TestSignAndParse(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmEdDSA, AlgorithmRS256} {
+		t.Run(algorithm, func(t *testing.T) {
+			ks, err := New(Config{Algorithm: algorithm})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			token, err := ks.Sign(testClaims())
+			if err != nil {
+				t.Fatalf("failed to sign: %v", err)
+			}
+
+			claims := &jwt.RegisteredClaims{}
+			if err := ks.Parse(token, claims); err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if claims.Subject != "user" {
+				t.Errorf("got subject %q, want %q", claims.Subject, "user")
+			}
+
+			keys := ks.Keys()
+			if len(keys) != 1 || keys[0].Alg != algorithm {
+				t.Fatalf("got keys %+v, want one %s key", keys, algorithm)
+			}
+
+			// Tokens from other key sets are rejected
+			other, _ := New(Config{Algorithm: algorithm})
+			foreign, _ := other.Sign(testClaims())
+			if err := ks.Parse(foreign, &jwt.RegisteredClaims{}); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("foreign token: got %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
+
+func TestParseRejectsSymmetricTokens(t *testing.T) {
+	ks, _ := New(Config{})
+	kid := ks.Keys()[0].Kid
+
+	// An HMAC token keyed with the public key must not verify
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+	token.Header["kid"] = kid
+	signed, _ := token.SignedString([]byte(ks.Keys()[0].X))
+	if err := ks.Parse(signed, &jwt.RegisteredClaims{}); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("got %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestKeyDirectoryRotation(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{Dir: dir, Rotation: 24 * time.Hour, Retention: 15 * time.Minute}
+
+	ks, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	oldToken, _ := ks.Sign(testClaims())
+
+	// Other instances share the directory's keys
+	other, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := other.Parse(oldToken, &jwt.RegisteredClaims{}); err != nil {
+		t.Fatalf("expected another instance to verify the token: %v", err)
+	}
+
+	start := time.Now()
+	at := func(d time.Duration) {
+		ks.now = func() time.Time { return start.Add(d) }
+		if err := ks.Rotate(); err != nil {
+			t.Fatalf("failed to rotate: %v", err)
+		}
+	}
+
+	// A new key is published but doesn't sign until it has been around for
+	// a while
+	at(25 * time.Hour)
+	if n := len(ks.Keys()); n != 2 {
+		t.Fatalf("got %d keys, want 2", n)
+	}
+	if token, _ := ks.Sign(testClaims()); kid(t, token) != kid(t, oldToken) {
+		t.Error("expected the old key to sign until the new one is active")
+	}
+
+	at(25*time.Hour + activationDelay)
+	newToken, _ := ks.Sign(testClaims())
+	if kid(t, newToken) == kid(t, oldToken) {
+		t.Error("expected the new key to sign once active")
+	}
+	if err := ks.Parse(oldToken, &jwt.RegisteredClaims{}); err != nil {
+		t.Errorf("expected the old key to still verify: %v", err)
+	}
+
+	// Once its tokens have expired the old key is removed
+	at(25*time.Hour + activationDelay + cfg.Retention + time.Minute)
+	if n := len(ks.Keys()); n != 1 {
+		t.Errorf("got %d keys, want 1", n)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.pem")); len(files) != 1 {
+		t.Errorf("got %d key files, want 1", len(files))
+	}
+}
+
+func TestKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string) (string, *KeySet) {
+		key, err := generateKey(AlgorithmEdDSA, time.Now())
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		data, _ := key.marshalPrivateKey()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("failed to write key: %v", err)
+		}
+		ks, err := New(Config{SigningKeyFile: path})
+		if err != nil {
+			t.Fatalf("failed to load key: %v", err)
+		}
+		return path, ks
+	}
+
+	oldPath, oldKeys := write("old.pem")
+	newPath, _ := write("new.pem")
+	oldToken, _ := oldKeys.Sign(testClaims())
+
+	ks, err := New(Config{SigningKeyFile: newPath, VerificationKeyFiles: []string{oldPath}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ks.Parse(oldToken, &jwt.RegisteredClaims{}); err != nil {
+		t.Errorf("expected the retired key to verify: %v", err)
+	}
+	if token, _ := ks.Sign(testClaims()); kid(t, token) == kid(t, oldToken) {
+		t.Error("expected the signing key file to sign")
+	}
+}
+
+func TestThumbprint(t *testing.T) {
+	// RFC 8037, appendix A.3
+	jwk := JWK{Kty: "OKP", Crv: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	if got, want := thumbprint(jwk), "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func kid(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatalf("failed to decode token: %v", err)
+	}
+	id, _ := parsed.Header["kid"].(string)
+	return id
+}
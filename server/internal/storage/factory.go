@@ -17,9 +17,10 @@ type Config struct {
 	Backend Backend
 
 	// Local storage config
-	LocalPath     string
-	SigningSecret string
-	BaseURL       string
+	LocalPath              string
+	SigningSecret          string
+	PreviousSigningSecrets []string
+	BaseURL                string
 
 	// S3 config (for future use)
 	S3Bucket          string
@@ -36,9 +37,10 @@ func New(cfg Config) (BlobStore, error) {
 	switch cfg.Backend {
 	case BackendLocal, "":
 		return NewLocalStore(LocalStoreConfig{
-			BasePath:      cfg.LocalPath,
-			SigningSecret: cfg.SigningSecret,
-			BaseURL:       cfg.BaseURL,
+			BasePath:               cfg.LocalPath,
+			SigningSecret:          cfg.SigningSecret,
+			PreviousSigningSecrets: cfg.PreviousSigningSecrets,
+			BaseURL:                cfg.BaseURL,
 		})
 
 	case BackendS3:
@@ -18,9 +18,19 @@ import (
 
 // LocalStore implements BlobStore using the local filesystem
 type LocalStore struct {
-	basePath      string
-	signingSecret []byte
-	baseURL       string
+	basePath string
+	baseURL  string
+
+	// signingKey signs new URLs; URLs signed with any of verifyKeys are
+	// accepted until they expire
+	signingKey *signingKey
+	verifyKeys map[string]*signingKey
+}
+
+// signingKey is a URL signing secret and the ID URLs name it by
+type signingKey struct {
+	id     string
+	secret []byte
 }
 
 // LocalStoreConfig holds configuration for LocalStore
@@ -28,6 +38,10 @@ type LocalStoreConfig struct {
 	BasePath      string
 	SigningSecret string
 	BaseURL       string // e.g., "/api/images"
+
+	// PreviousSigningSecrets are retired secrets whose URLs are still
+	// accepted, so rotating SigningSecret doesn't break links in notes
+	PreviousSigningSecrets []string
 }
 
 // NewLocalStore creates a new local filesystem blob store
@@ -56,11 +70,31 @@ func NewLocalStore(cfg LocalStoreConfig) (*LocalStore, error) {
 		return nil, fmt.Errorf("failed to get absolute path: %w", err)
 	}
 
-	return &LocalStore{
-		basePath:      absBasePath,
-		signingSecret: signingSecret,
-		baseURL:       cfg.BaseURL,
-	}, nil
+	store := &LocalStore{
+		basePath:   absBasePath,
+		baseURL:    cfg.BaseURL,
+		signingKey: newSigningKey(signingSecret),
+		verifyKeys: make(map[string]*signingKey),
+	}
+	store.verifyKeys[store.signingKey.id] = store.signingKey
+	for _, secret := range cfg.PreviousSigningSecrets {
+		if len(secret) < 32 {
+			log.Println("WARNING: Skipping previous signing secret of less than 32 bytes")
+			continue
+		}
+		key := newSigningKey([]byte(secret))
+		store.verifyKeys[key.id] = key
+	}
+
+	return store, nil
+}
+
+// newSigningKey derives a secret's key ID from the secret itself, so every
+// instance names it the same way without configuring IDs
+func newSigningKey(secret []byte) *signingKey {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("noted-signed-url-key-id"))
+	return &signingKey{id: hex.EncodeToString(h.Sum(nil)[:4]), secret: secret}
 }
 
 // sanitizePath validates and returns a safe file path within basePath
@@ -163,21 +197,36 @@ func (s *LocalStore) Exists(ctx context.Context, key string) (bool, error) {
 // GetSignedURL generates an HMAC-signed URL for accessing the blob
 func (s *LocalStore) GetSignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
 	expires := time.Now().Add(expiry).Unix()
-	sig := s.generateSignature(key, expires)
+	sig := s.signingKey.sign(key, expires)
 
-	// Format: /api/images/{key}?expires={timestamp}&sig={signature}
-	return fmt.Sprintf("%s/%s?expires=%d&sig=%s", s.baseURL, key, expires, sig), nil
+	// Format: /api/images/{key}?expires={timestamp}&kid={key ID}&sig={signature}
+	return fmt.Sprintf("%s/%s?expires=%d&kid=%s&sig=%s", s.baseURL, key, expires, s.signingKey.id, sig), nil
 }
 
-// VerifySignedURL verifies an HMAC signature for a signed URL
-func (s *LocalStore) VerifySignedURL(key string, expires int64, sig string) error {
+// VerifySignedURL verifies an HMAC signature for a signed URL, made with the
+// current secret or a previous one
+func (s *LocalStore) VerifySignedURL(key string, expires int64, keyID, sig string) error {
 	// Check expiration
 	if time.Now().Unix() > expires {
 		return ErrExpired
 	}
 
+	// URLs signed before key IDs were added may be signed with any secret
+	if keyID == "" {
+		for _, signingKey := range s.verifyKeys {
+			if hmac.Equal([]byte(sig), []byte(signingKey.sign(key, expires))) {
+				return nil
+			}
+		}
+		return ErrInvalidSignature
+	}
+
 	// Verify signature
-	expectedSig := s.generateSignature(key, expires)
+	signingKey, ok := s.verifyKeys[keyID]
+	if !ok {
+		return ErrInvalidSignature
+	}
+	expectedSig := signingKey.sign(key, expires)
 	if !hmac.Equal([]byte(sig), []byte(expectedSig)) {
 		return ErrInvalidSignature
 	}
@@ -185,16 +234,16 @@ func (s *LocalStore) VerifySignedURL(key string, expires int64, sig string) erro
 	return nil
 }
 
-// generateSignature creates an HMAC-SHA256 signature
-func (s *LocalStore) generateSignature(key string, expires int64) string {
+// sign creates an HMAC-SHA256 signature
+func (k *signingKey) sign(key string, expires int64) string {
 	message := fmt.Sprintf("%s:%d", key, expires)
-	h := hmac.New(sha256.New, s.signingSecret)
+	h := hmac.New(sha256.New, k.secret)
 	h.Write([]byte(message))
 	return hex.EncodeToString(h.Sum(nil))
 }
 
 // ParseSignedURLParams extracts signature parameters from query strings
-func ParseSignedURLParams(expiresStr, sig, key string) (*SignedURLParams, error) {
+func ParseSignedURLParams(expiresStr, keyID, sig, key string) (*SignedURLParams, error) {
 	if expiresStr == "" || sig == "" {
 		return nil, nil // No signed URL params present
 	}
@@ -207,6 +256,7 @@ func ParseSignedURLParams(expiresStr, sig, key string) (*SignedURLParams, error)
 	return &SignedURLParams{
 		Key:     key,
 		Expires: expires,
+		KeyID:   keyID,
 		Sig:     sig,
 	}, nil
 }
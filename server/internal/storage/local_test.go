@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	oldSecret = "old-signing-secret-at-least-32-characters"
+	newSecret = "new-signing-secret-at-least-32-characters"
+)
+
+func newTestStore(t *testing.T, secret string, previous ...string) *LocalStore {
+	t.Helper()
+	store, err := NewLocalStore(LocalStoreConfig{
+		BasePath:               t.TempDir(),
+		SigningSecret:          secret,
+		PreviousSigningSecrets: previous,
+		BaseURL:                "/api/images",
+	})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	return store
+}
+
+// signedURL returns a signed URL's key ID, expiry and signature
+func signedURL(t *testing.T, store *LocalStore, key string, expiry time.Duration) (string, int64, string) {
+	t.Helper()
+	raw, err := store.GetSignedURL(context.Background(), key, expiry)
+	if err != nil {
+		t.Fatalf("failed to sign URL: %v", err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("invalid signed URL %q: %v", raw, err)
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatalf("invalid expires in %q", raw)
+	}
+	return u.Query().Get("kid"), expires, u.Query().Get("sig")
+}
+
+func TestSignedURLRotation(t *testing.T) {
+	oldStore := newTestStore(t, oldSecret)
+	oldKeyID, expires, sig := signedURL(t, oldStore, "image", time.Hour)
+	if oldKeyID == "" {
+		t.Fatal("expected signed URL to have a key ID")
+	}
+
+	// After rotation, URLs signed with the old secret still verify
+	rotated := newTestStore(t, newSecret, oldSecret)
+	if err := rotated.VerifySignedURL("image", expires, oldKeyID, sig); err != nil {
+		t.Errorf("expected old URL to verify after rotation, got %v", err)
+	}
+
+	// New URLs are signed with the new secret
+	newKeyID, expires, sig := signedURL(t, rotated, "image", time.Hour)
+	if newKeyID == oldKeyID {
+		t.Error("expected new URLs to use the new key")
+	}
+	if err := rotated.VerifySignedURL("image", expires, newKeyID, sig); err != nil {
+		t.Errorf("expected new URL to verify, got %v", err)
+	}
+	if err := oldStore.VerifySignedURL("image", expires, newKeyID, sig); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected unknown key to be rejected, got %v", err)
+	}
+
+	// Once the old secret is dropped its URLs stop working
+	if err := newTestStore(t, newSecret).VerifySignedURL("image", expires, oldKeyID, sig); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected dropped key to be rejected, got %v", err)
+	}
+}
+
+func TestVerifySignedURL(t *testing.T) {
+	store := newTestStore(t, newSecret, oldSecret)
+	keyID, expires, sig := signedURL(t, store, "image", time.Hour)
+
+	tests := []struct {
+		name    string
+		key     string
+		expires int64
+		keyID   string
+		sig     string
+		want    error
+	}{
+		{"valid", "image", expires, keyID, sig, nil},
+		{"other key", "other", expires, keyID, sig, ErrInvalidSignature},
+		{"changed expiry", "image", expires + 1, keyID, sig, ErrInvalidSignature},
+		{"tampered signature", "image", expires, keyID, strings.Repeat("0", len(sig)), ErrInvalidSignature},
+		{"expired", "image", time.Now().Add(-time.Minute).Unix(), keyID, sig, ErrExpired},
+		// URLs from before key IDs were added are checked against every key
+		{"no key ID", "image", expires, "", sig, nil},
+		{"no key ID, tampered", "image", expires, "", strings.Repeat("0", len(sig)), ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := store.VerifySignedURL(tt.key, tt.expires, tt.keyID, tt.sig)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
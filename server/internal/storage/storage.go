@@ -42,13 +42,15 @@ type BlobStore interface {
 // SignedURLVerifier is an optional interface for blob stores that support
 // server-side signed URL verification (e.g., local storage with HMAC)
 type SignedURLVerifier interface {
-	// VerifySignedURL verifies a signed URL's signature and expiration
-	VerifySignedURL(key string, expires int64, sig string) error
+	// VerifySignedURL verifies a signed URL's signature and expiration.
+	// keyID names the secret the URL was signed with, if the URL has one.
+	VerifySignedURL(key string, expires int64, keyID, sig string) error
 }
 
 // SignedURLParams contains parameters extracted from a signed URL
 type SignedURLParams struct {
 	Key     string
 	Expires int64
+	KeyID   string
 	Sig     string
 }
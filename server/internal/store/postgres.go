@@ -6,10 +6,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/noted/server/internal/models"
 )
@@ -17,11 +21,33 @@ import (
 var (
 	ErrNotFound      = errors.New("not found")
 	ErrAlreadyExists = errors.New("already exists")
+
+	// ErrVersionConflict means a row was changed since the version an
+	// update was based on
+	ErrVersionConflict = errors.New("version conflict")
+
+	// ErrCursorExpired means tombstones newer than the cursor have been
+	// purged, so the client must do a full sync
+	ErrCursorExpired = errors.New("cursor expired")
+
+	// ErrRefreshTokenReused means a refresh token was presented after it had
+	// already been exchanged; its session has been revoked
+	ErrRefreshTokenReused = errors.New("refresh token reused")
 )
 
+// dbtx is satisfied by both the connection pool and a transaction, so the
+// same store methods work inside and outside WithTx
+type dbtx interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
 // PostgresStore implements Store using PostgreSQL
 type PostgresStore struct {
 	pool *pgxpool.Pool
+	db   dbtx
 }
 
 // NewPostgresStore creates a new PostgreSQL store
@@ -35,7 +61,7 @@ func NewPostgresStore(ctx context.Context, databaseURL string) (*PostgresStore,
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return &PostgresStore{pool: pool}, nil
+	return &PostgresStore{pool: pool, db: pool}, nil
 }
 
 // Close closes the database connection pool
@@ -49,6 +75,70 @@ func (s *PostgresStore) Pool() *pgxpool.Pool {
 	return s.pool
 }
 
+// WithTx runs fn with a store whose operations all belong to one transaction.
+// The transaction commits if fn returns nil and rolls back otherwise. Calling
+// WithTx on a store that is already in a transaction creates a savepoint.
+func (s *PostgresStore) WithTx(ctx context.Context, fn func(Store) error) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(&PostgresStore{pool: s.pool, db: tx}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// exec runs a statement that changes synced data. When ctx carries a device
+// ID the statement runs in a transaction that records it, so the change_seq
+// triggers can stamp the row's origin_device_id.
+func (s *PostgresStore) exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	// Outside a transaction the setting can't have been left over by an
+	// earlier statement, so there is nothing to clear
+	if _, ok := DeviceIDFromContext(ctx); !ok {
+		if _, isPool := s.db.(*pgxpool.Pool); isPool {
+			return s.db.Exec(ctx, sql, args...)
+		}
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return pgconn.CommandTag{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setOriginDevice(ctx, tx); err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	tag, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return tag, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return tag, fmt.Errorf("failed to commit: %w", err)
+	}
+	return tag, nil
+}
+
+// setOriginDevice sets the device the rest of tx's changes come from, or
+// clears it when ctx carries no device
+func setOriginDevice(ctx context.Context, tx pgx.Tx) error {
+	deviceID := ""
+	if id, ok := DeviceIDFromContext(ctx); ok {
+		deviceID = id.String()
+	}
+	if _, err := tx.Exec(ctx, `SELECT set_config('noted.device_id', $1, true)`, deviceID); err != nil {
+		return fmt.Errorf("failed to set origin device: %w", err)
+	}
+	return nil
+}
+
 // --- User Operations ---
 
 func (s *PostgresStore) CreateUser(ctx context.Context, user *models.User) error {
@@ -56,7 +146,7 @@ func (s *PostgresStore) CreateUser(ctx context.Context, user *models.User) error
 		INSERT INTO users (id, email, password_hash, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5)
 	`
-	_, err := s.pool.Exec(ctx, query,
+	_, err := s.db.Exec(ctx, query,
 		user.ID, user.Email, user.PasswordHash, user.CreatedAt, user.UpdatedAt)
 	if err != nil {
 		if isDuplicateKeyError(err) {
@@ -69,13 +159,16 @@ func (s *PostgresStore) CreateUser(ctx context.Context, user *models.User) error
 
 func (s *PostgresStore) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
 	query := `
-		SELECT id, email, password_hash, created_at, updated_at
+		SELECT id, email, password_hash, email_verified_at,
+		       EXISTS (SELECT 1 FROM user_totp WHERE user_id = users.id AND enabled_at IS NOT NULL),
+		       created_at, updated_at
 		FROM users
 		WHERE id = $1 AND deleted_at IS NULL
 	`
 	var user models.User
-	err := s.pool.QueryRow(ctx, query, id).Scan(
-		&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
+	err := s.db.QueryRow(ctx, query, id).Scan(
+		&user.ID, &user.Email, &user.PasswordHash, &user.EmailVerifiedAt, &user.MFAEnabled,
+		&user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, ErrNotFound
@@ -87,13 +180,16 @@ func (s *PostgresStore) GetUserByID(ctx context.Context, id uuid.UUID) (*models.
 
 func (s *PostgresStore) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
 	query := `
-		SELECT id, email, password_hash, created_at, updated_at
+		SELECT id, email, password_hash, email_verified_at,
+		       EXISTS (SELECT 1 FROM user_totp WHERE user_id = users.id AND enabled_at IS NOT NULL),
+		       created_at, updated_at
 		FROM users
 		WHERE email = $1 AND deleted_at IS NULL
 	`
 	var user models.User
-	err := s.pool.QueryRow(ctx, query, email).Scan(
-		&user.ID, &user.Email, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
+	err := s.db.QueryRow(ctx, query, email).Scan(
+		&user.ID, &user.Email, &user.PasswordHash, &user.EmailVerifiedAt, &user.MFAEnabled,
+		&user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, ErrNotFound
@@ -106,12 +202,16 @@ func (s *PostgresStore) GetUserByEmail(ctx context.Context, email string) (*mode
 func (s *PostgresStore) UpdateUser(ctx context.Context, user *models.User) error {
 	query := `
 		UPDATE users
-		SET email = $2, password_hash = $3, updated_at = $4
+		SET email = $2, password_hash = $3, updated_at = $4,
+		    email_verified_at = CASE WHEN email = $2 THEN email_verified_at END
 		WHERE id = $1 AND deleted_at IS NULL
 	`
-	result, err := s.pool.Exec(ctx, query,
+	result, err := s.db.Exec(ctx, query,
 		user.ID, user.Email, user.PasswordHash, user.UpdatedAt)
 	if err != nil {
+		if isDuplicateKeyError(err) {
+			return ErrAlreadyExists
+		}
 		return fmt.Errorf("failed to update user: %w", err)
 	}
 	if result.RowsAffected() == 0 {
@@ -120,378 +220,1688 @@ func (s *PostgresStore) UpdateUser(ctx context.Context, user *models.User) error
 	return nil
 }
 
-// --- Notebook Operations ---
-
-func (s *PostgresStore) CreateNotebook(ctx context.Context, notebook *models.Notebook) error {
+func (s *PostgresStore) SetEmailVerified(ctx context.Context, userID uuid.UUID, email string, at time.Time) error {
+	// The address may have changed since the token was sent
 	query := `
-		INSERT INTO notebooks (id, user_id, title, sort_order, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		UPDATE users SET email_verified_at = $3
+		WHERE id = $1 AND email = $2 AND deleted_at IS NULL
 	`
-	_, err := s.pool.Exec(ctx, query,
-		notebook.ID, notebook.UserID, notebook.Title, notebook.SortOrder, notebook.CreatedAt, notebook.UpdatedAt)
+	result, err := s.db.Exec(ctx, query, userID, email, at)
 	if err != nil {
-		return fmt.Errorf("failed to create notebook: %w", err)
+		return fmt.Errorf("failed to verify email: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
 	}
 	return nil
 }
 
-func (s *PostgresStore) GetNotebookByID(ctx context.Context, id uuid.UUID) (*models.Notebook, error) {
-	query := `
-		SELECT id, user_id, title, sort_order, created_at, updated_at, deleted_at
-		FROM notebooks
-		WHERE id = $1
-	`
-	var notebook models.Notebook
-	err := s.pool.QueryRow(ctx, query, id).Scan(
-		&notebook.ID, &notebook.UserID, &notebook.Title, &notebook.SortOrder,
-		&notebook.CreatedAt, &notebook.UpdatedAt, &notebook.DeletedAt)
+func (s *PostgresStore) DeleteUser(ctx context.Context, id uuid.UUID, at time.Time) error {
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, ErrNotFound
-		}
-		return nil, fmt.Errorf("failed to get notebook: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	return &notebook, nil
-}
+	defer tx.Rollback(ctx)
 
-func (s *PostgresStore) GetNotebooksByUserID(ctx context.Context, userID uuid.UUID) ([]models.Notebook, error) {
-	query := `
-		SELECT id, user_id, title, sort_order, created_at, updated_at, deleted_at
-		FROM notebooks
-		WHERE user_id = $1 AND deleted_at IS NULL
-		ORDER BY sort_order ASC, created_at ASC
-	`
-	rows, err := s.pool.Query(ctx, query, userID)
+	result, err := tx.Exec(ctx, `UPDATE users SET deleted_at = $2 WHERE id = $1 AND deleted_at IS NULL`, id, at)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get notebooks: %w", err)
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
 	}
-	defer rows.Close()
 
-	var notebooks []models.Notebook
-	for rows.Next() {
-		var nb models.Notebook
-		if err := rows.Scan(&nb.ID, &nb.UserID, &nb.Title, &nb.SortOrder, &nb.CreatedAt, &nb.UpdatedAt, &nb.DeletedAt); err != nil {
-			return nil, fmt.Errorf("failed to scan notebook: %w", err)
-		}
-		notebooks = append(notebooks, nb)
+	// Sign the user out everywhere and drop their credentials, which also
+	// frees their identity provider accounts to sign up again
+	if _, err := tx.Exec(ctx, `UPDATE sessions SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL`, id, at); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating notebooks: %w", err)
+	for _, table := range []string{"personal_access_tokens", "user_tokens", "user_identities", "user_totp", "recovery_codes"} {
+		if _, err := tx.Exec(ctx, `DELETE FROM `+table+` WHERE user_id = $1`, id); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", table, err)
+		}
 	}
-	return notebooks, nil
-}
 
-func (s *PostgresStore) UpdateNotebook(ctx context.Context, notebook *models.Notebook) error {
-	query := `
-		UPDATE notebooks
-		SET title = $2, sort_order = $3, updated_at = $4
-		WHERE id = $1 AND deleted_at IS NULL
-	`
-	result, err := s.pool.Exec(ctx, query, notebook.ID, notebook.Title, notebook.SortOrder, notebook.UpdatedAt)
-	if err != nil {
-		return fmt.Errorf("failed to update notebook: %w", err)
-	}
-	if result.RowsAffected() == 0 {
-		return ErrNotFound
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 	return nil
 }
 
-func (s *PostgresStore) DeleteNotebook(ctx context.Context, id uuid.UUID) error {
-	query := `UPDATE notebooks SET deleted_at = $2 WHERE id = $1 AND deleted_at IS NULL`
-	result, err := s.pool.Exec(ctx, query, id, time.Now())
+// --- User Token Operations ---
+
+func (s *PostgresStore) CreateUserToken(ctx context.Context, token *models.UserToken) error {
+	query := `
+		INSERT INTO user_tokens (token_hash, user_id, purpose, email, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err := s.db.Exec(ctx, query,
+		token.TokenHash, token.UserID, token.Purpose, token.Email, token.CreatedAt, token.ExpiresAt)
 	if err != nil {
-		return fmt.Errorf("failed to delete notebook: %w", err)
-	}
-	if result.RowsAffected() == 0 {
-		return ErrNotFound
+		return fmt.Errorf("failed to create user token: %w", err)
 	}
 	return nil
 }
 
-func (s *PostgresStore) GetNextNotebookSortOrder(ctx context.Context, userID uuid.UUID) (int, error) {
+func (s *PostgresStore) ConsumeUserToken(ctx context.Context, tokenHash []byte, purpose string) (*models.UserToken, error) {
+	// Using a token also retires every other outstanding token the user was
+	// sent for the same purpose. Event stream tickets are left alone, since
+	// each open tab asks for its own.
 	query := `
-		SELECT COALESCE(MAX(sort_order), -1) + 1
-		FROM notebooks
-		WHERE user_id = $1 AND deleted_at IS NULL
+		WITH consumed AS (
+			UPDATE user_tokens SET used_at = NOW()
+			WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+			RETURNING token_hash, user_id, purpose, email, created_at, expires_at, used_at, attempts
+		), retired AS (
+			UPDATE user_tokens SET used_at = NOW()
+			WHERE $3 AND user_id IN (SELECT user_id FROM consumed) AND purpose = $2 AND used_at IS NULL
+			  AND token_hash <> $1
+		)
+		SELECT token_hash, user_id, purpose, email, created_at, expires_at, used_at, attempts FROM consumed
 	`
-	var sortOrder int
-	err := s.pool.QueryRow(ctx, query, userID).Scan(&sortOrder)
+	retireOthers := purpose != models.UserTokenEventStream
+	var token models.UserToken
+	err := s.db.QueryRow(ctx, query, tokenHash, purpose, retireOthers).Scan(
+		&token.TokenHash, &token.UserID, &token.Purpose, &token.Email,
+		&token.CreatedAt, &token.ExpiresAt, &token.UsedAt, &token.Attempts)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get next sort order: %w", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to use user token: %w", err)
 	}
-	return sortOrder, nil
+	return &token, nil
 }
 
-func (s *PostgresStore) GetNotebooksSince(ctx context.Context, userID uuid.UUID, since time.Time) ([]models.Notebook, error) {
+func (s *PostgresStore) RecordUserTokenAttempt(ctx context.Context, tokenHash []byte, purpose string, maxAttempts int) (*models.UserToken, error) {
 	query := `
-		SELECT id, user_id, title, sort_order, created_at, updated_at, deleted_at
-		FROM notebooks
-		WHERE user_id = $1 AND updated_at > $2
-		ORDER BY updated_at ASC
+		UPDATE user_tokens SET attempts = attempts + 1
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > NOW()
+		  AND attempts < $3
+		RETURNING token_hash, user_id, purpose, email, created_at, expires_at, used_at, attempts
 	`
-	rows, err := s.pool.Query(ctx, query, userID, since)
+	var token models.UserToken
+	err := s.db.QueryRow(ctx, query, tokenHash, purpose, maxAttempts).Scan(
+		&token.TokenHash, &token.UserID, &token.Purpose, &token.Email,
+		&token.CreatedAt, &token.ExpiresAt, &token.UsedAt, &token.Attempts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get notebooks since: %w", err)
-	}
-	defer rows.Close()
-
-	var notebooks []models.Notebook
-	for rows.Next() {
-		var nb models.Notebook
-		if err := rows.Scan(&nb.ID, &nb.UserID, &nb.Title, &nb.SortOrder, &nb.CreatedAt, &nb.UpdatedAt, &nb.DeletedAt); err != nil {
-			return nil, fmt.Errorf("failed to scan notebook: %w", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
 		}
-		notebooks = append(notebooks, nb)
+		return nil, fmt.Errorf("failed to record user token attempt: %w", err)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating notebooks: %w", err)
+	return &token, nil
+}
+
+func (s *PostgresStore) DeleteUserTokensBefore(ctx context.Context, before time.Time) (int, error) {
+	query := `DELETE FROM user_tokens WHERE expires_at < $1 OR used_at < $1`
+	result, err := s.db.Exec(ctx, query, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete user tokens: %w", err)
 	}
-	return notebooks, nil
+	return int(result.RowsAffected()), nil
 }
 
-// --- Note Operations ---
+// --- User Identity Operations ---
 
-func (s *PostgresStore) CreateNote(ctx context.Context, note *models.Note) error {
+func (s *PostgresStore) CreateUserIdentity(ctx context.Context, identity *models.UserIdentity) error {
 	query := `
-		INSERT INTO notes (id, notebook_id, user_id, content, plain_text, is_todo, is_done, reminder_at, version, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		INSERT INTO user_identities (provider, subject, user_id, email, created_at, last_login_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
 	`
-	_, err := s.pool.Exec(ctx, query,
-		note.ID, note.NotebookID, note.UserID, note.Content, note.PlainText,
-		note.IsTodo, note.IsDone, note.ReminderAt, note.Version,
-		note.CreatedAt, note.UpdatedAt)
+	_, err := s.db.Exec(ctx, query,
+		identity.Provider, identity.Subject, identity.UserID, identity.Email,
+		identity.CreatedAt, identity.LastLoginAt)
 	if err != nil {
-		return fmt.Errorf("failed to create note: %w", err)
+		if isDuplicateKeyError(err) {
+			return ErrAlreadyExists
+		}
+		return fmt.Errorf("failed to create user identity: %w", err)
 	}
 	return nil
 }
 
-func (s *PostgresStore) GetNoteByID(ctx context.Context, id uuid.UUID) (*models.Note, error) {
+func (s *PostgresStore) GetUserIdentity(ctx context.Context, provider, subject string) (*models.UserIdentity, error) {
 	query := `
-		SELECT id, notebook_id, user_id, content, plain_text, is_todo, is_done, reminder_at, version, created_at, updated_at, deleted_at
-		FROM notes
-		WHERE id = $1
+		SELECT provider, subject, user_id, email, created_at, last_login_at
+		FROM user_identities
+		WHERE provider = $1 AND subject = $2
 	`
-	var note models.Note
-	var content []byte
-	err := s.pool.QueryRow(ctx, query, id).Scan(
-		&note.ID, &note.NotebookID, &note.UserID, &content, &note.PlainText,
-		&note.IsTodo, &note.IsDone, &note.ReminderAt, &note.Version,
-		&note.CreatedAt, &note.UpdatedAt, &note.DeletedAt)
+	var identity models.UserIdentity
+	err := s.db.QueryRow(ctx, query, provider, subject).Scan(
+		&identity.Provider, &identity.Subject, &identity.UserID, &identity.Email,
+		&identity.CreatedAt, &identity.LastLoginAt)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, ErrNotFound
 		}
-		return nil, fmt.Errorf("failed to get note: %w", err)
+		return nil, fmt.Errorf("failed to get user identity: %w", err)
 	}
-	note.Content = json.RawMessage(content)
-	return &note, nil
+	return &identity, nil
 }
 
-func (s *PostgresStore) GetNotesByNotebookID(ctx context.Context, notebookID uuid.UUID, since *time.Time) ([]models.Note, error) {
-	var query string
-	var args []interface{}
-
-	if since != nil {
-		query = `
-			SELECT id, notebook_id, user_id, content, plain_text, is_todo, is_done, reminder_at, version, created_at, updated_at, deleted_at
-			FROM notes
-			WHERE notebook_id = $1 AND updated_at > $2
-			ORDER BY created_at ASC
-		`
-		args = []interface{}{notebookID, *since}
-	} else {
-		query = `
-			SELECT id, notebook_id, user_id, content, plain_text, is_todo, is_done, reminder_at, version, created_at, updated_at, deleted_at
-			FROM notes
-			WHERE notebook_id = $1 AND deleted_at IS NULL
-			ORDER BY created_at ASC
-		`
-		args = []interface{}{notebookID}
-	}
-
-	rows, err := s.pool.Query(ctx, query, args...)
+func (s *PostgresStore) TouchUserIdentity(ctx context.Context, provider, subject, email string, at time.Time) error {
+	query := `
+		UPDATE user_identities SET email = $3, last_login_at = $4
+		WHERE provider = $1 AND subject = $2
+	`
+	result, err := s.db.Exec(ctx, query, provider, subject, email, at)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get notes: %w", err)
+		return fmt.Errorf("failed to update user identity: %w", err)
 	}
-	defer rows.Close()
-
-	return scanNotes(rows)
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
-func (s *PostgresStore) GetNotesByUserID(ctx context.Context, userID uuid.UUID, since *time.Time) ([]models.Note, error) {
-	var query string
-	var args []interface{}
-
-	if since != nil {
-		query = `
-			SELECT id, notebook_id, user_id, content, plain_text, is_todo, is_done, reminder_at, version, created_at, updated_at, deleted_at
-			FROM notes
-			WHERE user_id = $1 AND updated_at > $2
-			ORDER BY created_at ASC
-		`
-		args = []interface{}{userID, *since}
-	} else {
-		query = `
-			SELECT id, notebook_id, user_id, content, plain_text, is_todo, is_done, reminder_at, version, created_at, updated_at, deleted_at
-			FROM notes
-			WHERE user_id = $1 AND deleted_at IS NULL
-			ORDER BY created_at ASC
-		`
-		args = []interface{}{userID}
-	}
+// --- MFA Operations ---
 
-	rows, err := s.pool.Query(ctx, query, args...)
+func (s *PostgresStore) GetUserTOTP(ctx context.Context, userID uuid.UUID) (*models.UserTOTP, error) {
+	query := `
+		SELECT user_id, secret, last_step, created_at, enabled_at
+		FROM user_totp
+		WHERE user_id = $1
+	`
+	var t models.UserTOTP
+	err := s.db.QueryRow(ctx, query, userID).Scan(
+		&t.UserID, &t.Secret, &t.LastStep, &t.CreatedAt, &t.EnabledAt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get notes: %w", err)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get totp: %w", err)
 	}
-	defer rows.Close()
-
-	return scanNotes(rows)
+	return &t, nil
 }
 
-func (s *PostgresStore) UpdateNote(ctx context.Context, note *models.Note) error {
+func (s *PostgresStore) SetPendingTOTP(ctx context.Context, t *models.UserTOTP) error {
+	// A secret that hasn't been confirmed yet is simply replaced
 	query := `
-		UPDATE notes
-		SET content = $2, plain_text = $3, is_todo = $4, is_done = $5, reminder_at = $6, version = $7, updated_at = $8
-		WHERE id = $1 AND deleted_at IS NULL
+		INSERT INTO user_totp (user_id, secret, last_step, created_at)
+		VALUES ($1, $2, 0, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, last_step = 0, created_at = EXCLUDED.created_at
+		WHERE user_totp.enabled_at IS NULL
 	`
-	result, err := s.pool.Exec(ctx, query,
-		note.ID, note.Content, note.PlainText, note.IsTodo, note.IsDone,
-		note.ReminderAt, note.Version, note.UpdatedAt)
+	result, err := s.db.Exec(ctx, query, t.UserID, t.Secret, t.CreatedAt)
 	if err != nil {
-		return fmt.Errorf("failed to update note: %w", err)
+		return fmt.Errorf("failed to set totp: %w", err)
 	}
 	if result.RowsAffected() == 0 {
-		return ErrNotFound
+		return ErrAlreadyExists
 	}
 	return nil
 }
 
-func (s *PostgresStore) DeleteNote(ctx context.Context, id uuid.UUID) error {
-	query := `UPDATE notes SET deleted_at = $2, updated_at = $2 WHERE id = $1 AND deleted_at IS NULL`
-	now := time.Now()
-	result, err := s.pool.Exec(ctx, query, id, now)
+func (s *PostgresStore) EnableTOTP(ctx context.Context, userID uuid.UUID, step int64, at time.Time, codeHashes [][]byte) error {
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to delete note: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE user_totp SET enabled_at = $2, last_step = $3
+		WHERE user_id = $1 AND enabled_at IS NULL AND last_step < $3
+	`
+	result, err := tx.Exec(ctx, query, userID, at, step)
+	if err != nil {
+		return fmt.Errorf("failed to enable totp: %w", err)
 	}
 	if result.RowsAffected() == 0 {
 		return ErrNotFound
 	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
 	return nil
 }
 
-func (s *PostgresStore) SearchNotes(ctx context.Context, userID uuid.UUID, query string) ([]models.Note, error) {
-	sqlQuery := `
-		SELECT id, notebook_id, user_id, content, plain_text, is_todo, is_done, reminder_at, version, created_at, updated_at, deleted_at
-		FROM notes
-		WHERE user_id = $1 AND deleted_at IS NULL
-		  AND to_tsvector('english', plain_text) @@ plainto_tsquery('english', $2)
-		ORDER BY ts_rank(to_tsvector('english', plain_text), plainto_tsquery('english', $2)) DESC
-	`
-	rows, err := s.pool.Query(ctx, sqlQuery, userID, query)
+func (s *PostgresStore) DisableTOTP(ctx context.Context, userID uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to search notes: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	defer rows.Close()
+	defer tx.Rollback(ctx)
 
-	return scanNotes(rows)
-}
+	result, err := tx.Exec(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to disable totp: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
 
-func (s *PostgresStore) GetNotesSince(ctx context.Context, userID uuid.UUID, since time.Time) ([]models.Note, error) {
-	return s.GetNotesByUserID(ctx, userID, &since)
-}
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
 
-// --- Tag Operations ---
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
 
-func (s *PostgresStore) CreateTag(ctx context.Context, tag *models.Tag) error {
+func (s *PostgresStore) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) error {
 	query := `
-		INSERT INTO tags (id, user_id, name, color, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		UPDATE user_totp SET last_step = $2
+		WHERE user_id = $1 AND enabled_at IS NOT NULL AND last_step < $2
 	`
-	_, err := s.pool.Exec(ctx, query,
-		tag.ID, tag.UserID, tag.Name, tag.Color, tag.CreatedAt, tag.UpdatedAt)
+	result, err := s.db.Exec(ctx, query, userID, step)
 	if err != nil {
-		return fmt.Errorf("failed to create tag: %w", err)
+		return fmt.Errorf("failed to use totp code: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, codeHashes [][]byte) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID uuid.UUID, codeHashes [][]byte) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	query := `
+		INSERT INTO recovery_codes (user_id, code_hash)
+		SELECT $1, unnest($2::bytea[])
+	`
+	if _, err := tx.Exec(ctx, query, userID, codeHashes); err != nil {
+		return fmt.Errorf("failed to create recovery codes: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash []byte) error {
+	query := `
+		UPDATE recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+	result, err := s.db.Exec(ctx, query, userID, codeHash)
+	if err != nil {
+		return fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) CountRecoveryCodes(ctx context.Context, userID uuid.UUID) (int, error) {
+	query := `SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL`
+	var count int
+	if err := s.db.QueryRow(ctx, query, userID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count recovery codes: %w", err)
+	}
+	return count, nil
+}
+
+// --- Notebook Operations ---
+
+func (s *PostgresStore) CreateNotebook(ctx context.Context, notebook *models.Notebook) error {
+	query := `
+		INSERT INTO notebooks (id, user_id, title, sort_order, version, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := s.exec(ctx, query,
+		notebook.ID, notebook.UserID, notebook.Title, notebook.SortOrder, notebook.Version, notebook.CreatedAt, notebook.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create notebook: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetNotebookByID(ctx context.Context, id uuid.UUID) (*models.Notebook, error) {
+	query := `
+		SELECT id, user_id, title, sort_order, version, created_at, updated_at, deleted_at
+		FROM notebooks
+		WHERE id = $1
+	`
+	var notebook models.Notebook
+	err := s.db.QueryRow(ctx, query, id).Scan(
+		&notebook.ID, &notebook.UserID, &notebook.Title, &notebook.SortOrder, &notebook.Version,
+		&notebook.CreatedAt, &notebook.UpdatedAt, &notebook.DeletedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get notebook: %w", err)
+	}
+	return &notebook, nil
+}
+
+func (s *PostgresStore) GetNotebooksByUserID(ctx context.Context, userID uuid.UUID) ([]models.Notebook, error) {
+	query := `
+		SELECT id, user_id, title, sort_order, version, created_at, updated_at, deleted_at
+		FROM notebooks
+		WHERE user_id = $1 AND deleted_at IS NULL
+		ORDER BY sort_order ASC, created_at ASC
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notebooks: %w", err)
+	}
+	defer rows.Close()
+
+	var notebooks []models.Notebook
+	for rows.Next() {
+		var nb models.Notebook
+		if err := rows.Scan(&nb.ID, &nb.UserID, &nb.Title, &nb.SortOrder, &nb.Version, &nb.CreatedAt, &nb.UpdatedAt, &nb.DeletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan notebook: %w", err)
+		}
+		notebooks = append(notebooks, nb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating notebooks: %w", err)
+	}
+	return notebooks, nil
+}
+
+func (s *PostgresStore) UpdateNotebook(ctx context.Context, notebook *models.Notebook) error {
+	query := `
+		UPDATE notebooks
+		SET title = $2, sort_order = $3, version = $4, updated_at = $5
+		WHERE id = $1 AND deleted_at IS NULL AND version = $4 - 1
+	`
+	result, err := s.exec(ctx, query, notebook.ID, notebook.Title, notebook.SortOrder, notebook.Version, notebook.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to update notebook: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return s.missedUpdate(ctx, "notebooks", notebook.ID)
+	}
+	return nil
+}
+
+func (s *PostgresStore) DeleteNotebook(ctx context.Context, id uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setOriginDevice(ctx, tx); err != nil {
+		return err
+	}
+
+	// Everything deleted with the notebook shares its timestamp, which is
+	// how RestoreNotebook finds it again
+	now := time.Now()
+	result, err := tx.Exec(ctx, `UPDATE notebooks SET deleted_at = $2 WHERE id = $1 AND deleted_at IS NULL`, id, now)
+	if err != nil {
+		return fmt.Errorf("failed to delete notebook: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE images SET deleted_at = $2
+		WHERE deleted_at IS NULL
+		  AND note_id IN (SELECT id FROM notes WHERE notebook_id = $1 AND deleted_at IS NULL)
+	`, id, now)
+	if err != nil {
+		return fmt.Errorf("failed to delete images: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE note_tags SET deleted_at = $2
+		WHERE deleted_at IS NULL
+		  AND note_id IN (SELECT id FROM notes WHERE notebook_id = $1 AND deleted_at IS NULL)
+	`, id, now)
+	if err != nil {
+		return fmt.Errorf("failed to delete tag links: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE notes SET deleted_at = $2, updated_at = $2
+		WHERE notebook_id = $1 AND deleted_at IS NULL
+	`, id, now)
+	if err != nil {
+		return fmt.Errorf("failed to delete notes: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetDeletedNotebooks(ctx context.Context, userID uuid.UUID) ([]models.Notebook, error) {
+	query := `
+		SELECT id, user_id, title, sort_order, version, created_at, updated_at, deleted_at
+		FROM notebooks
+		WHERE user_id = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deleted notebooks: %w", err)
+	}
+	defer rows.Close()
+
+	var notebooks []models.Notebook
+	for rows.Next() {
+		var nb models.Notebook
+		if err := rows.Scan(&nb.ID, &nb.UserID, &nb.Title, &nb.SortOrder, &nb.Version, &nb.CreatedAt, &nb.UpdatedAt, &nb.DeletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan notebook: %w", err)
+		}
+		notebooks = append(notebooks, nb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating notebooks: %w", err)
+	}
+	return notebooks, nil
+}
+
+func (s *PostgresStore) RestoreNotebook(ctx context.Context, id uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setOriginDevice(ctx, tx); err != nil {
+		return err
+	}
+
+	var deletedAt time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT deleted_at FROM notebooks
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		FOR UPDATE
+	`, id).Scan(&deletedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("failed to get notebook: %w", err)
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec(ctx, `UPDATE notebooks SET deleted_at = NULL, updated_at = $2 WHERE id = $1`, id, now); err != nil {
+		return fmt.Errorf("failed to restore notebook: %w", err)
+	}
+
+	// Notes, images and tag links deleted along with the notebook share its
+	// timestamp; ones that were deleted separately stay in the trash
+	_, err = tx.Exec(ctx, `
+		UPDATE images SET deleted_at = NULL
+		WHERE deleted_at = $2
+		  AND note_id IN (SELECT id FROM notes WHERE notebook_id = $1 AND deleted_at = $2)
+	`, id, deletedAt)
+	if err != nil {
+		return fmt.Errorf("failed to restore images: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE note_tags SET deleted_at = NULL
+		WHERE deleted_at = $2
+		  AND note_id IN (SELECT id FROM notes WHERE notebook_id = $1 AND deleted_at = $2)
+	`, id, deletedAt)
+	if err != nil {
+		return fmt.Errorf("failed to restore tag links: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE notes SET deleted_at = NULL, updated_at = $3
+		WHERE notebook_id = $1 AND deleted_at = $2
+	`, id, deletedAt, now)
+	if err != nil {
+		return fmt.Errorf("failed to restore notes: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) PurgeNotebook(ctx context.Context, id uuid.UUID) (*models.PurgeResult, error) {
+	return s.purge(ctx, purgeScope{notebookID: &id})
+}
+
+func (s *PostgresStore) GetNextNotebookSortOrder(ctx context.Context, userID uuid.UUID) (int, error) {
+	query := `
+		SELECT COALESCE(MAX(sort_order), -1) + 1
+		FROM notebooks
+		WHERE user_id = $1 AND deleted_at IS NULL
+	`
+	var sortOrder int
+	err := s.db.QueryRow(ctx, query, userID).Scan(&sortOrder)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get next sort order: %w", err)
+	}
+	return sortOrder, nil
+}
+
+// --- Note Operations ---
+
+func (s *PostgresStore) CreateNote(ctx context.Context, note *models.Note) error {
+	// The first revision is written in the same statement as the note
+	query := `
+		WITH created AS (
+			INSERT INTO notes (id, notebook_id, parent_note_id, user_id, content, plain_text, is_todo, is_done, reminder_at, is_pinned, is_starred, archived_at, version, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+			RETURNING id, version, content, plain_text, is_todo, is_done, reminder_at, updated_at
+		)
+		INSERT INTO note_revisions (note_id, version, content, plain_text, is_todo, is_done, reminder_at, created_at)
+		SELECT id, version, content, plain_text, is_todo, is_done, reminder_at, updated_at FROM created
+	`
+	_, err := s.exec(ctx, query,
+		note.ID, note.NotebookID, note.ParentNoteID, note.UserID, note.Content, note.PlainText,
+		note.IsTodo, note.IsDone, note.ReminderAt, note.IsPinned, note.IsStarred, note.ArchivedAt, note.Version,
+		note.CreatedAt, note.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create note: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetNoteByID(ctx context.Context, id uuid.UUID) (*models.Note, error) {
+	query := `
+		SELECT id, notebook_id, parent_note_id, user_id, content, plain_text, is_todo, is_done, reminder_at, is_pinned, is_starred, archived_at, version, created_at, updated_at, deleted_at
+		FROM notes
+		WHERE id = $1
+	`
+	var note models.Note
+	var content []byte
+	err := s.db.QueryRow(ctx, query, id).Scan(
+		&note.ID, &note.NotebookID, &note.ParentNoteID, &note.UserID, &content, &note.PlainText,
+		&note.IsTodo, &note.IsDone, &note.ReminderAt, &note.IsPinned, &note.IsStarred, &note.ArchivedAt, &note.Version,
+		&note.CreatedAt, &note.UpdatedAt, &note.DeletedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get note: %w", err)
+	}
+	note.Content = json.RawMessage(content)
+	return &note, nil
+}
+
+func (s *PostgresStore) GetNotesByNotebookID(ctx context.Context, notebookID uuid.UUID, since *time.Time) ([]models.Note, error) {
+	var query string
+	var args []interface{}
+
+	if since != nil {
+		query = `
+			SELECT id, notebook_id, parent_note_id, user_id, content, plain_text, is_todo, is_done, reminder_at, is_pinned, is_starred, archived_at, version, created_at, updated_at, deleted_at
+			FROM notes
+			WHERE notebook_id = $1 AND updated_at > $2
+			ORDER BY created_at ASC
+		`
+		args = []interface{}{notebookID, *since}
+	} else {
+		query = `
+			SELECT id, notebook_id, parent_note_id, user_id, content, plain_text, is_todo, is_done, reminder_at, is_pinned, is_starred, archived_at, version, created_at, updated_at, deleted_at
+			FROM notes
+			WHERE notebook_id = $1 AND deleted_at IS NULL
+			ORDER BY created_at ASC
+		`
+		args = []interface{}{notebookID}
+	}
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notes: %w", err)
+	}
+	defer rows.Close()
+
+	return scanNotes(rows)
+}
+
+func (s *PostgresStore) GetNotebookTimeline(ctx context.Context, notebookID uuid.UUID, since *time.Time, filter models.NoteFilter, after, before *models.NoteCursor, limit int) ([]models.Note, error) {
+	// Pages are read towards the after cursor when there is none, so the
+	// page nearest the before cursor (or the end) comes first
+	order := "ASC"
+	if after == nil {
+		order = "DESC"
+	}
+
+	var afterAt, beforeAt *time.Time
+	var afterID, beforeID *uuid.UUID
+	if after != nil {
+		afterAt, afterID = &after.CreatedAt, &after.ID
+	}
+	if before != nil {
+		beforeAt, beforeID = &before.CreatedAt, &before.ID
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, notebook_id, parent_note_id, user_id, content, plain_text, is_todo, is_done, reminder_at, is_pinned, is_starred, archived_at, version, created_at, updated_at, deleted_at
+		FROM notes
+		WHERE notebook_id = $1 AND parent_note_id IS NULL
+			AND (($2::timestamptz IS NULL AND (deleted_at IS NULL OR EXISTS (
+				SELECT 1 FROM notes r WHERE r.parent_note_id = notes.id AND r.deleted_at IS NULL
+			))) OR updated_at > $2)
+			AND ($3::timestamptz IS NULL OR (created_at, id) > ($3, $4::uuid))
+			AND ($5::timestamptz IS NULL OR (created_at, id) < ($5, $6::uuid))
+			AND (NOT $7 OR is_pinned)
+			AND ($8 OR archived_at IS NULL)
+		ORDER BY created_at %[1]s, id %[1]s
+		LIMIT $9
+	`, order)
+
+	rows, err := s.db.Query(ctx, query, notebookID, since, afterAt, afterID, beforeAt, beforeID,
+		filter.PinnedOnly, filter.IncludeArchived, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notes: %w", err)
+	}
+	defer rows.Close()
+
+	notes, err := scanNotes(rows)
+	if err != nil {
+		return nil, err
+	}
+	if after == nil {
+		slices.Reverse(notes)
+	}
+	return notes, nil
+}
+
+func (s *PostgresStore) GetNoteReplies(ctx context.Context, noteID uuid.UUID) ([]models.Note, error) {
+	query := `
+		SELECT id, notebook_id, parent_note_id, user_id, content, plain_text, is_todo, is_done, reminder_at, is_pinned, is_starred, archived_at, version, created_at, updated_at, deleted_at
+		FROM notes
+		WHERE parent_note_id = $1 AND deleted_at IS NULL
+		ORDER BY created_at ASC, id ASC
+	`
+	rows, err := s.db.Query(ctx, query, noteID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get note replies: %w", err)
+	}
+	defer rows.Close()
+
+	return scanNotes(rows)
+}
+
+func (s *PostgresStore) CountNoteReplies(ctx context.Context, noteIDs []uuid.UUID) (map[uuid.UUID]int, error) {
+	query := `
+		SELECT parent_note_id, COUNT(*)
+		FROM notes
+		WHERE parent_note_id = ANY($1) AND deleted_at IS NULL
+		GROUP BY parent_note_id
+	`
+	rows, err := s.db.Query(ctx, query, noteIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count note replies: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[uuid.UUID]int)
+	for rows.Next() {
+		var noteID uuid.UUID
+		var count int
+		if err := rows.Scan(&noteID, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan reply count: %w", err)
+		}
+		counts[noteID] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating reply counts: %w", err)
+	}
+	return counts, nil
+}
+
+func (s *PostgresStore) GetNotesByUserID(ctx context.Context, userID uuid.UUID, since *time.Time) ([]models.Note, error) {
+	var query string
+	var args []interface{}
+
+	if since != nil {
+		query = `
+			SELECT id, notebook_id, parent_note_id, user_id, content, plain_text, is_todo, is_done, reminder_at, is_pinned, is_starred, archived_at, version, created_at, updated_at, deleted_at
+			FROM notes
+			WHERE user_id = $1 AND updated_at > $2
+			ORDER BY created_at ASC
+		`
+		args = []interface{}{userID, *since}
+	} else {
+		query = `
+			SELECT id, notebook_id, parent_note_id, user_id, content, plain_text, is_todo, is_done, reminder_at, is_pinned, is_starred, archived_at, version, created_at, updated_at, deleted_at
+			FROM notes
+			WHERE user_id = $1 AND deleted_at IS NULL
+			ORDER BY created_at ASC
+		`
+		args = []interface{}{userID}
+	}
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notes: %w", err)
+	}
+	defer rows.Close()
+
+	return scanNotes(rows)
+}
+
+func (s *PostgresStore) UpdateNote(ctx context.Context, note *models.Note) error {
+	// Record the new version as a revision in the same statement
+	query := `
+		WITH updated AS (
+			UPDATE notes
+			SET content = $2, plain_text = $3, is_todo = $4, is_done = $5, reminder_at = $6, version = $7, updated_at = $8,
+			    is_pinned = $9, is_starred = $10, archived_at = $11
+			WHERE id = $1 AND deleted_at IS NULL AND version = $7 - 1
+			RETURNING id, version, content, plain_text, is_todo, is_done, reminder_at, updated_at
+		)
+		INSERT INTO note_revisions (note_id, version, content, plain_text, is_todo, is_done, reminder_at, created_at)
+		SELECT id, version, content, plain_text, is_todo, is_done, reminder_at, updated_at FROM updated
+		ON CONFLICT (note_id, version) DO UPDATE
+		SET content = EXCLUDED.content, plain_text = EXCLUDED.plain_text, is_todo = EXCLUDED.is_todo,
+		    is_done = EXCLUDED.is_done, reminder_at = EXCLUDED.reminder_at, created_at = EXCLUDED.created_at
+	`
+	result, err := s.exec(ctx, query,
+		note.ID, note.Content, note.PlainText, note.IsTodo, note.IsDone,
+		note.ReminderAt, note.Version, note.UpdatedAt,
+		note.IsPinned, note.IsStarred, note.ArchivedAt)
+	if err != nil {
+		return fmt.Errorf("failed to update note: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return s.missedUpdate(ctx, "notes", note.ID)
+	}
+	return nil
+}
+
+func (s *PostgresStore) DeleteNote(ctx context.Context, id uuid.UUID) error {
+	// The note's images are deleted with the same timestamp so RestoreNote
+	// can bring them back
+	query := `
+		WITH deleted_images AS (
+			UPDATE images SET deleted_at = $2
+			WHERE note_id = $1 AND deleted_at IS NULL
+			  AND EXISTS (SELECT 1 FROM notes WHERE id = $1 AND deleted_at IS NULL)
+		)
+		UPDATE notes SET deleted_at = $2, updated_at = $2 WHERE id = $1 AND deleted_at IS NULL
+	`
+	result, err := s.exec(ctx, query, id, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to delete note: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetDeletedNotes(ctx context.Context, userID uuid.UUID) ([]models.Note, error) {
+	query := `
+		SELECT id, notebook_id, parent_note_id, user_id, content, plain_text, is_todo, is_done, reminder_at, is_pinned, is_starred, archived_at, version, created_at, updated_at, deleted_at
+		FROM notes
+		WHERE user_id = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get deleted notes: %w", err)
+	}
+	defer rows.Close()
+
+	return scanNotes(rows)
+}
+
+func (s *PostgresStore) RestoreNote(ctx context.Context, id uuid.UUID) error {
+	// Images and tag links deleted along with the note come back with it
+	query := `
+		WITH restored_images AS (
+			UPDATE images i SET deleted_at = NULL
+			FROM notes n
+			WHERE n.id = $1 AND i.note_id = n.id AND i.deleted_at = n.deleted_at
+		), restored_tags AS (
+			UPDATE note_tags nt SET deleted_at = NULL
+			FROM notes n
+			WHERE n.id = $1 AND nt.note_id = n.id AND nt.deleted_at = n.deleted_at
+		)
+		UPDATE notes SET deleted_at = NULL, updated_at = $2 WHERE id = $1 AND deleted_at IS NOT NULL
+	`
+	result, err := s.exec(ctx, query, id, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to restore note: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) MoveNotes(ctx context.Context, fromNotebookID, toNotebookID uuid.UUID) (int, error) {
+	// Moving is a new version of each note, recorded as a revision like
+	// any other update, so stale copies can't move them back
+	query := `
+		WITH moved AS (
+			UPDATE notes SET notebook_id = $2, version = version + 1, updated_at = $3
+			WHERE notebook_id = $1 AND deleted_at IS NULL
+			RETURNING id, version, content, plain_text, is_todo, is_done, reminder_at, updated_at
+		)
+		INSERT INTO note_revisions (note_id, version, content, plain_text, is_todo, is_done, reminder_at, created_at)
+		SELECT id, version, content, plain_text, is_todo, is_done, reminder_at, updated_at FROM moved
+		ON CONFLICT (note_id, version) DO UPDATE
+		SET content = EXCLUDED.content, plain_text = EXCLUDED.plain_text, is_todo = EXCLUDED.is_todo,
+		    is_done = EXCLUDED.is_done, reminder_at = EXCLUDED.reminder_at, created_at = EXCLUDED.created_at
+	`
+	result, err := s.exec(ctx, query, fromNotebookID, toNotebookID, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to move notes: %w", err)
+	}
+	return int(result.RowsAffected()), nil
+}
+
+func (s *PostgresStore) PurgeNote(ctx context.Context, id uuid.UUID) (*models.PurgeResult, error) {
+	return s.purge(ctx, purgeScope{noteID: &id})
+}
+
+func (s *PostgresStore) SearchNotes(ctx context.Context, userID uuid.UUID, query string, filter models.NoteFilter) ([]models.Note, error) {
+	sqlQuery := `
+		SELECT id, notebook_id, parent_note_id, user_id, content, plain_text, is_todo, is_done, reminder_at, is_pinned, is_starred, archived_at, version, created_at, updated_at, deleted_at
+		FROM notes
+		WHERE user_id = $1 AND deleted_at IS NULL
+		  AND to_tsvector('english', plain_text) @@ plainto_tsquery('english', $2)
+		  AND (NOT $3 OR is_pinned)
+		  AND ($4 OR archived_at IS NULL)
+		ORDER BY ts_rank(to_tsvector('english', plain_text), plainto_tsquery('english', $2)) DESC
+	`
+	rows, err := s.db.Query(ctx, sqlQuery, userID, query, filter.PinnedOnly, filter.IncludeArchived)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search notes: %w", err)
+	}
+	defer rows.Close()
+
+	return scanNotes(rows)
+}
+
+func (s *PostgresStore) GetStarredNotes(ctx context.Context, userID uuid.UUID, filter models.NoteFilter) ([]models.Note, error) {
+	query := `
+		SELECT id, notebook_id, parent_note_id, user_id, content, plain_text, is_todo, is_done, reminder_at, is_pinned, is_starred, archived_at, version, created_at, updated_at, deleted_at
+		FROM notes
+		WHERE user_id = $1 AND is_starred AND deleted_at IS NULL
+		  AND (NOT $2 OR is_pinned)
+		  AND ($3 OR archived_at IS NULL)
+		ORDER BY updated_at DESC
+	`
+	rows, err := s.db.Query(ctx, query, userID, filter.PinnedOnly, filter.IncludeArchived)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get starred notes: %w", err)
+	}
+	defer rows.Close()
+
+	return scanNotes(rows)
+}
+
+func (s *PostgresStore) GetNoteRevision(ctx context.Context, noteID uuid.UUID, version int64) (*models.NoteRevision, error) {
+	query := `
+		SELECT note_id, version, content, plain_text, is_todo, is_done, reminder_at, created_at
+		FROM note_revisions
+		WHERE note_id = $1 AND version = $2
+	`
+	var rev models.NoteRevision
+	var content []byte
+	err := s.db.QueryRow(ctx, query, noteID, version).Scan(
+		&rev.NoteID, &rev.Version, &content, &rev.PlainText,
+		&rev.IsTodo, &rev.IsDone, &rev.ReminderAt, &rev.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get note revision: %w", err)
+	}
+	rev.Content = json.RawMessage(content)
+	return &rev, nil
+}
+
+func (s *PostgresStore) GetNoteRevisions(ctx context.Context, noteID uuid.UUID, before *int64, limit int) ([]models.NoteRevision, error) {
+	query := `
+		SELECT note_id, version, plain_text, is_todo, is_done, reminder_at, created_at
+		FROM note_revisions
+		WHERE note_id = $1 AND ($2::bigint IS NULL OR version < $2)
+		ORDER BY version DESC
+		LIMIT $3
+	`
+	rows, err := s.db.Query(ctx, query, noteID, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get note revisions: %w", err)
+	}
+	defer rows.Close()
+
+	var revisions []models.NoteRevision
+	for rows.Next() {
+		var rev models.NoteRevision
+		if err := rows.Scan(
+			&rev.NoteID, &rev.Version, &rev.PlainText,
+			&rev.IsTodo, &rev.IsDone, &rev.ReminderAt, &rev.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan note revision: %w", err)
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating note revisions: %w", err)
+	}
+	return revisions, nil
+}
+
+// --- Tag Operations ---
+
+func (s *PostgresStore) CreateTag(ctx context.Context, tag *models.Tag) error {
+	query := `
+		INSERT INTO tags (id, user_id, name, color, version, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := s.exec(ctx, query,
+		tag.ID, tag.UserID, tag.Name, tag.Color, tag.Version, tag.CreatedAt, tag.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create tag: %w", err)
 	}
 	return nil
 }
 
 func (s *PostgresStore) GetTagByID(ctx context.Context, id uuid.UUID) (*models.Tag, error) {
 	query := `
-		SELECT id, user_id, name, color, created_at, updated_at, deleted_at
-		FROM tags
+		SELECT id, user_id, name, color, version, created_at, updated_at, deleted_at
+		FROM tags
+		WHERE id = $1
+	`
+	var tag models.Tag
+	var color sql.NullString
+	err := s.db.QueryRow(ctx, query, id).Scan(
+		&tag.ID, &tag.UserID, &tag.Name, &color, &tag.Version, &tag.CreatedAt, &tag.UpdatedAt, &tag.DeletedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get tag: %w", err)
+	}
+	if color.Valid {
+		tag.Color = color.String
+	}
+	return &tag, nil
+}
+
+func (s *PostgresStore) GetTagsByUserID(ctx context.Context, userID uuid.UUID) ([]models.Tag, error) {
+	query := `
+		SELECT id, user_id, name, color, version, created_at, updated_at, deleted_at
+		FROM tags
+		WHERE user_id = $1 AND deleted_at IS NULL
+		ORDER BY name ASC
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags: %w", err)
+	}
+	defer rows.Close()
+
+	var tags []models.Tag
+	for rows.Next() {
+		var tag models.Tag
+		var color sql.NullString
+		if err := rows.Scan(&tag.ID, &tag.UserID, &tag.Name, &color, &tag.Version, &tag.CreatedAt, &tag.UpdatedAt, &tag.DeletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		if color.Valid {
+			tag.Color = color.String
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tags: %w", err)
+	}
+	return tags, nil
+}
+
+func (s *PostgresStore) UpdateTag(ctx context.Context, tag *models.Tag) error {
+	query := `
+		UPDATE tags
+		SET name = $2, color = $3, version = $4, updated_at = $5
+		WHERE id = $1 AND deleted_at IS NULL AND version = $4 - 1
+	`
+	result, err := s.exec(ctx, query, tag.ID, tag.Name, tag.Color, tag.Version, tag.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to update tag: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return s.missedUpdate(ctx, "tags", tag.ID)
+	}
+	return nil
+}
+
+func (s *PostgresStore) DeleteTag(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE tags SET deleted_at = $2 WHERE id = $1 AND deleted_at IS NULL`
+	result, err := s.exec(ctx, query, id, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to delete tag: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) AddTagToNote(ctx context.Context, noteID, tagID uuid.UUID) error {
+	query := `
+		INSERT INTO note_tags (note_id, tag_id) VALUES ($1, $2)
+		ON CONFLICT (note_id, tag_id) DO UPDATE SET deleted_at = NULL
+		WHERE note_tags.deleted_at IS NOT NULL
+	`
+	_, err := s.exec(ctx, query, noteID, tagID)
+	if err != nil {
+		return fmt.Errorf("failed to add tag to note: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) RemoveTagFromNote(ctx context.Context, noteID, tagID uuid.UUID) error {
+	query := `DELETE FROM note_tags WHERE note_id = $1 AND tag_id = $2`
+	_, err := s.exec(ctx, query, noteID, tagID)
+	if err != nil {
+		return fmt.Errorf("failed to remove tag from note: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetTagsForNote(ctx context.Context, noteID uuid.UUID) ([]models.Tag, error) {
+	// Links deleted along with their note still describe it in the trash
+	query := `
+		SELECT t.id, t.user_id, t.name, t.color, t.version, t.created_at, t.updated_at, t.deleted_at
+		FROM tags t
+		JOIN note_tags nt ON t.id = nt.tag_id
+		JOIN notes n ON n.id = nt.note_id
+		WHERE nt.note_id = $1 AND t.deleted_at IS NULL
+		  AND (nt.deleted_at IS NULL OR nt.deleted_at = n.deleted_at)
+		ORDER BY t.name ASC
+	`
+	rows, err := s.db.Query(ctx, query, noteID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags for note: %w", err)
+	}
+	defer rows.Close()
+
+	var tags []models.Tag
+	for rows.Next() {
+		var tag models.Tag
+		var color sql.NullString
+		if err := rows.Scan(&tag.ID, &tag.UserID, &tag.Name, &color, &tag.Version, &tag.CreatedAt, &tag.UpdatedAt, &tag.DeletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		if color.Valid {
+			tag.Color = color.String
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tags: %w", err)
+	}
+	return tags, nil
+}
+
+func (s *PostgresStore) SetNoteTags(ctx context.Context, noteID uuid.UUID, tagIDs []uuid.UUID) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setOriginDevice(ctx, tx); err != nil {
+		return err
+	}
+
+	// Remove all existing tags
+	_, err = tx.Exec(ctx, `DELETE FROM note_tags WHERE note_id = $1`, noteID)
+	if err != nil {
+		return fmt.Errorf("failed to clear note tags: %w", err)
+	}
+
+	// Add new tags
+	for _, tagID := range tagIDs {
+		_, err = tx.Exec(ctx, `INSERT INTO note_tags (note_id, tag_id) VALUES ($1, $2)`, noteID, tagID)
+		if err != nil {
+			return fmt.Errorf("failed to add tag: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetTagsForNotes(ctx context.Context, noteIDs []uuid.UUID) (map[uuid.UUID][]models.Tag, error) {
+	query := `
+		SELECT nt.note_id, t.id, t.user_id, t.name, t.color, t.version, t.created_at, t.updated_at, t.deleted_at
+		FROM tags t
+		JOIN note_tags nt ON t.id = nt.tag_id
+		JOIN notes n ON n.id = nt.note_id
+		WHERE nt.note_id = ANY($1) AND t.deleted_at IS NULL
+		  AND (nt.deleted_at IS NULL OR nt.deleted_at = n.deleted_at)
+		ORDER BY t.name ASC
+	`
+	rows, err := s.db.Query(ctx, query, noteIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags for notes: %w", err)
+	}
+	defer rows.Close()
+
+	tagsByNote := make(map[uuid.UUID][]models.Tag)
+	for rows.Next() {
+		var noteID uuid.UUID
+		var tag models.Tag
+		var color sql.NullString
+		if err := rows.Scan(&noteID, &tag.ID, &tag.UserID, &tag.Name, &color, &tag.Version, &tag.CreatedAt, &tag.UpdatedAt, &tag.DeletedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		if color.Valid {
+			tag.Color = color.String
+		}
+		tagsByNote[noteID] = append(tagsByNote[noteID], tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tags: %w", err)
+	}
+	return tagsByNote, nil
+}
+
+// --- Image Operations ---
+
+func (s *PostgresStore) CreateImage(ctx context.Context, image *models.Image) error {
+	query := `
+		INSERT INTO images (id, note_id, filename, mime_type, storage_key, size, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err := s.exec(ctx, query,
+		image.ID, image.NoteID, image.Filename, image.MimeType, image.StorageKey, image.Size, image.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create image: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetImageByID(ctx context.Context, id uuid.UUID) (*models.Image, error) {
+	query := `
+		SELECT id, note_id, filename, mime_type, storage_key, size, created_at, deleted_at
+		FROM images
+		WHERE id = $1
+	`
+	var image models.Image
+	err := s.db.QueryRow(ctx, query, id).Scan(
+		&image.ID, &image.NoteID, &image.Filename, &image.MimeType, &image.StorageKey, &image.Size, &image.CreatedAt, &image.DeletedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get image: %w", err)
+	}
+	return &image, nil
+}
+
+func (s *PostgresStore) GetImagesByNoteID(ctx context.Context, noteID uuid.UUID) ([]models.Image, error) {
+	query := `
+		SELECT id, note_id, filename, mime_type, storage_key, size, created_at
+		FROM images
+		WHERE note_id = $1 AND deleted_at IS NULL
+		ORDER BY created_at ASC
+	`
+	rows, err := s.db.Query(ctx, query, noteID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get images: %w", err)
+	}
+	defer rows.Close()
+
+	var images []models.Image
+	for rows.Next() {
+		var img models.Image
+		if err := rows.Scan(&img.ID, &img.NoteID, &img.Filename, &img.MimeType, &img.StorageKey, &img.Size, &img.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan image: %w", err)
+		}
+		images = append(images, img)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating images: %w", err)
+	}
+	return images, nil
+}
+
+func (s *PostgresStore) DeleteImage(ctx context.Context, id uuid.UUID) error {
+	// Soft delete so the removal reaches other devices; the blob is kept
+	// until the record is purged
+	query := `UPDATE images SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`
+	result, err := s.exec(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete image: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// --- Device Operations ---
+
+func (s *PostgresStore) CreateDevice(ctx context.Context, device *models.Device) error {
+	query := `
+		INSERT INTO devices (id, user_id, name, platform, created_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err := s.db.Exec(ctx, query,
+		device.ID, device.UserID, device.Name, device.Platform, device.CreatedAt, device.LastSeenAt)
+	if err != nil {
+		return fmt.Errorf("failed to create device: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetDeviceByID(ctx context.Context, id uuid.UUID) (*models.Device, error) {
+	query := `
+		SELECT id, user_id, name, platform, created_at, last_seen_at, last_synced_at, revoked_at
+		FROM devices
+		WHERE id = $1
+	`
+	var device models.Device
+	err := s.db.QueryRow(ctx, query, id).Scan(
+		&device.ID, &device.UserID, &device.Name, &device.Platform, &device.CreatedAt,
+		&device.LastSeenAt, &device.LastSyncedAt, &device.RevokedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get device: %w", err)
+	}
+	return &device, nil
+}
+
+func (s *PostgresStore) GetDevicesByUserID(ctx context.Context, userID uuid.UUID) ([]models.Device, error) {
+	query := `
+		SELECT id, user_id, name, platform, created_at, last_seen_at, last_synced_at, revoked_at
+		FROM devices
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at ASC
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get devices: %w", err)
+	}
+	defer rows.Close()
+
+	var devices []models.Device
+	for rows.Next() {
+		var d models.Device
+		if err := rows.Scan(&d.ID, &d.UserID, &d.Name, &d.Platform, &d.CreatedAt,
+			&d.LastSeenAt, &d.LastSyncedAt, &d.RevokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan device: %w", err)
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating devices: %w", err)
+	}
+	return devices, nil
+}
+
+func (s *PostgresStore) RevokeDevice(ctx context.Context, id uuid.UUID) error {
+	// The device's sessions are signed out with it
+	query := `
+		WITH revoked_sessions AS (
+			UPDATE sessions SET revoked_at = $2
+			WHERE device_id = $1 AND revoked_at IS NULL
+		)
+		UPDATE devices SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL
+	`
+	result, err := s.db.Exec(ctx, query, id, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to revoke device: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) TouchDevice(ctx context.Context, userID, id uuid.UUID) error {
+	// Only write when the timestamp is noticeably out of date, since this
+	// runs on every request a device makes
+	query := `
+		WITH device AS (
+			SELECT id FROM devices
+			WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+		), touched AS (
+			UPDATE devices SET last_seen_at = NOW()
+			WHERE id IN (SELECT id FROM device)
+			  AND (last_seen_at IS NULL OR last_seen_at < NOW() - INTERVAL '1 minute')
+		)
+		SELECT count(*) FROM device
+	`
+	var count int
+	if err := s.db.QueryRow(ctx, query, id, userID).Scan(&count); err != nil {
+		return fmt.Errorf("failed to touch device: %w", err)
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) MarkDeviceSynced(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE devices SET last_synced_at = NOW(), last_seen_at = NOW() WHERE id = $1`
+	if _, err := s.db.Exec(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to mark device synced: %w", err)
+	}
+	return nil
+}
+
+// --- Session Operations ---
+
+func (s *PostgresStore) CreateSession(ctx context.Context, session *models.Session, tokenHash []byte) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// The device is only recorded if it is one of the user's active devices
+	err = tx.QueryRow(ctx, `
+		INSERT INTO sessions (id, user_id, device_id, user_agent, ip_address, created_at, last_used_at, expires_at)
+		VALUES ($1, $2, (SELECT id FROM devices WHERE id = $3 AND user_id = $2 AND revoked_at IS NULL), $4, $5, $6, $7, $8)
+		RETURNING device_id
+	`, session.ID, session.UserID, session.DeviceID, session.UserAgent, session.IPAddress,
+		session.CreatedAt, session.LastUsedAt, session.ExpiresAt).Scan(&session.DeviceID)
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO refresh_tokens (token_hash, family_id, created_at) VALUES ($1, $2, $3)`,
+		tokenHash, session.ID, session.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create refresh token: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetSessionByID(ctx context.Context, id uuid.UUID) (*models.Session, error) {
+	query := `
+		SELECT id, user_id, device_id, user_agent, ip_address, created_at, last_used_at, expires_at, revoked_at
+		FROM sessions
+		WHERE id = $1
+	`
+	var session models.Session
+	err := s.db.QueryRow(ctx, query, id).Scan(
+		&session.ID, &session.UserID, &session.DeviceID, &session.UserAgent, &session.IPAddress,
+		&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt, &session.RevokedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	return &session, nil
+}
+
+func (s *PostgresStore) GetSessionsByUserID(ctx context.Context, userID uuid.UUID) ([]models.Session, error) {
+	query := `
+		SELECT id, user_id, device_id, user_agent, ip_address, created_at, last_used_at, expires_at, revoked_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []models.Session
+	for rows.Next() {
+		var ss models.Session
+		if err := rows.Scan(&ss.ID, &ss.UserID, &ss.DeviceID, &ss.UserAgent, &ss.IPAddress,
+			&ss.CreatedAt, &ss.LastUsedAt, &ss.ExpiresAt, &ss.RevokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, ss)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+func (s *PostgresStore) RotateRefreshToken(ctx context.Context, tokenHash, newTokenHash []byte, deviceID *uuid.UUID, expiresAt time.Time) (*models.Session, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var session models.Session
+	var usedAt *time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT s.id, s.user_id, s.device_id, s.user_agent, s.ip_address, s.created_at, s.last_used_at,
+		       s.expires_at, s.revoked_at, rt.used_at
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.family_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE
+	`, tokenHash).Scan(
+		&session.ID, &session.UserID, &session.DeviceID, &session.UserAgent, &session.IPAddress,
+		&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt, &session.RevokedAt, &usedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get refresh token: %w", err)
+	}
+
+	now := time.Now()
+	if session.RevokedAt != nil || !session.ExpiresAt.After(now) {
+		return nil, ErrNotFound
+	}
+
+	// A token that was already exchanged has leaked or been replayed, so
+	// every token in the family stops working
+	if usedAt != nil {
+		if _, err := tx.Exec(ctx, `UPDATE sessions SET revoked_at = $2 WHERE id = $1`, session.ID, now); err != nil {
+			return nil, fmt.Errorf("failed to revoke session: %w", err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return nil, fmt.Errorf("failed to commit: %w", err)
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET used_at = $2 WHERE token_hash = $1`, tokenHash, now); err != nil {
+		return nil, fmt.Errorf("failed to use refresh token: %w", err)
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO refresh_tokens (token_hash, family_id, created_at) VALUES ($1, $2, $3)`,
+		newTokenHash, session.ID, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create refresh token: %w", err)
+	}
+
+	err = tx.QueryRow(ctx, `
+		UPDATE sessions
+		SET last_used_at = $2, expires_at = $3,
+		    device_id = COALESCE((SELECT id FROM devices WHERE id = $4 AND user_id = sessions.user_id AND revoked_at IS NULL), device_id)
+		WHERE id = $1
+		RETURNING device_id, last_used_at, expires_at
+	`, session.ID, now, expiresAt, deviceID).Scan(&session.DeviceID, &session.LastUsedAt, &session.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update session: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return &session, nil
+}
+
+func (s *PostgresStore) RevokeSession(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE sessions SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL`
+	result, err := s.db.Exec(ctx, query, id, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) RevokeSessionByToken(ctx context.Context, tokenHash []byte) error {
+	query := `
+		UPDATE sessions SET revoked_at = $2
+		WHERE id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1) AND revoked_at IS NULL
+	`
+	result, err := s.db.Exec(ctx, query, tokenHash, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) RevokeOtherSessions(ctx context.Context, userID, keepID uuid.UUID) (int, error) {
+	query := `UPDATE sessions SET revoked_at = $3 WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL`
+	result, err := s.db.Exec(ctx, query, userID, keepID, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return int(result.RowsAffected()), nil
+}
+
+func (s *PostgresStore) DeleteSessionsBefore(ctx context.Context, before time.Time) (int, error) {
+	// Refresh tokens go with their session
+	query := `DELETE FROM sessions WHERE expires_at < $1 OR revoked_at < $1`
+	result, err := s.db.Exec(ctx, query, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete sessions: %w", err)
+	}
+	return int(result.RowsAffected()), nil
+}
+
+// --- Personal Access Token Operations ---
+
+func (s *PostgresStore) CreatePersonalAccessToken(ctx context.Context, token *models.PersonalAccessToken) error {
+	query := `
+		INSERT INTO personal_access_tokens (id, user_id, name, token_hash, token_prefix, scopes, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	_, err := s.db.Exec(ctx, query,
+		token.ID, token.UserID, token.Name, token.TokenHash, token.Prefix, token.Scopes,
+		token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create personal access token: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetPersonalAccessTokenByID(ctx context.Context, id uuid.UUID) (*models.PersonalAccessToken, error) {
+	query := `
+		SELECT id, user_id, name, token_hash, token_prefix, scopes, created_at, last_used_at, expires_at, revoked_at
+		FROM personal_access_tokens
 		WHERE id = $1
 	`
-	var tag models.Tag
-	var color sql.NullString
-	err := s.pool.QueryRow(ctx, query, id).Scan(
-		&tag.ID, &tag.UserID, &tag.Name, &color, &tag.CreatedAt, &tag.UpdatedAt, &tag.DeletedAt)
+	var token models.PersonalAccessToken
+	err := s.db.QueryRow(ctx, query, id).Scan(
+		&token.ID, &token.UserID, &token.Name, &token.TokenHash, &token.Prefix, &token.Scopes,
+		&token.CreatedAt, &token.LastUsedAt, &token.ExpiresAt, &token.RevokedAt)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, ErrNotFound
 		}
-		return nil, fmt.Errorf("failed to get tag: %w", err)
+		return nil, fmt.Errorf("failed to get personal access token: %w", err)
 	}
-	if color.Valid {
-		tag.Color = color.String
+	return &token, nil
+}
+
+func (s *PostgresStore) GetPersonalAccessTokenByHash(ctx context.Context, tokenHash []byte) (*models.PersonalAccessToken, error) {
+	query := `
+		SELECT t.id, t.user_id, t.name, t.token_hash, t.token_prefix, t.scopes,
+		       t.created_at, t.last_used_at, t.expires_at, t.revoked_at
+		FROM personal_access_tokens t
+		JOIN users u ON u.id = t.user_id AND u.deleted_at IS NULL
+		WHERE t.token_hash = $1 AND t.revoked_at IS NULL
+		  AND (t.expires_at IS NULL OR t.expires_at > NOW())
+	`
+	var token models.PersonalAccessToken
+	err := s.db.QueryRow(ctx, query, tokenHash).Scan(
+		&token.ID, &token.UserID, &token.Name, &token.TokenHash, &token.Prefix, &token.Scopes,
+		&token.CreatedAt, &token.LastUsedAt, &token.ExpiresAt, &token.RevokedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get personal access token: %w", err)
 	}
-	return &tag, nil
+	return &token, nil
 }
 
-func (s *PostgresStore) GetTagsByUserID(ctx context.Context, userID uuid.UUID) ([]models.Tag, error) {
+func (s *PostgresStore) GetPersonalAccessTokensByUserID(ctx context.Context, userID uuid.UUID) ([]models.PersonalAccessToken, error) {
 	query := `
-		SELECT id, user_id, name, color, created_at, updated_at, deleted_at
-		FROM tags
-		WHERE user_id = $1 AND deleted_at IS NULL
-		ORDER BY name ASC
+		SELECT id, user_id, name, token_hash, token_prefix, scopes, created_at, last_used_at, expires_at, revoked_at
+		FROM personal_access_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC
 	`
-	rows, err := s.pool.Query(ctx, query, userID)
+	rows, err := s.db.Query(ctx, query, userID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get tags: %w", err)
+		return nil, fmt.Errorf("failed to get personal access tokens: %w", err)
 	}
 	defer rows.Close()
 
-	var tags []models.Tag
+	var tokens []models.PersonalAccessToken
 	for rows.Next() {
-		var tag models.Tag
-		var color sql.NullString
-		if err := rows.Scan(&tag.ID, &tag.UserID, &tag.Name, &color, &tag.CreatedAt, &tag.UpdatedAt, &tag.DeletedAt); err != nil {
-			return nil, fmt.Errorf("failed to scan tag: %w", err)
-		}
-		if color.Valid {
-			tag.Color = color.String
+		var token models.PersonalAccessToken
+		if err := rows.Scan(
+			&token.ID, &token.UserID, &token.Name, &token.TokenHash, &token.Prefix, &token.Scopes,
+			&token.CreatedAt, &token.LastUsedAt, &token.ExpiresAt, &token.RevokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan personal access token: %w", err)
 		}
-		tags = append(tags, tag)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating tags: %w", err)
+		tokens = append(tokens, token)
 	}
-	return tags, nil
+	return tokens, rows.Err()
 }
 
-func (s *PostgresStore) UpdateTag(ctx context.Context, tag *models.Tag) error {
+func (s *PostgresStore) TouchPersonalAccessToken(ctx context.Context, id uuid.UUID, at time.Time) error {
+	// Only write when the recorded time is stale, so busy tokens don't
+	// update their row on every request
 	query := `
-		UPDATE tags
-		SET name = $2, color = $3, updated_at = $4
-		WHERE id = $1 AND deleted_at IS NULL
+		UPDATE personal_access_tokens SET last_used_at = $2
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $2 - INTERVAL '1 minute')
 	`
-	result, err := s.pool.Exec(ctx, query, tag.ID, tag.Name, tag.Color, tag.UpdatedAt)
-	if err != nil {
-		return fmt.Errorf("failed to update tag: %w", err)
-	}
-	if result.RowsAffected() == 0 {
-		return ErrNotFound
+	if _, err := s.db.Exec(ctx, query, id, at); err != nil {
+		return fmt.Errorf("failed to touch personal access token: %w", err)
 	}
 	return nil
 }
 
-func (s *PostgresStore) DeleteTag(ctx context.Context, id uuid.UUID) error {
-	query := `UPDATE tags SET deleted_at = $2 WHERE id = $1 AND deleted_at IS NULL`
-	result, err := s.pool.Exec(ctx, query, id, time.Now())
+func (s *PostgresStore) RevokePersonalAccessToken(ctx context.Context, id uuid.UUID) error {
+	query := `UPDATE personal_access_tokens SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`
+	result, err := s.db.Exec(ctx, query, id)
 	if err != nil {
-		return fmt.Errorf("failed to delete tag: %w", err)
+		return fmt.Errorf("failed to revoke personal access token: %w", err)
 	}
 	if result.RowsAffected() == 0 {
 		return ErrNotFound
@@ -499,196 +1909,569 @@ func (s *PostgresStore) DeleteTag(ctx context.Context, id uuid.UUID) error {
 	return nil
 }
 
-func (s *PostgresStore) AddTagToNote(ctx context.Context, noteID, tagID uuid.UUID) error {
-	query := `INSERT INTO note_tags (note_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
-	_, err := s.pool.Exec(ctx, query, noteID, tagID)
-	if err != nil {
-		return fmt.Errorf("failed to add tag to note: %w", err)
-	}
-	return nil
+// --- Purge Operations ---
+
+func (s *PostgresStore) PurgeDeleted(ctx context.Context, before time.Time) (*models.PurgeResult, error) {
+	return s.purge(ctx, purgeScope{before: &before})
 }
 
-func (s *PostgresStore) RemoveTagFromNote(ctx context.Context, noteID, tagID uuid.UUID) error {
-	query := `DELETE FROM note_tags WHERE note_id = $1 AND tag_id = $2`
-	_, err := s.pool.Exec(ctx, query, noteID, tagID)
-	if err != nil {
-		return fmt.Errorf("failed to remove tag from note: %w", err)
-	}
-	return nil
+func (s *PostgresStore) EmptyTrash(ctx context.Context, userID uuid.UUID) (*models.PurgeResult, error) {
+	return s.purge(ctx, purgeScope{userID: &userID})
 }
 
-func (s *PostgresStore) GetTagsForNote(ctx context.Context, noteID uuid.UUID) ([]models.Tag, error) {
-	query := `
-		SELECT t.id, t.user_id, t.name, t.color, t.created_at, t.updated_at, t.deleted_at
-		FROM tags t
-		JOIN note_tags nt ON t.id = nt.tag_id
-		WHERE nt.note_id = $1 AND t.deleted_at IS NULL
-		ORDER BY t.name ASC
-	`
-	rows, err := s.pool.Query(ctx, query, noteID)
+func (s *PostgresStore) PurgeDeletedUsers(ctx context.Context) (*models.PurgeResult, error) {
+	return s.purge(ctx, purgeScope{deletedUsers: true})
+}
+
+// purgeScope selects the tombstones a purge removes. Nil fields don't
+// narrow it; a nil before matches everything that has been deleted. With
+// deletedUsers, everything belonging to deleted users is removed instead,
+// whether or not it was deleted itself.
+type purgeScope struct {
+	before       *time.Time
+	userID       *uuid.UUID
+	notebookID   *uuid.UUID
+	noteID       *uuid.UUID
+	deletedUsers bool
+}
+
+func (p purgeScope) args() []any {
+	return []any{p.before, p.userID, p.notebookID, p.noteID, p.deletedUsers}
+}
+
+// purge hard-deletes the tombstones in scope and expires sync cursors that
+// predate them, in one transaction
+func (s *PostgresStore) purge(ctx context.Context, scope purgeScope) (*models.PurgeResult, error) {
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get tags for note: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	defer rows.Close()
+	defer tx.Rollback(ctx)
 
-	var tags []models.Tag
+	result := &models.PurgeResult{}
+
+	// Highest purged tombstone per user, to expire older cursors
+	purgedSeqs := make(map[uuid.UUID]int64)
+	record := func(userID uuid.UUID, seq int64) {
+		if seq > purgedSeqs[userID] {
+			purgedSeqs[userID] = seq
+		}
+	}
+
+	// Images go first, both deleted ones and those of notes being purged
+	rows, err := tx.Query(ctx, `
+		DELETE FROM images i
+		USING notes n
+		WHERE n.id = i.note_id
+		  AND ($5 OR i.deleted_at < COALESCE($1::timestamptz, 'infinity') OR n.deleted_at < COALESCE($1::timestamptz, 'infinity'))
+		  AND (NOT $5 OR n.user_id IN (SELECT id FROM users WHERE deleted_at IS NOT NULL))
+		  AND ($2::uuid IS NULL OR n.user_id = $2)
+		  AND ($3::uuid IS NULL OR n.notebook_id = $3)
+		  AND ($4::uuid IS NULL OR n.id = $4)
+		RETURNING n.user_id, i.change_seq, i.deleted_at IS NOT NULL, i.storage_key
+	`, scope.args()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to purge images: %w", err)
+	}
 	for rows.Next() {
-		var tag models.Tag
-		var color sql.NullString
-		if err := rows.Scan(&tag.ID, &tag.UserID, &tag.Name, &color, &tag.CreatedAt, &tag.UpdatedAt, &tag.DeletedAt); err != nil {
-			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		var userID uuid.UUID
+		var seq int64
+		var tombstone bool
+		var key string
+		if err := rows.Scan(&userID, &seq, &tombstone, &key); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan purged image: %w", err)
 		}
-		if color.Valid {
-			tag.Color = color.String
+		if tombstone {
+			record(userID, seq)
 		}
-		tags = append(tags, tag)
+		result.StorageKeys = append(result.StorageKeys, key)
 	}
+	rows.Close()
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating tags: %w", err)
+		return nil, fmt.Errorf("error iterating purged images: %w", err)
+	}
+	result.Images = len(result.StorageKeys)
+
+	// Revisions and tag links are removed with their note
+	result.Notes, err = purgeRows(ctx, tx, `
+		DELETE FROM notes
+		WHERE ($5 OR deleted_at < COALESCE($1::timestamptz, 'infinity'))
+		  AND (NOT $5 OR user_id IN (SELECT id FROM users WHERE deleted_at IS NOT NULL))
+		  AND ($2::uuid IS NULL OR user_id = $2)
+		  AND ($3::uuid IS NULL OR notebook_id = $3)
+		  AND ($4::uuid IS NULL OR id = $4)
+		RETURNING user_id, change_seq
+	`, scope, record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to purge notes: %w", err)
 	}
-	return tags, nil
-}
 
-func (s *PostgresStore) SetNoteTags(ctx context.Context, noteID uuid.UUID, tagIDs []uuid.UUID) error {
-	tx, err := s.pool.Begin(ctx)
+	// Notebooks that still hold notes are kept until those are purged too
+	result.Notebooks, err = purgeRows(ctx, tx, `
+		DELETE FROM notebooks nb
+		WHERE ($5 OR nb.deleted_at < COALESCE($1::timestamptz, 'infinity'))
+		  AND (NOT $5 OR nb.user_id IN (SELECT id FROM users WHERE deleted_at IS NOT NULL))
+		  AND ($2::uuid IS NULL OR nb.user_id = $2)
+		  AND ($3::uuid IS NULL OR nb.id = $3)
+		  AND $4::uuid IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM notes n WHERE n.notebook_id = nb.id)
+		RETURNING nb.user_id, nb.change_seq
+	`, scope, record)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to purge notebooks: %w", err)
 	}
-	defer tx.Rollback(ctx)
 
-	// Remove all existing tags
-	_, err = tx.Exec(ctx, `DELETE FROM note_tags WHERE note_id = $1`, noteID)
+	result.Tags, err = purgeRows(ctx, tx, `
+		DELETE FROM tags
+		WHERE ($5 OR deleted_at < COALESCE($1::timestamptz, 'infinity'))
+		  AND (NOT $5 OR user_id IN (SELECT id FROM users WHERE deleted_at IS NOT NULL))
+		  AND ($2::uuid IS NULL OR user_id = $2)
+		  AND $3::uuid IS NULL AND $4::uuid IS NULL
+		RETURNING user_id, change_seq
+	`, scope, record)
 	if err != nil {
-		return fmt.Errorf("failed to clear note tags: %w", err)
+		return nil, fmt.Errorf("failed to purge tags: %w", err)
 	}
 
-	// Add new tags
-	for _, tagID := range tagIDs {
-		_, err = tx.Exec(ctx, `INSERT INTO note_tags (note_id, tag_id) VALUES ($1, $2)`, noteID, tagID)
+	// Purging a single item that isn't in the trash does nothing
+	if (scope.noteID != nil && result.Notes == 0) || (scope.notebookID != nil && result.Notebooks == 0) {
+		return nil, ErrNotFound
+	}
+
+	for userID, seq := range purgedSeqs {
+		_, err := tx.Exec(ctx, `UPDATE users SET purged_seq = GREATEST(purged_seq, $2) WHERE id = $1`, userID, seq)
 		if err != nil {
-			return fmt.Errorf("failed to add tag: %w", err)
+			return nil, fmt.Errorf("failed to record purged sequence: %w", err)
 		}
 	}
-
 	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("failed to commit: %w", err)
+		return nil, fmt.Errorf("failed to commit: %w", err)
 	}
-	return nil
+	return result, nil
+}
+
+func (s *PostgresStore) DeleteIdempotencyKeysBefore(ctx context.Context, before time.Time) (int, error) {
+	result, err := s.db.Exec(ctx, `DELETE FROM idempotency_keys WHERE created_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete idempotency keys: %w", err)
+	}
+	return int(result.RowsAffected()), nil
 }
 
-func (s *PostgresStore) GetTagsSince(ctx context.Context, userID uuid.UUID, since time.Time) ([]models.Tag, error) {
+func (s *PostgresStore) ThinNoteRevisions(ctx context.Context, hourlyBefore, dailyBefore time.Time, deleteBefore *time.Time) (int, error) {
+	// Older revisions are ranked within their hour or day, newest first, and
+	// all but the first of each are removed; a note's current version is
+	// never removed
 	query := `
-		SELECT id, user_id, name, color, created_at, updated_at, deleted_at
-		FROM tags
-		WHERE user_id = $1 AND updated_at > $2
-		ORDER BY updated_at ASC
+		WITH ranked AS (
+			SELECT r.note_id, r.version, r.created_at, r.version = n.version AS is_current,
+			       ROW_NUMBER() OVER (
+			           PARTITION BY r.note_id, r.created_at < $2,
+			               date_trunc(CASE WHEN r.created_at < $2 THEN 'day' ELSE 'hour' END, r.created_at)
+			           ORDER BY r.version DESC
+			       ) AS rank
+			FROM note_revisions r
+			JOIN notes n ON n.id = r.note_id
+			WHERE r.created_at < $1
+		)
+		DELETE FROM note_revisions r
+		USING ranked
+		WHERE r.note_id = ranked.note_id AND r.version = ranked.version
+		  AND NOT ranked.is_current
+		  AND (ranked.rank > 1 OR ranked.created_at < $3)
 	`
-	rows, err := s.pool.Query(ctx, query, userID, since)
+	result, err := s.db.Exec(ctx, query, hourlyBefore, dailyBefore, deleteBefore)
+	if err != nil {
+		return 0, fmt.Errorf("failed to thin note revisions: %w", err)
+	}
+	return int(result.RowsAffected()), nil
+}
+
+// purgeRows runs a DELETE ... RETURNING user_id, change_seq statement,
+// passing each deleted row to record, and returns how many were deleted
+func purgeRows(ctx context.Context, db dbtx, query string, scope purgeScope, record func(uuid.UUID, int64)) (int, error) {
+	rows, err := db.Query(ctx, query, scope.args()...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get tags since: %w", err)
+		return 0, err
 	}
 	defer rows.Close()
 
-	var tags []models.Tag
+	count := 0
 	for rows.Next() {
+		var userID uuid.UUID
+		var seq int64
+		if err := rows.Scan(&userID, &seq); err != nil {
+			return 0, err
+		}
+		record(userID, seq)
+		count++
+	}
+	return count, rows.Err()
+}
+
+// --- Change Feed Operations ---
+
+func (s *PostgresStore) GetChangesSince(ctx context.Context, userID uuid.UUID, cursor int64, limit int, excludeDeviceID *uuid.UUID) (*models.ChangeSet, error) {
+	// Read every table from one snapshot so the returned cursor covers exactly
+	// the rows that were seen
+	tx, err := s.beginSnapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// A NULL parameter would also hide changes with no origin device, so
+	// compare against the nil UUID instead, which no device has
+	exclude := uuid.Nil
+	if excludeDeviceID != nil {
+		exclude = *excludeDeviceID
+	}
+
+	changes := &models.ChangeSet{}
+	var purgedSeq int64
+	err = tx.QueryRow(ctx, `SELECT change_seq, purged_seq FROM users WHERE id = $1`, userID).Scan(&changes.Cursor, &purgedSeq)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get change sequence: %w", err)
+	}
+	// A full sync (cursor 0) never depends on purged tombstones
+	if cursor > 0 && cursor < purgedSeq {
+		return nil, ErrCursorExpired
+	}
+
+	// Sequence numbers are unique per user across all tables, so the page
+	// boundary is the limit-th smallest sequence after the cursor
+	seqRows, err := tx.Query(ctx, `
+		SELECT change_seq FROM (
+			SELECT change_seq FROM notebooks
+			WHERE user_id = $1 AND change_seq > $2 AND origin_device_id IS DISTINCT FROM $4
+			UNION ALL
+			SELECT change_seq FROM notes
+			WHERE user_id = $1 AND change_seq > $2 AND origin_device_id IS DISTINCT FROM $4
+			UNION ALL
+			SELECT change_seq FROM tags
+			WHERE user_id = $1 AND change_seq > $2 AND origin_device_id IS DISTINCT FROM $4
+			UNION ALL
+			SELECT i.change_seq FROM images i JOIN notes n ON n.id = i.note_id
+			WHERE n.user_id = $1 AND i.change_seq > $2 AND i.origin_device_id IS DISTINCT FROM $4
+		) changed
+		ORDER BY change_seq ASC
+		LIMIT $3
+	`, userID, cursor, limit+1, exclude)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get change sequences: %w", err)
+	}
+	seqs, err := pgx.CollectRows(seqRows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan change sequences: %w", err)
+	}
+	if len(seqs) > limit {
+		changes.HasMore = true
+		changes.Cursor = seqs[limit-1]
+	}
+	upper := changes.Cursor
+
+	notebookRows, err := tx.Query(ctx, `
+		SELECT id, user_id, title, sort_order, version, created_at, updated_at, deleted_at
+		FROM notebooks
+		WHERE user_id = $1 AND change_seq > $2 AND change_seq <= $3 AND origin_device_id IS DISTINCT FROM $4
+		ORDER BY change_seq ASC
+	`, userID, cursor, upper, exclude)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get notebook changes: %w", err)
+	}
+	for notebookRows.Next() {
+		var nb models.Notebook
+		if err := notebookRows.Scan(&nb.ID, &nb.UserID, &nb.Title, &nb.SortOrder, &nb.Version, &nb.CreatedAt, &nb.UpdatedAt, &nb.DeletedAt); err != nil {
+			notebookRows.Close()
+			return nil, fmt.Errorf("failed to scan notebook: %w", err)
+		}
+		changes.Notebooks = append(changes.Notebooks, nb)
+	}
+	notebookRows.Close()
+	if err := notebookRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating notebooks: %w", err)
+	}
+
+	noteRows, err := tx.Query(ctx, `
+		SELECT id, notebook_id, parent_note_id, user_id, content, plain_text, is_todo, is_done, reminder_at, is_pinned, is_starred, archived_at, version, created_at, updated_at, deleted_at
+		FROM notes
+		WHERE user_id = $1 AND change_seq > $2 AND change_seq <= $3 AND origin_device_id IS DISTINCT FROM $4
+		ORDER BY change_seq ASC
+	`, userID, cursor, upper, exclude)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get note changes: %w", err)
+	}
+	changes.Notes, err = scanNotes(noteRows)
+	noteRows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	tagRows, err := tx.Query(ctx, `
+		SELECT id, user_id, name, color, version, created_at, updated_at, deleted_at
+		FROM tags
+		WHERE user_id = $1 AND change_seq > $2 AND change_seq <= $3 AND origin_device_id IS DISTINCT FROM $4
+		ORDER BY change_seq ASC
+	`, userID, cursor, upper, exclude)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tag changes: %w", err)
+	}
+	for tagRows.Next() {
 		var tag models.Tag
 		var color sql.NullString
-		if err := rows.Scan(&tag.ID, &tag.UserID, &tag.Name, &color, &tag.CreatedAt, &tag.UpdatedAt, &tag.DeletedAt); err != nil {
+		if err := tagRows.Scan(&tag.ID, &tag.UserID, &tag.Name, &color, &tag.Version, &tag.CreatedAt, &tag.UpdatedAt, &tag.DeletedAt); err != nil {
+			tagRows.Close()
 			return nil, fmt.Errorf("failed to scan tag: %w", err)
 		}
 		if color.Valid {
 			tag.Color = color.String
 		}
-		tags = append(tags, tag)
+		changes.Tags = append(changes.Tags, tag)
 	}
-	if err := rows.Err(); err != nil {
+	tagRows.Close()
+	if err := tagRows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating tags: %w", err)
 	}
-	return tags, nil
+
+	imageRows, err := tx.Query(ctx, `
+		SELECT i.id, i.note_id, i.filename, i.mime_type, i.storage_key, i.size, i.created_at, i.deleted_at
+		FROM images i
+		JOIN notes n ON n.id = i.note_id
+		WHERE n.user_id = $1 AND i.change_seq > $2 AND i.change_seq <= $3 AND i.origin_device_id IS DISTINCT FROM $4
+		ORDER BY i.change_seq ASC
+	`, userID, cursor, upper, exclude)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image changes: %w", err)
+	}
+	for imageRows.Next() {
+		var img models.Image
+		if err := imageRows.Scan(&img.ID, &img.NoteID, &img.Filename, &img.MimeType, &img.StorageKey, &img.Size, &img.CreatedAt, &img.DeletedAt); err != nil {
+			imageRows.Close()
+			return nil, fmt.Errorf("failed to scan image: %w", err)
+		}
+		changes.Images = append(changes.Images, img)
+	}
+	imageRows.Close()
+	if err := imageRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating images: %w", err)
+	}
+
+	return changes, nil
 }
 
-// --- Image Operations ---
+// changesChannel is the NOTIFY channel next_change_seq announces changes on
+const changesChannel = "noted_changes"
+
+func (s *PostgresStore) ListenChanges(ctx context.Context, fn func(userID uuid.UUID, seq int64)) error {
+	// LISTEN is per connection, so hold one connection for as long as we listen
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+changesChannel); err != nil {
+		return fmt.Errorf("failed to listen for changes: %w", err)
+	}
+	// Don't hand the connection back to the pool still subscribed
+	defer conn.Exec(context.Background(), "UNLISTEN "+changesChannel)
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+
+		userIDStr, seqStr, ok := strings.Cut(n.Payload, ":")
+		if !ok {
+			continue
+		}
+		userID, err := uuid.Parse(userIDStr)
+		if err != nil {
+			continue
+		}
+		seq, err := strconv.ParseInt(seqStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		fn(userID, seq)
+	}
+}
+
+// beginSnapshot starts a read-only repeatable read transaction. Inside WithTx
+// the isolation level is already fixed, so a savepoint is used instead.
+func (s *PostgresStore) beginSnapshot(ctx context.Context) (pgx.Tx, error) {
+	if pool, ok := s.db.(*pgxpool.Pool); ok {
+		return pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	}
+	return s.db.Begin(ctx)
+}
+
+// --- Idempotency Key Operations ---
+
+func (s *PostgresStore) ClaimIdempotencyKey(ctx context.Context, userID uuid.UUID, key, requestHash string) (*models.IdempotencyKey, error) {
+	// A concurrent request holding the same key blocks this insert until it
+	// commits or rolls back
+	result, err := s.db.Exec(ctx, `
+		INSERT INTO idempotency_keys (user_id, key, request_hash, created_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (user_id, key) DO NOTHING
+	`, userID, key, requestHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	if result.RowsAffected() == 1 {
+		return nil, nil
+	}
 
-func (s *PostgresStore) CreateImage(ctx context.Context, image *models.Image) error {
 	query := `
-		INSERT INTO images (id, note_id, filename, mime_type, storage_key, size, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		SELECT user_id, key, request_hash, status_code, response_body, created_at
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2
 	`
-	_, err := s.pool.Exec(ctx, query,
-		image.ID, image.NoteID, image.Filename, image.MimeType, image.StorageKey, image.Size, image.CreatedAt)
+	var record models.IdempotencyKey
+	var statusCode sql.NullInt32
+	var body []byte
+	err = s.db.QueryRow(ctx, query, userID, key).Scan(
+		&record.UserID, &record.Key, &record.RequestHash, &statusCode, &body, &record.CreatedAt)
 	if err != nil {
-		return fmt.Errorf("failed to create image: %w", err)
+		return nil, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	record.StatusCode = int(statusCode.Int32)
+	record.ResponseBody = json.RawMessage(body)
+	return &record, nil
+}
+
+func (s *PostgresStore) SaveIdempotencyResponse(ctx context.Context, userID uuid.UUID, key string, statusCode int, body json.RawMessage) error {
+	query := `
+		UPDATE idempotency_keys
+		SET status_code = $3, response_body = $4
+		WHERE user_id = $1 AND key = $2
+	`
+	result, err := s.db.Exec(ctx, query, userID, key, statusCode, body)
+	if err != nil {
+		return fmt.Errorf("failed to save idempotency response: %w", err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
 	}
 	return nil
 }
 
-func (s *PostgresStore) GetImageByID(ctx context.Context, id uuid.UUID) (*models.Image, error) {
+// --- Rate Limit Operations ---
+
+func (s *PostgresStore) TakeRateLimit(ctx context.Context, key string, now time.Time, interval, tolerance time.Duration) (bool, time.Time, error) {
+	// A missing bucket is full. The update is skipped, returning no row,
+	// when the bucket has no token to take.
 	query := `
-		SELECT id, note_id, filename, mime_type, storage_key, size, created_at
-		FROM images
-		WHERE id = $1
+		INSERT INTO rate_limits (key, tat)
+		VALUES ($1, $2::timestamptz + $3::float8 * interval '1 second')
+		ON CONFLICT (key) DO UPDATE
+		SET tat = GREATEST(rate_limits.tat, $2::timestamptz) + $3::float8 * interval '1 second'
+		WHERE GREATEST(rate_limits.tat, $2::timestamptz) + $3::float8 * interval '1 second'
+			<= $2::timestamptz + $4::float8 * interval '1 second'
+		RETURNING tat
 	`
-	var image models.Image
-	err := s.pool.QueryRow(ctx, query, id).Scan(
-		&image.ID, &image.NoteID, &image.Filename, &image.MimeType, &image.StorageKey, &image.Size, &image.CreatedAt)
+	var tat time.Time
+	err := s.db.QueryRow(ctx, query, key, now, interval.Seconds(), tolerance.Seconds()).Scan(&tat)
+	if err == nil {
+		return true, tat, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return false, time.Time{}, fmt.Errorf("failed to take rate limit: %w", err)
+	}
+
+	if err := s.db.QueryRow(ctx, `SELECT tat FROM rate_limits WHERE key = $1`, key).Scan(&tat); err != nil {
+		return false, time.Time{}, fmt.Errorf("failed to get rate limit: %w", err)
+	}
+	return false, tat, nil
+}
+
+func (s *PostgresStore) GetLoginFailures(ctx context.Context, email string) (*models.LoginFailures, error) {
+	query := `
+		SELECT email, failures, last_failed_at, reset_at
+		FROM login_failures
+		WHERE email = $1
+	`
+	var failures models.LoginFailures
+	err := s.db.QueryRow(ctx, query, email).Scan(
+		&failures.Email, &failures.Failures, &failures.LastFailedAt, &failures.ResetAt)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, ErrNotFound
 		}
-		return nil, fmt.Errorf("failed to get image: %w", err)
+		return nil, fmt.Errorf("failed to get login failures: %w", err)
 	}
-	return &image, nil
+	return &failures, nil
 }
 
-func (s *PostgresStore) GetImagesByNoteID(ctx context.Context, noteID uuid.UUID) ([]models.Image, error) {
+func (s *PostgresStore) RecordLoginFailure(ctx context.Context, email string, at, resetAt time.Time) (*models.LoginFailures, error) {
 	query := `
-		SELECT id, note_id, filename, mime_type, storage_key, size, created_at
-		FROM images
-		WHERE note_id = $1
-		ORDER BY created_at ASC
+		INSERT INTO login_failures (email, failures, last_failed_at, reset_at)
+		VALUES ($1, 1, $2, $3)
+		ON CONFLICT (email) DO UPDATE
+		SET failures = CASE WHEN login_failures.reset_at < $2 THEN 1 ELSE login_failures.failures + 1 END,
+		    last_failed_at = $2,
+		    reset_at = $3
+		RETURNING email, failures, last_failed_at, reset_at
 	`
-	rows, err := s.pool.Query(ctx, query, noteID)
+	var failures models.LoginFailures
+	err := s.db.QueryRow(ctx, query, email, at, resetAt).Scan(
+		&failures.Email, &failures.Failures, &failures.LastFailedAt, &failures.ResetAt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get images: %w", err)
+		return nil, fmt.Errorf("failed to record login failure: %w", err)
 	}
-	defer rows.Close()
+	return &failures, nil
+}
 
-	var images []models.Image
-	for rows.Next() {
-		var img models.Image
-		if err := rows.Scan(&img.ID, &img.NoteID, &img.Filename, &img.MimeType, &img.StorageKey, &img.Size, &img.CreatedAt); err != nil {
-			return nil, fmt.Errorf("failed to scan image: %w", err)
-		}
-		images = append(images, img)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating images: %w", err)
+func (s *PostgresStore) ClearLoginFailures(ctx context.Context, email string) error {
+	_, err := s.db.Exec(ctx, `DELETE FROM login_failures WHERE email = $1`, email)
+	if err != nil {
+		return fmt.Errorf("failed to clear login failures: %w", err)
 	}
-	return images, nil
+	return nil
 }
 
-func (s *PostgresStore) DeleteImage(ctx context.Context, id uuid.UUID) error {
-	query := `DELETE FROM images WHERE id = $1`
-	result, err := s.pool.Exec(ctx, query, id)
+func (s *PostgresStore) DeleteRateLimitsBefore(ctx context.Context, before time.Time) (int, error) {
+	limits, err := s.db.Exec(ctx, `DELETE FROM rate_limits WHERE tat < $1`, before)
 	if err != nil {
-		return fmt.Errorf("failed to delete image: %w", err)
+		return 0, fmt.Errorf("failed to delete rate limits: %w", err)
 	}
-	if result.RowsAffected() == 0 {
-		return ErrNotFound
+	failures, err := s.db.Exec(ctx, `DELETE FROM login_failures WHERE reset_at < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete login failures: %w", err)
 	}
-	return nil
+	return int(limits.RowsAffected() + failures.RowsAffected()), nil
 }
 
 // Helper functions
 
+// missedUpdate explains an update by ID that matched no row: the row was
+// changed by someone else if it is still there, and is gone otherwise
+func (s *PostgresStore) missedUpdate(ctx context.Context, table string, id uuid.UUID) error {
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM ` + table + ` WHERE id = $1 AND deleted_at IS NULL)`
+	if err := s.db.QueryRow(ctx, query, id).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check %s: %w", table, err)
+	}
+	if exists {
+		return ErrVersionConflict
+	}
+	return ErrNotFound
+}
+
 func scanNotes(rows pgx.Rows) ([]models.Note, error) {
 	var notes []models.Note
 	for rows.Next() {
 		var note models.Note
 		var content []byte
 		if err := rows.Scan(
-			&note.ID, &note.NotebookID, &note.UserID, &content, &note.PlainText,
-			&note.IsTodo, &note.IsDone, &note.ReminderAt, &note.Version,
+			&note.ID, &note.NotebookID, &note.ParentNoteID, &note.UserID, &content, &note.PlainText,
+			&note.IsTodo, &note.IsDone, &note.ReminderAt, &note.IsPinned, &note.IsStarred, &note.ArchivedAt, &note.Version,
 			&note.CreatedAt, &note.UpdatedAt, &note.DeletedAt); err != nil {
 			return nil, fmt.Errorf("failed to scan note: %w", err)
 		}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,10 +12,23 @@ import (
 // Store defines the interface for data persistence
 type Store interface {
 	UserStore
+	UserTokenStore
+	UserIdentityStore
+	MFAStore
 	NotebookStore
 	NoteStore
 	TagStore
 	ImageStore
+	ChangeStore
+	IdempotencyStore
+	DeviceStore
+	SessionStore
+	PersonalAccessTokenStore
+	RateLimitStore
+	PurgeStore
+	// WithTx runs fn in a single transaction, committing only if it
+	// returns nil
+	WithTx(ctx context.Context, fn func(Store) error) error
 	Close() error
 }
 
@@ -23,7 +37,69 @@ type UserStore interface {
 	CreateUser(ctx context.Context, user *models.User) error
 	GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error)
 	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
+	// UpdateUser saves a user's email and password. Changing the email
+	// clears email_verified_at, and returns ErrAlreadyExists if another
+	// user has the address.
 	UpdateUser(ctx context.Context, user *models.User) error
+	// SetEmailVerified marks the user's address as verified, returning
+	// ErrNotFound if their address is no longer email
+	SetEmailVerified(ctx context.Context, userID uuid.UUID, email string, at time.Time) error
+	// DeleteUser soft-deletes a user, signing them out and removing their
+	// tokens, identities and two-factor secrets. Their data is left for
+	// PurgeDeletedUsers.
+	DeleteUser(ctx context.Context, id uuid.UUID, at time.Time) error
+}
+
+// UserTokenStore handles the single-use tokens emailed to users, the tickets
+// for event streams and MFA challenges. Tokens are identified by their SHA-256 hash.
+type UserTokenStore interface {
+	CreateUserToken(ctx context.Context, token *models.UserToken) error
+	// ConsumeUserToken marks an unexpired, unused token as used and returns
+	// it, retiring the user's other tokens for the same purpose unless they
+	// are event stream tickets. It returns ErrNotFound if there is no such
+	// token.
+	ConsumeUserToken(ctx context.Context, tokenHash []byte, purpose string) (*models.UserToken, error)
+	// RecordUserTokenAttempt counts an attempt to use an unexpired, unused
+	// token and returns it. It returns ErrNotFound if there is no such token
+	// or maxAttempts have already been made.
+	RecordUserTokenAttempt(ctx context.Context, tokenHash []byte, purpose string, maxAttempts int) (*models.UserToken, error)
+}
+
+// UserIdentityStore handles the accounts at external identity providers
+// that users sign in with
+type UserIdentityStore interface {
+	// CreateUserIdentity links an identity to a user, returning
+	// ErrAlreadyExists if it is already linked
+	CreateUserIdentity(ctx context.Context, identity *models.UserIdentity) error
+	GetUserIdentity(ctx context.Context, provider, subject string) (*models.UserIdentity, error)
+	// TouchUserIdentity records a sign-in and the address the provider
+	// reported for it
+	TouchUserIdentity(ctx context.Context, provider, subject, email string, at time.Time) error
+}
+
+// MFAStore handles authenticator app secrets and recovery codes. Recovery
+// codes are identified by their SHA-256 hash.
+type MFAStore interface {
+	GetUserTOTP(ctx context.Context, userID uuid.UUID) (*models.UserTOTP, error)
+	// SetPendingTOTP stores a secret that is awaiting confirmation, replacing
+	// any earlier unconfirmed one. It returns ErrAlreadyExists if the user
+	// already has two-factor authentication enabled.
+	SetPendingTOTP(ctx context.Context, totp *models.UserTOTP) error
+	// EnableTOTP turns on the user's pending secret, recording step as used,
+	// and replaces their recovery codes. It returns ErrNotFound if there is
+	// no pending secret.
+	EnableTOTP(ctx context.Context, userID uuid.UUID, step int64, at time.Time, codeHashes [][]byte) error
+	// DisableTOTP removes the user's secret and recovery codes
+	DisableTOTP(ctx context.Context, userID uuid.UUID) error
+	// UseTOTPStep records that a code for step was accepted, returning
+	// ErrNotFound if that step or a later one has already been used
+	UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) error
+	ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, codeHashes [][]byte) error
+	// UseRecoveryCode marks an unused recovery code as used, returning
+	// ErrNotFound if there is no such code
+	UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash []byte) error
+	// CountRecoveryCodes returns how many unused recovery codes are left
+	CountRecoveryCodes(ctx context.Context, userID uuid.UUID) (int, error)
 }
 
 // NotebookStore handles notebook data operations
@@ -31,10 +107,21 @@ type NotebookStore interface {
 	CreateNotebook(ctx context.Context, notebook *models.Notebook) error
 	GetNotebookByID(ctx context.Context, id uuid.UUID) (*models.Notebook, error)
 	GetNotebooksByUserID(ctx context.Context, userID uuid.UUID) ([]models.Notebook, error)
+	// UpdateNotebook saves a notebook as the given version, returning
+	// ErrVersionConflict unless it is still at the version before it
 	UpdateNotebook(ctx context.Context, notebook *models.Notebook) error
+	// DeleteNotebook soft-deletes a notebook together with its notes and
+	// their images
 	DeleteNotebook(ctx context.Context, id uuid.UUID) error
-	GetNotebooksSince(ctx context.Context, userID uuid.UUID, since time.Time) ([]models.Notebook, error)
 	GetNextNotebookSortOrder(ctx context.Context, userID uuid.UUID) (int, error)
+	GetDeletedNotebooks(ctx context.Context, userID uuid.UUID) ([]models.Notebook, error)
+	// RestoreNotebook undeletes a notebook along with the notes and images
+	// that were deleted at the same time as it
+	RestoreNotebook(ctx context.Context, id uuid.UUID) error
+	// PurgeNotebook permanently removes a deleted notebook and its deleted
+	// notes, returning ErrNotFound unless the notebook is in the trash and
+	// holds no other notes
+	PurgeNotebook(ctx context.Context, id uuid.UUID) (*models.PurgeResult, error)
 }
 
 // NoteStore handles note data operations
@@ -42,11 +129,42 @@ type NoteStore interface {
 	CreateNote(ctx context.Context, note *models.Note) error
 	GetNoteByID(ctx context.Context, id uuid.UUID) (*models.Note, error)
 	GetNotesByNotebookID(ctx context.Context, notebookID uuid.UUID, since *time.Time) ([]models.Note, error)
+	// GetNotebookTimeline returns up to limit notes of a notebook in timeline
+	// order, between the after and before cursors when they are set. The
+	// page starts right after "after" if it is set, otherwise it ends right
+	// before "before", or at the latest note. Replies are left out, and
+	// deleted notes are only included while they have replies. Like
+	// GetNotesByNotebookID, setting since returns only notes updated after
+	// it, deleted ones included.
+	GetNotebookTimeline(ctx context.Context, notebookID uuid.UUID, since *time.Time, filter models.NoteFilter, after, before *models.NoteCursor, limit int) ([]models.Note, error)
+	// GetNoteReplies returns the replies to a note that aren't deleted, oldest
+	// first
+	GetNoteReplies(ctx context.Context, noteID uuid.UUID) ([]models.Note, error)
+	// CountNoteReplies returns how many replies that aren't deleted each of
+	// the notes has, leaving out notes with none
+	CountNoteReplies(ctx context.Context, noteIDs []uuid.UUID) (map[uuid.UUID]int, error)
 	GetNotesByUserID(ctx context.Context, userID uuid.UUID, since *time.Time) ([]models.Note, error)
+	// UpdateNote saves a note as the given version and records it as a
+	// revision, returning ErrVersionConflict unless the note is still at the
+	// version before it
 	UpdateNote(ctx context.Context, note *models.Note) error
 	DeleteNote(ctx context.Context, id uuid.UUID) error
-	SearchNotes(ctx context.Context, userID uuid.UUID, query string) ([]models.Note, error)
-	GetNotesSince(ctx context.Context, userID uuid.UUID, since time.Time) ([]models.Note, error)
+	SearchNotes(ctx context.Context, userID uuid.UUID, query string, filter models.NoteFilter) ([]models.Note, error)
+	// GetStarredNotes returns a user's starred notes across notebooks, most
+	// recently updated first
+	GetStarredNotes(ctx context.Context, userID uuid.UUID, filter models.NoteFilter) ([]models.Note, error)
+	GetNoteRevision(ctx context.Context, noteID uuid.UUID, version int64) (*models.NoteRevision, error)
+	// GetNoteRevisions lists a note's revisions without their content,
+	// newest first, starting below the before version if it is given
+	GetNoteRevisions(ctx context.Context, noteID uuid.UUID, before *int64, limit int) ([]models.NoteRevision, error)
+	GetDeletedNotes(ctx context.Context, userID uuid.UUID) ([]models.Note, error)
+	RestoreNote(ctx context.Context, id uuid.UUID) error
+	// MoveNotes moves a notebook's notes that aren't deleted to another
+	// notebook, returning how many were moved
+	MoveNotes(ctx context.Context, fromNotebookID, toNotebookID uuid.UUID) (int, error)
+	// PurgeNote permanently removes a deleted note and its images, returning
+	// ErrNotFound unless the note is in the trash
+	PurgeNote(ctx context.Context, id uuid.UUID) (*models.PurgeResult, error)
 }
 
 // TagStore handles tag data operations
@@ -54,13 +172,15 @@ type TagStore interface {
 	CreateTag(ctx context.Context, tag *models.Tag) error
 	GetTagByID(ctx context.Context, id uuid.UUID) (*models.Tag, error)
 	GetTagsByUserID(ctx context.Context, userID uuid.UUID) ([]models.Tag, error)
+	// UpdateTag saves a tag as the given version, returning
+	// ErrVersionConflict unless it is still at the version before it
 	UpdateTag(ctx context.Context, tag *models.Tag) error
 	DeleteTag(ctx context.Context, id uuid.UUID) error
 	AddTagToNote(ctx context.Context, noteID, tagID uuid.UUID) error
 	RemoveTagFromNote(ctx context.Context, noteID, tagID uuid.UUID) error
 	GetTagsForNote(ctx context.Context, noteID uuid.UUID) ([]models.Tag, error)
 	SetNoteTags(ctx context.Context, noteID uuid.UUID, tagIDs []uuid.UUID) error
-	GetTagsSince(ctx context.Context, userID uuid.UUID, since time.Time) ([]models.Tag, error)
+	GetTagsForNotes(ctx context.Context, noteIDs []uuid.UUID) (map[uuid.UUID][]models.Tag, error)
 }
 
 // ImageStore handles image data operations
@@ -70,3 +190,142 @@ type ImageStore interface {
 	GetImagesByNoteID(ctx context.Context, noteID uuid.UUID) ([]models.Image, error)
 	DeleteImage(ctx context.Context, id uuid.UUID) error
 }
+
+// ChangeStore reads the per-user change feed used by sync
+type ChangeStore interface {
+	// GetChangesSince returns up to limit notebooks, notes, tags and images
+	// whose change sequence is greater than cursor, in sequence order,
+	// together with the cursor to resume from and whether more changes
+	// remain. Changes made by excludeDeviceID, if set, are left out.
+	GetChangesSince(ctx context.Context, userID uuid.UUID, cursor int64, limit int, excludeDeviceID *uuid.UUID) (*models.ChangeSet, error)
+	// ListenChanges calls fn with the new change sequence each time one of a
+	// user's entities changes, on any server instance, until ctx is done or
+	// the connection fails
+	ListenChanges(ctx context.Context, fn func(userID uuid.UUID, seq int64)) error
+}
+
+// IdempotencyStore records responses to requests sent with an idempotency key
+type IdempotencyStore interface {
+	// ClaimIdempotencyKey reserves key for a new request and returns nil, or
+	// returns the existing record if the key has been used before
+	ClaimIdempotencyKey(ctx context.Context, userID uuid.UUID, key, requestHash string) (*models.IdempotencyKey, error)
+	SaveIdempotencyResponse(ctx context.Context, userID uuid.UUID, key string, statusCode int, body json.RawMessage) error
+}
+
+// PurgeStore permanently removes data that was deleted long enough ago
+type PurgeStore interface {
+	// PurgeDeleted hard-deletes notebooks, notes, tags and images soft-deleted
+	// before the given time and expires sync cursors that predate them. The
+	// storage keys of removed images are returned so their blobs can be
+	// deleted.
+	PurgeDeleted(ctx context.Context, before time.Time) (*models.PurgeResult, error)
+	// EmptyTrash purges everything the user has deleted, regardless of age
+	EmptyTrash(ctx context.Context, userID uuid.UUID) (*models.PurgeResult, error)
+	// PurgeDeletedUsers hard-deletes all notebooks, notes, tags and images
+	// of deleted users
+	PurgeDeletedUsers(ctx context.Context) (*models.PurgeResult, error)
+	DeleteIdempotencyKeysBefore(ctx context.Context, before time.Time) (int, error)
+	// ThinNoteRevisions keeps one revision per hour of those saved before
+	// hourlyBefore and one per day of those saved before dailyBefore, and
+	// removes those saved before deleteBefore if it is given. The current
+	// version of each note is always kept.
+	ThinNoteRevisions(ctx context.Context, hourlyBefore, dailyBefore time.Time, deleteBefore *time.Time) (int, error)
+	// DeleteSessionsBefore removes sessions that expired or were revoked
+	// before the given time, along with their refresh tokens
+	DeleteSessionsBefore(ctx context.Context, before time.Time) (int, error)
+	// DeleteUserTokensBefore removes user tokens that expired or were
+	// used before the given time
+	DeleteUserTokensBefore(ctx context.Context, before time.Time) (int, error)
+	// DeleteRateLimitsBefore removes rate limit buckets that are full at the
+	// given time, and failed login counts that have been reset
+	DeleteRateLimitsBefore(ctx context.Context, before time.Time) (int, error)
+}
+
+// DeviceStore handles the devices registered to each user
+type DeviceStore interface {
+	CreateDevice(ctx context.Context, device *models.Device) error
+	GetDeviceByID(ctx context.Context, id uuid.UUID) (*models.Device, error)
+	GetDevicesByUserID(ctx context.Context, userID uuid.UUID) ([]models.Device, error)
+	// RevokeDevice revokes a device and signs out its sessions
+	RevokeDevice(ctx context.Context, id uuid.UUID) error
+	// TouchDevice records that a device was seen, returning ErrNotFound if it
+	// doesn't belong to the user or has been revoked
+	TouchDevice(ctx context.Context, userID, id uuid.UUID) error
+	MarkDeviceSynced(ctx context.Context, id uuid.UUID) error
+}
+
+// SessionStore handles sign-in sessions and their refresh tokens. Tokens
+// are identified by their SHA-256 hash.
+type SessionStore interface {
+	// CreateSession starts a session with its first refresh token. The
+	// session's device is only kept if it is one of the user's active
+	// devices.
+	CreateSession(ctx context.Context, session *models.Session, tokenHash []byte) error
+	GetSessionByID(ctx context.Context, id uuid.UUID) (*models.Session, error)
+	// GetSessionsByUserID returns the user's sessions that are neither
+	// revoked nor expired
+	GetSessionsByUserID(ctx context.Context, userID uuid.UUID) ([]models.Session, error)
+	// RotateRefreshToken exchanges a refresh token for newTokenHash and
+	// extends its session until expiresAt, recording deviceID if it is one
+	// of the user's active devices. It returns ErrNotFound if the token is
+	// unknown or its session has ended, and ErrRefreshTokenReused, after
+	// revoking the session, if the token was already exchanged.
+	RotateRefreshToken(ctx context.Context, tokenHash, newTokenHash []byte, deviceID *uuid.UUID, expiresAt time.Time) (*models.Session, error)
+	RevokeSession(ctx context.Context, id uuid.UUID) error
+	RevokeSessionByToken(ctx context.Context, tokenHash []byte) error
+	// RevokeOtherSessions revokes all of the user's sessions except keepID
+	RevokeOtherSessions(ctx context.Context, userID, keepID uuid.UUID) (int, error)
+}
+
+// PersonalAccessTokenStore handles long-lived tokens for scripts and
+// integrations. Tokens are identified by their SHA-256 hash.
+type PersonalAccessTokenStore interface {
+	CreatePersonalAccessToken(ctx context.Context, token *models.PersonalAccessToken) error
+	GetPersonalAccessTokenByID(ctx context.Context, id uuid.UUID) (*models.PersonalAccessToken, error)
+	// GetPersonalAccessTokenByHash returns a token that is neither revoked
+	// nor expired, or ErrNotFound
+	GetPersonalAccessTokenByHash(ctx context.Context, tokenHash []byte) (*models.PersonalAccessToken, error)
+	// GetPersonalAccessTokensByUserID returns the user's tokens that haven't
+	// been revoked, including expired ones
+	GetPersonalAccessTokensByUserID(ctx context.Context, userID uuid.UUID) ([]models.PersonalAccessToken, error)
+	// TouchPersonalAccessToken records that a token was used at the given
+	// time, to within a minute
+	TouchPersonalAccessToken(ctx context.Context, id uuid.UUID, at time.Time) error
+	RevokePersonalAccessToken(ctx context.Context, id uuid.UUID) error
+}
+
+// RateLimitStore handles rate limit buckets and failed login counts shared
+// between server instances
+type RateLimitStore interface {
+	// TakeRateLimit advances the bucket for key by interval, unless that
+	// would put it more than tolerance ahead of now. It reports whether the
+	// token was taken, and the bucket's arrival time afterwards.
+	TakeRateLimit(ctx context.Context, key string, now time.Time, interval, tolerance time.Duration) (bool, time.Time, error)
+	// GetLoginFailures returns the failed logins for an email address, or
+	// ErrNotFound if there are none
+	GetLoginFailures(ctx context.Context, email string) (*models.LoginFailures, error)
+	// RecordLoginFailure counts a failed login and returns the new total.
+	// Failures from before the previous reset time aren't counted.
+	RecordLoginFailure(ctx context.Context, email string, at, resetAt time.Time) (*models.LoginFailures, error)
+	ClearLoginFailures(ctx context.Context, email string) error
+}
+
+type deviceIDKey struct{}
+
+// WithDeviceID returns a context whose writes are recorded as coming from
+// the given device
+func WithDeviceID(ctx context.Context, deviceID uuid.UUID) context.Context {
+	return context.WithValue(ctx, deviceIDKey{}, deviceID)
+}
+
+// WithoutDeviceID returns a context whose writes aren't attributed to any
+// device, so every device receives them through sync
+func WithoutDeviceID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, deviceIDKey{}, uuid.Nil)
+}
+
+// DeviceIDFromContext returns the device set by WithDeviceID
+func DeviceIDFromContext(ctx context.Context) (uuid.UUID, bool) {
+	id, ok := ctx.Value(deviceIDKey{}).(uuid.UUID)
+	return id, ok && id != uuid.Nil
+}
@@ -8,6 +8,8 @@ import (
 	"testing"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/noted/server/internal/mail"
+	"github.com/noted/server/internal/signing"
 	"github.com/noted/server/internal/storage"
 	"github.com/noted/server/internal/store"
 	"github.com/noted/server/migrations"
@@ -62,7 +64,7 @@ func CleanTables(t *testing.T, db *store.PostgresStore) {
 	t.Helper()
 	ctx := context.Background()
 
-	tables := []string{"note_tags", "images", "notes", "tags", "notebooks", "users"}
+	tables := []string{"note_tags", "images", "notes", "tags", "notebooks", "users", "rate_limits", "login_failures"}
 	for _, table := range tables {
 		_, err := db.Pool().Exec(ctx, fmt.Sprintf("TRUNCATE TABLE %s CASCADE", table))
 		if err != nil {
@@ -96,3 +98,25 @@ func TestBlobStore(t *testing.T) storage.BlobStore {
 
 	return blobStore
 }
+
+// TestMailer returns an in-memory outbox that records the messages sent
+func TestMailer(t *testing.T) *mail.Outbox {
+	t.Helper()
+
+	outbox, err := mail.NewOutbox("")
+	if err != nil {
+		t.Fatalf("Failed to create outbox: %v", err)
+	}
+	return outbox
+}
+
+// TestKeys returns token signing keys held in memory
+func TestKeys(t *testing.T) *signing.KeySet {
+	t.Helper()
+
+	keys, err := signing.New(signing.Config{})
+	if err != nil {
+		t.Fatalf("Failed to create signing keys: %v", err)
+	}
+	return keys
+}
@@ -0,0 +1,121 @@
+package tiptap
+
+import (
+	"encoding/json"
+)
+
+// Block diff operations
+const (
+	DiffEqual   = "equal"
+	DiffInsert  = "insert"
+	DiffDelete  = "delete"
+	DiffReplace = "replace"
+)
+
+// BlockDiff is one step of a block-level diff. Old is the block as it was
+// and New the block as it became; unchanged blocks only carry New.
+type BlockDiff struct {
+	Op  string          `json:"op"`
+	Old json.RawMessage `json:"old,omitempty"`
+	New json.RawMessage `json:"new,omitempty"`
+}
+
+// Diff compares the top-level blocks of two documents. Blocks removed and
+// added at the same position are paired up as replacements, so an edited
+// paragraph shows as one change rather than a deletion and an insertion.
+func Diff(old, new json.RawMessage) ([]BlockDiff, error) {
+	oldBlocks, err := topLevelBlocks(old)
+	if err != nil {
+		return nil, err
+	}
+	newBlocks, err := topLevelBlocks(new)
+	if err != nil {
+		return nil, err
+	}
+	oldKeys, err := canonicalAll(oldBlocks)
+	if err != nil {
+		return nil, err
+	}
+	newKeys, err := canonicalAll(newBlocks)
+	if err != nil {
+		return nil, err
+	}
+
+	match := matchBlocks(oldKeys, newKeys)
+
+	diff := []BlockDiff{}
+	i, j := 0, 0
+	for i < len(oldBlocks) || j < len(newBlocks) {
+		// The blocks up to the next one kept in both documents changed
+		nextOld := i
+		for nextOld < len(oldBlocks) && match[nextOld] < 0 {
+			nextOld++
+		}
+		nextNew := len(newBlocks)
+		if nextOld < len(oldBlocks) {
+			nextNew = match[nextOld]
+		}
+
+		for ; i < nextOld && j < nextNew; i, j = i+1, j+1 {
+			diff = append(diff, BlockDiff{Op: DiffReplace, Old: oldBlocks[i], New: newBlocks[j]})
+		}
+		for ; i < nextOld; i++ {
+			diff = append(diff, BlockDiff{Op: DiffDelete, Old: oldBlocks[i]})
+		}
+		for ; j < nextNew; j++ {
+			diff = append(diff, BlockDiff{Op: DiffInsert, New: newBlocks[j]})
+		}
+
+		if nextOld < len(oldBlocks) {
+			diff = append(diff, BlockDiff{Op: DiffEqual, New: newBlocks[j]})
+			i, j = i+1, j+1
+		}
+	}
+	return diff, nil
+}
+
+// topLevelBlocks returns the content of a document. An empty value is a
+// document with no blocks.
+func topLevelBlocks(raw json.RawMessage) ([]json.RawMessage, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	return splitContent(fields)
+}
+
+// matchBlocks pairs the blocks of a with those of b like lcsMatch. Blocks
+// unchanged at the start and end are matched directly, and if what remains
+// is too large to diff it is reported as entirely changed.
+func matchBlocks(a, b []string) []int {
+	match := make([]int, len(a))
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		match[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		match[len(a)-1-suffix] = len(b) - 1 - suffix
+		suffix++
+	}
+
+	middleA, middleB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(middleA)*len(middleB) > maxMergeCells {
+		for i := range middleA {
+			match[prefix+i] = -1
+		}
+		return match
+	}
+	for i, j := range lcsMatch(middleA, middleB) {
+		if j >= 0 {
+			j += prefix
+		}
+		match[prefix+i] = j
+	}
+	return match
+}
@@ -0,0 +1,115 @@
+package tiptap
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		old  json.RawMessage
+		new  json.RawMessage
+		want []BlockDiff
+	}{
+		{
+			name: "unchanged",
+			old:  doc(paragraph("a"), paragraph("b")),
+			new:  doc(paragraph("a"), paragraph("b")),
+			want: []BlockDiff{
+				{Op: DiffEqual, New: json.RawMessage(paragraph("a"))},
+				{Op: DiffEqual, New: json.RawMessage(paragraph("b"))},
+			},
+		},
+		{
+			name: "paragraph edited",
+			old:  doc(paragraph("a"), paragraph("b"), paragraph("c")),
+			new:  doc(paragraph("a"), paragraph("B"), paragraph("c")),
+			want: []BlockDiff{
+				{Op: DiffEqual, New: json.RawMessage(paragraph("a"))},
+				{Op: DiffReplace, Old: json.RawMessage(paragraph("b")), New: json.RawMessage(paragraph("B"))},
+				{Op: DiffEqual, New: json.RawMessage(paragraph("c"))},
+			},
+		},
+		{
+			name: "insert and delete",
+			old:  doc(paragraph("a"), paragraph("b"), paragraph("c")),
+			new:  doc(paragraph("new"), paragraph("a"), paragraph("c")),
+			want: []BlockDiff{
+				{Op: DiffInsert, New: json.RawMessage(paragraph("new"))},
+				{Op: DiffEqual, New: json.RawMessage(paragraph("a"))},
+				{Op: DiffDelete, Old: json.RawMessage(paragraph("b"))},
+				{Op: DiffEqual, New: json.RawMessage(paragraph("c"))},
+			},
+		},
+		{
+			name: "more blocks replaced than removed",
+			old:  doc(paragraph("a"), paragraph("z")),
+			new:  doc(paragraph("b"), paragraph("c"), paragraph("z")),
+			want: []BlockDiff{
+				{Op: DiffReplace, Old: json.RawMessage(paragraph("a")), New: json.RawMessage(paragraph("b"))},
+				{Op: DiffInsert, New: json.RawMessage(paragraph("c"))},
+				{Op: DiffEqual, New: json.RawMessage(paragraph("z"))},
+			},
+		},
+		{
+			name: "from empty document",
+			old:  json.RawMessage(`{}`),
+			new:  doc(paragraph("a")),
+			want: []BlockDiff{
+				{Op: DiffInsert, New: json.RawMessage(paragraph("a"))},
+			},
+		},
+		{
+			name: "to empty document",
+			old:  doc(paragraph("a")),
+			new:  doc(),
+			want: []BlockDiff{
+				{Op: DiffDelete, Old: json.RawMessage(paragraph("a"))},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Diff(tt.old, tt.new)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !equalDiffs(got, tt.want) {
+				t.Errorf("got %s\nwant %s", mustJSON(got), mustJSON(tt.want))
+			}
+		})
+	}
+}
+
+func TestDiffInvalidDocument(t *testing.T) {
+	if _, err := Diff(json.RawMessage(`not json`), doc()); err == nil {
+		t.Error("expected an error for an invalid document")
+	}
+}
+
+// equalDiffs compares diffs with blocks compared as JSON values
+func equalDiffs(a, b []BlockDiff) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Op != b[i].Op || !equalBlock(a[i].Old, b[i].Old) || !equalBlock(a[i].New, b[i].New) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalBlock(a, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	return Equal(a, b)
+}
+
+func mustJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,312 @@
+package tiptap
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// ErrConflict is returned by Merge when both sides changed the same blocks
+var ErrConflict = errors.New("tiptap: conflicting edits")
+
+// maxMergeCells bounds the size of the LCS table built while diffing. Larger
+// documents are reported as conflicts rather than merged.
+const maxMergeCells = 4_000_000
+
+// listTypes are the container nodes whose items are merged individually
+// instead of treating the whole list as a single block
+var listTypes = map[string]bool{
+	"bulletList":  true,
+	"orderedList": true,
+	"taskList":    true,
+}
+
+// Merge performs a three-way merge of two documents that were both derived
+// from base. Top-level blocks (paragraphs, headings, ...) and the items of
+// lists are the unit of merging: edits to different blocks are combined,
+// while different edits to the same block, or insertions at the same
+// position, return ErrConflict.
+func Merge(base, ours, theirs json.RawMessage) (json.RawMessage, error) {
+	switch {
+	case Equal(ours, theirs), Equal(base, theirs):
+		return ours, nil
+	case Equal(base, ours):
+		return theirs, nil
+	}
+	return mergeNode(base, ours, theirs, 0)
+}
+
+// mergeNode merges a node's own fields atomically and its content blockwise.
+// Only the document and lists directly inside it are merged by content;
+// deeper nodes are compared as whole values.
+func mergeNode(base, ours, theirs json.RawMessage, depth int) (json.RawMessage, error) {
+	var baseFields, ourFields, theirFields map[string]json.RawMessage
+	if err := json.Unmarshal(base, &baseFields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(ours, &ourFields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(theirs, &theirFields); err != nil {
+		return nil, err
+	}
+
+	baseContent, err := splitContent(baseFields)
+	if err != nil {
+		return nil, err
+	}
+	ourContent, err := splitContent(ourFields)
+	if err != nil {
+		return nil, err
+	}
+	theirContent, err := splitContent(theirFields)
+	if err != nil {
+		return nil, err
+	}
+
+	// Everything except content (type, attrs, ...) merges as one value
+	merged, err := pickChange(baseFields, ourFields, theirFields)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := mergeBlocks(baseContent, ourContent, theirContent, depth)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > 0 {
+		raw, err := json.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		merged["content"] = raw
+	}
+
+	return json.Marshal(merged)
+}
+
+// splitContent removes and decodes the "content" array of a node
+func splitContent(fields map[string]json.RawMessage) ([]json.RawMessage, error) {
+	raw, ok := fields["content"]
+	delete(fields, "content")
+	if !ok {
+		return nil, nil
+	}
+	var content []json.RawMessage
+	if err := json.Unmarshal(raw, &content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// pickChange resolves a value that can't be merged further: whichever side
+// changed it wins, and both changing it differently is a conflict
+func pickChange(base, ours, theirs map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	baseKey, err := canonicalFields(base)
+	if err != nil {
+		return nil, err
+	}
+	ourKey, err := canonicalFields(ours)
+	if err != nil {
+		return nil, err
+	}
+	theirKey, err := canonicalFields(theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case ourKey == theirKey, theirKey == baseKey:
+		return ours, nil
+	case ourKey == baseKey:
+		return theirs, nil
+	default:
+		return nil, ErrConflict
+	}
+}
+
+func canonicalFields(fields map[string]json.RawMessage) (string, error) {
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return canonical(raw)
+}
+
+// mergeBlocks runs a diff3 over three block sequences
+func mergeBlocks(base, ours, theirs []json.RawMessage, depth int) ([]json.RawMessage, error) {
+	baseKeys, err := canonicalAll(base)
+	if err != nil {
+		return nil, err
+	}
+	ourKeys, err := canonicalAll(ours)
+	if err != nil {
+		return nil, err
+	}
+	theirKeys, err := canonicalAll(theirs)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(baseKeys)*len(ourKeys) > maxMergeCells || len(baseKeys)*len(theirKeys) > maxMergeCells {
+		return nil, ErrConflict
+	}
+
+	var merged []json.RawMessage
+	for _, c := range diff3(baseKeys, ourKeys, theirKeys) {
+		if c.stable {
+			merged = append(merged, ours[c.ourStart:c.ourEnd]...)
+			continue
+		}
+
+		o := baseKeys[c.baseStart:c.baseEnd]
+		a := ourKeys[c.ourStart:c.ourEnd]
+		b := theirKeys[c.theirStart:c.theirEnd]
+		switch {
+		case equalKeys(a, o), equalKeys(a, b):
+			merged = append(merged, theirs[c.theirStart:c.theirEnd]...)
+		case equalKeys(b, o):
+			merged = append(merged, ours[c.ourStart:c.ourEnd]...)
+		case depth == 0 && len(o) == 1 && len(a) == 1 && len(b) == 1 &&
+			sameListType(base[c.baseStart], ours[c.ourStart], theirs[c.theirStart]):
+			// The same list was edited on both sides; merge its items
+			list, err := mergeNode(base[c.baseStart], ours[c.ourStart], theirs[c.theirStart], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, list)
+		default:
+			return nil, ErrConflict
+		}
+	}
+	return merged, nil
+}
+
+func canonicalAll(blocks []json.RawMessage) ([]string, error) {
+	keys := make([]string, len(blocks))
+	for i, b := range blocks {
+		key, err := canonical(b)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+func equalKeys(a, b []string) bool {
+	return reflect.DeepEqual(a, b) || (len(a) == 0 && len(b) == 0)
+}
+
+// sameListType reports whether all three blocks are lists of the same type
+func sameListType(blocks ...json.RawMessage) bool {
+	listType := ""
+	for _, raw := range blocks {
+		var n struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(raw, &n); err != nil || !listTypes[n.Type] {
+			return false
+		}
+		if listType != "" && n.Type != listType {
+			return false
+		}
+		listType = n.Type
+	}
+	return true
+}
+
+// chunk is a region of a diff3 result. Stable chunks are unchanged on both
+// sides; the ranges of an unstable chunk show what each side has instead of
+// the base range.
+type chunk struct {
+	stable               bool
+	baseStart, baseEnd   int
+	ourStart, ourEnd     int
+	theirStart, theirEnd int
+}
+
+// diff3 splits three sequences into alternating stable and unstable chunks,
+// anchored on base elements that both sides kept
+func diff3(base, ours, theirs []string) []chunk {
+	ourMatch := lcsMatch(base, ours)
+	theirMatch := lcsMatch(base, theirs)
+
+	var chunks []chunk
+	i, j, k := 0, 0, 0
+	for {
+		// Extend a run of elements kept, in place, by both sides
+		n := 0
+		for i+n < len(base) && ourMatch[i+n] == j+n && theirMatch[i+n] == k+n {
+			n++
+		}
+		if n > 0 {
+			chunks = append(chunks, chunk{
+				stable:    true,
+				baseStart: i, baseEnd: i + n,
+				ourStart: j, ourEnd: j + n,
+				theirStart: k, theirEnd: k + n,
+			})
+			i, j, k = i+n, j+n, k+n
+			continue
+		}
+
+		// Find the next base element both sides kept
+		next := i
+		for next < len(base) && (ourMatch[next] < 0 || theirMatch[next] < 0) {
+			next++
+		}
+
+		ourEnd, theirEnd := len(ours), len(theirs)
+		if next < len(base) {
+			ourEnd, theirEnd = ourMatch[next], theirMatch[next]
+		}
+		if next > i || ourEnd > j || theirEnd > k {
+			chunks = append(chunks, chunk{
+				baseStart: i, baseEnd: next,
+				ourStart: j, ourEnd: ourEnd,
+				theirStart: k, theirEnd: theirEnd,
+			})
+		}
+		if next >= len(base) {
+			return chunks
+		}
+		i, j, k = next, ourEnd, theirEnd
+	}
+}
+
+// lcsMatch maps each index of a to the index of the element of b it is paired
+// with in a longest common subsequence, or -1 if it was removed
+func lcsMatch(a, b []string) []int {
+	// lengths[i][j] is the LCS length of a[i:] and b[j:]
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = max(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+
+	match := make([]int, len(a))
+	i, j := 0, 0
+	for i < len(a) {
+		switch {
+		case j < len(b) && a[i] == b[j]:
+			match[i] = j
+			i++
+			j++
+		case j < len(b) && lengths[i][j+1] >= lengths[i+1][j]:
+			j++
+		default:
+			match[i] = -1
+			i++
+		}
+	}
+	return match
+}
@@ -0,0 +1,131 @@
+package tiptap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func paragraph(text string) string {
+	return fmt.Sprintf(`{"type":"paragraph","content":[{"type":"text","text":%q}]}`, text)
+}
+
+func bulletList(items ...string) string {
+	parts := make([]string, len(items))
+	for i, item := range items {
+		parts[i] = fmt.Sprintf(`{"type":"listItem","content":[%s]}`, paragraph(item))
+	}
+	return `{"type":"bulletList","content":[` + strings.Join(parts, ",") + `]}`
+}
+
+func doc(blocks ...string) json.RawMessage {
+	return json.RawMessage(`{"type":"doc","content":[` + strings.Join(blocks, ",") + `]}`)
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    json.RawMessage
+		ours    json.RawMessage
+		theirs  json.RawMessage
+		want    json.RawMessage
+		wantErr error
+	}{
+		{
+			name:   "only theirs changed",
+			base:   doc(paragraph("a"), paragraph("b")),
+			ours:   doc(paragraph("a"), paragraph("b")),
+			theirs: doc(paragraph("a"), paragraph("B")),
+			want:   doc(paragraph("a"), paragraph("B")),
+		},
+		{
+			name:   "different paragraphs edited",
+			base:   doc(paragraph("a"), paragraph("b"), paragraph("c")),
+			ours:   doc(paragraph("A"), paragraph("b"), paragraph("c")),
+			theirs: doc(paragraph("a"), paragraph("b"), paragraph("C")),
+			want:   doc(paragraph("A"), paragraph("b"), paragraph("C")),
+		},
+		{
+			name:   "insert and delete in different places",
+			base:   doc(paragraph("a"), paragraph("b"), paragraph("c")),
+			ours:   doc(paragraph("a"), paragraph("new"), paragraph("b"), paragraph("c")),
+			theirs: doc(paragraph("a"), paragraph("b")),
+			want:   doc(paragraph("a"), paragraph("new"), paragraph("b")),
+		},
+		{
+			name:   "same edit on both sides",
+			base:   doc(paragraph("a")),
+			ours:   doc(paragraph("x")),
+			theirs: doc(paragraph("x")),
+			want:   doc(paragraph("x")),
+		},
+		{
+			name:   "different list items edited",
+			base:   doc(paragraph("todo"), bulletList("one", "two", "three")),
+			ours:   doc(paragraph("todo"), bulletList("ONE", "two", "three")),
+			theirs: doc(paragraph("todo"), bulletList("one", "two", "three", "four")),
+			want:   doc(paragraph("todo"), bulletList("ONE", "two", "three", "four")),
+		},
+		{
+			name:    "same paragraph edited differently",
+			base:    doc(paragraph("a"), paragraph("b")),
+			ours:    doc(paragraph("a"), paragraph("ours")),
+			theirs:  doc(paragraph("a"), paragraph("theirs")),
+			wantErr: ErrConflict,
+		},
+		{
+			name:    "same list item edited differently",
+			base:    doc(bulletList("one", "two")),
+			ours:    doc(bulletList("uno", "two")),
+			theirs:  doc(bulletList("eins", "two")),
+			wantErr: ErrConflict,
+		},
+		{
+			name:    "insertions at the same position",
+			base:    doc(paragraph("a")),
+			ours:    doc(paragraph("a"), paragraph("x")),
+			theirs:  doc(paragraph("a"), paragraph("y")),
+			wantErr: ErrConflict,
+		},
+		{
+			name:   "key order and whitespace are ignored",
+			base:   doc(paragraph("a"), paragraph("b")),
+			ours:   json.RawMessage(`{"content": [{"content": [{"text": "a", "type": "text"}], "type": "paragraph"}, {"content": [{"text": "b", "type": "text"}], "type": "paragraph"}], "type": "doc"}`),
+			theirs: doc(paragraph("a"), paragraph("c")),
+			want:   doc(paragraph("a"), paragraph("c")),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Merge(tt.base, tt.ours, tt.theirs)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !Equal(got, tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	content := doc(
+		paragraph("Hello"),
+		`{"type":"paragraph","content":[{"type":"text","text":"line one"},{"type":"hardBreak"},{"type":"text","text":"line two"}]}`,
+		bulletList("milk", "eggs"),
+	)
+
+	want := "Hello\n\nline one\nline two\n\nmilk\n\neggs"
+	if got := PlainText(content); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+// Package tiptap works with the Tiptap (ProseMirror) JSON documents stored in
+// note content.
+package tiptap
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Node is a single node of a Tiptap document. Unknown fields are not kept;
+// use the raw JSON when the original bytes must be preserved.
+type Node struct {
+	Type    string          `json:"type"`
+	Attrs   json.RawMessage `json:"attrs,omitempty"`
+	Content []Node          `json:"content,omitempty"`
+	Text    string          `json:"text,omitempty"`
+	Marks   json.RawMessage `json:"marks,omitempty"`
+}
+
+// blockSeparator matches the separator Tiptap's editor.getText() puts between
+// text blocks, which is what clients store as plain_text
+const blockSeparator = "\n\n"
+
+// PlainText extracts the text of a document the same way the web client does,
+// so server-generated content stays searchable
+func PlainText(content json.RawMessage) string {
+	var doc Node
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return ""
+	}
+
+	var blocks []string
+	collectText(doc, &blocks)
+	return strings.TrimSpace(strings.Join(blocks, blockSeparator))
+}
+
+// collectText appends the text of every text block under n to blocks
+func collectText(n Node, blocks *[]string) {
+	if isTextBlock(n) {
+		var b strings.Builder
+		for _, child := range n.Content {
+			switch {
+			case child.Type == "text":
+				b.WriteString(child.Text)
+			case child.Type == "hardBreak":
+				b.WriteString("\n")
+			}
+		}
+		*blocks = append(*blocks, b.String())
+		return
+	}
+	for _, child := range n.Content {
+		collectText(child, blocks)
+	}
+}
+
+// isTextBlock reports whether n holds inline content directly
+func isTextBlock(n Node) bool {
+	if n.Type == "text" {
+		return false
+	}
+	for _, child := range n.Content {
+		if child.Type == "text" || child.Type == "hardBreak" {
+			return true
+		}
+	}
+	return n.Type == "paragraph" || n.Type == "heading" || n.Type == "codeBlock"
+}
+
+// canonical re-encodes a JSON value with sorted keys and no insignificant
+// whitespace, so values that differ only in formatting compare equal.
+// PostgreSQL's jsonb reorders keys, so raw bytes from the database and from
+// clients cannot be compared directly.
+func canonical(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Equal reports whether two documents are the same once formatting is ignored
+func Equal(a, b json.RawMessage) bool {
+	ca, errA := canonical(a)
+	cb, errB := canonical(b)
+	return errA == nil && errB == nil && ca == cb
+}
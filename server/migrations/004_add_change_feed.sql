@@ -0,0 +1,100 @@
+-- +goose Up
+-- Per-user change sequence for cursor-based sync
+-- Every mutation of a user's notebooks, notes, tags, note-tag links and images
+-- takes the next value of users.change_seq. The counter row is locked until the
+-- mutating transaction commits, so sequence order always matches commit order
+-- and a client reading "everything after N" can never skip a change.
+
+ALTER TABLE users ADD COLUMN change_seq BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE notebooks ADD COLUMN change_seq BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE notes ADD COLUMN change_seq BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE tags ADD COLUMN change_seq BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE images ADD COLUMN change_seq BIGINT NOT NULL DEFAULT 0;
+
+-- +goose StatementBegin
+CREATE FUNCTION next_change_seq(p_user_id UUID) RETURNS BIGINT AS $$
+DECLARE
+    seq BIGINT;
+BEGIN
+    UPDATE users SET change_seq = change_seq + 1 WHERE id = p_user_id
+    RETURNING change_seq INTO seq;
+    RETURN seq;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION stamp_change_seq() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.change_seq := next_change_seq(NEW.user_id);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION stamp_image_change_seq() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.change_seq := next_change_seq((SELECT user_id FROM notes WHERE id = NEW.note_id));
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- Tag links have no row of their own in the feed; re-stamp the parent note instead
+-- +goose StatementBegin
+CREATE FUNCTION stamp_note_tags_change_seq() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        UPDATE notes SET change_seq = change_seq WHERE id = OLD.note_id;
+    ELSE
+        UPDATE notes SET change_seq = change_seq WHERE id = NEW.note_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER notebooks_change_seq BEFORE INSERT OR UPDATE ON notebooks
+    FOR EACH ROW EXECUTE FUNCTION stamp_change_seq();
+CREATE TRIGGER notes_change_seq BEFORE INSERT OR UPDATE ON notes
+    FOR EACH ROW EXECUTE FUNCTION stamp_change_seq();
+CREATE TRIGGER tags_change_seq BEFORE INSERT OR UPDATE ON tags
+    FOR EACH ROW EXECUTE FUNCTION stamp_change_seq();
+CREATE TRIGGER images_change_seq BEFORE INSERT OR UPDATE ON images
+    FOR EACH ROW EXECUTE FUNCTION stamp_image_change_seq();
+CREATE TRIGGER note_tags_change_seq AFTER INSERT OR DELETE ON note_tags
+    FOR EACH ROW EXECUTE FUNCTION stamp_note_tags_change_seq();
+
+-- Stamp existing rows so they are part of the feed
+UPDATE notebooks SET change_seq = change_seq;
+UPDATE tags SET change_seq = change_seq;
+UPDATE notes SET change_seq = change_seq;
+UPDATE images SET change_seq = change_seq;
+
+CREATE INDEX idx_notebooks_change_seq ON notebooks(user_id, change_seq);
+CREATE INDEX idx_notes_change_seq ON notes(user_id, change_seq);
+CREATE INDEX idx_tags_change_seq ON tags(user_id, change_seq);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_tags_change_seq;
+DROP INDEX IF EXISTS idx_notes_change_seq;
+DROP INDEX IF EXISTS idx_notebooks_change_seq;
+
+DROP TRIGGER IF EXISTS note_tags_change_seq ON note_tags;
+DROP TRIGGER IF EXISTS images_change_seq ON images;
+DROP TRIGGER IF EXISTS tags_change_seq ON tags;
+DROP TRIGGER IF EXISTS notes_change_seq ON notes;
+DROP TRIGGER IF EXISTS notebooks_change_seq ON notebooks;
+
+DROP FUNCTION IF EXISTS stamp_note_tags_change_seq();
+DROP FUNCTION IF EXISTS stamp_image_change_seq();
+DROP FUNCTION IF EXISTS stamp_change_seq();
+DROP FUNCTION IF EXISTS next_change_seq(UUID);
+
+ALTER TABLE images DROP COLUMN IF EXISTS change_seq;
+ALTER TABLE tags DROP COLUMN IF EXISTS change_seq;
+ALTER TABLE notes DROP COLUMN IF EXISTS change_seq;
+ALTER TABLE notebooks DROP COLUMN IF EXISTS change_seq;
+ALTER TABLE users DROP COLUMN IF EXISTS change_seq;
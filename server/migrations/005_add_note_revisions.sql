@@ -0,0 +1,23 @@
+-- +goose Up
+-- Snapshot of every saved version of a note, used as the common base when
+-- merging edits that were made offline against an older version
+
+CREATE TABLE note_revisions (
+    note_id UUID NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    version BIGINT NOT NULL,
+    content JSONB NOT NULL DEFAULT '{}',
+    plain_text TEXT NOT NULL DEFAULT '',
+    is_todo BOOLEAN NOT NULL DEFAULT FALSE,
+    is_done BOOLEAN NOT NULL DEFAULT FALSE,
+    reminder_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (note_id, version)
+);
+
+-- Existing notes start with their current version as the only revision
+INSERT INTO note_revisions (note_id, version, content, plain_text, is_todo, is_done, reminder_at, created_at)
+SELECT id, version, content, plain_text, is_todo, is_done, reminder_at, updated_at
+FROM notes;
+
+-- +goose Down
+DROP TABLE IF EXISTS note_revisions;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- Soft-delete images so removals reach other devices through the sync feed
+
+ALTER TABLE images ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+
+-- +goose Down
+ALTER TABLE images DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,30 @@
+-- +goose Up
+-- Announce every new change sequence so connected clients can be told to
+-- sync. NOTIFY is delivered when the transaction commits, on the
+-- "noted_changes" channel, with a "<user id>:<change seq>" payload.
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION next_change_seq(p_user_id UUID) RETURNS BIGINT AS $$
+DECLARE
+    seq BIGINT;
+BEGIN
+    UPDATE users SET change_seq = change_seq + 1 WHERE id = p_user_id
+    RETURNING change_seq INTO seq;
+    PERFORM pg_notify('noted_changes', p_user_id::text || ':' || seq::text);
+    RETURN seq;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION next_change_seq(p_user_id UUID) RETURNS BIGINT AS $$
+DECLARE
+    seq BIGINT;
+BEGIN
+    UPDATE users SET change_seq = change_seq + 1 WHERE id = p_user_id
+    RETURNING change_seq INTO seq;
+    RETURN seq;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
@@ -0,0 +1,69 @@
+-- +goose Up
+-- Devices registered by each user, and the device each change came from.
+-- Writes made on behalf of a device set the "noted.device_id" setting for
+-- their transaction; the change_seq triggers copy it to origin_device_id so
+-- the sync feed can leave out a device's own changes.
+
+CREATE TABLE devices (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    platform VARCHAR(50) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_seen_at TIMESTAMP WITH TIME ZONE,
+    last_synced_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_devices_user_id ON devices(user_id);
+
+ALTER TABLE notebooks ADD COLUMN origin_device_id UUID REFERENCES devices(id) ON DELETE SET NULL;
+ALTER TABLE notes ADD COLUMN origin_device_id UUID REFERENCES devices(id) ON DELETE SET NULL;
+ALTER TABLE tags ADD COLUMN origin_device_id UUID REFERENCES devices(id) ON DELETE SET NULL;
+ALTER TABLE images ADD COLUMN origin_device_id UUID REFERENCES devices(id) ON DELETE SET NULL;
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION stamp_change_seq() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.change_seq := next_change_seq(NEW.user_id);
+    NEW.origin_device_id := NULLIF(current_setting('noted.device_id', true), '')::UUID;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION stamp_image_change_seq() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.change_seq := next_change_seq((SELECT user_id FROM notes WHERE id = NEW.note_id));
+    NEW.origin_device_id := NULLIF(current_setting('noted.device_id', true), '')::UUID;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION stamp_image_change_seq() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.change_seq := next_change_seq((SELECT user_id FROM notes WHERE id = NEW.note_id));
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION stamp_change_seq() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.change_seq := next_change_seq(NEW.user_id);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+ALTER TABLE images DROP COLUMN IF EXISTS origin_device_id;
+ALTER TABLE tags DROP COLUMN IF EXISTS origin_device_id;
+ALTER TABLE notes DROP COLUMN IF EXISTS origin_device_id;
+ALTER TABLE notebooks DROP COLUMN IF EXISTS origin_device_id;
+
+DROP TABLE IF EXISTS devices;
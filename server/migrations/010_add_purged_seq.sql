@@ -0,0 +1,18 @@
+-- +goose Up
+-- Highest change sequence of a tombstone that has been purged. Clients
+-- syncing from an older cursor would miss that deletion and must resync.
+
+ALTER TABLE users ADD COLUMN purged_seq BIGINT NOT NULL DEFAULT 0;
+
+CREATE INDEX idx_notebooks_deleted_at ON notebooks(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX idx_notes_deleted_at ON notes(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX idx_tags_deleted_at ON tags(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX idx_images_deleted_at ON images(deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_images_deleted_at;
+DROP INDEX IF EXISTS idx_tags_deleted_at;
+DROP INDEX IF EXISTS idx_notes_deleted_at;
+DROP INDEX IF EXISTS idx_notebooks_deleted_at;
+
+ALTER TABLE users DROP COLUMN IF EXISTS purged_seq;
@@ -0,0 +1,19 @@
+-- +goose Up
+-- Deleting a notebook now deletes its notes and images with it. Bring notes
+-- left live in notebooks that were deleted before that into line, using the
+-- notebook's timestamp so restoring it brings them back.
+
+UPDATE images i
+SET deleted_at = nb.deleted_at
+FROM notes n, notebooks nb
+WHERE i.note_id = n.id AND n.notebook_id = nb.id
+  AND nb.deleted_at IS NOT NULL AND n.deleted_at IS NULL AND i.deleted_at IS NULL;
+
+UPDATE notes n
+SET deleted_at = nb.deleted_at, updated_at = nb.deleted_at
+FROM notebooks nb
+WHERE n.notebook_id = nb.id AND nb.deleted_at IS NOT NULL AND n.deleted_at IS NULL;
+
+-- +goose Down
+-- The cascaded deletions can't be told apart from others, so they are kept
+SELECT 1;
@@ -0,0 +1,27 @@
+-- +goose Up
+-- Authenticator app (TOTP) secrets for two-factor sign-in. A secret only
+-- protects sign-ins once enabled_at is set, after the user has confirmed a
+-- code from it. last_step is the last time step a code was accepted for, so
+-- a code can't be used twice.
+
+CREATE TABLE user_totp (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    last_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    enabled_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Single-use recovery codes for signing in without the authenticator app.
+-- Only SHA-256 hashes of the codes are stored.
+CREATE TABLE recovery_codes (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    used_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS user_totp;
@@ -0,0 +1,26 @@
+-- +goose Up
+-- Rate limit buckets shared between server instances. Each bucket is its
+-- theoretical arrival time; one in the past is a full bucket.
+
+CREATE TABLE rate_limits (
+    key VARCHAR(255) PRIMARY KEY,
+    tat TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_rate_limits_tat ON rate_limits(tat);
+
+-- Failed logins per email address, whether or not it has an account. The
+-- count is forgotten at reset_at, or on a successful login.
+
+CREATE TABLE login_failures (
+    email VARCHAR(255) PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    reset_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_login_failures_reset_at ON login_failures(reset_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS login_failures;
+DROP TABLE IF EXISTS rate_limits;
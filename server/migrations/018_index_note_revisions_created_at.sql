@@ -0,0 +1,7 @@
+-- +goose Up
+-- Old revisions are thinned by age, which scans revisions by creation time
+
+CREATE INDEX idx_note_revisions_created_at ON note_revisions(created_at);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_note_revisions_created_at;
@@ -0,0 +1,10 @@
+-- +goose Up
+-- Notebooks and tags get a version like notes, so updates can be made
+-- conditional on the version the client last saw
+
+ALTER TABLE notebooks ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE tags ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+
+-- +goose Down
+ALTER TABLE tags DROP COLUMN IF EXISTS version;
+ALTER TABLE notebooks DROP COLUMN IF EXISTS version;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- A notebook's notes are paged through in (created_at, id) order
+
+CREATE INDEX idx_notes_notebook_timeline ON notes(notebook_id, created_at, id);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_notes_notebook_timeline;
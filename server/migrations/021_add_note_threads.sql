@@ -0,0 +1,11 @@
+-- +goose Up
+-- Replies point at the note that starts their thread. Soft-deleting the
+-- parent keeps the thread; once the parent is purged its replies stand alone.
+
+ALTER TABLE notes ADD COLUMN parent_note_id UUID REFERENCES notes(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_notes_parent_note_id ON notes(parent_note_id) WHERE parent_note_id IS NOT NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_notes_parent_note_id;
+ALTER TABLE notes DROP COLUMN IF EXISTS parent_note_id;
@@ -0,0 +1,19 @@
+-- +goose Up
+-- Notes can be pinned to the top of their notebook, starred to collect them
+-- across notebooks, and archived to hide them without deleting them
+
+ALTER TABLE notes ADD COLUMN is_pinned BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE notes ADD COLUMN is_starred BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE notes ADD COLUMN archived_at TIMESTAMPTZ;
+
+CREATE INDEX idx_notes_pinned ON notes(notebook_id, created_at, id) WHERE is_pinned AND deleted_at IS NULL;
+CREATE INDEX idx_notes_starred ON notes(user_id, updated_at) WHERE is_starred AND deleted_at IS NULL;
+CREATE INDEX idx_notes_archived_at ON notes(notebook_id) WHERE archived_at IS NOT NULL AND deleted_at IS NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_notes_archived_at;
+DROP INDEX IF EXISTS idx_notes_starred;
+DROP INDEX IF EXISTS idx_notes_pinned;
+ALTER TABLE notes DROP COLUMN IF EXISTS archived_at;
+ALTER TABLE notes DROP COLUMN IF EXISTS is_starred;
+ALTER TABLE notes DROP COLUMN IF EXISTS is_pinned;
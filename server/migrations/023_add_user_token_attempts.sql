@@ -0,0 +1,8 @@
+-- +goose Up
+-- MFA challenges are kept as user tokens, with a count of the codes tried
+-- against each so a challenge can't be used to guess codes indefinitely
+
+ALTER TABLE user_tokens ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE user_tokens DROP COLUMN IF EXISTS attempts;
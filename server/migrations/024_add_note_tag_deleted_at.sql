@@ -0,0 +1,18 @@
+-- +goose Up
+-- Tag links are soft-deleted along with their notebook, sharing its
+-- timestamp, so restoring the notebook brings them back
+
+ALTER TABLE note_tags ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+
+-- Soft deletes and restores re-stamp the note like other link changes
+DROP TRIGGER IF EXISTS note_tags_change_seq ON note_tags;
+CREATE TRIGGER note_tags_change_seq AFTER INSERT OR UPDATE OR DELETE ON note_tags
+    FOR EACH ROW EXECUTE FUNCTION stamp_note_tags_change_seq();
+
+-- +goose Down
+DROP TRIGGER IF EXISTS note_tags_change_seq ON note_tags;
+CREATE TRIGGER note_tags_change_seq AFTER INSERT OR DELETE ON note_tags
+    FOR EACH ROW EXECUTE FUNCTION stamp_note_tags_change_seq();
+
+DELETE FROM note_tags WHERE deleted_at IS NOT NULL;
+ALTER TABLE note_tags DROP COLUMN IF EXISTS deleted_at;